@@ -0,0 +1,18 @@
+// Assert that a prebuilt image exists in the cache repo and is fresher than
+// 7 days. Scoping the data source to the check block means a failed
+// assertion is reported as a warning and does not fail the apply.
+check "prebuild" {
+  data "envbuilder_cache_health" "example" {
+    cache_repo         = "registry.example.com/envbuilder/cache"
+    max_age_days       = 7
+    required_platforms = ["linux/amd64", "linux/arm64"]
+    required_labels = {
+      "org.opencontainers.image.source" = "https://github.com/coder/envbuilder-starter-devcontainer"
+    }
+  }
+
+  assert {
+    condition     = data.envbuilder_cache_health.example.healthy
+    error_message = join("\n", data.envbuilder_cache_health.example.messages)
+  }
+}
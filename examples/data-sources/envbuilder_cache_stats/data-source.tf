@@ -0,0 +1,16 @@
+// Summarize the contents of a cache repo populated by envbuilder.
+data "envbuilder_cache_stats" "example" {
+  cache_repo = "registry.example.com/envbuilder/cache"
+}
+
+output "cache_tag_count" {
+  value = data.envbuilder_cache_stats.example.tag_count
+}
+
+output "cache_total_size_bytes" {
+  value = data.envbuilder_cache_stats.example.total_size_bytes
+}
+
+output "cache_newest_created_at" {
+  value = data.envbuilder_cache_stats.example.newest_created_at
+}
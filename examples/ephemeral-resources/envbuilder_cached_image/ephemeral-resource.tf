@@ -0,0 +1,45 @@
+// The below example illustrates the behavior of the envbuilder_cached_image
+// ephemeral resource. Ephemeral resources require Terraform 1.10 or later.
+
+terraform {
+  required_providers {
+    envbuilder = {
+      source = "coder/envbuilder"
+    }
+  }
+}
+
+variable "repo_url" {
+  type    = string
+  default = "https://github.com/coder/envbuilder-starter-devcontainer"
+}
+
+variable "builder_image" {
+  type    = string
+  default = "ghcr.io/coder/envbuilder:latest"
+}
+
+variable "cache_repo" {
+  type = string
+}
+
+// Unlike the envbuilder_cached_image resource, the ephemeral resource runs
+// the cache probe on every plan and apply and does not store anything in
+// state. Its attributes can only be referenced from other ephemeral
+// contexts, such as provider configuration, write-only arguments, ephemeral
+// variables and outputs, and other ephemeral resources.
+ephemeral "envbuilder_cached_image" "example" {
+  builder_image = var.builder_image
+  git_url       = var.repo_url
+  cache_repo    = var.cache_repo
+  extra_env = {
+    "ENVBUILDER_VERBOSE" : "true"
+  }
+}
+
+locals {
+  // Either the cached image, or var.builder_image if no cached image was
+  // found in var.cache_repo.
+  image = ephemeral.envbuilder_cached_image.example.image
+  env   = ephemeral.envbuilder_cached_image.example.env
+}
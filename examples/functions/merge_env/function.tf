@@ -0,0 +1,15 @@
+// Merge the environment computed by envbuilder_cached_image with
+// additional environment variables. Later arguments take precedence.
+locals {
+  env = provider::envbuilder::merge_env(
+    envbuilder_cached_image.example.env_map,
+    { "CODER_AGENT_TOKEN" : coder_agent.main.token },
+    ["FOO=bar"],
+  )
+}
+
+resource "docker_container" "example" {
+  name  = "envbuilder-merge-env-example"
+  image = envbuilder_cached_image.example.image
+  env   = local.env.list
+}
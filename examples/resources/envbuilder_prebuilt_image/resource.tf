@@ -0,0 +1,17 @@
+// Build the devcontainer and push it to the cache repo on apply, then use
+// the cached image. Requires access to a Docker daemon.
+resource "envbuilder_prebuilt_image" "example" {
+  builder_image = "ghcr.io/coder/envbuilder:latest"
+  cache_repo    = "registry.example.com/envbuilder-cache"
+  git_url       = "https://github.com/coder/envbuilder-starter-devcontainer"
+}
+
+resource "envbuilder_cached_image" "example" {
+  builder_image = envbuilder_prebuilt_image.example.builder_image
+  cache_repo    = envbuilder_prebuilt_image.example.cache_repo
+  git_url       = envbuilder_prebuilt_image.example.git_url
+}
+
+output "image" {
+  value = envbuilder_cached_image.example.image
+}
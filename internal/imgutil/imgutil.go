@@ -8,9 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	eboptions "github.com/coder/envbuilder/options"
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
@@ -18,13 +18,15 @@ import (
 )
 
 // GetRemoteImage fetches the image manifest of the image.
-func GetRemoteImage(imgRef string) (v1.Image, error) {
+// Any additional remote options are applied after the defaults.
+func GetRemoteImage(ctx context.Context, imgRef string, opts ...remote.Option) (v1.Image, error) {
 	ref, err := name.ParseReference(imgRef)
 	if err != nil {
 		return nil, fmt.Errorf("parse reference: %w", err)
 	}
 
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	opts = append([]remote.Option{remote.WithAuthFromKeychain(Keychain), remote.WithContext(ctx)}, opts...)
+	img, err := remote.Image(ref, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("check remote image: %w", err)
 	}
@@ -32,13 +34,31 @@ func GetRemoteImage(imgRef string) (v1.Image, error) {
 	return img, nil
 }
 
+// GetImageDigest resolves imgRef to the digest of the manifest or index it
+// references, without fetching the manifest itself.
+// Any additional remote options are applied after the defaults.
+func GetImageDigest(ctx context.Context, imgRef string, opts ...remote.Option) (v1.Hash, error) {
+	ref, err := name.ParseReference(imgRef)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("parse reference: %w", err)
+	}
+
+	opts = append([]remote.Option{remote.WithAuthFromKeychain(Keychain), remote.WithContext(ctx)}, opts...)
+	desc, err := remote.Head(ref, opts...)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("resolve image digest: %w", err)
+	}
+
+	return desc.Digest, nil
+}
+
 // ExtractEnvbuilderFromImage reads the image located at imgRef and extracts
 // MagicBinaryLocation to destPath.
-func ExtractEnvbuilderFromImage(ctx context.Context, imgRef, destPath string) error {
+func ExtractEnvbuilderFromImage(ctx context.Context, imgRef, destPath string, opts ...remote.Option) error {
 	var o eboptions.Options
 	o.SetDefaults()
 	needle := strings.TrimPrefix(o.BinaryPath, "/")
-	img, err := GetRemoteImage(imgRef)
+	img, err := GetRemoteImage(ctx, imgRef, opts...)
 	if err != nil {
 		return fmt.Errorf("check remote image: %w", err)
 	}
@@ -51,56 +71,351 @@ func ExtractEnvbuilderFromImage(ctx context.Context, imgRef, destPath string) er
 	// Check the layers in reverse order. The last layers are more likely to
 	// include the binary.
 	for i := len(layers) - 1; i >= 0; i-- {
-		ul, err := layers[i].Uncompressed()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		found, err := extractLayerFile(ctx, layers[i], i+1, needle, destPath)
 		if err != nil {
-			return fmt.Errorf("get uncompressed layer: %w", err)
+			return err
+		}
+		if found {
+			return nil
 		}
+	}
 
-		tr := tar.NewReader(ul)
-		for {
-			th, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
+	return fmt.Errorf("extract envbuilder binary from image %q: %w", imgRef, os.ErrNotExist)
+}
 
-			if err != nil {
-				return fmt.Errorf("read tar header: %w", err)
-			}
+// extractBufferSize is the size of the buffer used to copy a file out of a
+// layer, which bounds the memory used by extraction regardless of the size of
+// the layer or the file.
+const extractBufferSize = 32 * 1024
 
-			name := filepath.Clean(th.Name)
-			if th.Typeflag != tar.TypeReg {
-				tflog.Debug(ctx, "skip non-regular file", map[string]any{"name": name, "layer_idx": i + 1})
-				continue
-			}
+// extractLayerFile streams the layer and writes the regular file at needle,
+// if it has one, to destPath. It reports whether the file was found. The file
+// is written to a temporary file next to destPath first, so destPath is never
+// left partially written.
+func extractLayerFile(ctx context.Context, layer v1.Layer, layerIdx int, needle, destPath string) (bool, error) {
+	ul, err := layer.Uncompressed()
+	if err != nil {
+		return false, fmt.Errorf("get uncompressed layer: %w", err)
+	}
+	// Close the layer as soon as we are done with it, rather than holding
+	// on to the stream and its buffers while reading other layers.
+	defer ul.Close()
 
-			if name != needle {
-				tflog.Debug(ctx, "skip file", map[string]any{"name": name, "layer_idx": i + 1})
-				continue
-			}
+	tr := tar.NewReader(ul)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("read tar header: %w", err)
+		}
+
+		name := filepath.Clean(th.Name)
+		if th.Typeflag != tar.TypeReg {
+			tflog.Debug(ctx, "skip non-regular file", map[string]any{"name": name, "layer_idx": layerIdx})
+			continue
+		}
+		if name != needle {
+			tflog.Debug(ctx, "skip file", map[string]any{"name": name, "layer_idx": layerIdx})
+			continue
+		}
+
+		tflog.Debug(ctx, "found file", map[string]any{"name": name, "layer_idx": layerIdx})
+		if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+			return false, fmt.Errorf("create parent directories: %w", err)
+		}
+		destF, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".*")
+		if err != nil {
+			return false, fmt.Errorf("create dest file for writing: %w", err)
+		}
+		defer os.Remove(destF.Name())
+		defer destF.Close()
+		// Hide destF's ReadFrom so that the copy always uses our buffer.
+		w := struct{ io.Writer }{destF}
+		if _, err := io.CopyBuffer(w, tr, make([]byte, extractBufferSize)); err != nil {
+			return false, fmt.Errorf("copy dest file from image: %w", err)
+		}
+		if err := destF.Close(); err != nil {
+			return false, fmt.Errorf("close dest file: %w", err)
+		}
+		if err := os.Chmod(destF.Name(), 0o755); err != nil {
+			return false, fmt.Errorf("chmod file: %w", err)
+		}
+		if err := os.Rename(destF.Name(), destPath); err != nil {
+			return false, fmt.Errorf("rename dest file: %w", err)
+		}
+		return true, nil
+	}
+}
+
+// RepoStats summarizes the images stored in a repository.
+type RepoStats struct {
+	// TagCount is the number of tags in the repository.
+	TagCount int
+	// TotalSize is the total size in bytes of all unique blobs referenced by
+	// tagged images, including manifests' config blobs.
+	TotalSize int64
+	// Oldest and Newest are the oldest and newest creation timestamps of
+	// tagged images. They are zero if no image has a creation timestamp.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// GetRepoStats walks all tags in the repository repoRef and returns a
+// summary of the images they reference. Image indexes are walked
+// recursively.
+func GetRepoStats(ctx context.Context, repoRef string, opts ...remote.Option) (RepoStats, error) {
+	var stats RepoStats
+	repo, err := name.NewRepository(repoRef)
+	if err != nil {
+		return stats, fmt.Errorf("parse repository: %w", err)
+	}
 
-			tflog.Debug(ctx, "found file", map[string]any{"name": name, "layer_idx": i + 1})
-			if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
-				return fmt.Errorf("create parent directories: %w", err)
+	opts = append([]remote.Option{remote.WithAuthFromKeychain(Keychain), remote.WithContext(ctx)}, opts...)
+	tags, err := remote.List(repo, opts...)
+	if err != nil {
+		return stats, fmt.Errorf("list tags: %w", err)
+	}
+	stats.TagCount = len(tags)
+
+	seen := make(map[v1.Hash]bool)
+	addBlob := func(desc v1.Descriptor) {
+		if seen[desc.Digest] {
+			return
+		}
+		seen[desc.Digest] = true
+		stats.TotalSize += desc.Size
+	}
+	addCreated := func(created time.Time) {
+		if created.IsZero() {
+			return
+		}
+		if stats.Oldest.IsZero() || created.Before(stats.Oldest) {
+			stats.Oldest = created
+		}
+		if created.After(stats.Newest) {
+			stats.Newest = created
+		}
+	}
+
+	var addImage func(img v1.Image) error
+	addImage = func(img v1.Image) error {
+		m, err := img.Manifest()
+		if err != nil {
+			return fmt.Errorf("get manifest: %w", err)
+		}
+		addBlob(m.Config)
+		for _, l := range m.Layers {
+			addBlob(l)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("get config file: %w", err)
+		}
+		addCreated(cfg.Created.Time)
+		return nil
+	}
+	var addIndex func(idx v1.ImageIndex) error
+	addIndex = func(idx v1.ImageIndex) error {
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return fmt.Errorf("get index manifest: %w", err)
+		}
+		for _, desc := range m.Manifests {
+			if desc.MediaType.IsIndex() {
+				child, err := idx.ImageIndex(desc.Digest)
+				if err != nil {
+					return fmt.Errorf("get child index %s: %w", desc.Digest, err)
+				}
+				if err := addIndex(child); err != nil {
+					return err
+				}
+				continue
 			}
-			destF, err := os.Create(destPath)
+			child, err := idx.Image(desc.Digest)
 			if err != nil {
-				return fmt.Errorf("create dest file for writing: %w", err)
+				return fmt.Errorf("get child image %s: %w", desc.Digest, err)
 			}
-			defer destF.Close()
-			_, err = io.Copy(destF, tr)
+			if err := addImage(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, tag := range tags {
+		ref := repo.Tag(tag)
+		desc, err := remote.Get(ref, opts...)
+		if err != nil {
+			return stats, fmt.Errorf("get %s: %w", ref, err)
+		}
+		if seen[desc.Digest] {
+			continue
+		}
+		seen[desc.Digest] = true
+		if desc.MediaType.IsIndex() {
+			idx, err := desc.ImageIndex()
 			if err != nil {
-				return fmt.Errorf("copy dest file from image: %w", err)
+				return stats, fmt.Errorf("get index %s: %w", ref, err)
 			}
-			if err := destF.Close(); err != nil {
-				return fmt.Errorf("close dest file: %w", err)
+			if err := addIndex(idx); err != nil {
+				return stats, fmt.Errorf("walk index %s: %w", ref, err)
 			}
+			continue
+		}
+		img, err := desc.Image()
+		if err != nil {
+			return stats, fmt.Errorf("get image %s: %w", ref, err)
+		}
+		if err := addImage(img); err != nil {
+			return stats, fmt.Errorf("walk image %s: %w", ref, err)
+		}
+	}
+
+	return stats, nil
+}
 
-			if err := os.Chmod(destPath, 0o755); err != nil {
-				return fmt.Errorf("chmod file: %w", err)
+// ImageInfo describes an image or image index stored in a repository.
+type ImageInfo struct {
+	// Ref is the digest reference of the image, in the form repo@digest.
+	Ref string
+	// Created is the creation timestamp of the image. For an image index,
+	// this is the newest creation timestamp of any of its images.
+	Created time.Time
+	// Platforms are the platforms the image was built for.
+	Platforms []v1.Platform
+	// Labels are the labels set on the image. For an image index, only
+	// labels set to the same value on all of its images are included.
+	Labels map[string]string
+}
+
+// GetImageInfo fetches the image or image index referenced by imgRef and
+// returns a description of it. Image indexes are walked recursively.
+func GetImageInfo(ctx context.Context, imgRef string, opts ...remote.Option) (ImageInfo, error) {
+	var info ImageInfo
+	ref, err := name.ParseReference(imgRef)
+	if err != nil {
+		return info, fmt.Errorf("parse reference: %w", err)
+	}
+
+	opts = append([]remote.Option{remote.WithAuthFromKeychain(Keychain), remote.WithContext(ctx)}, opts...)
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return info, fmt.Errorf("get %s: %w", ref, err)
+	}
+	info.Ref = ref.Context().Digest(desc.Digest.String()).String()
+
+	first := true
+	addImage := func(img v1.Image) error {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("get config file: %w", err)
+		}
+		if cfg.Created.After(info.Created) {
+			info.Created = cfg.Created.Time
+		}
+		if p := cfg.Platform(); p != nil {
+			info.Platforms = append(info.Platforms, *p)
+		}
+		if first {
+			info.Labels = make(map[string]string, len(cfg.Config.Labels))
+			for k, v := range cfg.Config.Labels {
+				info.Labels[k] = v
 			}
+			first = false
 			return nil
 		}
+		for k, v := range info.Labels {
+			if cfg.Config.Labels[k] != v {
+				delete(info.Labels, k)
+			}
+		}
+		return nil
+	}
+	var addIndex func(idx v1.ImageIndex) error
+	addIndex = func(idx v1.ImageIndex) error {
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return fmt.Errorf("get index manifest: %w", err)
+		}
+		for _, desc := range m.Manifests {
+			if desc.MediaType.IsIndex() {
+				child, err := idx.ImageIndex(desc.Digest)
+				if err != nil {
+					return fmt.Errorf("get child index %s: %w", desc.Digest, err)
+				}
+				if err := addIndex(child); err != nil {
+					return err
+				}
+				continue
+			}
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("get child image %s: %w", desc.Digest, err)
+			}
+			if err := addImage(child); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	return fmt.Errorf("extract envbuilder binary from image %q: %w", imgRef, os.ErrNotExist)
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return info, fmt.Errorf("get index %s: %w", ref, err)
+		}
+		if err := addIndex(idx); err != nil {
+			return info, fmt.Errorf("walk index %s: %w", ref, err)
+		}
+		return info, nil
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return info, fmt.Errorf("get image %s: %w", ref, err)
+	}
+	if err := addImage(img); err != nil {
+		return info, fmt.Errorf("walk image %s: %w", ref, err)
+	}
+	return info, nil
+}
+
+// GetNewestImageInfo returns a description of the most recently created
+// image tagged in the repository repoRef. It returns an error wrapping
+// os.ErrNotExist if the repository contains no tags.
+func GetNewestImageInfo(ctx context.Context, repoRef string, opts ...remote.Option) (ImageInfo, error) {
+	var newest ImageInfo
+	repo, err := name.NewRepository(repoRef)
+	if err != nil {
+		return newest, fmt.Errorf("parse repository: %w", err)
+	}
+
+	listOpts := append([]remote.Option{remote.WithAuthFromKeychain(Keychain), remote.WithContext(ctx)}, opts...)
+	tags, err := remote.List(repo, listOpts...)
+	if err != nil {
+		return newest, fmt.Errorf("list tags: %w", err)
+	}
+	if len(tags) == 0 {
+		return newest, fmt.Errorf("repository %s has no tags: %w", repo, os.ErrNotExist)
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		info, err := GetImageInfo(ctx, repo.Tag(tag).String(), opts...)
+		if err != nil {
+			return newest, err
+		}
+		if seen[info.Ref] {
+			continue
+		}
+		seen[info.Ref] = true
+		if newest.Ref == "" || info.Created.After(newest.Created) {
+			newest = info
+		}
+	}
+	return newest, nil
 }
@@ -0,0 +1,150 @@
+package imgutil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Keychain resolves registry credentials from the Docker config, like
+// authn.DefaultKeychain. Registries without credentials in the Docker config
+// fall back to the Podman auth file, which authn.DefaultKeychain only reads
+// when there is no Docker config at all.
+var Keychain = authn.NewMultiKeychain(authn.DefaultKeychain, PodmanKeychain)
+
+// PodmanKeychain resolves registry credentials from the Podman auth file
+// only, ignoring the Docker config.
+var PodmanKeychain authn.Keychain = podmanKeychain{}
+
+// NewPodmanKeychain returns a keychain that resolves registry credentials
+// from the auth file at path, which is in the format of the Podman auth file.
+// Unlike PodmanKeychain, it fails if the file does not exist.
+func NewPodmanKeychain(path string) authn.Keychain {
+	return podmanKeychain{path: path}
+}
+
+// PodmanAuthFile returns the path of the registry auth file used by Podman:
+// $REGISTRY_AUTH_FILE if set, or the first of
+// $XDG_RUNTIME_DIR/containers/auth.json and
+// $XDG_CONFIG_HOME/containers/auth.json that exists. XDG_CONFIG_HOME
+// defaults to ~/.config. It returns an empty string if there is no such file.
+func PodmanAuthFile() string {
+	if path := os.Getenv("REGISTRY_AUTH_FILE"); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return ""
+		}
+		return path
+	}
+	var paths []string
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		paths = append(paths, filepath.Join(runtimeDir, "containers", "auth.json"))
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configDir = filepath.Join(home, ".config")
+		}
+	}
+	if configDir != "" {
+		paths = append(paths, filepath.Join(configDir, "containers", "auth.json"))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// podmanAuth is an entry of the auths map of a Podman auth file, which uses
+// the same format as the Docker config.
+type podmanAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// podmanKeychain resolves registry credentials from the Podman auth file.
+type podmanKeychain struct {
+	// path is the auth file. If empty, that of PodmanAuthFile is used, if
+	// any.
+	path string
+}
+
+func (k podmanKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	path := k.path
+	if path == "" {
+		if path = PodmanAuthFile(); path == "" {
+			return authn.Anonymous, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read podman auth file: %w", err)
+	}
+	var cfg struct {
+		Auths map[string]podmanAuth `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse podman auth file %q: %w", path, err)
+	}
+
+	for _, key := range podmanAuthKeys(target) {
+		auth, ok := cfg.Auths[key]
+		if !ok {
+			continue
+		}
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decode podman auth for %q: %w", key, err)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+		}), nil
+	}
+	return authn.Anonymous, nil
+}
+
+// podmanAuthKeys returns the keys of the auths map that may hold credentials
+// for target, most specific first. Podman allows credentials to be scoped to
+// a repository or namespace, as well as a registry.
+func podmanAuthKeys(target authn.Resource) []string {
+	registry := target.RegistryStr()
+	hosts := []string{registry}
+	if registry == name.DefaultRegistry {
+		hosts = append(hosts, "docker.io")
+	}
+	repo := strings.TrimPrefix(strings.TrimPrefix(target.String(), registry), "/")
+
+	var keys []string
+	for ; repo != ""; repo, _ = cutLast(repo, "/") {
+		for _, host := range hosts {
+			keys = append(keys, host+"/"+repo)
+		}
+	}
+	keys = append(keys, hosts...)
+	if registry == name.DefaultRegistry {
+		keys = append(keys, authn.DefaultAuthKey)
+	}
+	return keys
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return "", s
+}
@@ -0,0 +1,424 @@
+package netutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gitclient "github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// defaultTransport is the original value of http.DefaultTransport. We keep a
+// reference to it as http.DefaultTransport may be replaced by Install.
+var defaultTransport = http.DefaultTransport.(*http.Transport) //nolint:forcetypeassert
+
+// defaultDialTimeout is the dial timeout used by http.DefaultTransport.
+const defaultDialTimeout = 30 * time.Second
+
+// AddressFamily is an IP address family.
+type AddressFamily string
+
+const (
+	// AddressFamilyAny does not prefer any address family.
+	AddressFamilyAny AddressFamily = ""
+	// AddressFamilyIPv4 is the IPv4 address family.
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	// AddressFamilyIPv6 is the IPv6 address family.
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+)
+
+// Options configures how outbound network connections are made while
+// probing.
+type Options struct {
+	// SOCKS5Proxy is the URL of a SOCKS5 proxy through which all outbound
+	// connections are made. If nil, connections are made directly.
+	SOCKS5Proxy *url.URL
+	// HostAliases maps hostnames to the IP addresses that should be used
+	// when connecting to them, similar to entries in /etc/hosts.
+	HostAliases map[string]string
+	// Nameserver is the host:port address of a DNS server used to resolve
+	// hostnames instead of the system resolver.
+	Nameserver string
+	// PreferredFamily is the address family to try first when a hostname
+	// resolves to both IPv4 and IPv6 addresses.
+	PreferredFamily AddressFamily
+	// DialTimeoutIPv4 and DialTimeoutIPv6 are the timeouts for connecting to
+	// a single IPv4 or IPv6 address respectively. If zero, the default dial
+	// timeout is used.
+	DialTimeoutIPv4 time.Duration
+	DialTimeoutIPv6 time.Duration
+	// TLSSkipVerifyHosts are the hostnames, as returned by
+	// ParseTLSSkipVerifyHosts, whose TLS certificates are not verified.
+	// Certificates of all other hosts are verified as usual.
+	TLSSkipVerifyHosts []string
+}
+
+// ParseAddressFamily validates the given address family.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch af := AddressFamily(strings.ToLower(s)); af {
+	case AddressFamilyAny, AddressFamilyIPv4, AddressFamilyIPv6:
+		return af, nil
+	default:
+		return "", fmt.Errorf("unsupported address family %q: must be one of %q or %q", s, AddressFamilyIPv4, AddressFamilyIPv6)
+	}
+}
+
+// ParseHostAliases validates the given hostname to IP address mapping and
+// returns it with all hostnames in lowercase.
+func ParseHostAliases(aliases map[string]string) (map[string]string, error) {
+	parsed := make(map[string]string, len(aliases))
+	for host, ip := range aliases {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address %q for host %q", ip, host)
+		}
+		parsed[strings.ToLower(host)] = ip
+	}
+	return parsed, nil
+}
+
+// ParseNameserver validates the given DNS server address and returns it in
+// host:port form. If no port is specified, the default DNS port is used.
+func ParseNameserver(addr string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	if net.ParseIP(strings.Trim(addr, "[]")) == nil {
+		return "", fmt.Errorf("invalid nameserver address %q: must be an IP address with an optional port", addr)
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53"), nil
+}
+
+// SOCKS5ProxyURL returns the URL of the SOCKS5 proxy listening on addr.
+// addr may be either a host:port pair or a socks5:// or socks5h:// URL.
+// If username is set, it is used to authenticate with the proxy.
+func SOCKS5ProxyURL(addr, username, password string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		// Assume a host:port pair.
+		u = &url.URL{Scheme: "socks5", Host: addr}
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q: must be one of socks5 or socks5h", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %w", u.Host, err)
+	}
+	if username != "" {
+		u.User = url.UserPassword(username, password)
+	}
+	return u, nil
+}
+
+// Transport returns a new *http.Transport based on http.DefaultTransport
+// configured according to o.
+func (o Options) Transport() *http.Transport {
+	tr := defaultTransport.Clone()
+	if o.SOCKS5Proxy != nil {
+		tr.Proxy = http.ProxyURL(o.SOCKS5Proxy)
+	}
+	tr.DialContext = o.DialContext
+	if len(o.TLSSkipVerifyHosts) > 0 {
+		tr.TLSClientConfig = tlsConfigSkipVerify(o.TLSSkipVerifyHosts)
+	}
+	return tr
+}
+
+// ParseTLSSkipVerifyHosts validates the given hosts, optionally with a port,
+// and returns their hostnames in lowercase. The port is dropped as it is not
+// known when verifying a connection. IP addresses are not supported, as the
+// address of a connection is not known when verifying it either.
+func ParseTLSSkipVerifyHosts(hosts []string) ([]string, error) {
+	parsed := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			return nil, errors.New("host must not be empty")
+		}
+		if net.ParseIP(strings.Trim(host, "[]")) != nil {
+			return nil, fmt.Errorf("IP address %q is not supported: use a host alias to connect to it by hostname", host)
+		}
+		parsed = append(parsed, strings.ToLower(host))
+	}
+	return parsed, nil
+}
+
+// tlsConfigSkipVerify returns a TLS client config that does not verify the
+// certificates of the given hosts, as returned by ParseTLSSkipVerifyHosts.
+func tlsConfigSkipVerify(hosts []string) *tls.Config {
+	skip := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		skip[host] = true
+	}
+	return &tls.Config{
+		// The default verification is skipped for all hosts, and performed
+		// in VerifyConnection for hosts that are not skipped instead.
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if skip[strings.ToLower(cs.ServerName)] {
+				return nil
+			}
+			// The server name is only empty when connecting to an IP
+			// address, which cannot be verified here.
+			if cs.ServerName == "" {
+				return errors.New("tls: cannot verify a connection to an IP address while skipping verification for some hosts")
+			}
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("tls: server did not present a certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
+
+// DialContext connects to addr on the named network, applying any host
+// aliases and custom name resolution configured in o.
+func (o Options) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip, ok := o.HostAliases[strings.ToLower(host)]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+	}
+	d := o.dialer()
+	if o.PreferredFamily == AddressFamilyAny && o.DialTimeoutIPv4 == 0 && o.DialTimeoutIPv6 == 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+	return o.dialSerial(ctx, d, network, addr)
+}
+
+// dialSerial resolves addr and attempts to connect to each of its addresses
+// in turn, preferring the configured address family and applying the dial
+// timeout for each address family.
+func (o Options) dialSerial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolver := d.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	ips = sortByFamily(ips, o.PreferredFamily)
+	var errs []error
+	for _, ip := range ips {
+		isIPv4 := ip.To4() != nil
+		if (network == "tcp4" && !isIPv4) || (network == "tcp6" && isIPv4) {
+			continue
+		}
+		timeout := o.DialTimeoutIPv6
+		if isIPv4 {
+			timeout = o.DialTimeoutIPv4
+		}
+		if timeout == 0 {
+			timeout = defaultDialTimeout
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := d.DialContext(dialCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("dial %s: no suitable address found", addr)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// sortByFamily returns ips with addresses of the preferred family first,
+// otherwise preserving their order.
+func sortByFamily(ips []net.IP, preferred AddressFamily) []net.IP {
+	if preferred == AddressFamilyAny {
+		return ips
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	var rest []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (preferred == AddressFamilyIPv4) {
+			sorted = append(sorted, ip)
+		} else {
+			rest = append(rest, ip)
+		}
+	}
+	return append(sorted, rest...)
+}
+
+// dialer returns a *net.Dialer with the same settings as the one used by
+// http.DefaultTransport, using the configured nameserver if set.
+func (o Options) dialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if o.Nameserver != "" {
+		nameserver := o.Nameserver
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var nd net.Dialer
+				return nd.DialContext(ctx, network, nameserver)
+			},
+		}
+	}
+	return d
+}
+
+// installLock serializes Install, as http.DefaultTransport and the
+// transports of go-git are shared by the whole process. It is a channel
+// rather than a mutex so that waiting for it can be cancelled.
+var installLock = make(chan struct{}, 1)
+
+// Install waits until the transports installed by any other caller have
+// been restored, or for ctx to be done, then replaces http.DefaultTransport
+// with tr, and the transport used by go-git for HTTP(S) remotes with gitTr.
+// This is required as both kaniko and go-git only ever use the default
+// transport. The returned function restores the previous values, and must
+// be called for other callers to proceed.
+func Install(ctx context.Context, tr, gitTr *http.Transport) (restore func(), err error) {
+	select {
+	case installLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for other transports to be restored: %w", context.Cause(ctx))
+	}
+	oldDefaultTransport := http.DefaultTransport
+	oldGitHTTP := gitclient.Protocols["http"]
+	oldGitHTTPS := gitclient.Protocols["https"]
+
+	http.DefaultTransport = tr
+	gitClient := githttp.NewClient(&http.Client{Transport: gitTr})
+	gitclient.InstallProtocol("http", gitClient)
+	gitclient.InstallProtocol("https", gitClient)
+
+	return func() {
+		http.DefaultTransport = oldDefaultTransport
+		gitclient.InstallProtocol("http", oldGitHTTP)
+		gitclient.InstallProtocol("https", oldGitHTTPS)
+		<-installLock
+	}, nil
+}
+
+// CancelOnDone makes tr abort its connections once ctx is done: new
+// connections fail, and open connections are closed. This cancels requests
+// made with tr that do not use ctx themselves, such as those made by kaniko.
+// It returns a function that stops watching ctx.
+func CancelOnDone(ctx context.Context, tr *http.Transport) func() {
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	var mu sync.Mutex
+	conns := make(map[*trackedConn]struct{})
+	tr.DialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+		dialCtx, cancel := context.WithCancel(dialCtx)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+		conn, err := dial(dialCtx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		tc := &trackedConn{Conn: conn}
+		tc.untrack = func() {
+			mu.Lock()
+			delete(conns, tc)
+			mu.Unlock()
+		}
+		conns[tc] = struct{}{}
+		return tc, nil
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		for tc := range conns {
+			_ = tc.Conn.Close()
+		}
+		mu.Unlock()
+		tr.CloseIdleConnections()
+	})
+	return func() { stop() }
+}
+
+// trackedConn is a connection tracked by CancelOnDone.
+type trackedConn struct {
+	net.Conn
+	untrack func()
+}
+
+func (c *trackedConn) Close() error {
+	c.untrack()
+	return c.Conn.Close()
+}
+
+// CountBytesRead adds the number of bytes read from connections made by tr to
+// n.
+func CountBytesRead(tr *http.Transport, n *atomic.Int64) {
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, n: n}, nil
+	}
+}
+
+// countingConn is a connection that counts the bytes read from it.
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
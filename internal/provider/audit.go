@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// auditSignatureHeader holds the HMAC-SHA256 signature of the body of an
+// audit event, as "sha256=" followed by the hex encoded signature.
+const auditSignatureHeader = "X-Envbuilder-Signature-256"
+
+// auditTimeout is how long sending an audit event may take.
+const auditTimeout = 10 * time.Second
+
+// auditEnvironment are the environment variables that identify who applied
+// which template, as set by Coder provisioners, Terraform Cloud and the
+// Terraform CLI. Those that are set are included in audit events.
+var auditEnvironment = []string{
+	"CODER_WORKSPACE_OWNER",
+	"CODER_WORKSPACE_NAME",
+	"CODER_WORKSPACE_TEMPLATE_NAME",
+	"CODER_WORKSPACE_TEMPLATE_VERSION",
+	"TFC_RUN_ID",
+	"TFC_WORKSPACE_NAME",
+	"TF_WORKSPACE",
+}
+
+// auditWebhook sends an event for every cache probe to a webhook, configured
+// by audit_webhook_url. A nil *auditWebhook sends nothing.
+type auditWebhook struct {
+	url string
+	// secret signs the body of every event, if set.
+	secret string
+	client *http.Client
+}
+
+// auditEvent describes the outcome of a cache probe.
+type auditEvent struct {
+	Time time.Time `json:"time"`
+	// Resource is the type of the resource that probed, "resource" or
+	// "ephemeral_resource".
+	Resource     string            `json:"resource"`
+	Environment  map[string]string `json:"environment"`
+	GitURL       string            `json:"git_url"`
+	CacheRepo    string            `json:"cache_repo"`
+	BuilderImage string            `json:"builder_image"`
+	InputsHash   string            `json:"inputs_hash"`
+	Commit       string            `json:"commit"`
+	Hit          bool              `json:"hit"`
+	Image        string            `json:"image"`
+	Digest       string            `json:"digest"`
+	DurationMS   int64             `json:"duration_ms"`
+}
+
+// newAuditEvent returns the event of the probe by resource that started at
+// started and produced data, with the inputs hash inputsHash of commit.
+func newAuditEvent(resource string, data *CachedImageResourceModel, inputsHash, commit string, started time.Time) auditEvent {
+	env := make(map[string]string)
+	for _, key := range auditEnvironment {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	return auditEvent{
+		Time:         started.UTC(),
+		Resource:     resource,
+		Environment:  env,
+		GitURL:       data.GitURLUsed.ValueString(),
+		CacheRepo:    data.cacheRepo(),
+		BuilderImage: data.BuilderImage.ValueString(),
+		InputsHash:   inputsHash,
+		Commit:       commit,
+		Hit:          data.Exists.ValueBool(),
+		Image:        data.Image.ValueString(),
+		Digest:       data.ImageDigest.ValueString(),
+		DurationMS:   time.Since(started).Milliseconds(),
+	}
+}
+
+// send posts event to the webhook as JSON. Any response other than a 2xx
+// status is an error.
+func (w *auditWebhook) send(ctx context.Context, event auditEvent) error {
+	if w == nil {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, auditTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set(auditSignatureHeader, "sha256="+signAuditEvent(w.secret, body))
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("audit webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// signAuditEvent returns the hex encoded HMAC-SHA256 of body with secret.
+func signAuditEvent(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditWebhook(t *testing.T) {
+	t.Parallel()
+
+	var received auditEvent
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		signature = r.Header.Get(auditSignatureHeader)
+		assert.Equal(t, "sha256="+signAuditEvent("secret", body), signature)
+		assert.NoError(t, json.Unmarshal(body, &received))
+		if received.Hit {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	webhook := &auditWebhook{url: srv.URL, secret: "secret", client: srv.Client()}
+	event := auditEvent{Time: time.Now().UTC(), Resource: "resource", InputsHash: "hash", Hit: true, Image: "localhost:5000/cache@sha256:abc"}
+	require.NoError(t, webhook.send(ctx, event))
+	assert.NotEmpty(t, signature)
+	assert.Equal(t, event.Image, received.Image)
+	assert.Equal(t, event.InputsHash, received.InputsHash)
+
+	event.Hit = false
+	assert.ErrorContains(t, webhook.send(ctx, event), "500")
+
+	var noWebhook *auditWebhook
+	assert.NoError(t, noWebhook.send(ctx, event))
+}
+
+// Not parallel, as the environment is set.
+func TestNewAuditEvent(t *testing.T) {
+	t.Setenv("CODER_WORKSPACE_OWNER", "alice")
+	t.Setenv("TF_WORKSPACE", "")
+
+	data := CachedImageResourceModel{
+		BuilderImage: types.StringValue("ghcr.io/coder/envbuilder:latest"),
+		CacheRepo:    types.StringValue("localhost:5000/cache"),
+		GitURLUsed:   types.StringValue("https://git.local/repo.git"),
+		Exists:       types.BoolValue(true),
+		Image:        types.StringValue("localhost:5000/cache@sha256:abc"),
+		ImageDigest:  types.StringValue("sha256:abc"),
+	}
+	event := newAuditEvent("resource", &data, "hash", "commit", time.Now().Add(-time.Second))
+	assert.Equal(t, map[string]string{"CODER_WORKSPACE_OWNER": "alice", "TF_WORKSPACE": ""}, event.Environment)
+	assert.Equal(t, "localhost:5000/cache", event.CacheRepo)
+	assert.Equal(t, "https://git.local/repo.git", event.GitURL)
+	assert.Equal(t, "sha256:abc", event.Digest)
+	assert.True(t, event.Hit)
+	assert.GreaterOrEqual(t, event.DurationMS, int64(1000))
+}
+
+func TestAuditFromDataModel(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		data        EnvbuilderProviderModel
+		expectNil   bool
+		expectErr   bool
+		expectWarns int
+	}{
+		{name: "not configured", expectNil: true},
+		{name: "secret only", data: EnvbuilderProviderModel{AuditWebhookSecret: types.StringValue("secret")}, expectNil: true, expectWarns: 1},
+		{name: "url", data: EnvbuilderProviderModel{AuditWebhookURL: types.StringValue("https://audit.local/events")}},
+		{name: "invalid url", data: EnvbuilderProviderModel{AuditWebhookURL: types.StringValue("audit.local/events")}, expectNil: true, expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var diags diag.Diagnostics
+			webhook := auditFromDataModel(tc.data, netutil.Options{}, &diags)
+			assert.Equal(t, tc.expectErr, diags.HasError(), diags)
+			assert.Equal(t, tc.expectWarns, diags.WarningsCount(), diags)
+			assert.Equal(t, tc.expectNil, webhook == nil)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrismellard/docker-credential-acr-env/pkg/credhelper"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// azureRegistryHost matches the hosts of Azure Container Registry, in the
+// public and national clouds.
+var azureRegistryHost = regexp.MustCompile(`^[a-z0-9-]+\.azurecr\.(io|cn|de|us)$`)
+
+// azureTokenLifetime is how long a registry refresh token is used before a
+// new one is requested. The tokens issued by Azure Container Registry are
+// valid for three hours.
+const azureTokenLifetime = time.Hour
+
+// azureCredentials gets credentials for Azure Container Registry from the
+// Azure identity in the environment, configured by azure_auth: a service
+// principal, a federated token, or a managed identity. The Azure AD token is
+// exchanged for a registry refresh token, which is held for
+// azureTokenLifetime. A nil *azureCredentials has no credentials.
+type azureCredentials struct {
+	// get returns the username and secret for a registry host. If nil, the
+	// ACR credential helper is used, as kaniko would.
+	get func(host string) (string, string, error)
+
+	mu    sync.Mutex
+	cache map[string]azureToken
+}
+
+// azureToken is a registry refresh token.
+type azureToken struct {
+	cfg     authn.AuthConfig
+	expires time.Time
+}
+
+var _ cloudCredentials = &azureCredentials{}
+
+// isAzureRegistry reports whether host is an Azure Container Registry host,
+// e.g. example.azurecr.io.
+func isAzureRegistry(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	return azureRegistryHost.MatchString(host)
+}
+
+func (*azureCredentials) registry(host string) bool {
+	return isAzureRegistry(host)
+}
+
+// credentials returns the credentials of host. The returned config is empty
+// if host is not an Azure registry.
+func (a *azureCredentials) credentials(_ context.Context, host string) (authn.AuthConfig, error) {
+	if a == nil || !isAzureRegistry(host) {
+		return authn.AuthConfig{}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if token, ok := a.cache[host]; ok && time.Now().Before(token.expires) {
+		return token.cfg, nil
+	}
+
+	get := a.get
+	if get == nil {
+		get = credhelper.NewACRCredentialsHelper().Get
+	}
+	username, secret, err := get(host)
+	if err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("get azure registry token for %q: %w", host, err)
+	}
+	// As with Docker credential helpers, a username of "<token>" means that
+	// the secret is an identity token.
+	cfg := authn.AuthConfig{Username: username, Password: secret}
+	if username == "<token>" {
+		cfg = authn.AuthConfig{IdentityToken: secret}
+	}
+	if a.cache == nil {
+		a.cache = make(map[string]azureToken)
+	}
+	a.cache[host] = azureToken{cfg: cfg, expires: time.Now().Add(azureTokenLifetime)}
+	return cfg, nil
+}
+
+func (a *azureCredentials) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return a.ResolveContext(context.Background(), target)
+}
+
+func (a *azureCredentials) ResolveContext(ctx context.Context, target authn.Resource) (authn.Authenticator, error) {
+	cfg, err := a.credentials(ctx, target.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	if cfg == (authn.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(cfg), nil
+}
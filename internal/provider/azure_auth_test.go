@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsAzureRegistry(t *testing.T) {
+	t.Parallel()
+
+	for host, want := range map[string]bool{
+		"example.azurecr.io":     true,
+		"Example.AzureCR.io:443": true,
+		"example.azurecr.cn":     true,
+		"mcr.microsoft.com":      false,
+		"azurecr.io":             false,
+		"example.azurecr.io.com": false,
+		"ghcr.io":                false,
+	} {
+		assert.Equal(t, want, isAzureRegistry(host), host)
+	}
+}
+
+func TestAzureCredentials(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	a := &azureCredentials{get: func(host string) (string, string, error) {
+		calls++
+		assert.Equal(t, "example.azurecr.io", host)
+		return "<token>", "refresh-token", nil
+	}}
+	repo, err := name.NewRepository("example.azurecr.io/cache")
+	require.NoError(t, err)
+	auth, err := a.Resolve(repo)
+	require.NoError(t, err)
+	cfg, err := auth.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &authn.AuthConfig{IdentityToken: "refresh-token"}, cfg)
+
+	// The token is reused.
+	_, err = a.Resolve(repo)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	// Other registries get no credentials.
+	repo, err = name.NewRepository("ghcr.io/coder/cache")
+	require.NoError(t, err)
+	auth, err = a.Resolve(repo)
+	require.NoError(t, err)
+	assert.Equal(t, authn.Anonymous, auth)
+
+	got, err := dockerConfigWithCloudCredentials(context.Background(), "", []cloudCredentials{a}, "example.azurecr.io/cache", "ghcr.io/coder/envbuilder")
+	require.NoError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"example.azurecr.io": {"identitytoken": "refresh-token"}}}`, string(decoded))
+}
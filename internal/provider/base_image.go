@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/envbuilder/devcontainer"
+	eboptions "github.com/coder/envbuilder/options"
+)
+
+// findBaseImage returns the image that the devcontainer or Dockerfile in
+// workspaceFolder is based on, following the same lookup rules as
+// envbuilder. For multi-stage Dockerfiles, this is the image the final stage
+// is based on. If neither is found, the fallback image is returned.
+func findBaseImage(workspaceFolder string, opts eboptions.Options) (string, error) {
+	if opts.DockerfilePath != "" {
+		return baseImageFromDockerfile(filepath.Join(workspaceFolder, opts.DockerfilePath))
+	}
+
+	devcontainerPath, devcontainerDir, err := findDevcontainerJSON(workspaceFolder, opts)
+	if errors.Is(err, os.ErrNotExist) {
+		return fallbackBaseImage(opts)
+	}
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(devcontainerPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fallbackBaseImage(opts)
+	}
+	if err != nil {
+		return "", fmt.Errorf("read devcontainer.json: %w", err)
+	}
+	spec, err := devcontainer.Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("parse devcontainer.json: %w", err)
+	}
+	switch {
+	case spec.HasImage():
+		return spec.Image, nil
+	case spec.HasDockerfile():
+		dockerfile := spec.Dockerfile
+		if dockerfile == "" {
+			dockerfile = spec.Build.Dockerfile
+		}
+		return baseImageFromDockerfile(filepath.Join(devcontainerDir, dockerfile))
+	default:
+		return fallbackBaseImage(opts)
+	}
+}
+
+// findDevcontainerJSON returns the path to the devcontainer.json file in
+// workspaceFolder and the directory containing it. It mirrors the lookup
+// performed by envbuilder, which is not exported.
+func findDevcontainerJSON(workspaceFolder string, opts eboptions.Options) (string, string, error) {
+	if opts.DevcontainerDir != "" || opts.DevcontainerJSONPath != "" {
+		devcontainerDir := opts.DevcontainerDir
+		if devcontainerDir == "" {
+			devcontainerDir = ".devcontainer"
+		}
+		if !filepath.IsAbs(devcontainerDir) {
+			devcontainerDir = filepath.Join(workspaceFolder, devcontainerDir)
+		}
+		devcontainerPath := opts.DevcontainerJSONPath
+		if devcontainerPath == "" {
+			devcontainerPath = "devcontainer.json"
+		}
+		if !filepath.IsAbs(devcontainerPath) {
+			devcontainerPath = filepath.Join(devcontainerDir, devcontainerPath)
+		}
+		return devcontainerPath, devcontainerDir, nil
+	}
+
+	for _, location := range []string{
+		filepath.Join(workspaceFolder, ".devcontainer", "devcontainer.json"),
+		filepath.Join(workspaceFolder, "devcontainer.json"),
+	} {
+		if _, err := os.Stat(location); err == nil {
+			return location, filepath.Dir(location), nil
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(workspaceFolder, ".devcontainer"))
+	if err != nil {
+		return "", "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		location := filepath.Join(workspaceFolder, ".devcontainer", entry.Name(), "devcontainer.json")
+		if _, err := os.Stat(location); err == nil {
+			return location, filepath.Dir(location), nil
+		}
+	}
+	return "", "", fmt.Errorf("devcontainer.json: %w", os.ErrNotExist)
+}
+
+// baseImageFromDockerfile returns the image that the final stage of the
+// Dockerfile at path is based on.
+func baseImageFromDockerfile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read Dockerfile: %w", err)
+	}
+	ref, err := devcontainer.ImageFromDockerfile(string(content))
+	if err != nil {
+		return "", fmt.Errorf("find base image in %s: %w", path, err)
+	}
+	return ref.String(), nil
+}
+
+// fallbackBaseImage returns the fallback image, which envbuilder builds when
+// no devcontainer.json or Dockerfile is found.
+func fallbackBaseImage(opts eboptions.Options) (string, error) {
+	if opts.FallbackImage == "" {
+		return "", errors.New("no devcontainer.json, Dockerfile or fallback image found")
+	}
+	return opts.FallbackImage, nil
+}
+
+// referencedImages returns the images that the devcontainer or Dockerfile in
+// workspaceFolder references, and the path of the file that references them
+// relative to workspaceFolder. For Dockerfiles, these are the images of all
+// stages that are not based on an earlier stage. If neither is found, there
+// are no images.
+func referencedImages(workspaceFolder string, opts eboptions.Options) (string, []string, error) {
+	dockerfilePath := ""
+	if opts.DockerfilePath != "" {
+		dockerfilePath = filepath.Join(workspaceFolder, opts.DockerfilePath)
+	} else {
+		devcontainerPath, devcontainerDir, err := findDevcontainerJSON(workspaceFolder, opts)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		content, err := os.ReadFile(devcontainerPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, nil
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("read devcontainer.json: %w", err)
+		}
+		spec, err := devcontainer.Parse(content)
+		if err != nil {
+			return "", nil, fmt.Errorf("parse devcontainer.json: %w", err)
+		}
+		switch {
+		case spec.HasImage():
+			return relativeSource(workspaceFolder, devcontainerPath), []string{spec.Image}, nil
+		case spec.HasDockerfile():
+			dockerfile := spec.Dockerfile
+			if dockerfile == "" {
+				dockerfile = spec.Build.Dockerfile
+			}
+			dockerfilePath = filepath.Join(devcontainerDir, dockerfile)
+		default:
+			return "", nil, nil
+		}
+	}
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("read Dockerfile: %w", err)
+	}
+	return relativeSource(workspaceFolder, dockerfilePath), imagesFromDockerfile(string(content)), nil
+}
+
+// imagesFromDockerfile returns the images of the FROM instructions in the
+// Dockerfile content, with ARG defaults substituted. Stages based on an
+// earlier stage, and scratch, are left out.
+func imagesFromDockerfile(content string) []string {
+	args := make(map[string]string)
+	stages := make(map[string]bool)
+	var images []string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if k, v, ok := strings.Cut(fields[1], "="); ok {
+				args[k] = strings.Trim(v, `"'`)
+			}
+		case "FROM":
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+				fields = fields[1:]
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			image := os.Expand(fields[0], func(k string) string { return args[k] })
+			if image != "scratch" && !stages[strings.ToLower(image)] {
+				images = append(images, image)
+			}
+			if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+				stages[strings.ToLower(fields[2])] = true
+			}
+		}
+	}
+	return images
+}
+
+// relativeSource returns path relative to workspaceFolder, for diagnostics.
+func relativeSource(workspaceFolder, path string) string {
+	if rel, err := filepath.Rel(workspaceFolder, path); err == nil {
+		return rel
+	}
+	return path
+}
@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindBaseImage(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		files       map[string]string
+		opts        eboptions.Options
+		expectImage string
+		expectErr   bool
+	}{
+		{
+			name: "devcontainer image",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": "ubuntu:22.04"}`,
+			},
+			expectImage: "ubuntu:22.04",
+		},
+		{
+			name: "devcontainer dockerfile",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"build": {"dockerfile": "Dockerfile"}}`,
+				".devcontainer/Dockerfile":        "ARG VERSION=22.04\nFROM ubuntu:${VERSION}\nRUN date",
+			},
+			expectImage: "ubuntu:22.04",
+		},
+		{
+			name: "nested devcontainer",
+			files: map[string]string{
+				".devcontainer/go/devcontainer.json": `{"image": "golang:1.22"}`,
+			},
+			expectImage: "golang:1.22",
+		},
+		{
+			name: "custom devcontainer dir",
+			files: map[string]string{
+				"custom/devcontainer.json": `{"image": "debian:12"}`,
+			},
+			opts:        eboptions.Options{DevcontainerDir: "custom"},
+			expectImage: "debian:12",
+		},
+		{
+			name: "multi-stage dockerfile",
+			files: map[string]string{
+				"Dockerfile": "FROM golang:1.22 AS build\nRUN go version\nFROM debian:12\nCOPY --from=build /go /go",
+			},
+			opts:        eboptions.Options{DockerfilePath: "Dockerfile"},
+			expectImage: "debian:12",
+		},
+		{
+			name:        "fallback image",
+			opts:        eboptions.Options{FallbackImage: "alpine:3.20"},
+			expectImage: "alpine:3.20",
+		},
+		{
+			name:      "nothing found",
+			expectErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for path, content := range tc.files {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644))
+			}
+			image, err := findBaseImage(dir, tc.opts)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectImage, image)
+		})
+	}
+}
+
+func TestReferencedImages(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		files        map[string]string
+		opts         eboptions.Options
+		expectSource string
+		expectImages []string
+	}{
+		{
+			name: "devcontainer image",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": "ubuntu:22.04"}`,
+			},
+			expectSource: ".devcontainer/devcontainer.json",
+			expectImages: []string{"ubuntu:22.04"},
+		},
+		{
+			name: "devcontainer dockerfile",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"build": {"dockerfile": "Dockerfile"}}`,
+				".devcontainer/Dockerfile":        "ARG VERSION=22.04\nFROM ubuntu:${VERSION}\nRUN date",
+			},
+			expectSource: ".devcontainer/Dockerfile",
+			expectImages: []string{"ubuntu:22.04"},
+		},
+		{
+			name: "multi-stage dockerfile",
+			files: map[string]string{
+				"Dockerfile": "FROM --platform=linux/amd64 golang:1.22 AS build\nFROM scratch AS empty\nFROM build AS test\nfrom ghcr.io/org/base:1\nCOPY --from=build /go /go",
+			},
+			opts:         eboptions.Options{DockerfilePath: "Dockerfile"},
+			expectSource: "Dockerfile",
+			expectImages: []string{"golang:1.22", "ghcr.io/org/base:1"},
+		},
+		{
+			name: "fallback image",
+			opts: eboptions.Options{FallbackImage: "alpine:3.20"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for path, content := range tc.files {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644))
+			}
+			source, images, err := referencedImages(dir, tc.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectSource, source)
+			assert.Equal(t, tc.expectImages, images)
+		})
+	}
+}
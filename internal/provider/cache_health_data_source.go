@@ -0,0 +1,314 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &CacheHealthDataSource{}
+
+func NewCacheHealthDataSource() datasource.DataSource {
+	return &CacheHealthDataSource{}
+}
+
+// CacheHealthDataSource defines the data source implementation.
+type CacheHealthDataSource struct {
+	data *providerData
+}
+
+// CacheHealthDataSourceModel describes the envbuilder cache health data source.
+type CacheHealthDataSourceModel struct {
+	// Required "inputs".
+	CacheRepo types.String `tfsdk:"cache_repo"`
+	// Optional "inputs".
+	CacheNamespace    types.String `tfsdk:"cache_namespace"`
+	MaxAgeDays        types.Int64  `tfsdk:"max_age_days"`
+	RequiredLabels    types.Map    `tfsdk:"required_labels"`
+	RequiredPlatforms types.List   `tfsdk:"required_platforms"`
+	Tag               types.String `tfsdk:"tag"`
+	// Computed "outputs".
+	CreatedAt   types.String `tfsdk:"created_at"`
+	Exists      types.Bool   `tfsdk:"exists"`
+	Fresh       types.Bool   `tfsdk:"fresh"`
+	Healthy     types.Bool   `tfsdk:"healthy"`
+	ID          types.String `tfsdk:"id"`
+	Image       types.String `tfsdk:"image"`
+	LabelsOK    types.Bool   `tfsdk:"labels_ok"`
+	Messages    types.List   `tfsdk:"messages"`
+	PlatformsOK types.Bool   `tfsdk:"platforms_ok"`
+}
+
+func (d *CacheHealthDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cache_health"
+}
+
+func (d *CacheHealthDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		// This description is used by the documentation generator and the language server.
+		MarkdownDescription: "The cache health data source checks an image in a cache repo populated by envbuilder against a set of expectations. It is designed to be used in `check` blocks: failing expectations, and errors reaching the cache repo, are reported in its outputs rather than as errors, so they do not fail the apply.",
+
+		Attributes: map[string]schema.Attribute{
+			// Required "inputs".
+			"cache_repo": schema.StringAttribute{
+				MarkdownDescription: "The name of the container registry repository to check.",
+				Required:            true,
+			},
+
+			// Optional "inputs".
+			"cache_namespace": schema.StringAttribute{
+				MarkdownDescription: "The namespace within `cache_repo` to check, as set by the `cache_namespace` attribute of the `envbuilder_cached_image` resource.",
+				Optional:            true,
+				Validators: []validator.String{
+					cacheNamespace(),
+				},
+			},
+			"max_age_days": schema.Int64Attribute{
+				MarkdownDescription: "The maximum age in days of the image. The age is determined from the creation timestamp in the image config. If not set, the age of the image is not checked.",
+				Optional:            true,
+			},
+			"required_labels": schema.MapAttribute{
+				MarkdownDescription: "Labels that must be set on the image, with their expected values. For multi-platform images, each label must be set to the expected value on the image for every platform.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"required_platforms": schema.ListAttribute{
+				MarkdownDescription: "Platforms the image must be available for, in the form `os/arch[/variant]`, for example `linux/amd64`.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"tag": schema.StringAttribute{
+				MarkdownDescription: "The tag of the image to check. If not set, the most recently created image in the cache repo is checked.",
+				Optional:            true,
+			},
+
+			// Computed "outputs".
+			"created_at": schema.StringAttribute{
+				MarkdownDescription: "The creation timestamp of the image in RFC3339 format. Empty if the image was not found or has no creation timestamp.",
+				Computed:            true,
+			},
+			"exists": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image was found in the cache repo.",
+				Computed:            true,
+			},
+			"fresh": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image exists and is no older than `max_age_days`.",
+				Computed:            true,
+			},
+			"healthy": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image exists and meets all expectations.",
+				Computed:            true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "The cache repo, including `cache_namespace`.",
+				Computed:            true,
+			},
+			"image": schema.StringAttribute{
+				MarkdownDescription: "The checked image in the form repo@digest. Empty if the image was not found.",
+				Computed:            true,
+			},
+			"labels_ok": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image exists and has all `required_labels`.",
+				Computed:            true,
+			},
+			"messages": schema.ListAttribute{
+				MarkdownDescription: "Human-readable descriptions of each expectation that was not met. Empty if the image is healthy.",
+				ElementType:         types.StringType,
+				Computed:            true,
+			},
+			"platforms_ok": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image exists and is available for all `required_platforms`.",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *CacheHealthDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	data, ok := req.ProviderData.(*providerData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *providerData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.data = data
+}
+
+func (d *CacheHealthDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data CacheHealthDataSourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Invalid expectations are configuration errors, and are reported as such.
+	if !data.MaxAgeDays.IsNull() && data.MaxAgeDays.ValueInt64() <= 0 {
+		resp.Diagnostics.AddAttributeError(path.Root("max_age_days"),
+			"Invalid max_age_days",
+			fmt.Sprintf("max_age_days must be a positive number of days, got %d.", data.MaxAgeDays.ValueInt64()),
+		)
+	}
+	var requiredPlatforms []v1.Platform
+	for idx, s := range tfutil.TFListToStringSlice(data.RequiredPlatforms) {
+		p, err := v1.ParsePlatform(s)
+		if err != nil || p.OS == "" || p.Architecture == "" {
+			resp.Diagnostics.AddAttributeError(path.Root("required_platforms").AtListIndex(idx),
+				"Invalid platform",
+				fmt.Sprintf("%q is not of the form os/arch[/variant].", s),
+			)
+			continue
+		}
+		requiredPlatforms = append(requiredPlatforms, *p)
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var (
+		netOpts netutil.Options
+		auth    registryAuth
+	)
+	if d.data != nil {
+		netOpts, auth = d.data.netOpts, d.data.registryAuth
+	}
+	repo := joinCacheNamespace(data.CacheRepo.ValueString(), data.CacheNamespace.ValueString())
+	var (
+		info imgutil.ImageInfo
+		err  error
+	)
+	if data.Tag.IsNull() {
+		info, err = imgutil.GetNewestImageInfo(ctx, repo, remoteOptions(netOpts, auth)...)
+	} else {
+		info, err = imgutil.GetImageInfo(ctx, repo+":"+data.Tag.ValueString(), remoteOptions(netOpts, auth)...)
+	}
+
+	data.ID = types.StringValue(repo)
+	messages := checkCacheHealth(info, err, time.Now(), data.MaxAgeDays, requiredPlatforms, tfutil.TFMapToStringMap(data.RequiredLabels))
+	data.Exists = types.BoolValue(err == nil)
+	data.Image = types.StringValue(info.Ref)
+	data.CreatedAt = types.StringValue(formatTime(info.Created))
+	data.Fresh = types.BoolValue(err == nil && messages.fresh == "")
+	data.PlatformsOK = types.BoolValue(err == nil && len(messages.platforms) == 0)
+	data.LabelsOK = types.BoolValue(err == nil && len(messages.labels) == 0)
+	all := messages.all()
+	data.Healthy = types.BoolValue(len(all) == 0)
+	messagesList, diags := types.ListValueFrom(ctx, types.StringType, all)
+	data.Messages = messagesList
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// cacheHealthMessages holds a message for each failed cache health
+// expectation.
+type cacheHealthMessages struct {
+	exists    string
+	fresh     string
+	platforms []string
+	labels    []string
+}
+
+// all returns all messages in a stable order.
+func (m cacheHealthMessages) all() []string {
+	all := []string{}
+	if m.exists != "" {
+		all = append(all, m.exists)
+	}
+	if m.fresh != "" {
+		all = append(all, m.fresh)
+	}
+	all = append(all, m.platforms...)
+	return append(all, m.labels...)
+}
+
+// checkCacheHealth checks the image described by info, or the error
+// encountered fetching it, against the given expectations.
+func checkCacheHealth(info imgutil.ImageInfo, err error, now time.Time, maxAgeDays types.Int64, requiredPlatforms []v1.Platform, requiredLabels map[string]string) cacheHealthMessages {
+	var m cacheHealthMessages
+	if err != nil {
+		m.exists = fmt.Sprintf("Image not found: %s", err.Error())
+		return m
+	}
+
+	if !maxAgeDays.IsNull() {
+		maxAge := time.Duration(maxAgeDays.ValueInt64()) * 24 * time.Hour
+		switch {
+		case info.Created.IsZero():
+			m.fresh = fmt.Sprintf("Image %s has no creation timestamp.", info.Ref)
+		case now.Sub(info.Created) > maxAge:
+			m.fresh = fmt.Sprintf("Image %s was created at %s, more than %d days ago.", info.Ref, formatTime(info.Created), maxAgeDays.ValueInt64())
+		}
+	}
+
+	for _, want := range requiredPlatforms {
+		found := false
+		for _, have := range info.Platforms {
+			if have.Satisfies(want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			var have []string
+			for _, p := range info.Platforms {
+				have = append(have, p.String())
+			}
+			m.platforms = append(m.platforms, fmt.Sprintf("Image %s is not available for platform %s (available: %s).", info.Ref, want.String(), strings.Join(have, ", ")))
+		}
+	}
+
+	m.labels = checkLabels(info.Ref, info.Labels, requiredLabels)
+
+	return m
+}
+
+// checkLabels returns a message, in a stable order, for each label in
+// requiredLabels that is missing from labels or set to a different value.
+func checkLabels(imgRef string, labels, requiredLabels map[string]string) []string {
+	var messages []string
+	labelKeys := make([]string, 0, len(requiredLabels))
+	for k := range requiredLabels {
+		labelKeys = append(labelKeys, k)
+	}
+	sort.Strings(labelKeys)
+	for _, k := range labelKeys {
+		want := requiredLabels[k]
+		have, ok := labels[k]
+		switch {
+		case !ok:
+			messages = append(messages, fmt.Sprintf("Image %s does not have label %q.", imgRef, k))
+		case have != want:
+			messages = append(messages, fmt.Sprintf("Image %s has label %q set to %q, expected %q.", imgRef, k, have, want))
+		}
+	}
+	return messages
+}
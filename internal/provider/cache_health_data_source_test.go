@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCacheHealth(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	info := imgutil.ImageInfo{
+		Ref:       "localhost:5000/cache@sha256:deadbeef",
+		Created:   now.Add(-3 * 24 * time.Hour),
+		Platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		Labels:    map[string]string{"org.opencontainers.image.source": "https://example.com/repo"},
+	}
+
+	for _, tc := range []struct {
+		name              string
+		err               error
+		maxAgeDays        types.Int64
+		requiredPlatforms []v1.Platform
+		requiredLabels    map[string]string
+		expectMessages    int
+		expectFresh       bool
+		expectPlatforms   bool
+		expectLabels      bool
+	}{
+		{
+			name:            "no expectations",
+			maxAgeDays:      types.Int64Null(),
+			expectFresh:     true,
+			expectPlatforms: true,
+			expectLabels:    true,
+		},
+		{
+			name:              "all met",
+			maxAgeDays:        types.Int64Value(7),
+			requiredPlatforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			requiredLabels:    map[string]string{"org.opencontainers.image.source": "https://example.com/repo"},
+			expectFresh:       true,
+			expectPlatforms:   true,
+			expectLabels:      true,
+		},
+		{
+			name:              "all failed",
+			maxAgeDays:        types.Int64Value(1),
+			requiredPlatforms: []v1.Platform{{OS: "linux", Architecture: "riscv64"}},
+			requiredLabels:    map[string]string{"org.opencontainers.image.source": "https://example.com/other", "missing": ""},
+			expectMessages:    4,
+		},
+		{
+			name:           "not found",
+			err:            errors.New("MANIFEST_UNKNOWN"),
+			maxAgeDays:     types.Int64Null(),
+			expectMessages: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			m := checkCacheHealth(info, tc.err, now, tc.maxAgeDays, tc.requiredPlatforms, tc.requiredLabels)
+			assert.Len(t, m.all(), tc.expectMessages)
+			if tc.err != nil {
+				return
+			}
+			assert.Equal(t, tc.expectFresh, m.fresh == "")
+			assert.Equal(t, tc.expectPlatforms, len(m.platforms) == 0)
+			assert.Equal(t, tc.expectLabels, len(m.labels) == 0)
+		})
+	}
+}
+
+func TestAccCacheHealthDataSource(t *testing.T) {
+	reg := registrytest.New(t, t.TempDir())
+	repo := reg + "/cache"
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	img, err = mutate.CreatedAt(img, v1.Time{Time: time.Now().Add(-24 * time.Hour)})
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg.OS, cfg.Architecture = "linux", "amd64"
+	cfg.Config.Labels = map[string]string{"team": "platform"}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(repo + ":latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`data "envbuilder_cache_health" "test" {
+  cache_repo         = %q
+  max_age_days       = 7
+  required_platforms = ["linux/amd64"]
+  required_labels    = { team = "platform" }
+}`, repo),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.envbuilder_cache_health.test", "exists", "true"),
+					resource.TestCheckResourceAttr("data.envbuilder_cache_health.test", "healthy", "true"),
+					resource.TestCheckResourceAttr("data.envbuilder_cache_health.test", "messages.#", "0"),
+				),
+			},
+			{
+				Config: fmt.Sprintf(`data "envbuilder_cache_health" "test" {
+  cache_repo         = %q
+  tag                = "missing"
+}`, repo),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.envbuilder_cache_health.test", "exists", "false"),
+					resource.TestCheckResourceAttr("data.envbuilder_cache_health.test", "healthy", "false"),
+					resource.TestCheckResourceAttr("data.envbuilder_cache_health.test", "messages.#", "1"),
+				),
+			},
+		},
+	})
+}
@@ -0,0 +1,267 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// cacheRepos returns the cache repos to probe, in order: cache_repo, and then
+// each of cache_repos, all including the cache namespace if set.
+func (data *CachedImageResourceModel) cacheRepos() []string {
+	repos := []string{data.cacheRepo()}
+	for _, repo := range tfutil.TFListToStringSlice(data.CacheRepos) {
+		repos = append(repos, joinCacheNamespace(repo, data.CacheNamespace.ValueString()))
+	}
+	return repos
+}
+
+// imageRepo returns the cache repo the cached image was found in, or
+// cache_repo if it has not been found.
+func (data *CachedImageResourceModel) imageRepo() string {
+	if repo := data.CacheRepoUsed.ValueString(); repo != "" {
+		return repo
+	}
+	return data.cacheRepo()
+}
+
+// computeEnv computes the environment variables to set from opts, pointing
+// envbuilder at the cache repo the cached image was found in.
+func (data *CachedImageResourceModel) computeEnv(opts eboptions.Options) map[string]string {
+	opts.CacheRepo = data.imageRepo()
+	return computeEnvFromOptions(opts, tfutil.TFMapToStringMap(data.ExtraEnv), data.LegacyEnvNames.ValueString())
+}
+
+// runCacheProbes runs runCacheProbe against each of cacheRepos in order,
+// until the cached image is found in one of them. Only if it is found in
+// none of them is a stale image or a candidate fallen back to, from the
+// first cache repo that has one. It returns the result of the probe that
+// found an image, or of the last probe, and the cache repo it ran against.
+// Probes that failed for reasons that would not differ between cache repos,
+// such as an invalid devcontainer or a cancellation, are not repeated
+// against the others. The envbuilder binary and the repository are only
+// fetched by the first probe.
+func runCacheProbes(ctx context.Context, builderImage string, opts eboptions.Options, probeOpts cacheProbeOptions, cacheRepos []string) (cacheProbeResult, string, error) {
+	if len(cacheRepos) > 1 {
+		session, err := newProbeSession()
+		if err != nil {
+			return cacheProbeResult{}, cacheRepos[0], fmt.Errorf("unable to create temp directory: %w", err)
+		}
+		defer session.cleanup(ctx)
+		probeOpts.session = session
+		probeOpts.deferFallback = true
+	}
+
+	var (
+		result  cacheProbeResult
+		repo    string
+		err     error
+		results []cacheProbeResult
+		repos   []string
+	)
+	for i, cacheRepo := range cacheRepos {
+		repo = cacheRepo
+		opts.CacheRepo = cacheRepo
+		result, err = runCacheProbe(ctx, builderImage, opts, probeOpts)
+		results, repos = append(results, result), append(repos, cacheRepo)
+		if err == nil || i == len(cacheRepos)-1 || !probeNextCacheRepo(ctx, err) {
+			break
+		}
+		tflog.Info(ctx, "cached image not found, probing the next cache repo", map[string]any{
+			"cache_repo": cacheRepo,
+			"next":       cacheRepos[i+1],
+			"err":        err,
+		})
+	}
+	if err == nil || !probeOpts.deferFallback || !probeNextCacheRepo(ctx, err) {
+		return result, repo, err
+	}
+
+	// Stale images are preferred to candidates, as in a single cache repo.
+	for _, stale := range []bool{true, false} {
+		for i, fallbackResult := range results {
+			if fallbackResult.fallback != nil && fallbackResult.fallback.apply(ctx, probeOpts, stale, &fallbackResult) {
+				return fallbackResult, repos[i], nil
+			}
+		}
+	}
+	return result, repo, err
+}
+
+// probeSession holds what the probes of several cache repos share, so that
+// it is only fetched once: the envbuilder binary of the builder image, and
+// the repository. A nil *probeSession shares nothing.
+type probeSession struct {
+	// dir holds the envbuilder binary and the repository.
+	dir string
+	// envbuilderPath is the envbuilder binary, once it is extracted.
+	envbuilderPath string
+	// repoPath is the repository, once a probe cloned it.
+	repoPath string
+}
+
+// newProbeSession creates a probe session in a temporary directory, which is
+// removed by cleanup.
+func newProbeSession() (*probeSession, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "envbuilder-provider-probe-session")
+	if err != nil {
+		return nil, err
+	}
+	return &probeSession{dir: dir}, nil
+}
+
+// cleanup removes the directory of the session.
+func (s *probeSession) cleanup(ctx context.Context) {
+	if err := os.RemoveAll(s.dir); err != nil {
+		tflog.Error(ctx, "failed to clean up probe session directory", map[string]any{"err": err})
+	}
+}
+
+// extractEnvbuilder writes the envbuilder binary of builderImage to dest,
+// extracting it from the image only the first time in the session. Later
+// probes get a link to it, or a copy if it cannot be linked.
+func (s *probeSession) extractEnvbuilder(ctx context.Context, builderImage, dest string, remoteOpts ...remote.Option) error {
+	if s == nil {
+		return imgutil.ExtractEnvbuilderFromImage(ctx, builderImage, dest, remoteOpts...)
+	}
+	if s.envbuilderPath == "" {
+		path := filepath.Join(s.dir, "envbuilder")
+		if err := imgutil.ExtractEnvbuilderFromImage(ctx, builderImage, path, remoteOpts...); err != nil {
+			return err
+		}
+		s.envbuilderPath = path
+	}
+	if err := os.Link(s.envbuilderPath, dest); err == nil {
+		return nil
+	}
+	return copyRegularFile(s.envbuilderPath, dest, 0o755)
+}
+
+// keepRepo keeps a copy of the repository a probe cloned into dir, if it
+// did, for the probes that follow in the session to clone from. Cloning a
+// local repository requires git, so it is not kept if git is not installed.
+func (s *probeSession) keepRepo(ctx context.Context, dir string) {
+	if s == nil || s.repoPath != "" {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		tflog.Debug(ctx, "git is not installed, the repository will be cloned for each cache repo")
+		return
+	}
+	path := filepath.Join(s.dir, "repo")
+	if err := copySourceDir(dir, path); err != nil {
+		tflog.Warn(ctx, "unable to keep the cloned repository, it will be cloned for each cache repo", map[string]any{"err": err})
+		_ = os.RemoveAll(path)
+		return
+	}
+	s.repoPath = path
+}
+
+// gitURL returns the URL to clone gitURL from: the repository kept by an
+// earlier probe of the session, at the same ref, if there is one.
+func (s *probeSession) gitURL(gitURL string) string {
+	if s == nil || s.repoPath == "" || gitURL == "" {
+		return gitURL
+	}
+	return localRepoURL(s.repoPath, gitURL)
+}
+
+// probeFallback falls back to another image in a cache repo, if the cached
+// image was not found in it.
+type probeFallback struct {
+	// cacheRepo is the cache repo the images are looked for in, with
+	// keychain, as by the probe.
+	cacheRepo string
+	insecure  bool
+	keychain  authn.Keychain
+	// inputsHash is the inputs hash of the probe, which stale images are
+	// found by.
+	inputsHash string
+}
+
+// apply sets the image of result to the image last found with the same
+// inputs if stale is set, or to the image of the first candidate tag that
+// exists otherwise, if falling back to it is enabled in probeOpts. It
+// returns whether an image was found.
+func (f *probeFallback) apply(ctx context.Context, probeOpts cacheProbeOptions, stale bool, result *cacheProbeResult) bool {
+	remoteOpts := []remote.Option{
+		remote.WithTransport(probeOpts.netOpts.Transport()),
+		remote.WithAuthFromKeychain(f.keychain),
+	}
+	if probeOpts.platform != nil {
+		remoteOpts = append(remoteOpts, remote.WithPlatform(*probeOpts.platform))
+	}
+	if stale {
+		if !probeOpts.staleFallback {
+			return false
+		}
+		entry, ok := probeOpts.resultCache.latest(f.inputsHash, time.Now())
+		if !ok {
+			return false
+		}
+		staleResult, err := entry.result(ctx, f.cacheRepo, remoteOpts...)
+		if err != nil {
+			tflog.Info(ctx, "stale image no longer exists", map[string]any{"cache_repo": f.cacheRepo, "err": err})
+			return false
+		}
+		tflog.Info(ctx, "using a stale image", map[string]any{"cache_repo": f.cacheRepo, "digest": entry.Digest, "stored_at": entry.StoredAt})
+		result.image, result.stale = staleResult.image, true
+		return true
+	}
+	if len(probeOpts.candidateTags) == 0 {
+		return false
+	}
+	img, tag, err := firstCandidateImage(ctx, f.cacheRepo, probeOpts.candidateTags, f.insecure, remoteOpts...)
+	if err != nil {
+		tflog.Info(ctx, "no candidate tag found", map[string]any{"cache_repo": f.cacheRepo, "err": err})
+		return false
+	}
+	tflog.Info(ctx, "using the image of a candidate tag", map[string]any{"cache_repo": f.cacheRepo, "tag": tag})
+	result.image, result.candidateTag = img, tag
+	return true
+}
+
+// probeNextCacheRepo reports whether a probe that failed with err should be
+// repeated against the next cache repo. Access errors are, as the next cache
+// repo may be reachable when the first is not.
+func probeNextCacheRepo(ctx context.Context, err error) bool {
+	var (
+		configErr    *probeConfigError
+		registryErr  *registryNotAllowedError
+		scratchErr   *scratchLimitError
+		cancelledErr *probeCancelledError
+	)
+	return ctx.Err() == nil &&
+		!errors.As(err, &configErr) &&
+		!errors.As(err, &registryErr) &&
+		!errors.As(err, &scratchErr) &&
+		!errors.As(err, &cancelledErr)
+}
+
+// describeCacheRepos describes repos in diagnostics, as the repository the
+// cached image was looked for in.
+func describeCacheRepos(repos []string) string {
+	if len(repos) == 1 {
+		return fmt.Sprintf("repository %q", repos[0])
+	}
+	quoted := make([]string, len(repos))
+	for i, repo := range repos {
+		quoted[i] = fmt.Sprintf("%q", repo)
+	}
+	return "any of the repositories " + strings.Join(quoted, ", ")
+}
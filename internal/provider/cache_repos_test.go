@@ -0,0 +1,200 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheRepos(t *testing.T) {
+	t.Parallel()
+
+	data := CachedImageResourceModel{
+		CacheRepo:      types.StringValue("eu.registry.example.com/cache"),
+		CacheNamespace: types.StringValue("team-a"),
+		CacheRepos: types.ListValueMust(types.StringType, []attr.Value{
+			types.StringValue("registry.example.com/cache"),
+		}),
+	}
+	assert.Equal(t, []string{"eu.registry.example.com/cache/team-a", "registry.example.com/cache/team-a"}, data.cacheRepos())
+
+	// The image is in cache_repo until it is found elsewhere.
+	assert.Equal(t, "eu.registry.example.com/cache/team-a", data.imageRepo())
+	data.CacheRepoUsed = types.StringValue("registry.example.com/cache/team-a")
+	assert.Equal(t, "registry.example.com/cache/team-a", data.imageRepo())
+
+	// The workspace pulls the cached image from the cache repo it was found
+	// in.
+	env := data.computeEnv(eboptions.Options{CacheRepo: data.cacheRepo()})
+	assert.Equal(t, "registry.example.com/cache/team-a", env["ENVBUILDER_CACHE_REPO"])
+
+	assert.Equal(t, `repository "a"`, describeCacheRepos([]string{"a"}))
+	assert.Equal(t, `any of the repositories "a", "b"`, describeCacheRepos([]string{"a", "b"}))
+}
+
+func TestProbeNextCacheRepo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	assert.True(t, probeNextCacheRepo(ctx, errors.New("uncached RUN command")))
+	assert.True(t, probeNextCacheRepo(ctx, &probeAccessError{summary: "Registry unreachable."}))
+	assert.False(t, probeNextCacheRepo(ctx, fmt.Errorf("probe: %w", &probeConfigError{summary: "Invalid devcontainer.json."})))
+	assert.False(t, probeNextCacheRepo(ctx, &scratchLimitError{limit: 1, size: 2}))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, probeNextCacheRepo(cancelled, errors.New("uncached RUN command")))
+}
+
+// missingExecutor runs cache probes that never find the cached image, and
+// records the envbuilder binaries they are given.
+type missingExecutor struct {
+	binaries []string
+}
+
+func (*missingExecutor) needsEnvbuilderBinary() bool {
+	return true
+}
+
+func (e *missingExecutor) run(_ context.Context, probe remoteProbe, _ ...remote.Option) (v1.Image, error) {
+	content, err := os.ReadFile(probe.envbuilderPath)
+	if err != nil {
+		return nil, err
+	}
+	e.binaries = append(e.binaries, string(content))
+	return nil, errors.New("uncached RUN command")
+}
+
+// writeBuilderImage pushes an image containing a fake envbuilder binary to
+// ref.
+func writeBuilderImage(t *testing.T, ref string) {
+	t.Helper()
+	img, err := crane.Image(map[string][]byte{".envbuilder/bin/envbuilder": []byte("envbuilder")})
+	require.NoError(t, err)
+	registrytest.WriteImage(t, ref, img)
+}
+
+// Not parallel, as the cache probe replaces process-wide state.
+func TestRunCacheProbes(t *testing.T) {
+	reg := registrytest.New(t, t.TempDir())
+	repo := gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM " + reg + "/base:latest"})
+	builderImage := reg + "/envbuilder:latest"
+	writeBuilderImage(t, builderImage)
+	opts := eboptions.Options{
+		GitURL:         "file://" + repo,
+		DockerfilePath: "Dockerfile",
+	}
+	ctx := context.Background()
+
+	t.Run("exact hits first", func(t *testing.T) {
+		// The first cache repo only has a candidate, and the second has the
+		// cached image, as stored in the probe result cache.
+		first, second := reg+"/exact-a", reg+"/exact-b"
+		registrytest.WriteRandomImage(t, first+":main")
+		cached := registrytest.WriteRandomImage(t, second+":latest")
+		cachedDigest, err := cached.Digest()
+		require.NoError(t, err)
+		executor := &missingExecutor{}
+		probeOpts := cacheProbeOptions{
+			registryAuth:  registryAuth{skipLocalDockerConfig: true},
+			resultCache:   probeResultCache{dir: t.TempDir(), ttl: time.Hour},
+			candidateTags: []string{"main"},
+			executor:      executor,
+		}
+		secondOpts := opts
+		secondOpts.CacheRepo = second
+		logf := func(format string, args ...any) { t.Logf(format, args...) }
+		commit, builderDigest, err := resolveProbeInputs(ctx, logf, builderImage, secondOpts, nil)
+		require.NoError(t, err)
+		key := probeOpts.resultCache.key(probeInputsHash(builderImage, nil, secondOpts, nil, ""), commit, builderDigest)
+		require.NoError(t, probeOpts.resultCache.put(key, probeResultCacheEntry{StoredAt: time.Now(), Digest: cachedDigest.String()}))
+
+		result, probedRepo, err := runCacheProbes(ctx, builderImage, opts, probeOpts, []string{first, second})
+		require.NoError(t, err)
+		assert.Equal(t, second, probedRepo)
+		assert.Empty(t, result.candidateTag)
+		digest, err := result.image.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, cachedDigest, digest)
+		assert.Len(t, executor.binaries, 1)
+	})
+
+	t.Run("fallback once not found", func(t *testing.T) {
+		// Neither cache repo has the cached image, and only the second has
+		// a candidate.
+		first, second := reg+"/fallback-a", reg+"/fallback-b"
+		candidate := registrytest.WriteRandomImage(t, second+":main")
+		candidateDigest, err := candidate.Digest()
+		require.NoError(t, err)
+		executor := &missingExecutor{}
+		probeOpts := cacheProbeOptions{
+			registryAuth:  registryAuth{skipLocalDockerConfig: true},
+			candidateTags: []string{"main"},
+			executor:      executor,
+		}
+
+		result, probedRepo, err := runCacheProbes(ctx, builderImage, opts, probeOpts, []string{first, second})
+		require.NoError(t, err)
+		assert.Equal(t, second, probedRepo)
+		assert.Equal(t, "main", result.candidateTag)
+		digest, err := result.image.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, candidateDigest, digest)
+		// Both probes ran with the binary extracted by the first.
+		assert.Equal(t, []string{"envbuilder", "envbuilder"}, executor.binaries)
+	})
+}
+
+func TestProbeSession(t *testing.T) {
+	t.Parallel()
+
+	reg := registrytest.New(t, t.TempDir())
+	builderImage := reg + "/envbuilder:latest"
+	writeBuilderImage(t, builderImage)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	session, err := newProbeSession()
+	require.NoError(t, err)
+	defer session.cleanup(ctx)
+
+	// The binary is only extracted once, so it is found after the builder
+	// image is deleted.
+	require.NoError(t, session.extractEnvbuilder(ctx, builderImage, filepath.Join(dir, "first")))
+	ref, err := name.ParseReference(builderImage)
+	require.NoError(t, err)
+	require.NoError(t, remote.Delete(ref))
+	require.NoError(t, session.extractEnvbuilder(ctx, builderImage, filepath.Join(dir, "second")))
+	content, err := os.ReadFile(filepath.Join(dir, "second"))
+	require.NoError(t, err)
+	assert.Equal(t, "envbuilder", string(content))
+
+	// The repository is cloned from the first clone once it is kept.
+	gitURL := "ssh://git.local/repo.git#refs/heads/main"
+	assert.Equal(t, gitURL, session.gitURL(gitURL))
+	session.keepRepo(ctx, t.TempDir())
+	assert.Equal(t, gitURL, session.gitURL(gitURL), "not a repository")
+	session.keepRepo(ctx, gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM scratch"}))
+	assert.Equal(t, "file://"+session.repoPath+"#refs/heads/main", session.gitURL(gitURL))
+	assert.FileExists(t, filepath.Join(session.repoPath, "Dockerfile"))
+
+	// Without a session, nothing is shared.
+	var none *probeSession
+	assert.Equal(t, gitURL, none.gitURL(gitURL))
+}
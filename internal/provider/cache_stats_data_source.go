@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &CacheStatsDataSource{}
+
+func NewCacheStatsDataSource() datasource.DataSource {
+	return &CacheStatsDataSource{}
+}
+
+// CacheStatsDataSource defines the data source implementation.
+type CacheStatsDataSource struct {
+	data *providerData
+}
+
+// CacheStatsDataSourceModel describes the envbuilder cache stats data source.
+type CacheStatsDataSourceModel struct {
+	// Required "inputs".
+	CacheRepo types.String `tfsdk:"cache_repo"`
+	// Optional "inputs".
+	CacheNamespace types.String `tfsdk:"cache_namespace"`
+	// Computed "outputs".
+	ID              types.String `tfsdk:"id"`
+	NewestCreatedAt types.String `tfsdk:"newest_created_at"`
+	OldestCreatedAt types.String `tfsdk:"oldest_created_at"`
+	TagCount        types.Int64  `tfsdk:"tag_count"`
+	TotalSizeBytes  types.Int64  `tfsdk:"total_size_bytes"`
+}
+
+func (d *CacheStatsDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cache_stats"
+}
+
+func (d *CacheStatsDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		// This description is used by the documentation generator and the language server.
+		MarkdownDescription: "The cache stats data source summarizes the contents of a cache repo populated by envbuilder. Reading this data source lists all tags in the cache repo and fetches the manifest and config of each tagged image, which may take some time for large cache repos.",
+
+		Attributes: map[string]schema.Attribute{
+			// Required "inputs".
+			"cache_repo": schema.StringAttribute{
+				MarkdownDescription: "The name of the container registry repository to summarize.",
+				Required:            true,
+			},
+
+			// Optional "inputs".
+			"cache_namespace": schema.StringAttribute{
+				MarkdownDescription: "The namespace within `cache_repo` to summarize, as set by the `cache_namespace` attribute of the `envbuilder_cached_image` resource.",
+				Optional:            true,
+				Validators: []validator.String{
+					cacheNamespace(),
+				},
+			},
+
+			// Computed "outputs".
+			"id": schema.StringAttribute{
+				MarkdownDescription: "The cache repo, including `cache_namespace`.",
+				Computed:            true,
+			},
+			"newest_created_at": schema.StringAttribute{
+				MarkdownDescription: "The creation timestamp of the most recently created image in the cache repo, in RFC3339 format. Container registries do not record when an image was pushed, so this is read from the image config. Empty if no image has a creation timestamp.",
+				Computed:            true,
+			},
+			"oldest_created_at": schema.StringAttribute{
+				MarkdownDescription: "The creation timestamp of the least recently created image in the cache repo, in RFC3339 format. Empty if no image has a creation timestamp.",
+				Computed:            true,
+			},
+			"tag_count": schema.Int64Attribute{
+				MarkdownDescription: "The number of tags in the cache repo.",
+				Computed:            true,
+			},
+			"total_size_bytes": schema.Int64Attribute{
+				MarkdownDescription: "The total size in bytes of all unique layer and config blobs referenced by tagged images in the cache repo.",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *CacheStatsDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	data, ok := req.ProviderData.(*providerData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *providerData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.data = data
+}
+
+func (d *CacheStatsDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data CacheStatsDataSourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var (
+		netOpts netutil.Options
+		auth    registryAuth
+	)
+	if d.data != nil {
+		netOpts, auth = d.data.netOpts, d.data.registryAuth
+	}
+	repo := joinCacheNamespace(data.CacheRepo.ValueString(), data.CacheNamespace.ValueString())
+	stats, err := imgutil.GetRepoStats(ctx, repo, remoteOptions(netOpts, auth)...)
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to read cache repo",
+			fmt.Sprintf("The repository %q returned the following error: %s", repo, err.Error()),
+		)
+		return
+	}
+
+	data.ID = types.StringValue(repo)
+	data.TagCount = types.Int64Value(int64(stats.TagCount))
+	data.TotalSizeBytes = types.Int64Value(stats.TotalSize)
+	data.OldestCreatedAt = types.StringValue(formatTime(stats.Oldest))
+	data.NewestCreatedAt = types.StringValue(formatTime(stats.Newest))
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// formatTime formats t in RFC3339 format, or returns an empty string if t is
+// the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccCacheStatsDataSource(t *testing.T) {
+	reg := registrytest.New(t, t.TempDir())
+	repo := reg + "/cache"
+
+	// Push two tags referencing the same image, and one other image.
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	other, err := random.Image(512, 1)
+	require.NoError(t, err)
+	var expectSize int64
+	for _, img := range []v1.Image{img, other} {
+		m, err := img.Manifest()
+		require.NoError(t, err)
+		expectSize += m.Config.Size
+		for _, l := range m.Layers {
+			expectSize += l.Size
+		}
+	}
+	for tag, img := range map[string]v1.Image{"a": img, "b": img, "c": other} {
+		ref, err := name.ParseReference(repo + ":" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`data "envbuilder_cache_stats" "test" {
+  cache_repo = %q
+}`, repo),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.envbuilder_cache_stats.test", "id", repo),
+					resource.TestCheckResourceAttr("data.envbuilder_cache_stats.test", "tag_count", "3"),
+					resource.TestCheckResourceAttr("data.envbuilder_cache_stats.test", "total_size_bytes", fmt.Sprintf("%d", expectSize)),
+				),
+			},
+		},
+	})
+}
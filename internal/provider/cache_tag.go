@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// cacheTagPattern matches a valid image tag.
+var cacheTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// cacheTagInvalidChars matches the characters that may not appear in an
+// image tag.
+var cacheTagInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// expandCacheTag returns the tag that format expands to for the repository
+// at gitURL. {ref} is replaced with the git ref in the fragment of gitURL,
+// without a refs/heads/ or refs/tags/ prefix, or "head" if there is none, and
+// {repo} with the name of the repository. Characters that may not appear in
+// a tag are replaced with dashes.
+func expandCacheTag(format, gitURL string) (string, error) {
+	remoteURL, ref, _ := strings.Cut(gitURL, "#")
+	ref = strings.TrimPrefix(ref, "refs/heads/")
+	ref = strings.TrimPrefix(ref, "refs/tags/")
+	if ref == "" {
+		ref = "head"
+	}
+	repo := strings.TrimRight(remoteURL, "/")
+	repo = repo[strings.LastIndexAny(repo, "/:")+1:]
+	repo = strings.TrimSuffix(repo, ".git")
+
+	tag := strings.NewReplacer(
+		"{ref}", cacheTagInvalidChars.ReplaceAllString(ref, "-"),
+		"{repo}", cacheTagInvalidChars.ReplaceAllString(repo, "-"),
+	).Replace(format)
+	if !cacheTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("%q is not a valid image tag: a tag is at most 128 letters, digits, underscores, periods and dashes, and may not start with a period or dash", tag)
+	}
+	return tag, nil
+}
+
+// tagCachedImage tags img with tag in cacheRepo.
+func tagCachedImage(ctx context.Context, cacheRepo, tag string, insecure bool, img v1.Image, remoteOpts ...remote.Option) error {
+	var nameOpts []name.Option
+	if insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	ref, err := name.NewTag(cacheRepo+":"+tag, nameOpts...)
+	if err != nil {
+		return err
+	}
+	if err := remote.Tag(ref, img, append(remoteOpts, remote.WithContext(ctx))...); err != nil {
+		return fmt.Errorf("tag %s: %w", ref, err)
+	}
+	return nil
+}
+
+// firstCandidateImage returns the image of the first of tags that exists in
+// cacheRepo, and its tag.
+func firstCandidateImage(ctx context.Context, cacheRepo string, tags []string, insecure bool, remoteOpts ...remote.Option) (v1.Image, string, error) {
+	var nameOpts []name.Option
+	if insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	var errs []error
+	for _, tag := range tags {
+		ref, err := name.NewTag(cacheRepo+":"+tag, nameOpts...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		img, err := remote.Image(ref, append(remoteOpts, remote.WithContext(ctx))...)
+		if err == nil {
+			// Fetch the config, so that an image that cannot be pulled is
+			// not used.
+			_, err = img.ConfigFile()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ref, err))
+			continue
+		}
+		return img, tag, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandCacheTag(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		format    string
+		gitURL    string
+		expect    string
+		expectErr bool
+	}{
+		{format: "ws-{ref}", gitURL: "https://github.com/coder/envbuilder.git", expect: "ws-head"},
+		{format: "{repo}-{ref}", gitURL: "https://github.com/coder/envbuilder.git#refs/heads/feature/x", expect: "envbuilder-feature-x"},
+		{format: "{repo}-{ref}", gitURL: "ssh://git@github.com/coder/envbuilder#v1.0.0", expect: "envbuilder-v1.0.0"},
+		{format: "{repo}", gitURL: "git@github.com:envbuilder.git", expect: "envbuilder"},
+		{format: "{ref}", gitURL: "https://git.local/repo.git#" + strings.Repeat("a", 129), expectErr: true},
+		{format: "{ref}", gitURL: "https://git.local/repo.git#-main", expectErr: true},
+	} {
+		tag, err := expandCacheTag(tc.format, tc.gitURL)
+		if tc.expectErr {
+			assert.Error(t, err, tc.gitURL)
+			continue
+		}
+		require.NoError(t, err, tc.gitURL)
+		assert.Equal(t, tc.expect, tag, tc.gitURL)
+	}
+}
+
+// Not parallel, as the cache probe replaces process-wide state.
+func TestRunCacheProbeCacheTag(t *testing.T) {
+	reg := registrytest.New(t, t.TempDir())
+	repo := gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM " + reg + "/base:latest"})
+	builderImage := reg + "/envbuilder:latest"
+	registrytest.WriteRandomImage(t, builderImage)
+	cached := registrytest.WriteRandomImage(t, reg+"/cache:latest")
+	cachedDigest, err := cached.Digest()
+	require.NoError(t, err)
+
+	// The probe is skipped with a cached result, as the builder image does
+	// not contain envbuilder.
+	opts := eboptions.Options{
+		CacheRepo:      reg + "/cache",
+		GitURL:         "file://" + repo,
+		DockerfilePath: "Dockerfile",
+	}
+	probeOpts := cacheProbeOptions{
+		registryAuth: registryAuth{skipLocalDockerConfig: true},
+		resultCache:  probeResultCache{dir: t.TempDir(), ttl: time.Hour},
+		cacheTag:     "team-a-head",
+	}
+	ctx := context.Background()
+	logf := func(format string, args ...any) { t.Logf(format, args...) }
+	commit, builderDigest, err := resolveProbeInputs(ctx, logf, builderImage, opts, nil)
+	require.NoError(t, err)
+	key := probeOpts.resultCache.key(probeInputsHash(builderImage, nil, opts, nil, ""), commit, builderDigest)
+	require.NoError(t, probeOpts.resultCache.put(key, probeResultCacheEntry{StoredAt: time.Now(), Digest: cachedDigest.String()}))
+
+	result, err := runCacheProbe(ctx, builderImage, opts, probeOpts)
+	require.NoError(t, err)
+	require.NoError(t, result.cacheTagErr)
+	assert.Contains(t, result.progress, "Tagging the cached image")
+
+	ref, err := name.NewTag(reg + "/cache:team-a-head")
+	require.NoError(t, err)
+	desc, err := remote.Head(ref)
+	require.NoError(t, err)
+	assert.Equal(t, cachedDigest, desc.Digest)
+}
+
+func TestFirstCandidateImage(t *testing.T) {
+	t.Parallel()
+
+	reg := registrytest.New(t, t.TempDir())
+	main := registrytest.WriteRandomImage(t, reg+"/cache:main")
+	mainDigest, err := main.Digest()
+	require.NoError(t, err)
+	registrytest.WriteRandomImage(t, reg+"/cache:release")
+
+	ctx := context.Background()
+	img, tag, err := firstCandidateImage(ctx, reg+"/cache", []string{"feature-x", "main", "release"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "main", tag)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, mainDigest, imgDigest)
+
+	_, _, err = firstCandidateImage(ctx, reg+"/cache", []string{"feature-x", "feature-y"}, false)
+	assert.ErrorContains(t, err, "feature-x")
+	assert.ErrorContains(t, err, "feature-y")
+}
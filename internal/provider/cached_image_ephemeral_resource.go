@@ -0,0 +1,213 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	rschema "github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ ephemeral.EphemeralResource              = &CachedImageEphemeralResource{}
+	_ ephemeral.EphemeralResourceWithConfigure = &CachedImageEphemeralResource{}
+)
+
+func NewCachedImageEphemeralResource() ephemeral.EphemeralResource {
+	return &CachedImageEphemeralResource{}
+}
+
+// CachedImageEphemeralResource defines the ephemeral resource implementation.
+// It shares its model with CachedImageResource, but runs the cache probe on
+// every Terraform run and does not persist anything in state.
+type CachedImageEphemeralResource struct {
+	data *providerData
+}
+
+func (r *CachedImageEphemeralResource) Metadata(ctx context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cached_image"
+}
+
+func (r *CachedImageEphemeralResource) Schema(ctx context.Context, req ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	// The attributes are the same as those of the cached image resource,
+	// including validators but without any plan modifiers.
+	var rs resource.SchemaResponse
+	(&CachedImageResource{}).Schema(ctx, resource.SchemaRequest{}, &rs)
+
+	attrs := make(map[string]schema.Attribute, len(rs.Schema.Attributes))
+	for name, attr := range rs.Schema.Attributes {
+		attrs[name] = ephemeralAttribute(attr)
+	}
+
+	resp.Schema = schema.Schema{
+		// This description is used by the documentation generator and the language server.
+		MarkdownDescription: "The cached image ephemeral resource can be used to retrieve a cached image produced by envbuilder without persisting anything in state. Opening this ephemeral resource will clone the specified Git repository, read a Devcontainer specification or Dockerfile, and check for its presence in the provided cache repo on every Terraform run. If any of the layers of the cached image are missing in the provided cache repo, the builder image is returned instead. Requires Terraform 1.10 or later.",
+
+		Attributes: attrs,
+		Blocks: map[string]schema.Block{
+			"policy":   ephemeralPolicyBlock(),
+			"timeouts": ephemeralTimeoutsBlock(),
+		},
+	}
+}
+
+// ephemeralAttribute converts an attribute of the cached image resource
+// schema to the equivalent ephemeral resource schema attribute.
+func ephemeralAttribute(attr rschema.Attribute) schema.Attribute {
+	switch a := attr.(type) {
+	case rschema.StringAttribute:
+		return schema.StringAttribute{
+			MarkdownDescription: a.MarkdownDescription,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	case rschema.BoolAttribute:
+		return schema.BoolAttribute{
+			MarkdownDescription: a.MarkdownDescription,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	case rschema.Int64Attribute:
+		return schema.Int64Attribute{
+			MarkdownDescription: a.MarkdownDescription,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	case rschema.ListAttribute:
+		return schema.ListAttribute{
+			MarkdownDescription: a.MarkdownDescription,
+			ElementType:         a.ElementType,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	case rschema.MapAttribute:
+		return schema.MapAttribute{
+			MarkdownDescription: a.MarkdownDescription,
+			ElementType:         a.ElementType,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	case rschema.ObjectAttribute:
+		return schema.ObjectAttribute{
+			MarkdownDescription: a.MarkdownDescription,
+			AttributeTypes:      a.AttributeTypes,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	case rschema.DynamicAttribute:
+		return schema.DynamicAttribute{
+			MarkdownDescription: a.MarkdownDescription,
+			Required:            a.Required,
+			Optional:            a.Optional,
+			Computed:            a.Computed,
+			Sensitive:           a.Sensitive,
+			Validators:          a.Validators,
+		}
+	default:
+		panic(fmt.Sprintf("unhandled cached image attribute type %T", attr))
+	}
+}
+
+func (r *CachedImageEphemeralResource) Configure(ctx context.Context, req ephemeral.ConfigureRequest, resp *ephemeral.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	data, ok := req.ProviderData.(*providerData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Ephemeral Resource Configure Type",
+			fmt.Sprintf("Expected *providerData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.data = data
+}
+
+// overridePolicy returns the override policy configured on the provider.
+func (r *CachedImageEphemeralResource) overridePolicy() overridePolicy {
+	if r.data == nil {
+		return overridePolicy{}
+	}
+	return r.data.overridePolicy
+}
+
+// audit returns the audit webhook configured on the provider, if any.
+func (r *CachedImageEphemeralResource) audit() *auditWebhook {
+	if r.data == nil {
+		return nil
+	}
+	return r.data.audit
+}
+
+// defaultIgnorePaths returns the ignore paths configured on the provider.
+func (r *CachedImageEphemeralResource) defaultIgnorePaths() []string {
+	if r.data == nil {
+		return nil
+	}
+	return r.data.defaultIgnorePaths
+}
+
+func (r *CachedImageEphemeralResource) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	var data CachedImageResourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Get the options from the data model.
+	opts, diags := optionsFromDataModel(data, r.overridePolicy())
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	addDefaultIgnorePaths(&opts, r.defaultIgnorePaths())
+	data.GitURLCanonical = types.StringValue(opts.GitURL)
+
+	probeOpts, diags := data.cacheProbeOptions(r.data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	meta, diags := probeAndPopulate(ctx, &data, opts, probeOpts, "open", "Using the builder image instead.")
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	event := newAuditEvent("ephemeral_resource", &data, meta.InputsHash, meta.Commit, meta.ProbedAt)
+	if err := r.audit().send(ctx, event); err != nil {
+		resp.Diagnostics.AddWarning("Unable to send audit event.", fmt.Sprintf("The cache probe could not be reported to audit_webhook_url: %s", err))
+	}
+
+	// Save data into the ephemeral result
+	resp.Diagnostics.Append(resp.Result.Set(ctx, &data)...)
+}
@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedImageEphemeralResourceSchema(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var rresp resource.SchemaResponse
+	NewCachedImageResource().Schema(ctx, resource.SchemaRequest{}, &rresp)
+	require.False(t, rresp.Diagnostics.HasError())
+
+	var eresp ephemeral.SchemaResponse
+	NewCachedImageEphemeralResource().Schema(ctx, ephemeral.SchemaRequest{}, &eresp)
+	require.False(t, eresp.Diagnostics.HasError())
+	require.False(t, eresp.Schema.ValidateImplementation(ctx).HasError())
+
+	// The ephemeral resource must accept and return the same attributes as
+	// the resource, as they share a model.
+	require.Len(t, eresp.Schema.Attributes, len(rresp.Schema.Attributes))
+	for name, rattr := range rresp.Schema.Attributes {
+		eattr, ok := eresp.Schema.Attributes[name]
+		if !assert.True(t, ok, "missing attribute %q", name) {
+			continue
+		}
+		assert.Equal(t, rattr.GetType(), eattr.GetType(), name)
+		assert.Equal(t, rattr.IsRequired(), eattr.IsRequired(), name)
+		assert.Equal(t, rattr.IsOptional(), eattr.IsOptional(), name)
+		assert.Equal(t, rattr.IsComputed(), eattr.IsComputed(), name)
+		assert.Equal(t, rattr.IsSensitive(), eattr.IsSensitive(), name)
+	}
+}
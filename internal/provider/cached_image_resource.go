@@ -2,29 +2,42 @@ package provider
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	kconfig "github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/coder/envbuilder"
 	eboptions "github.com/coder/envbuilder/options"
 	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
 	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/docker/go-units"
 	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/uuid"
 
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/boolplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/dynamicplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/listplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/objectplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
@@ -39,45 +52,123 @@ func NewCachedImageResource() resource.Resource {
 
 // CachedImageResource defines the resource implementation.
 type CachedImageResource struct {
-	client *http.Client
+	data *providerData
 }
 
 // CachedImageResourceModel describes an envbuilder cached image resource.
 type CachedImageResourceModel struct {
-	// Required "inputs".
+	// Required "inputs". Either git_url or source_dir must be set.
 	BuilderImage types.String `tfsdk:"builder_image"`
 	CacheRepo    types.String `tfsdk:"cache_repo"`
 	GitURL       types.String `tfsdk:"git_url"`
 	// Optional "inputs".
-	BaseImageCacheDir      types.String `tfsdk:"base_image_cache_dir"`
-	BuildContextPath       types.String `tfsdk:"build_context_path"`
-	CacheTTLDays           types.Int64  `tfsdk:"cache_ttl_days"`
-	DevcontainerDir        types.String `tfsdk:"devcontainer_dir"`
-	DevcontainerJSONPath   types.String `tfsdk:"devcontainer_json_path"`
-	DockerfilePath         types.String `tfsdk:"dockerfile_path"`
-	DockerConfigBase64     types.String `tfsdk:"docker_config_base64"`
-	ExitOnBuildFailure     types.Bool   `tfsdk:"exit_on_build_failure"`
-	ExtraEnv               types.Map    `tfsdk:"extra_env"`
-	FallbackImage          types.String `tfsdk:"fallback_image"`
-	GitCloneDepth          types.Int64  `tfsdk:"git_clone_depth"`
-	GitCloneSingleBranch   types.Bool   `tfsdk:"git_clone_single_branch"`
-	GitHTTPProxyURL        types.String `tfsdk:"git_http_proxy_url"`
-	GitPassword            types.String `tfsdk:"git_password"`
-	GitSSHPrivateKeyPath   types.String `tfsdk:"git_ssh_private_key_path"`
-	GitSSHPrivateKeyBase64 types.String `tfsdk:"git_ssh_private_key_base64"`
-	GitUsername            types.String `tfsdk:"git_username"`
-	IgnorePaths            types.List   `tfsdk:"ignore_paths"`
-	Insecure               types.Bool   `tfsdk:"insecure"`
-	RemoteRepoBuildMode    types.Bool   `tfsdk:"remote_repo_build_mode"`
-	SSLCertBase64          types.String `tfsdk:"ssl_cert_base64"`
-	Verbose                types.Bool   `tfsdk:"verbose"`
-	WorkspaceFolder        types.String `tfsdk:"workspace_folder"`
+	AllowedRegistries         types.List    `tfsdk:"allowed_registries"`
+	BaseImageAllowedLabels    types.Map     `tfsdk:"base_image_allowed_labels"`
+	BaseImageCacheDir         types.String  `tfsdk:"base_image_cache_dir"`
+	BaseImageCompliancePolicy types.String  `tfsdk:"base_image_compliance_policy"`
+	BaseImageDeniedLabels     types.Map     `tfsdk:"base_image_denied_labels"`
+	BuildContextPath          types.String  `tfsdk:"build_context_path"`
+	CacheNamespace            types.String  `tfsdk:"cache_namespace"`
+	CacheRepos                types.List    `tfsdk:"cache_repos"`
+	CacheTagFormat            types.String  `tfsdk:"cache_tag_format"`
+	CandidateTags             types.List    `tfsdk:"candidate_tags"`
+	CacheTTLDays              types.Int64   `tfsdk:"cache_ttl_days"`
+	CoderAgentSubsystem       types.List    `tfsdk:"coder_agent_subsystem"`
+	DebugBundlePath           types.String  `tfsdk:"debug_bundle_path"`
+	DevcontainerDir           types.String  `tfsdk:"devcontainer_dir"`
+	DevcontainerEnv           types.Map     `tfsdk:"devcontainer_env"`
+	DevcontainerJSONPath      types.String  `tfsdk:"devcontainer_json_path"`
+	DevcontainerJSONContent   types.String  `tfsdk:"devcontainer_json_content"`
+	DockerfilePath            types.String  `tfsdk:"dockerfile_path"`
+	DockerConfigBase64        types.String  `tfsdk:"docker_config_base64"`
+	EnforceCacheTTL           types.Bool    `tfsdk:"enforce_cache_ttl"`
+	ExitOnBuildFailure        types.Bool    `tfsdk:"exit_on_build_failure"`
+	ExportEnvFile             types.String  `tfsdk:"export_env_file"`
+	ExtraEnv                  types.Map     `tfsdk:"extra_env"`
+	FallbackImage             types.String  `tfsdk:"fallback_image"`
+	GitBitbucketAuthType      types.String  `tfsdk:"git_bitbucket_auth_type"`
+	GitCloneDepth             types.Int64   `tfsdk:"git_clone_depth"`
+	GitCloneSingleBranch      types.Bool    `tfsdk:"git_clone_single_branch"`
+	GitHTTPProxyURL           types.String  `tfsdk:"git_http_proxy_url"`
+	GitMirrorURLs             types.List    `tfsdk:"git_mirror_urls"`
+	GitPassword               types.String  `tfsdk:"git_password"`
+	GitRef                    types.String  `tfsdk:"git_ref"`
+	GitSSHPrivateKeyPath      types.String  `tfsdk:"git_ssh_private_key_path"`
+	GitSSHPrivateKeyBase64    types.String  `tfsdk:"git_ssh_private_key_base64"`
+	GitTLSClientCert          types.String  `tfsdk:"git_tls_client_cert"`
+	GitTLSClientKey           types.String  `tfsdk:"git_tls_client_key"`
+	GitUsername               types.String  `tfsdk:"git_username"`
+	IgnorePaths               types.List    `tfsdk:"ignore_paths"`
+	InitArgs                  types.String  `tfsdk:"init_args"`
+	InitCommand               types.String  `tfsdk:"init_command"`
+	Insecure                  types.Bool    `tfsdk:"insecure"`
+	LegacyEnvNames            types.String  `tfsdk:"legacy_env_names"`
+	LocalRepoPath             types.String  `tfsdk:"local_repo_path"`
+	MaxImageSizeBytes         types.Int64   `tfsdk:"max_image_size_bytes"`
+	MaxImageSizePolicy        types.String  `tfsdk:"max_image_size_policy"`
+	Options                   types.Dynamic `tfsdk:"options"`
+	Platform                  types.String  `tfsdk:"platform"`
+	Platforms                 types.List    `tfsdk:"platforms"`
+	Policy                    types.Object  `tfsdk:"policy"`
+	PushImage                 types.Bool    `tfsdk:"push_image"`
+	RecreateOnBaseImageUpdate types.Bool    `tfsdk:"recreate_on_base_image_update"`
+	RequiredLabels            types.Map     `tfsdk:"required_labels"`
+	RequiredLabelsPolicy      types.String  `tfsdk:"required_labels_policy"`
+	RemoteRepoBuildMode       types.Bool    `tfsdk:"remote_repo_build_mode"`
+	RuntimeLayerCacheDir      types.String  `tfsdk:"runtime_layer_cache_dir"`
+	SkipRebuild               types.Bool    `tfsdk:"skip_rebuild"`
+	SourceDir                 types.String  `tfsdk:"source_dir"`
+	SSLCertBase64             types.String  `tfsdk:"ssl_cert_base64"`
+	StaleFallback             types.Bool    `tfsdk:"stale_fallback"`
+	SuppressOverrideWarnings  types.List    `tfsdk:"suppress_override_warnings"`
+	SuppressUnpinnedFeatures  types.Bool    `tfsdk:"suppress_unpinned_features_warning"`
+	Timeouts                  types.Object  `tfsdk:"timeouts"`
+	TLSSkipVerifyRegistries   types.List    `tfsdk:"tls_skip_verify_registries"`
+	TrackBaseImage            types.Bool    `tfsdk:"track_base_image"`
+	Triggers                  types.Map     `tfsdk:"triggers"`
+	Verbose                   types.Bool    `tfsdk:"verbose"`
+	WorkspaceFolder           types.String  `tfsdk:"workspace_folder"`
 	// Computed "outputs".
-	Env    types.List   `tfsdk:"env"`
-	EnvMap types.Map    `tfsdk:"env_map"`
-	Exists types.Bool   `tfsdk:"exists"`
-	ID     types.String `tfsdk:"id"`
-	Image  types.String `tfsdk:"image"`
+	AgeSeconds           types.Int64  `tfsdk:"age_seconds"`
+	Annotations          types.Map    `tfsdk:"annotations"`
+	BaseImage            types.String `tfsdk:"base_image"`
+	BaseImageDigest      types.String `tfsdk:"base_image_digest"`
+	BaseImageUpdated     types.Bool   `tfsdk:"base_image_updated"`
+	CacheRepoUsed        types.String `tfsdk:"cache_repo_used"`
+	CacheTag             types.String `tfsdk:"cache_tag"`
+	CandidateTag         types.String `tfsdk:"candidate_tag"`
+	Cmd                  types.List   `tfsdk:"cmd"`
+	CompiledDockerfile   types.String `tfsdk:"compiled_dockerfile"`
+	Compliance           types.Object `tfsdk:"compliance"`
+	CreatedAt            types.String `tfsdk:"created_at"`
+	Customizations       types.String `tfsdk:"customizations"`
+	DevcontainerResolved types.String `tfsdk:"devcontainer_resolved"`
+	Entrypoint           types.List   `tfsdk:"entrypoint"`
+	Env                  types.List   `tfsdk:"env"`
+	EnvMap               types.Map    `tfsdk:"env_map"`
+	Exists               types.Bool   `tfsdk:"exists"`
+	ExposedPorts         types.List   `tfsdk:"exposed_ports"`
+	GitCommit            types.String `tfsdk:"git_commit"`
+	GitURLCanonical      types.String `tfsdk:"git_url_canonical"`
+	GitURLUsed           types.String `tfsdk:"git_url_used"`
+	ID                   types.String `tfsdk:"id"`
+	Image                types.String `tfsdk:"image"`
+	ImageDigest          types.String `tfsdk:"image_digest"`
+	ImageRegistry        types.String `tfsdk:"image_registry"`
+	ImageRepository      types.String `tfsdk:"image_repository"`
+	ImageSizeBytes       types.Int64  `tfsdk:"image_size_bytes"`
+	ImageTag             types.String `tfsdk:"image_tag"`
+	Labels               types.Map    `tfsdk:"labels"`
+	LastProbedAt         types.String `tfsdk:"last_probed_at"`
+	LayerCount           types.Int64  `tfsdk:"layer_count"`
+	MissingLayers        types.List   `tfsdk:"missing_layers"`
+	PlatformImages       types.Map    `tfsdk:"platform_images"`
+	ProbeHistory         types.List   `tfsdk:"probe_history"`
+	Stale                types.Bool   `tfsdk:"stale"`
+	User                 types.String `tfsdk:"user"`
+	UsesFeatures         types.Bool   `tfsdk:"uses_features"`
+	VSCodeExtensions     types.List   `tfsdk:"vscode_extensions"`
+	Workdir              types.String `tfsdk:"workdir"`
 }
 
 func (r *CachedImageResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
@@ -87,7 +178,7 @@ func (r *CachedImageResource) Metadata(ctx context.Context, req resource.Metadat
 func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		// This description is used by the documentation generator and the language server.
-		MarkdownDescription: "The cached image resource can be used to retrieve a cached image produced by envbuilder. Creating this resource will clone the specified Git repository, read a Devcontainer specification or Dockerfile, and check for its presence in the provided cache repo. If any of the layers of the cached image are missing in the provided cache repo, the image will be considered as missing. A cached image in this state will be recreated until found.",
+		MarkdownDescription: "The cached image resource can be used to retrieve a cached image produced by envbuilder. Creating this resource will clone the specified Git repository, read a Devcontainer specification or Dockerfile, and check for its presence in the provided cache repo. If any of the layers of the cached image are missing in the provided cache repo, the image will be considered as missing. A cached image in this state will be recreated until found. A cached image that was found is also recreated, probing for it again, if the builder image has since been updated, or the options of the probe have changed through the provider configuration. Several cached images can be probed in parallel, though their dry-run builds run one at a time unless they run in a subprocess or a container; see `max_concurrent_probes`, `probe_mode` and `probe_executor` of the provider.",
 
 		Attributes: map[string]schema.Attribute{
 			// Required "inputs".
@@ -106,24 +197,119 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 				},
 			},
 			"git_url": schema.StringAttribute{
-				MarkdownDescription: "(Envbuilder option) The URL of a Git repository containing a Devcontainer or Docker image to clone.",
-				Required:            true,
+				MarkdownDescription: "(Envbuilder option) The URL of a Git repository containing a Devcontainer or Docker image to clone. This may be a URL such as `https://github.com/org/repo.git`, an scp-style URL such as `git@github.com:org/repo.git`, or an absolute path, optionally followed by `#` and a branch or ref. scp-style URLs are converted to `ssh://` URLs, as envbuilder does; see `git_url_canonical`. Exactly one of `git_url` and `source_dir` must be set.",
+				Optional:            true,
+				Validators: []validator.String{
+					gitURL(),
+				},
 				PlanModifiers: []planmodifier.String{
 					stringplanmodifier.RequiresReplace(),
 				},
 			},
 			// Optional "inputs".
+			"allowed_registries": schema.ListAttribute{
+				MarkdownDescription: "Registry hosts, such as `ghcr.io` or `registry.internal:5000`, that the devcontainer or Dockerfile may reference images from. If set, the image of the devcontainer, the images of all stages of the Dockerfile, and `fallback_image` must be on one of these registries; otherwise, no image is used and the offending reference is reported. `docker.io` matches images without a registry. This is checked by the cache probe, so that templates referencing other registries fail early rather than in the workspace build.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
+			},
+			"base_image_allowed_labels": schema.MapAttribute{
+				MarkdownDescription: "Labels that the base image of the devcontainer or Dockerfile must have, mapped to the values allowed for each, such as `{ \"org.opencontainers.image.licenses\" = [\"MIT\", \"Apache-2.0\"] }`. The licenses of an SPDX license expression in `org.opencontainers.image.licenses` must each be allowed. " +
+					"The base image is fetched from its registry by the cache probe, and violations are reported in `compliance` and handled according to `base_image_compliance_policy`.",
+				ElementType: types.ListType{ElemType: types.StringType},
+				Optional:    true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
 			"base_image_cache_dir": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The path to a directory where the base image can be found. This should be a read-only directory solely mounted for the purpose of caching the base image.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"base_image_compliance_policy": schema.StringAttribute{
+				MarkdownDescription: "How a base image violating `base_image_allowed_labels` or `base_image_denied_labels`, or whose labels cannot be checked, is handled. With `error`, an error is reported. With `warn`, a warning is reported and the image is used. Defaults to `error`.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(compliancePolicyError, compliancePolicyWarn),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"base_image_denied_labels": schema.MapAttribute{
+				MarkdownDescription: "Labels of the base image of the devcontainer or Dockerfile mapped to values they must not have, as with `base_image_allowed_labels`. For example, `{ \"org.opencontainers.image.licenses\" = [\"AGPL-3.0-only\"] }`.",
+				ElementType:         types.ListType{ElemType: types.StringType},
+				Optional:            true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
 			},
 			"build_context_path": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) Can be specified when a DockerfilePath is specified outside the base WorkspaceFolder. This path MUST be relative to the WorkspaceFolder path into which the repo is cloned.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"cache_namespace": schema.StringAttribute{
+				MarkdownDescription: "A namespace within `cache_repo` to use as the cache repo, e.g. `team-a` or `team-a/my-workspace`, so that a single registry project can host a separate cache for each team or workspace. It is appended to `cache_repo` as one or more path components, e.g. `registry.example.com/cache/team-a`, both when probing and in the computed environment. Each component must be lowercase letters and digits, optionally separated by periods, underscores or dashes, as required by registries.",
+				Optional:            true,
+				Validators: []validator.String{
+					cacheNamespace(),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"cache_repos": schema.ListAttribute{
+				MarkdownDescription: "Other cache repos to probe, in order, if the cached image is not found in `cache_repo`, e.g. a central registry after a regional mirror in `cache_repo`. The first repository the cached image is found in is used for `image`, and output as `cache_repo_used`. Each probe is a separate dry-run build, though `git_url` is only cloned and the envbuilder binary only extracted once, and a repository that cannot be reached is skipped. `cache_namespace` is appended to each of them. A stale image or a candidate of `candidate_tags` is only used if the cached image is found in none of them. The computed environment points envbuilder at the repository the cached image was found in.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
+			},
+			"cache_tag_format": schema.StringAttribute{
+				MarkdownDescription: "A tag to apply to the cached image in `cache_repo` once it is found, so that templates sharing a cache repo each have their own tag for their image, rather than all using the `latest` tag that envbuilder pushes to. `{ref}` is replaced with the git ref of `git_url`, such as `main`, or `head` if it has none, and `{repo}` with the name of the repository. Other values, such as the workspace or template name, can be included with Terraform interpolation, e.g. `\"${data.coder_workspace.me.name}-{ref}\"`. Characters that may not appear in a tag are replaced with dashes. This requires permission to push to `cache_repo`. The layers of the cached image are still looked up by their content, so the tag does not affect which image is found. See `cache_tag` for the result.",
+				Optional:            true,
+				Validators: []validator.String{
+					cacheTagFormat(),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"candidate_tags": schema.ListAttribute{
+				MarkdownDescription: "Tags of images in `cache_repo` to fall back to, in order, if the cached image is not found, e.g. `[\"{ref}\", \"main\"]` to fall back to the image of the main branch. The first tag that exists in `cache_repo` is used as `image`, and output as `candidate_tag`. The images are typically tagged with `cache_tag_format`, and the same placeholders are supported. The image of a candidate may not match the devcontainer of `git_url`, so it should only be used where a slightly different image is preferable to building one.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
 			},
 			"cache_ttl_days": schema.Int64Attribute{
 				MarkdownDescription: "(Envbuilder option) The number of days to use cached layers before expiring them. Defaults to 7 days.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"coder_agent_subsystem": schema.ListAttribute{
+				MarkdownDescription: "(Envbuilder option) Coder agent subsystems to report when forwarding logs. The envbuilder subsystem is always included. Sets `CODER_AGENT_SUBSYSTEM` in the computed environment only and does not affect the cache probe.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"debug_bundle_path": schema.StringAttribute{
+				MarkdownDescription: "The absolute path of a file to write a debug bundle to if the cache probe fails, including when the cached image is not found. The bundle is a gzipped tarball with the logs of the probe, the resolved envbuilder options, a listing of the kaniko directory and the manifests of the builder and base images, with secrets scrubbed, for attaching to support requests. It is replaced on each failed probe. This only affects the cache probe and is not set in the computed environment.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
 			},
 			"devcontainer_dir": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The path to the folder containing the devcontainer.json file that will be used to build the workspace and can either be an absolute path or a path relative to the workspace folder. If not provided, defaults to `.devcontainer`.",
@@ -132,6 +318,15 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 					stringplanmodifier.RequiresReplace(),
 				},
 			},
+			"devcontainer_env": schema.MapAttribute{
+				MarkdownDescription: "Environment variables that `${localEnv:VAR}` and `${env:VAR}` in devcontainer.json resolve to while probing. Envbuilder only substitutes variables in `build.args`. Variables not set here resolve to the environment of the provider. The real build resolves them from the environment of the builder container, so set the same values there, for example in `extra_env`. `${containerWorkspaceFolder}` resolves to `workspace_folder`, or to a temporary directory if it is not set. Probes that set this attribute do not run concurrently with other probes, as the variables are set in the environment of the provider process. This only affects the cache probe and is not set in the computed environment.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				Sensitive:           true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
 			"devcontainer_json_path": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The path to a devcontainer.json file that is either an absolute path or a path relative to DevcontainerDir. This can be used in cases where one wants to substitute an edited devcontainer.json file for the one that exists in the repo.",
 				Optional:            true,
@@ -139,6 +334,13 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 					stringplanmodifier.RequiresReplace(),
 				},
 			},
+			"devcontainer_json_content": schema.StringAttribute{
+				MarkdownDescription: "The content of the devcontainer.json to probe, e.g. rendered with `templatefile()`, in place of the one in the repository. It is written to a file in the probe workspace, and used as if `devcontainer_json_path` were set to its path, so relative paths in it, such as that of the Dockerfile, are still relative to `devcontainer_dir`. This allows devcontainer definitions to be managed centrally rather than committed to every repository. The workspace must be built with the same devcontainer.json for the cached image to be used. Conflicts with `devcontainer_json_path` and `dockerfile_path`.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
 			"dockerfile_path": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The relative path to the Dockerfile that will be used to build the workspace. This is an alternative to using a devcontainer that some might find simpler.",
 				Optional:            true,
@@ -147,12 +349,26 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 				},
 			},
 			"docker_config_base64": schema.StringAttribute{
-				MarkdownDescription: "(Envbuilder option) The base64 encoded Docker config file that will be used to pull images from private container registries.",
+				MarkdownDescription: "(Envbuilder option) The base64 encoded Docker config file that will be used to pull images from private container registries. If not set, the Docker config secret at `docker_config_secret_path` of the provider is used when probing if set, or the local Docker config of the host running Terraform, unless `use_local_docker_config` of the provider is `false`. When probing, registry credentials in the Podman auth file of the host running Terraform (`registry_auth_file` of the provider if set, or else `$REGISTRY_AUTH_FILE`, `$XDG_RUNTIME_DIR/containers/auth.json` or `~/.config/containers/auth.json`) are also used for registries that this config, or the local Docker config if not set, has no credentials for.",
+				Optional:            true,
+			},
+			"enforce_cache_ttl": schema.BoolAttribute{
+				MarkdownDescription: "If set, refreshing removes the resource from state when the cached image is older than `cache_ttl_days`, so that the cache probe runs again in the next apply. As envbuilder does not use expired layers, the probe will then not find the cached image and the image will be rebuilt.",
 				Optional:            true,
 			},
 			"exit_on_build_failure": schema.BoolAttribute{
 				MarkdownDescription: "(Envbuilder option) Terminates upon a build failure. This is handy when preferring the FALLBACK_IMAGE in cases where no devcontainer.json or image is provided. However, it ensures that the container stops if the build process encounters an error.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"export_env_file": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) Optional absolute path to a .env file where envbuilder will dump environment variables from devcontainer.json and the built container image. This is only set in the computed environment and does not affect the cache probe.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
 			},
 			"extra_env": schema.MapAttribute{
 				MarkdownDescription: "Extra environment variables to set for the container. This may include envbuilder options.",
@@ -165,47 +381,192 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 			"fallback_image": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) Specifies an alternative image to use when neither an image is declared in the devcontainer.json file nor a Dockerfile is present. If there's a build failure (from a faulty Dockerfile) or a misconfiguration, this image will be the substitute. Set ExitOnBuildFailure to true to halt the container if the build faces an issue.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"git_bitbucket_auth_type": schema.StringAttribute{
+				MarkdownDescription: "The kind of Bitbucket Cloud credential set in `git_password`, which has non-standard username requirements. One of `app_password`, for an app password used with the Bitbucket username in `git_username` (not the account email), or `access_token`, for a repository, project or workspace access token, where `git_username` defaults to `x-token-auth`. The credentials are validated when set. Changing this attribute forces recreation.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(bitbucketAuthAppPassword, bitbucketAuthAccessToken),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
 			},
 			"git_clone_depth": schema.Int64Attribute{
 				MarkdownDescription: "(Envbuilder option) The depth to use when cloning the Git repository.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
 			},
 			"git_clone_single_branch": schema.BoolAttribute{
 				MarkdownDescription: "(Envbuilder option) Clone only a single branch of the Git repository.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
 			},
 			"git_http_proxy_url": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The URL for the HTTP proxy. This is optional.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"git_mirror_urls": schema.ListAttribute{
+				MarkdownDescription: "URLs of mirrors of `git_url`, which are tried in order when probing if `git_url` cannot be reached. The same credentials are used for all of them. Mirrors are only used by the cache probe: the computed environment always uses `git_url`. See `git_url_used` for the URL that was probed.",
+				ElementType:         types.StringType,
+				Optional:            true,
 			},
 			"git_password": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The password to use for Git authentication. This is optional.",
 				Sensitive:           true,
 				Optional:            true,
 			},
+			"git_ref": schema.StringAttribute{
+				MarkdownDescription: "The branch, tag or full ref name of `git_url` to probe and build, such as `main`, `v1.2.0` or `refs/heads/feature/x`, instead of the default branch. It is appended to `git_url` after `#`, so it is passed to envbuilder in `ENVBUILDER_GIT_URL`, and must not be set if `git_url` already has a ref. Envbuilder cannot check out a specific commit, but the commit the ref resolves to is exposed as `git_commit`, and the cached image is probed again on refresh once the ref has moved.",
+				Optional:            true,
+				Validators: []validator.String{
+					nonEmptyString(),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
 			"git_ssh_private_key_path": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) Path to an SSH private key to be used for Git authentication.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
 			},
 			"git_ssh_private_key_base64": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) Base64 encoded SSH private key to be used for Git authentication.",
 				Optional:            true,
 				Sensitive:           true,
 			},
+			"git_tls_client_cert": schema.StringAttribute{
+				MarkdownDescription: "PEM encoded client certificate presented to HTTPS git remotes that require mutual TLS, together with `git_tls_client_key`. This is only used by the cache probe, as envbuilder does not support client certificates.",
+				Optional:            true,
+			},
+			"git_tls_client_key": schema.StringAttribute{
+				MarkdownDescription: "PEM encoded private key of `git_tls_client_cert`.",
+				Optional:            true,
+				Sensitive:           true,
+			},
 			"git_username": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The username to use for Git authentication. This is optional.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
 			},
 
 			"ignore_paths": schema.ListAttribute{
-				MarkdownDescription: "(Envbuilder option) The comma separated list of paths to ignore when building the workspace.",
+				MarkdownDescription: "(Envbuilder option) The comma separated list of paths to ignore when building the workspace. Paths must be absolute, and what is below a path is ignored too. Each segment of a path may be a pattern as matched by Go's `filepath.Match`, such as `/var/cache/*` or `/workspaces/*/node_modules`, both when probing and in the real build. `**` is not special and matches within a single segment like `*`. The `default_ignore_paths` of the provider are added to these.",
 				ElementType:         types.StringType,
 				Optional:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
+			},
+
+			"init_args": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The arguments to pass to the init command. They are split according to /bin/sh rules. This is only set in the computed environment and does not affect the cache probe.",
+				Optional:            true,
+				Validators: []validator.String{
+					shellWords(),
+				},
+			},
+			"init_command": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The command to run to initialize the workspace. Defaults to `/bin/sh`. This is only set in the computed environment and does not affect the cache probe.",
+				Optional:            true,
+				Validators: []validator.String{
+					nonEmptyString(),
+				},
 			},
 
 			"insecure": schema.BoolAttribute{
 				MarkdownDescription: "(Envbuilder option) Bypass TLS verification when cloning and pulling from container registries.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"legacy_env_names": schema.StringAttribute{
+				MarkdownDescription: "Whether the computed environment sets envbuilder options using their `ENVBUILDER_` prefixed names (`none`), their legacy names without the prefix (`only`), or both (`both`). Legacy names are required by envbuilder releases older than v1.0.0. Defaults to `none`.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(legacyEnvNamesNone, legacyEnvNamesBoth, legacyEnvNamesOnly),
+				},
+			},
+			"local_repo_path": schema.StringAttribute{
+				MarkdownDescription: "The absolute path to an existing local clone of `git_url`. If set, the cache probe clones this repository from the local filesystem instead of cloning `git_url` over the network. The ref in `git_url` is used if set, otherwise the currently checked out commit. As in remote repo build mode, only committed files are considered: uncommitted changes in the working tree are ignored. Requires the `git` executable. The devcontainer.json in the working tree, if any, is validated when the configuration is validated. This only affects the cache probe and is not set in the computed environment.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+			},
+			"max_image_size_bytes": schema.Int64Attribute{
+				MarkdownDescription: "The maximum size in bytes of the cached image, as measured by `image_size_bytes`. If the cached image is larger, it is handled according to `max_image_size_policy`.",
+				Optional:            true,
+				Validators: []validator.Int64{
+					positive(),
+				},
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"max_image_size_policy": schema.StringAttribute{
+				MarkdownDescription: "How a cached image larger than `max_image_size_bytes` is handled. With `error`, an error is reported. With `warn`, a warning is reported and the image is used. Defaults to `error`.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(maxImageSizePolicyError, maxImageSizePolicyWarn),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"options": schema.DynamicAttribute{
+				MarkdownDescription: "Envbuilder options as an object mapping option names to values of the option's type, e.g. `{ git_clone_depth = 1, verbose = true, ignore_paths = [\"/var/run\"] }`. " +
+					"Option names are the envbuilder flag names with underscores instead of dashes. Values set here override the corresponding attributes of this resource, and are themselves overridden by `ENVBUILDER_` keys in `extra_env`. " +
+					"Prefer this over `extra_env` for envbuilder options, as names and values are validated when the configuration is validated.",
+				Optional: true,
+				Validators: []validator.Dynamic{
+					typedOptionsValidator{},
+				},
+				PlanModifiers: []planmodifier.Dynamic{
+					dynamicplanmodifier.RequiresReplace(),
+				},
+			},
+			"platform": schema.StringAttribute{
+				MarkdownDescription: "The platform of the cached image, in the form `os/arch[/variant]`, for example `linux/arm64`, if it differs from `linux/amd64`. The envbuilder binary is extracted from the builder image for this platform, and images in `cache_repo` that are multi-platform are resolved for it. Envbuilder itself resolves the base image for the platform of the host the provider runs on, so the layers built from a multi-platform base image are only found if the host has this platform too. Changing this attribute forces recreation.",
+				Optional:            true,
+				Validators: []validator.String{
+					platform(),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"platforms": schema.ListAttribute{
+				MarkdownDescription: "Platforms to probe for, in the form `os/arch[/variant]`, for example `[\"linux/amd64\", \"linux/arm64\"]`, to use the same configuration for workspaces of several architectures. The cache probe runs for each platform in turn, as for `platform`, and `platform_images` is set to the cached image for each. `image` and the other outputs describe the first platform, and `exists` is only set if the cached image is found for all platforms. Conflicts with `platform`. Changing this attribute forces recreation.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
+			},
+			"push_image": schema.BoolAttribute{
+				MarkdownDescription: "(Envbuilder option) Push the built image to the cache repo when the build completes successfully. This is only set in the computed environment and does not affect the cache probe.",
+				Optional:            true,
+			},
+			"recreate_on_base_image_update": schema.BoolAttribute{
+				MarkdownDescription: "If `track_base_image` is set and the base image has been updated, remove the resource from state on refresh so that it is recreated and the cache probe runs again in the next apply.",
+				Optional:            true,
 			},
 			"remote_repo_build_mode": schema.BoolAttribute{
 				MarkdownDescription: "(Envbuilder option) RemoteRepoBuildMode uses the remote repository as the source of truth when building the image. Enabling this option ignores user changes to local files and they will not be reflected in the image. This can be used to improve cache utilization when multiple users are working on the same repository. (NOTE: The Terraform provider will **always** use remote repo build mode for probing the cache repo.)",
@@ -214,9 +575,87 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 					boolplanmodifier.RequiresReplace(),
 				},
 			},
+			"required_labels": schema.MapAttribute{
+				MarkdownDescription: "Labels that the cached image must have, with their expected values. If the cached image is missing any of them, it is handled according to `required_labels_policy`. Changing this attribute forces recreation.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
+			"required_labels_policy": schema.StringAttribute{
+				MarkdownDescription: "How a cached image missing `required_labels` is handled. With `miss`, it is treated as if it was not found. With `error`, an error is reported. Defaults to `miss`. Changing this attribute forces recreation.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(requiredLabelsPolicyMiss, requiredLabelsPolicyError),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"runtime_layer_cache_dir": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The absolute path to a directory in the workspace container where built layers will be stored. This spawns an in-memory registry to serve the layers from. Sets `ENVBUILDER_LAYER_CACHE_DIR` in the computed environment only and does not affect the cache probe.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+			},
+			"skip_rebuild": schema.BoolAttribute{
+				MarkdownDescription: "(Envbuilder option) Skip building if the MagicFile exists. This is used to skip building when a container is restarting, e.g. docker stop -> docker start. This is only set in the computed environment and does not affect the cache probe.",
+				Optional:            true,
+			},
+			"source_dir": schema.StringAttribute{
+				MarkdownDescription: "The absolute path to a local directory containing a Devcontainer or Dockerfile, to probe instead of cloning `git_url`, such as a checkout the Terraform runner already has or a directory of a mono-repo. It need not be a git repository, and uncommitted changes are included. The directory is copied into the workspace folder of the probe, so it is not modified. Exactly one of `git_url` and `source_dir` must be set, and `git_ref`, `git_mirror_urls` and `local_repo_path` cannot be set with it. The probe result cache is not used, and the kubernetes probe executor cannot read the directory. This only affects the cache probe and is not set in the computed environment: the workspace must be built from the same files in its workspace folder.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
 			"ssl_cert_base64": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) The content of an SSL cert file. This is useful for self-signed certificates.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"stale_fallback": schema.BoolAttribute{
+				MarkdownDescription: "If the cached image is not found, fall back to the image most recently found by a probe with the same inputs, at an earlier commit of `git_url` or with an earlier builder image, and set `stale`. A slightly out of date image is often preferable to building one. Images found by earlier probes are only known if `probe_result_cache_dir` is set on the provider, and are used as long as they are younger than `probe_result_cache_ttl` and still exist in `cache_repo`. This is tried before `candidate_tags`.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"suppress_override_warnings": schema.ListAttribute{
+				MarkdownDescription: "Envbuilder options, by environment variable name, that are intentionally overridden by `extra_env` or `options`. Overriding these options does not produce a warning. For example, `[\"ENVBUILDER_VERBOSE\"]`.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"suppress_unpinned_features_warning": schema.BoolAttribute{
+				MarkdownDescription: "Do not warn when the devcontainer declares features that are not pinned to a version. See `uses_features`.",
+				Optional:            true,
+			},
+			"tls_skip_verify_registries": schema.ListAttribute{
+				MarkdownDescription: "Hostnames of container registries, optionally with a port, whose TLS certificates are not verified while probing, for example an internal registry with a self-signed certificate. Certificates of all other registries are still verified, unlike with `insecure`. IP addresses are not supported, use `host_aliases` on the provider to connect to them by hostname. This is only used by the provider, as envbuilder has no equivalent option.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"track_base_image": schema.BoolAttribute{
+				MarkdownDescription: "Resolve the image that the devcontainer or Dockerfile is based on to a digest when the cached image is found. On refresh, `base_image_updated` is set if the tag of the base image has since moved to a different digest. Changing this attribute forces recreation.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"triggers": schema.MapAttribute{
+				MarkdownDescription: "Arbitrary values that force recreation when changed, so that the cache probe runs again, like the `triggers` of `null_resource`. Use it for changes that the provider does not track, such as a new template version or a rebuilt base image. The values are not passed to envbuilder. The ephemeral resource probes on every Terraform run regardless.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
 			},
 			"verbose": schema.BoolAttribute{
 				MarkdownDescription: "(Envbuilder option) Enable verbose output.",
@@ -225,70 +664,376 @@ func (r *CachedImageResource) Schema(ctx context.Context, req resource.SchemaReq
 			"workspace_folder": schema.StringAttribute{
 				MarkdownDescription: "(Envbuilder option) path to the workspace folder that will be built. This is optional.",
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
 			},
 
 			// Computed "outputs".
-			"env": schema.ListAttribute{
-				MarkdownDescription: "Computed envbuilder configuration to be set for the container in the form of a list of strings of `key=value`. May contain secrets.",
-				ElementType:         types.StringType,
+			"age_seconds": schema.Int64Attribute{
+				MarkdownDescription: "The age of the cached image in seconds when it was last found or refreshed, based on its creation timestamp. Zero if the cached image was not found or has no creation timestamp.",
 				Computed:            true,
-				Sensitive:           true,
-				PlanModifiers: []planmodifier.List{
-					listplanmodifier.RequiresReplace(),
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
 				},
 			},
-			"env_map": schema.MapAttribute{
-				MarkdownDescription: "Computed envbuilder configuration to be set for the container in the form of a key-value map. May contain secrets.",
+			"annotations": schema.MapAttribute{
+				MarkdownDescription: "The annotations of the manifest of the cached image, such as `org.opencontainers.image.created`. Empty if the cached image was not found, or has none.",
 				ElementType:         types.StringType,
 				Computed:            true,
-				Sensitive:           true,
 				PlanModifiers: []planmodifier.Map{
-					mapplanmodifier.RequiresReplace(),
+					mapplanmodifier.UseStateForUnknown(),
 				},
 			},
-			"exists": schema.BoolAttribute{
-				MarkdownDescription: "Whether the cached image was exists or not for the given config.",
+			"base_image": schema.StringAttribute{
+				MarkdownDescription: "The image that the devcontainer or Dockerfile is based on, as written in the configuration. Empty unless `track_base_image` is set and the cached image was found.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"base_image_digest": schema.StringAttribute{
+				MarkdownDescription: "The digest that `base_image` resolved to when the cached image was found. Empty unless `track_base_image` is set and the cached image was found.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"base_image_updated": schema.BoolAttribute{
+				MarkdownDescription: "Whether `base_image` resolved to a different digest than `base_image_digest` on the last refresh.",
 				Computed:            true,
 				PlanModifiers: []planmodifier.Bool{
-					boolplanmodifier.RequiresReplace(),
+					boolplanmodifier.UseStateForUnknown(),
 				},
 			},
-			"id": schema.StringAttribute{
-				MarkdownDescription: "Cached image identifier. This will generally be the image's SHA256 digest.",
+			"cache_repo_used": schema.StringAttribute{
+				MarkdownDescription: "The cache repo the cached image was found in: `cache_repo`, or one of `cache_repos`. Empty if it was not found.",
 				Computed:            true,
 				PlanModifiers: []planmodifier.String{
-					stringplanmodifier.RequiresReplace(),
+					stringplanmodifier.UseStateForUnknown(),
 				},
 			},
-			"image": schema.StringAttribute{
-				MarkdownDescription: "Outputs the cached image repo@digest if it exists, and builder image otherwise.",
+			"cache_tag": schema.StringAttribute{
+				MarkdownDescription: "The tag that `cache_tag_format` expanded to, if the cached image was found and tagged with it in `cache_repo`. Empty otherwise.",
 				Computed:            true,
 				PlanModifiers: []planmodifier.String{
-					stringplanmodifier.RequiresReplace(),
+					stringplanmodifier.UseStateForUnknown(),
 				},
 			},
-		},
-	}
-}
-
-func (r *CachedImageResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
-	// Prevent panic if the provider has not been configured.
-	if req.ProviderData == nil {
-		return
-	}
-
-	client, ok := req.ProviderData.(*http.Client)
-
+			"candidate_tag": schema.StringAttribute{
+				MarkdownDescription: "The tag in `candidate_tags` whose image is used as `image`, if the cached image was not found but a candidate was. Empty otherwise. As after a cache miss, the cached image is probed for again on the next refresh, so that it replaces the candidate once it is built.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"cmd": schema.ListAttribute{
+				MarkdownDescription: "The `Cmd` of the config of the cached image. Empty if the cached image was not found. Images built by envbuilder end with the directives it appends, so this is that of envbuilder rather than of the devcontainer; see `devcontainer_resolved` for the user the devcontainer runs as.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"compiled_dockerfile": schema.StringAttribute{
+				MarkdownDescription: "The Dockerfile that envbuilder compiled from the devcontainer.json and probed, with the directives of devcontainer features added, or the Dockerfile at `dockerfile_path`. Comparing it between probes shows why the cache keys of its instructions changed. Envbuilder appends directives of its own when building, which are not included. It is empty if it could not be compiled. Marked sensitive, as the options of features are written to it; use `nonsensitive()` to output it.",
+				Computed:            true,
+				Sensitive:           true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"compliance": schema.ObjectAttribute{
+				MarkdownDescription: "The result of checking the labels of the base image against `base_image_allowed_labels` and `base_image_denied_labels`: whether they were `checked`, whether the base image is `compliant`, the `base_image`, its `labels`, and the `violations` found. Not checked if neither is set.",
+				AttributeTypes:      complianceAttrTypes,
+				Computed:            true,
+				PlanModifiers: []planmodifier.Object{
+					objectplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"created_at": schema.StringAttribute{
+				MarkdownDescription: "The creation timestamp of the cached image in RFC3339 format. Empty if the cached image was not found or has no creation timestamp.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"customizations": schema.StringAttribute{
+				MarkdownDescription: "The `customizations` property of the probed devcontainer as JSON, such as the VS Code extensions and settings, or the Codespaces configuration, or `{}` if it has none. Use `jsondecode` to access it.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"devcontainer_resolved": schema.StringAttribute{
+				MarkdownDescription: "The probed devcontainer.json as JSON, with variables such as `${localEnv:VAR}` and `${containerWorkspaceFolder}` substituted in its values, and `containerUser` and `remoteUser` set to the user the Dockerfile or image ends with if they are not set, as envbuilder does. Variables resolve as they do in `build.args` while probing, except that `${containerWorkspaceFolder}` resolves to `workspace_folder`, or to the folder envbuilder clones `git_url` into by default. Envbuilder does not support `extends`, and adds the properties of features to the image rather than to the devcontainer.json, so neither is merged. `{}` if a Dockerfile is used, or if there is no valid devcontainer.json. Use `jsondecode` to access it, e.g. `jsondecode(nonsensitive(envbuilder_cached_image.example.devcontainer_resolved)).remoteUser`. Marked sensitive, as variables may resolve to the values of `devcontainer_env`.",
+				Computed:            true,
+				Sensitive:           true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"entrypoint": schema.ListAttribute{
+				MarkdownDescription: "The `Entrypoint` of the config of the cached image. Empty if the cached image was not found. Images built by envbuilder end with the directives it appends, so this is that of envbuilder rather than of the devcontainer; see `devcontainer_resolved` for the user the devcontainer runs as.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"env": schema.ListAttribute{
+				MarkdownDescription: "Computed envbuilder configuration to be set for the container in the form of a list of strings of `key=value`. May contain secrets.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				Sensitive:           true,
+			},
+			"env_map": schema.MapAttribute{
+				MarkdownDescription: "Computed envbuilder configuration to be set for the container in the form of a key-value map. May contain secrets.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				Sensitive:           true,
+			},
+			"exists": schema.BoolAttribute{
+				MarkdownDescription: "Whether the cached image was exists or not for the given config.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"exposed_ports": schema.ListAttribute{
+				MarkdownDescription: "The ports exposed by the config of the cached image, such as `8080/tcp`, in order. Empty if the cached image was not found.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"git_commit": schema.StringAttribute{
+				MarkdownDescription: "The commit SHA that `git_url`, at `git_ref` if set, resolved to when probing. Empty if it could not be resolved, or if `local_repo_path` is set.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"git_url_canonical": schema.StringAttribute{
+				MarkdownDescription: "`git_url` in the form used both when probing and in the computed environment. scp-style URLs such as `git@github.com:org/repo.git#main` are converted to `ssh://git@github.com/org/repo.git#main`, and other URLs are unchanged.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"git_url_used": schema.StringAttribute{
+				MarkdownDescription: "The URL of the repository that was probed: `git_url`, one of `git_mirror_urls`, or a `file://` URL if `local_repo_path` is set.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Cached image identifier. This will generally be the image's SHA256 digest.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image": schema.StringAttribute{
+				MarkdownDescription: "Outputs the cached image repo@digest if it exists, and builder image otherwise.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image_digest": schema.StringAttribute{
+				MarkdownDescription: "The digest of `image`, e.g. `sha256:...`, if it is referenced by digest. Empty otherwise, such as when `image` is the builder image referenced by tag. The cached image can be referenced as `${image_registry}/${image_repository}@${image_digest}` without parsing `image`.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image_registry": schema.StringAttribute{
+				MarkdownDescription: "The registry of `image`, e.g. `ghcr.io`. Images on Docker Hub have the registry `index.docker.io`.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image_repository": schema.StringAttribute{
+				MarkdownDescription: "The repository of `image` within `image_registry`, e.g. `coder/envbuilder`. If the cached image was found, this is the repository of `cache_repo_used`.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image_size_bytes": schema.Int64Attribute{
+				MarkdownDescription: "The size in bytes of the cached image as stored in the registry: the sum of the sizes of its config and compressed layers. Zero if the cached image was not found.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+			},
+			"image_tag": schema.StringAttribute{
+				MarkdownDescription: "The tag of `image`, if it is referenced by tag, such as when `image` is the builder image. Empty if it is referenced by digest, as the cached image is; see `cache_tag` for the tag applied to it in `cache_repo`.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"labels": schema.MapAttribute{
+				MarkdownDescription: "The labels of the config of the cached image, such as `org.opencontainers.image.revision` or the labels checked by `required_labels`. Empty if the cached image was not found, or has none.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"last_probed_at": schema.StringAttribute{
+				MarkdownDescription: "The time of the cache probe that determined `image`, in RFC3339 format.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"layer_count": schema.Int64Attribute{
+				MarkdownDescription: "The number of layers of the cached image. Together with `image_size_bytes` and `created_at`, this allows images that grew unexpectedly to be caught, e.g. with a `check` block, in the same run that uses them. Zero if the cached image was not found.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+			},
+			"missing_layers": schema.ListAttribute{
+				MarkdownDescription: "If the cached image was not found, the Dockerfile instructions whose layers are not in `cache_repo`, as reported by kaniko, for example `RUN apt-get update`. This is the first instruction of each build stage that is not cached: the instructions after it are not cached either, as their cache keys depend on its layer. Empty if the cached image was found, or if the probe failed before checking the cache.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"platform_images": schema.MapAttribute{
+				MarkdownDescription: "The cached image for each of `platforms`, by platform, as `image@digest`, or the builder image for platforms it was not found for. Empty if `platforms` is not set.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"probe_history": schema.ListAttribute{
+				MarkdownDescription: "The outcomes of the last 10 cache probes with the same inputs, oldest first, to see whether the cache has been flapping between hit and miss. Each has the `probed_at` time in RFC3339 format, and whether the probe was a `hit`. As the resource is recreated for every probe, probes are only recorded across Terraform runs if `probe_result_cache_dir` is set on the provider; otherwise, only the last probe is included.",
+				ElementType:         types.ObjectType{AttrTypes: probeHistoryAttrTypes},
+				Computed:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"stale": schema.BoolAttribute{
+				MarkdownDescription: "Whether `image` is a stale image found by an earlier probe, used as the cached image was not found and `stale_fallback` is set. As after a cache miss, the cached image is probed for again on the next refresh, so that it replaces the stale image once it is built.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"user": schema.StringAttribute{
+				MarkdownDescription: "The `User` of the config of the cached image. Empty if the cached image was not found. Images built by envbuilder end with the directives it appends, so this is that of envbuilder rather than of the devcontainer; see `devcontainer_resolved` for the user the devcontainer runs as.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"uses_features": schema.BoolAttribute{
+				MarkdownDescription: "Whether the probed devcontainer declares any features. Features that are not pinned to a version, such as `ghcr.io/devcontainers/features/go` or `ghcr.io/devcontainers/features/go:latest`, change whenever a new version is released, which causes cache misses without any change to the repository. A warning is produced for them unless `suppress_unpinned_features_warning` is set.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"vscode_extensions": schema.ListAttribute{
+				MarkdownDescription: "The VS Code extensions in the `customizations` of the probed devcontainer, for example to install them with `coder_script`.",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"workdir": schema.StringAttribute{
+				MarkdownDescription: "The `WorkingDir` of the config of the cached image. Empty if the cached image was not found. Images built by envbuilder end with the directives it appends, so this is that of envbuilder rather than of the devcontainer; see `devcontainer_resolved` for the user the devcontainer runs as.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+
+		Blocks: map[string]schema.Block{
+			"policy":   policyBlock(),
+			"timeouts": timeoutsBlock(),
+		},
+	}
+}
+
+func (r *CachedImageResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	data, ok := req.ProviderData.(*providerData)
+
 	if !ok {
 		resp.Diagnostics.AddError(
 			"Unexpected Resource Configure Type",
-			fmt.Sprintf("Expected *http.Client, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+			fmt.Sprintf("Expected *providerData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
 		)
 
 		return
 	}
 
-	r.client = client
+	r.data = data
+}
+
+// netOpts returns the network options configured on the provider.
+func (r *CachedImageResource) netOpts() netutil.Options {
+	if r.data == nil {
+		return netutil.Options{}
+	}
+	return r.data.netOpts
+}
+
+// overridePolicy returns the override policy configured on the provider.
+func (r *CachedImageResource) overridePolicy() overridePolicy {
+	if r.data == nil {
+		return overridePolicy{}
+	}
+	return r.data.overridePolicy
+}
+
+// audit returns the audit webhook configured on the provider, if any.
+func (r *CachedImageResource) audit() *auditWebhook {
+	if r.data == nil {
+		return nil
+	}
+	return r.data.audit
+}
+
+// defaultIgnorePaths returns the ignore paths configured on the provider.
+func (r *CachedImageResource) defaultIgnorePaths() []string {
+	if r.data == nil {
+		return nil
+	}
+	return r.data.defaultIgnorePaths
+}
+
+// registryAuth returns the registry auth settings configured on the provider.
+func (r *CachedImageResource) registryAuth() registryAuth {
+	if r.data == nil {
+		return registryAuth{}
+	}
+	return r.data.registryAuth
+}
+
+func (r *CachedImageResource) containerd() containerdOptions {
+	if r.data == nil {
+		return containerdOptions{}
+	}
+	return r.data.containerd
 }
 
 // setComputedEnv sets data.Env and data.EnvMap based on the values of the
@@ -302,73 +1047,758 @@ func (data *CachedImageResourceModel) setComputedEnv(ctx context.Context, env ma
 	return diag
 }
 
-func (r *CachedImageResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
-	var data CachedImageResourceModel
-
-	// Read prior state into the model
-	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
-	if resp.Diagnostics.HasError() {
-		return
+// setCreated sets data.CreatedAt and data.AgeSeconds from the creation
+// timestamp in the config of img, and returns the timestamp. The outputs of
+// the rest of the config are set with setImageConfig.
+func (data *CachedImageResourceModel) setCreated(img v1.Image, now time.Time) (time.Time, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, err
+	}
+	data.setImageConfig(cfg)
+	return data.setCreatedFromConfig(cfg, now), nil
+}
+
+// setCreatedFromConfig sets data.CreatedAt and data.AgeSeconds from the image
+// config cfg, and returns the creation time.
+func (data *CachedImageResourceModel) setCreatedFromConfig(cfg *v1.ConfigFile, now time.Time) time.Time {
+	created := cfg.Created.Time
+	data.CreatedAt = types.StringValue(formatTime(created))
+	data.AgeSeconds = types.Int64Value(0)
+	if !created.IsZero() {
+		data.AgeSeconds = types.Int64Value(int64(now.Sub(created).Seconds()))
+	}
+	return created
+}
+
+// gitURL returns git_url with git_ref appended, if set.
+func (data *CachedImageResourceModel) gitURL() string {
+	if data.GitRef.IsNull() || data.GitRef.IsUnknown() {
+		return data.GitURL.ValueString()
+	}
+	return data.GitURL.ValueString() + "#" + data.GitRef.ValueString()
+}
+
+// cacheRepo returns the cache repo, including the cache namespace if set.
+func (data *CachedImageResourceModel) cacheRepo() string {
+	return joinCacheNamespace(data.CacheRepo.ValueString(), data.CacheNamespace.ValueString())
+}
+
+// setCacheTag sets cache_tag to tag if the cached image was tagged with it,
+// or warns that it could not be tagged with tagErr.
+func (data *CachedImageResourceModel) setCacheTag(tag string, tagErr error, diags *diag.Diagnostics) {
+	if tagErr != nil {
+		diags.AddAttributeWarning(path.Root("cache_tag_format"), "Failed to tag the cached image.", fmt.Sprintf(
+			"The cached image was found in repository %q, but could not be tagged with %q: %s",
+			data.imageRepo(), tag, tagErr.Error(),
+		))
+		return
+	}
+	data.CacheTag = types.StringValue(tag)
+}
+
+// setCandidateTag sets candidate_tag to tag, warning that the image of the
+// candidate is used if it is set.
+func (data *CachedImageResourceModel) setCandidateTag(tag string, diags *diag.Diagnostics) {
+	data.CandidateTag = types.StringValue(tag)
+	if tag != "" {
+		diags.AddWarning("Using the image of a candidate tag.", fmt.Sprintf(
+			"The cached image was not found in repository %q, so the image tagged %q is used instead. It may not match the devcontainer of the repository.",
+			data.imageRepo(), tag,
+		))
+	}
+}
+
+// setStale sets stale, warning that a stale image is used if it is set.
+func (data *CachedImageResourceModel) setStale(stale bool, diags *diag.Diagnostics) {
+	data.Stale = types.BoolValue(stale)
+	if stale {
+		diags.AddWarning("Using a stale cached image.", fmt.Sprintf(
+			"The cached image was not found in repository %q, so the image last found with the same inputs, at an earlier commit or with an earlier builder image, is used instead. It may not match the devcontainer of the repository.",
+			data.imageRepo(),
+		))
+	}
+}
+
+// setProbeHistory sets probe_history to history, and last_probed_at to the
+// time of its last entry.
+func (data *CachedImageResourceModel) setProbeHistory(history []probeHistoryEntry) {
+	elems := make([]attr.Value, 0, len(history))
+	for _, entry := range history {
+		elems = append(elems, types.ObjectValueMust(probeHistoryAttrTypes, map[string]attr.Value{
+			"probed_at": types.StringValue(entry.ProbedAt.UTC().Format(time.RFC3339)),
+			"hit":       types.BoolValue(entry.Hit),
+		}))
+	}
+	data.ProbeHistory = types.ListValueMust(types.ObjectType{AttrTypes: probeHistoryAttrTypes}, elems)
+	data.LastProbedAt = types.StringValue("")
+	if len(history) > 0 {
+		data.LastProbedAt = types.StringValue(history[len(history)-1].ProbedAt.UTC().Format(time.RFC3339))
+	}
+}
+
+// setImageReference sets image_registry, image_repository, image_tag and
+// image_digest to the components of image.
+func (data *CachedImageResourceModel) setImageReference() {
+	var registry, repository, tag, digest string
+	if ref, err := name.ParseReference(data.Image.ValueString()); err == nil {
+		registry, repository = ref.Context().RegistryStr(), ref.Context().RepositoryStr()
+		switch ref := ref.(type) {
+		case name.Tag:
+			tag = ref.TagStr()
+		case name.Digest:
+			digest = ref.DigestStr()
+		}
+	}
+	data.ImageRegistry = types.StringValue(registry)
+	data.ImageRepository = types.StringValue(repository)
+	data.ImageTag = types.StringValue(tag)
+	data.ImageDigest = types.StringValue(digest)
+}
+
+// cacheProbeOptions returns the options for runCacheProbe set in data and
+// on the provider. pd may be nil if the provider is not configured.
+func (data *CachedImageResourceModel) cacheProbeOptions(pd *providerData) (cacheProbeOptions, diag.Diagnostics) {
+	if pd == nil {
+		pd = &providerData{}
+	}
+	netOpts, diags := data.registryNetOpts(pd.netOpts)
+	probeOpts := cacheProbeOptions{
+		localRepoPath:    data.LocalRepoPath.ValueString(),
+		sourceDir:        data.SourceDir.ValueString(),
+		debugBundlePath:  data.DebugBundlePath.ValueString(),
+		devcontainerEnv:  tfutil.TFMapToStringMap(data.DevcontainerEnv),
+		netOpts:          netOpts,
+		devcontainerJSON: data.DevcontainerJSONContent.ValueString(),
+		registryAuth:     pd.registryAuth,
+		progress:         pd.progress,
+		scratchLimit:     pd.scratchLimit,
+		limiter:          pd.probeLimiter,
+		subprocess:       pd.probeMode == probeModeSubprocess,
+		memoryLimit:      pd.memoryLimit,
+		executor:         pd.probeExecutor,
+		secrets:          pd.probeSecrets,
+		resultCache:      pd.resultCache,
+		vault:            pd.vault,
+	}
+	if !data.CacheTagFormat.IsNull() {
+		tag, err := expandCacheTag(data.CacheTagFormat.ValueString(), data.source())
+		if err != nil {
+			diags.AddAttributeError(path.Root("cache_tag_format"), "Invalid cache tag", err.Error()+".")
+		}
+		probeOpts.cacheTag = tag
+	}
+	for i, format := range tfutil.TFListToStringSlice(data.CandidateTags) {
+		tag, err := expandCacheTag(format, data.source())
+		if err != nil {
+			diags.AddAttributeError(path.Root("candidate_tags").AtListIndex(i), "Invalid candidate tag", err.Error()+".")
+			continue
+		}
+		probeOpts.candidateTags = append(probeOpts.candidateTags, tag)
+	}
+	probeOpts.staleFallback = data.StaleFallback.ValueBool()
+	if !data.Platform.IsNull() && !data.Platform.IsUnknown() {
+		p, err := v1.ParsePlatform(data.Platform.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("platform"), "Invalid platform", err.Error()+".")
+		} else {
+			probeOpts.platform = p
+			diags.Append(hostPlatformWarning(path.Root("platform"), *p)...)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, s := range tfutil.TFListToStringSlice(data.Platforms) {
+		attrPath := path.Root("platforms").AtListIndex(i)
+		p, err := v1.ParsePlatform(s)
+		if err != nil {
+			diags.AddAttributeError(attrPath, "Invalid platform", err.Error()+".")
+			continue
+		}
+		if seen[p.String()] {
+			diags.AddAttributeError(attrPath, "Duplicate platform", fmt.Sprintf("The platform %s is listed more than once.", p.String()))
+			continue
+		}
+		seen[p.String()] = true
+		probeOpts.platforms = append(probeOpts.platforms, *p)
+		diags.Append(hostPlatformWarning(attrPath, *p)...)
+	}
+	if len(probeOpts.platforms) > 0 {
+		if probeOpts.platform != nil {
+			diags.AddAttributeError(path.Root("platforms"), "Conflicting platforms", "Only one of platform and platforms may be set.")
+		}
+		probeOpts.platform = &probeOpts.platforms[0]
+	}
+	probeOpts.policy = data.probePolicy()
+	if !data.Policy.IsNull() && !probeOpts.policy.enabled() {
+		diags.AddAttributeError(path.Root("policy"), "Invalid policy", "One of bundle_path and rego must be set.")
+	}
+	probeOpts.compliance = baseImageCompliance{
+		allowed: labelLists(data.BaseImageAllowedLabels),
+		denied:  labelLists(data.BaseImageDeniedLabels),
+	}
+	for i, registry := range tfutil.TFListToStringSlice(data.AllowedRegistries) {
+		normalized, err := normalizeRegistry(registry)
+		if err != nil {
+			diags.AddAttributeError(path.Root("allowed_registries").AtListIndex(i), "Invalid registry", err.Error()+".")
+			continue
+		}
+		probeOpts.allowedRegistries = append(probeOpts.allowedRegistries, normalized)
+	}
+	if probeOpts.staleFallback && probeOpts.resultCache.dir == "" {
+		diags.AddAttributeWarning(path.Root("stale_fallback"), "No probe result cache",
+			"stale_fallback falls back to images found by earlier probes, which are only known if probe_result_cache_dir is set on the provider.")
+	}
+	for i, mirrorURL := range tfutil.TFListToStringSlice(data.GitMirrorURLs) {
+		normalized, err := normalizeGitURL(mirrorURL)
+		if err != nil {
+			diags.AddAttributeError(path.Root("git_mirror_urls").AtListIndex(i), "Invalid git mirror URL",
+				fmt.Sprintf("%q is not a valid git URL: %s.", mirrorURL, err))
+			continue
+		}
+		probeOpts.gitMirrorURLs = append(probeOpts.gitMirrorURLs, normalized)
+	}
+	cert, key := data.GitTLSClientCert.ValueString(), data.GitTLSClientKey.ValueString()
+	switch {
+	case cert == "" && key == "":
+	case cert == "" || key == "":
+		diags.AddAttributeError(path.Root("git_tls_client_cert"), "Incomplete git client certificate",
+			"Both git_tls_client_cert and git_tls_client_key must be set to use a client certificate.")
+	default:
+		clientCert, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			diags.AddAttributeError(path.Root("git_tls_client_cert"), "Invalid git client certificate",
+				fmt.Sprintf("Unable to load the client certificate and key: %s", err))
+			break
+		}
+		probeOpts.gitClientCert = &clientCert
+	}
+	return probeOpts, diags
+}
+
+// registryNetOpts returns netOpts with the registry settings in data
+// applied.
+func (data *CachedImageResourceModel) registryNetOpts(netOpts netutil.Options) (netutil.Options, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	hosts, err := netutil.ParseTLSSkipVerifyHosts(tfutil.TFListToStringSlice(data.TLSSkipVerifyRegistries))
+	if err != nil {
+		diags.AddAttributeError(path.Root("tls_skip_verify_registries"), "Invalid registry host", err.Error())
+		return netOpts, diags
+	}
+	netOpts.TLSSkipVerifyHosts = hosts
+	return netOpts, diags
+}
+
+// checkRequiredLabels checks that img has the labels in data.RequiredLabels.
+// If it does not, depending on data.RequiredLabelsPolicy, either an error is
+// returned so that the image is treated as not found, or an error diagnostic
+// is added to diags.
+func (data *CachedImageResourceModel) checkRequiredLabels(img v1.Image, diags *diag.Diagnostics) error {
+	requiredLabels := tfutil.TFMapToStringMap(data.RequiredLabels)
+	if len(requiredLabels) == 0 {
+		return nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		diags.AddError("Failed to get cached image config", err.Error())
+		return nil
+	}
+	messages := checkLabels(data.imageRepo(), cfg.Config.Labels, requiredLabels)
+	if len(messages) == 0 {
+		return nil
+	}
+	if data.RequiredLabelsPolicy.ValueString() == requiredLabelsPolicyError {
+		diags.AddAttributeError(path.Root("required_labels"),
+			"Cached image is missing required labels",
+			strings.Join(messages, "\n"),
+		)
+		return nil
+	}
+	return fmt.Errorf("cached image is missing required labels: %s", strings.Join(messages, " "))
+}
+
+// checkImageSize sets data.ImageSizeBytes to the size of img. If it exceeds
+// data.MaxImageSizeBytes, depending on data.MaxImageSizePolicy, either an
+// error or a warning diagnostic is added to diags.
+func (data *CachedImageResourceModel) checkImageSize(img v1.Image, diags *diag.Diagnostics) {
+	size, err := imageSize(img)
+	if err != nil {
+		diags.AddError("Failed to get cached image manifest", err.Error())
+		return
+	}
+	data.ImageSizeBytes = types.Int64Value(size)
+	maxSize := data.MaxImageSizeBytes.ValueInt64()
+	if data.MaxImageSizeBytes.IsNull() || size <= maxSize {
+		return
+	}
+	summary := "Cached image exceeds max_image_size_bytes"
+	detail := fmt.Sprintf("The cached image in repository %q is %s (%d bytes), which exceeds the maximum of %s (%d bytes).",
+		data.imageRepo(), units.BytesSize(float64(size)), size, units.BytesSize(float64(maxSize)), maxSize)
+	if data.MaxImageSizePolicy.ValueString() == maxImageSizePolicyWarn {
+		diags.AddAttributeWarning(path.Root("max_image_size_bytes"), summary, detail)
+		return
+	}
+	diags.AddAttributeError(path.Root("max_image_size_bytes"), summary, detail)
+}
+
+// imageSize returns the size of img as stored in a registry: the sizes of
+// its config and layers, as listed in its manifest.
+func imageSize(img v1.Image) (int64, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// setDevcontainer sets the outputs read from the devcontainer.json of the
+// probed repository.
+func (data *CachedImageResourceModel) setDevcontainer(ctx context.Context, dc probedDevcontainer) diag.Diagnostics {
+	data.UsesFeatures = types.BoolValue(len(dc.features) > 0)
+	data.Customizations = types.StringValue(dc.customizations)
+	data.DevcontainerResolved = types.StringValue(dc.resolved)
+	var diags diag.Diagnostics
+	data.VSCodeExtensions, diags = types.ListValueFrom(ctx, types.StringType, append([]string{}, dc.vscodeExtensions...))
+	return diags
+}
+
+// setBaseImage sets data.BaseImage to baseImage and data.BaseImageDigest to
+// the digest it currently resolves to. Failing to determine either is not
+// an error, and leaves both empty.
+func (data *CachedImageResourceModel) setBaseImage(ctx context.Context, baseImage string, remoteOpts ...remote.Option) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if baseImage == "" {
+		diags.AddWarning("Unable to determine base image.",
+			"The base image of the devcontainer or Dockerfile could not be determined, so it will not be tracked.",
+		)
+		return diags
+	}
+	digest, err := imgutil.GetImageDigest(ctx, baseImage, remoteOpts...)
+	if err != nil {
+		diags.AddWarning("Unable to resolve base image.",
+			fmt.Sprintf("Failed to resolve the base image %q, so it will not be tracked: %q", baseImage, err.Error()),
+		)
+		return diags
+	}
+	data.BaseImage = types.StringValue(baseImage)
+	data.BaseImageDigest = types.StringValue(digest.String())
+	return diags
+}
+
+func (r *CachedImageResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data CachedImageResourceModel
+
+	// Read prior state into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := data.withTimeout(ctx, "read")
+	defer cancel()
+
+	// Get the options from the data model.
+	opts, diags := optionsFromDataModel(data, r.overridePolicy())
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	addDefaultIgnorePaths(&opts, r.defaultIgnorePaths())
+	netOpts, diags := data.registryNetOpts(r.netOpts())
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	remoteOpts := remoteOptions(netOpts, r.registryAuth())
+	// Set the expected environment variables.
+	resp.Diagnostics.Append(data.setComputedEnv(ctx, data.computeEnv(opts))...)
+	data.GitURLCanonical = types.StringValue(opts.GitURL)
+
+	// If the previous state is that Image == BuilderImage, then we previously did
+	// not find the image. We will need to run another cache probe.
+	if data.Image.Equal(data.BuilderImage) {
+		resp.Diagnostics.AddWarning(
+			"Re-running cache probe due to previous miss.",
+			fmt.Sprintf(`The previous state specifies image == builder_image %q, which indicates a previous cache miss.`,
+				data.Image.ValueString(),
+			))
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	// The image of a candidate tag is not the cached image, so we will need
+	// to run another cache probe in case it has been built since.
+	if tag := data.CandidateTag.ValueString(); tag != "" {
+		resp.Diagnostics.AddWarning(
+			"Re-running cache probe due to previous candidate tag.",
+			fmt.Sprintf(`The previous state specifies the image of candidate tag %q, which indicates a previous cache miss. The cached image will be probed for again in the next apply.`,
+				tag,
+			))
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	// Neither is a stale image.
+	if data.Stale.ValueBool() {
+		resp.Diagnostics.AddWarning(
+			"Re-running cache probe due to previous stale image.",
+			"The previous state specifies a stale image, which indicates a previous cache miss. The cached image will be probed for again in the next apply.",
+		)
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	// Probe again if the image we previously found may not be the one a
+	// probe would find now.
+	if reason := r.probeOutdated(ctx, &data, opts, req.Private, remoteOpts); reason != "" {
+		resp.Diagnostics.AddWarning("Re-running cache probe as its inputs changed.", reason+" It will be probed again in the next apply.")
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	// Check containerd, if configured, and then the remote registry for the
+	// image we previously found. The outputs of its manifest are left as
+	// they are if it is found in containerd, as only its config is, and the
+	// manifest of the same digest cannot have changed.
+	cfg, found := r.containerdImageConfig(ctx, data.ID.ValueString())
+	if found {
+		tflog.Info(ctx, "found cached image in containerd", map[string]any{"digest": data.ID.ValueString()})
+		data.Image = types.StringValue(fmt.Sprintf("%s@%s", data.imageRepo(), data.ID.ValueString()))
+		data.Exists = types.BoolValue(true)
+		data.setImageConfig(cfg)
+		created := data.setCreatedFromConfig(cfg, time.Now())
+		r.checkCachedImage(ctx, &data, created, remoteOpts, resp)
+		return
+	}
+	img, err := imgutil.GetRemoteImage(ctx, data.Image.ValueString(), remoteOpts...)
+	if err != nil {
+		if !strings.Contains(err.Error(), "MANIFEST_UNKNOWN") {
+			// Explicitly not making this an error diag.
+			resp.Diagnostics.AddWarning("Unable to check remote image.",
+				fmt.Sprintf("The repository %q returned the following error while checking for a cached image %q: %q",
+					data.imageRepo(),
+					data.Image.ValueString(),
+					err.Error(),
+				))
+			return
+		}
+		// Image does not exist any longer! Remove the resource so we can re-create
+		// it next time.
+		resp.Diagnostics.AddWarning("Previously built image not found, recreating.",
+			fmt.Sprintf("The repository %q does not contain the cached image %q. It will be rebuilt in the next apply.",
+				data.imageRepo(),
+				data.Image.ValueString(),
+			))
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	created, err := data.setCachedImage(img, time.Now())
+	if err != nil {
+		resp.Diagnostics.AddError("Error reading cached image", err.Error())
+		return
+	}
+	r.checkCachedImage(ctx, &data, created, remoteOpts, resp)
+}
+
+// containerdImageConfig returns the config of the image with the digest dgst
+// in containerd, and whether it was found. It is never found if containerd
+// is not configured, or cannot be reached.
+func (r *CachedImageResource) containerdImageConfig(ctx context.Context, dgst string) (*v1.ConfigFile, bool) {
+	opts := r.containerd()
+	if opts.address == "" || dgst == uuid.Nil.String() {
+		return nil, false
+	}
+	cfg, found, err := opts.imageConfig(ctx, dgst)
+	if err != nil {
+		tflog.Warn(ctx, "unable to check containerd for the cached image, checking the remote registry", map[string]any{"err": err})
+		return nil, false
+	}
+	return cfg, found
+}
+
+// probeOutdated returns why a probe could now find a different image than
+// the probe recorded in the private state found, or the empty string if it
+// would not or if there is no record of the probe. The commit of the
+// repository is only compared if git_ref is set.
+func (r *CachedImageResource) probeOutdated(ctx context.Context, data *CachedImageResourceModel, opts eboptions.Options, private privateStateGetter, remoteOpts []remote.Option) string {
+	meta, ok, diags := getProbeMetadata(ctx, private)
+	if !ok {
+		if diags.HasError() || diags.WarningsCount() > 0 {
+			tflog.Warn(ctx, "unable to read probe metadata", map[string]any{"diags": diags})
+		}
+		return ""
+	}
+	probeOpts, diags := data.cacheProbeOptions(r.data)
+	if diags.HasError() {
+		return ""
+	}
+	if probeInputsHash(data.BuilderImage.ValueString(), probeOpts.platform, opts, probeOpts.devcontainerEnv, probeOpts.devcontainerJSON) != meta.InputsHash {
+		return fmt.Sprintf("The options of the cache probe, which ran at %s, have changed, for example as the provider configuration changed.",
+			meta.ProbedAt.Format(time.RFC3339),
+		)
+	}
+	if reason := probeRefMoved(ctx, data, opts, probeOpts, meta); reason != "" {
+		return reason
+	}
+	if meta.BuilderDigest == "" {
+		return ""
+	}
+	dgst, err := imgutil.GetImageDigest(ctx, data.BuilderImage.ValueString(), remoteOpts...)
+	if err != nil {
+		tflog.Warn(ctx, "unable to resolve the builder image, not comparing it with the one probed with", map[string]any{"err": err})
+		return ""
+	}
+	if dgst.String() != meta.BuilderDigest {
+		return fmt.Sprintf("The builder image %q now resolves to %s instead of %s, which the cache probe ran with at %s.",
+			data.BuilderImage.ValueString(), dgst, meta.BuilderDigest, meta.ProbedAt.Format(time.RFC3339),
+		)
+	}
+	return ""
+}
+
+// probeRefMoved returns why the cache probe described by meta is outdated if
+// git_ref is set and now resolves to a different commit, or the empty string
+// otherwise. The commit is resolved as by a probe with opts and probeOpts.
+func probeRefMoved(ctx context.Context, data *CachedImageResourceModel, opts eboptions.Options, probeOpts cacheProbeOptions, meta probeMetadata) string {
+	if data.GitRef.IsNull() || meta.Commit == "" {
+		return ""
 	}
-
-	// Get the options from the data model.
-	opts, diags := optionsFromDataModel(data)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
-		return
+	probeOpts.secrets.apply(&opts)
+	logf := func(format string, args ...any) {
+		tflog.Debug(ctx, fmt.Sprintf(format, args...))
 	}
-	// Set the expected environment variables.
-	computedEnv := computeEnvFromOptions(opts, tfutil.TFMapToStringMap(data.ExtraEnv))
-	resp.Diagnostics.Append(data.setComputedEnv(ctx, computedEnv)...)
+	_, gitTr := probeOpts.transports()
+	commit, err := resolveGitCommit(ctx, logf, opts, gitTr)
+	if err != nil {
+		tflog.Warn(ctx, "unable to resolve git_ref, not comparing it with the commit probed", map[string]any{"err": err})
+		return ""
+	}
+	if commit != meta.Commit {
+		return fmt.Sprintf("git_ref %q now resolves to commit %s instead of %s, which the cache probe ran at %s.",
+			data.GitRef.ValueString(), commit, meta.Commit, meta.ProbedAt.Format(time.RFC3339),
+		)
+	}
+	return ""
+}
 
-	// If the previous state is that Image == BuilderImage, then we previously did
-	// not find the image. We will need to run another cache probe.
-	if data.Image.Equal(data.BuilderImage) {
-		resp.Diagnostics.AddWarning(
-			"Re-running cache probe due to previous miss.",
-			fmt.Sprintf(`The previous state specifies image == builder_image %q, which indicates a previous cache miss.`,
+// checkCachedImage checks whether the cached image found during Read, created
+// at created, has expired or has an updated base image, and saves data into
+// the state otherwise.
+func (r *CachedImageResource) checkCachedImage(ctx context.Context, data *CachedImageResourceModel, created time.Time, remoteOpts []remote.Option, resp *resource.ReadResponse) {
+	// Check whether the image has outlived the cache TTL.
+	if data.EnforceCacheTTL.ValueBool() && cacheExpired(created, data.CacheTTLDays.ValueInt64(), time.Now()) {
+		resp.Diagnostics.AddWarning("Cached image expired, recreating.",
+			fmt.Sprintf("The cached image %q was created at %s, which is more than cache_ttl_days ago. It will be rebuilt in the next apply.",
 				data.Image.ValueString(),
+				formatTime(created),
 			))
 		resp.State.RemoveResource(ctx)
 		return
 	}
 
-	// Check the remote registry for the image we previously found.
-	img, err := imgutil.GetRemoteImage(data.Image.ValueString())
-	if err != nil {
-		if !strings.Contains(err.Error(), "MANIFEST_UNKNOWN") {
+	// Check whether the base image has moved since the cached image was found.
+	if data.TrackBaseImage.ValueBool() && data.BaseImageDigest.ValueString() != "" {
+		baseDigest, err := imgutil.GetImageDigest(ctx, data.BaseImage.ValueString(), remoteOpts...)
+		if err != nil {
 			// Explicitly not making this an error diag.
-			resp.Diagnostics.AddWarning("Unable to check remote image.",
-				fmt.Sprintf("The repository %q returned the following error while checking for a cached image %q: %q",
-					data.CacheRepo.ValueString(),
-					data.Image.ValueString(),
+			resp.Diagnostics.AddWarning("Unable to check base image.",
+				fmt.Sprintf("Failed to resolve the base image %q: %q",
+					data.BaseImage.ValueString(),
 					err.Error(),
 				))
-			return
+		} else if baseDigest.String() != data.BaseImageDigest.ValueString() {
+			data.BaseImageUpdated = types.BoolValue(true)
+			if data.RecreateOnBaseImageUpdate.ValueBool() {
+				resp.Diagnostics.AddWarning("Base image updated, recreating.",
+					fmt.Sprintf("The base image %q now resolves to %s instead of %s. The cached image will be probed again in the next apply.",
+						data.BaseImage.ValueString(),
+						baseDigest,
+						data.BaseImageDigest.ValueString(),
+					))
+				resp.State.RemoveResource(ctx)
+				return
+			}
+			resp.Diagnostics.AddWarning("Base image updated.",
+				fmt.Sprintf("The base image %q now resolves to %s instead of %s. The cached image may be out of date.",
+					data.BaseImage.ValueString(),
+					baseDigest,
+					data.BaseImageDigest.ValueString(),
+				))
+		}
+	}
+
+	data.setImageReference()
+	resp.Diagnostics.Append(resp.State.Set(ctx, data)...)
+}
+
+// probeAndPopulate runs the cache probe for data and sets its computed
+// attributes from the result, as when creating the cached image resource or
+// opening the ephemeral one. The probe is stopped after the timeout of data
+// for op, and missAction tells the user what happens if the cached image is
+// not found. It returns the metadata of the probe.
+func probeAndPopulate(ctx context.Context, data *CachedImageResourceModel, opts eboptions.Options, probeOpts cacheProbeOptions, op, missAction string) (probeMetadata, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	meta := probeMetadata{
+		InputsHash: probeInputsHash(data.BuilderImage.ValueString(), probeOpts.platform, opts, probeOpts.devcontainerEnv, probeOpts.devcontainerJSON),
+		ProbedAt:   time.Now(),
+	}
+	probeCtx, cancel := data.withTimeout(ctx, op)
+	result, probedRepo, err := runCacheProbes(probeCtx, data.BuilderImage.ValueString(), opts, probeOpts, data.cacheRepos())
+	opts.CacheRepo = probedRepo
+	data.CacheRepoUsed = types.StringValue("")
+	if err == nil {
+		data.CacheRepoUsed = types.StringValue(probedRepo)
+	}
+	platformsErr := data.probePlatforms(probeCtx, data.BuilderImage.ValueString(), opts, probeOpts, result, err)
+	cancel()
+	meta.Commit, meta.BuilderDigest = result.commit, result.builderDigest
+	if probeOpts.progress.diagnostics {
+		diags.AddWarning("Cache probe summary.", result.progress)
+	}
+	if result.debugBundle != "" {
+		diags.AddWarning("Debug bundle written.", fmt.Sprintf("The cache probe failed, and a debug bundle was written to %q.", result.debugBundle))
+	}
+	var scratchErr *scratchLimitError
+	if errors.As(err, &scratchErr) {
+		diags.AddError("Scratch space limit exceeded.", fmt.Sprintf(
+			"Probing for a cached image in repository %q was stopped as %s. Increase probe_scratch_limit of the provider to allow it.",
+			probedRepo,
+			scratchErr.Error(),
+		))
+		return meta, diags
+	}
+	var registryErr *registryNotAllowedError
+	if errors.As(err, &registryErr) {
+		diags.AddError("Registry not allowed.", fmt.Sprintf(
+			"No image is used, as %s. The allowed registries are: %s.",
+			registryErr.Error(),
+			probeOpts.allowedRegistries,
+		))
+		return meta, diags
+	}
+	var configErr *probeConfigError
+	if errors.As(err, &configErr) {
+		diags.AddError(configErr.summary, fmt.Sprintf(
+			"Failed to probe for a cached image in repository %q.\n\n%s",
+			probedRepo,
+			configErr.detail(),
+		))
+		return meta, diags
+	}
+	var accessErr *probeAccessError
+	if errors.As(err, &accessErr) {
+		diags.AddError(accessErr.summary, fmt.Sprintf(
+			"Failed to probe for a cached image in repository %q.\n\n%s",
+			probedRepo,
+			accessErr.detail(),
+		))
+		return meta, diags
+	}
+	diags.Append(policyDiagnostics(probeOpts.policy, result, err)...)
+	diags.Append(data.setCompliance(ctx, probeOpts.compliance, result.compliance, err)...)
+	if diags.HasError() {
+		return meta, diags
+	}
+	cachedImg := result.image
+	if err == nil {
+		err = data.checkRequiredLabels(cachedImg, &diags)
+		if diags.HasError() {
+			return meta, diags
+		}
+	}
+	if err == nil {
+		err = platformsErr
+	}
+	data.ID = types.StringValue(uuid.Nil.String())
+	data.Exists = types.BoolValue(err == nil)
+	data.BaseImage = types.StringValue("")
+	data.BaseImageDigest = types.StringValue("")
+	data.BaseImageUpdated = types.BoolValue(false)
+	data.CreatedAt = types.StringValue("")
+	data.AgeSeconds = types.Int64Value(0)
+	data.ImageSizeBytes = types.Int64Value(0)
+	data.setImageConfig(nil)
+	data.setManifest(nil)
+	data.GitURLUsed = types.StringValue(result.gitURL)
+	data.GitCommit = types.StringValue(result.commit)
+	data.setMissingLayers(result.missingLayers, err)
+	history, histErr := probeOpts.resultCache.appendHistory(meta.InputsHash, probeHistoryEntry{ProbedAt: meta.ProbedAt, Hit: err == nil})
+	if histErr != nil {
+		tflog.Warn(ctx, "unable to store the probe history", map[string]any{"err": histErr})
+	}
+	data.setProbeHistory(history)
+	data.CacheTag = types.StringValue("")
+	if err == nil && probeOpts.cacheTag != "" {
+		data.setCacheTag(probeOpts.cacheTag, result.cacheTagErr, &diags)
+	}
+	data.setCandidateTag(result.candidateTag, &diags)
+	data.setStale(result.stale, &diags)
+	diags.Append(data.setDevcontainer(ctx, result.devcontainer)...)
+	data.CompiledDockerfile = types.StringValue(result.dockerfile)
+	if !data.SuppressUnpinnedFeatures.ValueBool() {
+		diags.Append(unpinnedFeaturesWarning(result.devcontainer.features)...)
+	}
+	var cancelledErr *probeCancelledError
+	if errors.As(err, &cancelledErr) {
+		diags.AddWarning(cancelledErr.summary(), cancelledErr.detail(probedRepo))
+		data.CacheRepoUsed = types.StringValue("")
+		data.Image = data.BuilderImage
+	} else if err != nil {
+		// Configuration and access errors were reported above, so this is
+		// most likely a layer missing from the cache.
+		diags.AddWarning("Cached image not found.", fmt.Sprintf(
+			"Failed to find cached image in repository %q. %s Error: %s%s",
+			probedRepo,
+			missAction,
+			err.Error(),
+			missingLayersDetail(result.missingLayers),
+		))
+		data.CacheRepoUsed = types.StringValue("")
+		data.Image = data.BuilderImage
+	} else if _, err := data.setCachedImage(cachedImg, time.Now()); err != nil {
+		// There's something seriously up with this image!
+		diags.AddError("Failed to read cached image", err.Error())
+		return meta, diags
+	} else {
+		tflog.Info(ctx, "found image: "+data.Image.ValueString())
+		data.checkImageSize(cachedImg, &diags)
+		if diags.HasError() {
+			return meta, diags
+		}
+		if data.TrackBaseImage.ValueBool() {
+			diags.Append(data.setBaseImage(ctx, result.baseImage, remoteOptions(probeOpts.netOpts, probeOpts.registryAuth)...)...)
 		}
-		// Image does not exist any longer! Remove the resource so we can re-create
-		// it next time.
-		resp.Diagnostics.AddWarning("Previously built image not found, recreating.",
-			fmt.Sprintf("The repository %q does not contain the cached image %q. It will be rebuilt in the next apply.",
-				data.CacheRepo.ValueString(),
-				data.Image.ValueString(),
-			))
-		resp.State.RemoveResource(ctx)
-		return
 	}
+	// Set the expected environment variables, now that the cache repo the
+	// cached image was found in is known.
+	diags.Append(data.setComputedEnv(ctx, data.computeEnv(opts))...)
+	data.setImageReference()
+	return meta, diags
+}
 
-	// Found image! Get the digest.
+// setCachedImage sets the outputs of the cached image img, found in the
+// cache repo of data. It returns when img was created.
+func (data *CachedImageResourceModel) setCachedImage(img v1.Image, now time.Time) (time.Time, error) {
 	digest, err := img.Digest()
 	if err != nil {
-		resp.Diagnostics.AddError("Error fetching image digest", err.Error())
-		return
+		return time.Time{}, fmt.Errorf("get digest: %w", err)
 	}
-
 	data.ID = types.StringValue(digest.String())
-	data.Image = types.StringValue(fmt.Sprintf("%s@%s", data.CacheRepo.ValueString(), digest))
+	data.Image = types.StringValue(fmt.Sprintf("%s@%s", data.imageRepo(), digest))
 	data.Exists = types.BoolValue(true)
-
-	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+	created, err := data.setCreated(img, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get config: %w", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get manifest: %w", err)
+	}
+	data.setManifest(manifest)
+	return created, nil
 }
 
 func (r *CachedImageResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
@@ -382,45 +1812,42 @@ func (r *CachedImageResource) Create(ctx context.Context, req resource.CreateReq
 	}
 
 	// Get the options from the data model.
-	opts, diags := optionsFromDataModel(data)
+	opts, diags := optionsFromDataModel(data, r.overridePolicy())
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
+	addDefaultIgnorePaths(&opts, r.defaultIgnorePaths())
+	data.GitURLCanonical = types.StringValue(opts.GitURL)
 
-	// Set the expected environment variables.
-	computedEnv := computeEnvFromOptions(opts, tfutil.TFMapToStringMap(data.ExtraEnv))
-	resp.Diagnostics.Append(data.setComputedEnv(ctx, computedEnv)...)
+	probeOpts, diags := data.cacheProbeOptions(r.data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	cachedImg, err := runCacheProbe(ctx, data.BuilderImage.ValueString(), opts)
-	data.ID = types.StringValue(uuid.Nil.String())
-	data.Exists = types.BoolValue(err == nil)
-	if err != nil {
-		// FIXME: there are legit errors that can crop up here.
-		// We should add a sentinel error in Kaniko for uncached layers, and check
-		// it here.
-		resp.Diagnostics.AddWarning("Cached image not found.", fmt.Sprintf(
-			"Failed to find cached image in repository %q. It will be rebuilt in the next apply. Error: %s",
-			data.CacheRepo.ValueString(),
-			err.Error(),
-		))
-		data.Image = data.BuilderImage
-	} else if digest, err := cachedImg.Digest(); err != nil {
-		// There's something seriously up with this image!
-		resp.Diagnostics.AddError("Failed to get cached image digest", err.Error())
+	meta, diags := probeAndPopulate(ctx, &data, opts, probeOpts, "create", "It will be rebuilt in the next apply.")
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
 		return
-	} else {
-		tflog.Info(ctx, fmt.Sprintf("found image: %s@%s", data.CacheRepo.ValueString(), digest))
-		data.Image = types.StringValue(fmt.Sprintf("%s@%s", data.CacheRepo.ValueString(), digest))
-		data.ID = types.StringValue(digest.String())
+	}
+	event := newAuditEvent("resource", &data, meta.InputsHash, meta.Commit, meta.ProbedAt)
+	if err := r.audit().send(ctx, event); err != nil {
+		resp.Diagnostics.AddWarning("Unable to send audit event.", fmt.Sprintf("The cache probe could not be reported to audit_webhook_url: %s", err))
 	}
 
 	// Save data into Terraform state
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+	resp.Diagnostics.Append(setProbeMetadata(ctx, resp.Private, meta)...)
 }
 
 func (r *CachedImageResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
-	// Updates are a no-op.
+	// Attributes whose changes cannot change the cached image found are
+	// updated in place, so the cache probe does not run again: the options
+	// that only take effect in the final builder image, credentials, and how
+	// the probe reaches the repository and registries. They may still change
+	// the computed environment. All others force recreation, and are part of
+	// the probe inputs hash compared on Read.
 	var data CachedImageResourceModel
 
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
@@ -429,6 +1856,14 @@ func (r *CachedImageResource) Update(ctx context.Context, req resource.UpdateReq
 		return
 	}
 
+	opts, diags := optionsFromDataModel(data, r.overridePolicy())
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	addDefaultIgnorePaths(&opts, r.defaultIgnorePaths())
+	resp.Diagnostics.Append(data.setComputedEnv(ctx, data.computeEnv(opts))...)
+
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
@@ -445,44 +1880,485 @@ func (r *CachedImageResource) Delete(ctx context.Context, req resource.DeleteReq
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
+// clearBuildOnlyOptions sets the options that are not relevant to the cache
+// probe to their zero value explicitly. They only take effect in the final
+// builder image, through the computed env.
+func clearBuildOnlyOptions(opts *eboptions.Options) {
+	opts.CoderAgentSubsystem = nil
+	opts.CoderAgentToken = ""
+	opts.CoderAgentURL = ""
+	opts.ExportEnvFile = ""
+	opts.InitArgs = ""
+	opts.InitCommand = ""
+	opts.InitScript = ""
+	opts.LayerCacheDir = ""
+	opts.PostStartScriptPath = ""
+	opts.PushImage = false
+	opts.SetupScript = ""
+	opts.SkipRebuild = false
+}
+
+// cacheProbeOptions configures how runCacheProbe reaches the repository and
+// registries.
+type cacheProbeOptions struct {
+	// localRepoPath is the path to an existing local clone of the repository,
+	// which is probed instead of cloning git_url.
+	localRepoPath string
+	// sourceDir is the directory that is probed if git_url is not set. It is
+	// copied into the workspace folder.
+	sourceDir string
+	// gitMirrorURLs are tried in order if git_url cannot be reached.
+	gitMirrorURLs []string
+	// devcontainerJSON is the content of the devcontainer.json to probe in
+	// place of the one in the repository, if not empty.
+	devcontainerJSON string
+	// devcontainerEnv are the variables that devcontainer.json is substituted
+	// with, in addition to the environment of the provider.
+	devcontainerEnv map[string]string
+	// gitClientCert is presented to HTTPS git remotes that request a client
+	// certificate, if set.
+	gitClientCert *tls.Certificate
+	// netOpts configures all outbound connections made while probing.
+	netOpts netutil.Options
+	// registryAuth configures where registry credentials come from.
+	registryAuth registryAuth
+	// progress configures how the progress of the probe is reported.
+	progress progressOptions
+	// scratchLimit is the maximum size in bytes of the temporary directory
+	// used by the probe. If zero, there is no limit.
+	scratchLimit int64
+	// limiter limits the number of probes that run at once. If nil, they
+	// are not limited.
+	limiter *probeLimiter
+	// subprocess runs envbuilder in a subprocess rather than in the
+	// provider process.
+	subprocess bool
+	// memoryLimit is the soft memory limit in bytes of the subprocess. If
+	// zero, it inherits GOMEMLIMIT from the provider.
+	memoryLimit int64
+	// executor runs envbuilder in a container. If nil, it runs in the
+	// provider process or a subprocess.
+	executor probeExecutor
+	// secrets are set in the options of the probe if they are not already.
+	secrets probeSecrets
+	// debugBundlePath is where a debug bundle is written if the probe fails.
+	// If empty, no bundle is written.
+	debugBundlePath string
+	// resultCache stores the results of probes that found an image across
+	// runs.
+	resultCache probeResultCache
+	// cacheTag is the tag to apply to the cached image in the cache repo
+	// once it is found. If empty, it is not tagged.
+	cacheTag string
+	// candidateTags are the tags of images in the cache repo to fall back
+	// to, in order, if the cached image is not found.
+	candidateTags []string
+	// staleFallback falls back to the image last found by a probe with the
+	// same inputs if the cached image is not found.
+	staleFallback bool
+	// policy is evaluated against the probed devcontainer before the result
+	// is used.
+	policy probePolicy
+	// allowedRegistries are the registries that referenced images may be
+	// on.
+	allowedRegistries registryAllowlist
+	// compliance checks the labels of the base image.
+	compliance baseImageCompliance
+	// vault fetches credentials that are not set otherwise from Vault, if
+	// configured.
+	vault *vaultCredentials
+	// platform is the platform that the builder image and images in the
+	// cache repo are resolved for, if set.
+	platform *v1.Platform
+	// platforms are the platforms to probe for, if several are. platform is
+	// the first of them.
+	platforms []v1.Platform
+	// deferFallback leaves falling back to a stale image or a candidate to
+	// the caller, by setting the fallback of the result.
+	deferFallback bool
+	// session is shared by the probes of several cache repos, if set.
+	session *probeSession
+}
+
+// probeSecrets are credentials set on the provider, or fetched from Vault,
+// that are used for probing by cached images that do not set their own. They
+// are applied after the environment is computed, so they never end up in the
+// plan or state.
+type probeSecrets struct {
+	gitUsername            string
+	gitPassword            string
+	gitSSHPrivateKeyBase64 string
+	dockerConfigBase64     string
+}
+
+// apply sets the secrets in opts whose options are not set.
+func (s probeSecrets) apply(opts *eboptions.Options) {
+	if opts.GitUsername == "" {
+		opts.GitUsername = s.gitUsername
+	}
+	if opts.GitPassword == "" {
+		opts.GitPassword = s.gitPassword
+	}
+	if opts.GitSSHPrivateKeyPath == "" && opts.GitSSHPrivateKeyBase64 == "" {
+		opts.GitSSHPrivateKeyBase64 = s.gitSSHPrivateKeyBase64
+	}
+	if opts.DockerConfigBase64 == "" {
+		opts.DockerConfigBase64 = s.dockerConfigBase64
+	}
+}
+
+// transports returns the transports for registry and git requests made
+// while probing. Only git remotes are presented with the client certificate,
+// and registry settings do not apply to them.
+func (probeOpts cacheProbeOptions) transports() (tr, gitTr *http.Transport) {
+	tr = probeOpts.netOpts.Transport()
+	gitNetOpts := probeOpts.netOpts
+	gitNetOpts.TLSSkipVerifyHosts = nil
+	gitTr = gitNetOpts.Transport()
+	if probeOpts.gitClientCert != nil {
+		if gitTr.TLSClientConfig == nil {
+			gitTr.TLSClientConfig = &tls.Config{}
+		}
+		gitTr.TLSClientConfig.Certificates = []tls.Certificate{*probeOpts.gitClientCert}
+	}
+	return tr, gitTr
+}
+
+// lookupDevcontainerEnv looks up key in devcontainer_env, and then in the
+// environment of the provider, as variables in devcontainer.json resolve
+// while probing.
+func (probeOpts cacheProbeOptions) lookupDevcontainerEnv(key string) (string, bool) {
+	if value, ok := probeOpts.devcontainerEnv[key]; ok {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+// cacheProbeResult is the result of runCacheProbe.
+type cacheProbeResult struct {
+	// image is the cached image.
+	image v1.Image
+	// baseImage is the base image of the probed devcontainer or Dockerfile,
+	// or the empty string if it cannot be determined.
+	baseImage string
+	// gitURL is the URL of the repository that was probed.
+	gitURL string
+	// devcontainer is read from the devcontainer.json of the probed
+	// repository.
+	devcontainer probedDevcontainer
+	// progress summarizes the progress of the probe, whether or not it
+	// succeeded.
+	progress string
+	// debugBundle is the path the debug bundle was written to, if the probe
+	// failed and one was requested.
+	debugBundle string
+	// cacheTagErr is the error tagging the cached image, if it was found but
+	// could not be tagged.
+	cacheTagErr error
+	// commit is the commit of the probed repository, and builderDigest the
+	// digest of the builder image. Either is empty if it was not resolved.
+	commit        string
+	builderDigest string
+	// candidateTag is the tag in candidateTags of the image, if the cached
+	// image was not found but a candidate was.
+	candidateTag string
+	// stale is whether the image was found by an earlier probe with the same
+	// inputs, as the cached image was not found.
+	stale bool
+	// policy holds the messages of the policy, if one was evaluated.
+	policy *policyResult
+	// compliance is the result of checking the base image, if it was.
+	compliance *complianceResult
+	// missingLayers are the instructions whose layers were not found in the
+	// cache, as logged by kaniko, if the probe ran.
+	missingLayers []string
+	// dockerfile is the Dockerfile compiled from the devcontainer, if it
+	// could be compiled.
+	dockerfile string
+	// fallback falls back to another image in the cache repo, if the cached
+	// image was not found and falling back was deferred.
+	fallback *probeFallback
+}
+
+// probeWorkspaceFolder returns the folder the repository is cloned to by a
+// probe with opts and the kaniko directory kanikoDir.
+func probeWorkspaceFolder(opts eboptions.Options, kanikoDir string) string {
+	if opts.RemoteRepoBuildMode {
+		return filepath.Join(kanikoDir, "repo")
+	}
+	return opts.WorkspaceFolder
+}
+
 // runCacheProbe performs a 'fake build' of the requested image and ensures that
 // all of the resulting layers of the image are present in the configured cache
 // repo. Otherwise, returns an error.
-func runCacheProbe(ctx context.Context, builderImage string, opts eboptions.Options) (v1.Image, error) {
-	tmpDir, err := os.MkdirTemp(os.TempDir(), "envbuilder-provider-cached-image-data-source")
-	if err != nil {
-		return nil, fmt.Errorf("unable to create temp directory: %s", err.Error())
-	}
+func runCacheProbe(ctx context.Context, builderImage string, opts eboptions.Options, probeOpts cacheProbeOptions) (result cacheProbeResult, err error) {
+	localRepoPath, netOpts := probeOpts.localRepoPath, probeOpts.netOpts
+	probeOpts.secrets.apply(&opts)
+
+	// Write a debug bundle if the probe fails. This is deferred first so that
+	// it runs last, once a panic has been turned into an error.
+	bundle := newDebugBundle(probeOpts.debugBundlePath)
+	defer func() {
+		if err == nil || bundle == nil {
+			return
+		}
+		if bundleErr := bundle.write(opts, err); bundleErr != nil {
+			tflog.Warn(ctx, "failed to write debug bundle", map[string]any{"path": bundle.path, "err": bundleErr})
+			return
+		}
+		tflog.Info(ctx, "wrote debug bundle", map[string]any{"path": bundle.path})
+		result.debugBundle = bundle.path
+	}()
+
+	// Report a panic while probing as an error rather than crashing the
+	// provider. The deferred cleanup below runs first.
 	defer func() {
-		if err := os.RemoveAll(tmpDir); err != nil {
-			tflog.Error(ctx, "failed to clean up tmpDir", map[string]any{"tmpDir": tmpDir, "err": err})
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cache probe panicked: %v", r)
 		}
 	}()
 
-	oldKanikoDir := kconfig.KanikoDir
-	tmpKanikoDir := filepath.Join(tmpDir, ".envbuilder")
-	// Normally you would set the KANIKO_DIR environment variable, but we are importing kaniko directly.
-	kconfig.KanikoDir = tmpKanikoDir
-	tflog.Info(ctx, "set kaniko dir to "+tmpKanikoDir)
+	// Log the progress periodically, as the probe may take a long time. If
+	// the probe is cancelled or times out, whatever error it was stopped with
+	// is replaced with how far it got.
+	probeCtx := ctx
+	progress := newProbeProgress()
+	stopHeartbeat := progress.heartbeat(ctx, probeOpts.progress.heartbeatInterval)
 	defer func() {
-		kconfig.KanikoDir = oldKanikoDir
-		tflog.Info(ctx, "restored kaniko dir to "+oldKanikoDir)
+		stopHeartbeat()
+		result.progress = progress.summary()
+		if err != nil && probeCtx.Err() != nil {
+			err = progress.cancelled(context.Cause(probeCtx))
+		}
 	}()
 
+	// Wait for other probes to finish if too many are running.
+	if probeOpts.limiter != nil {
+		progress.setStage("Waiting for other cache probes to finish")
+		release, err := probeOpts.limiter.acquire(ctx)
+		if err != nil {
+			return result, err
+		}
+		defer release()
+	}
+
+	// The fallback image is checked before anything is cloned.
+	if opts.FallbackImage != "" {
+		if err := probeOpts.allowedRegistries.check("fallback_image", opts.FallbackImage); err != nil {
+			return result, err
+		}
+	}
+
+	// Clone an existing local repository instead of the remote one, if
+	// requested.
+	if localRepoPath != "" {
+		if err := checkLocalRepo(localRepoPath); err != nil {
+			return result, err
+		}
+		opts.GitURL = localRepoURL(localRepoPath, opts.GitURL)
+		tflog.Debug(ctx, "using local repository", map[string]any{"git_url": opts.GitURL})
+	}
+
+	// Fetch the credentials that are not set otherwise from Vault, if
+	// configured.
+	if probeOpts.vault != nil {
+		progress.setStage("Fetching credentials from Vault")
+		secrets, err := probeOpts.vault.secrets(ctx)
+		if err != nil {
+			return result, fmt.Errorf("unable to fetch credentials from vault: %w", err)
+		}
+		secrets.apply(&opts)
+	}
+
+	// The scratch directory is removed however the probe ends, and the probe
+	// is cancelled if the directory grows beyond the scratch limit.
+	scratch, err := newScratchDir(ctx, probeOpts.scratchLimit)
+	if err != nil {
+		return result, fmt.Errorf("unable to create temp directory: %s", err.Error())
+	}
+	defer scratch.cleanup(ctx)
+	ctx = scratch.ctx
+	tmpDir := scratch.path
+
+	// Normally you would set the KANIKO_DIR environment variable, but we are
+	// importing kaniko directly. It is set while envbuilder runs, below.
+	tmpKanikoDir := filepath.Join(tmpDir, ".envbuilder")
 	if err := os.MkdirAll(tmpKanikoDir, 0o755); err != nil {
-		return nil, fmt.Errorf("failed to create kaniko dir: %w", err)
+		return result, fmt.Errorf("failed to create kaniko dir: %w", err)
+	}
+	// The kaniko directory is removed once the probe ends, so the debug
+	// bundle takes what it needs from it beforehand. Manifests are fetched
+	// even if the probe was cancelled or timed out, within their own timeout.
+	defer func() {
+		if err == nil || bundle == nil {
+			return
+		}
+		baseImage, _ := findBaseImage(probeWorkspaceFolder(opts, tmpKanikoDir), opts)
+		bundle.snapshot(context.WithoutCancel(probeCtx), tmpKanikoDir, []string{builderImage, baseImage}, remoteOptions(netOpts, probeOpts.registryAuth)...)
+	}()
+
+	// Registry and git requests are made with the transports of the probe,
+	// which envbuilder is run with below.
+	tr, gitTr := probeOpts.transports()
+	netutil.CountBytesRead(tr, &progress.bytesRead)
+	netutil.CountBytesRead(gitTr, &progress.bytesRead)
+	// Kaniko does not use ctx, so abort its connections once ctx is done to
+	// stop the probe promptly if it is cancelled.
+	defer netutil.CancelOnDone(ctx, tr)()
+	defer netutil.CancelOnDone(ctx, gitTr)()
+
+	// Git over SSH does not use the HTTP transport, but will honor a SOCKS5
+	// proxy URL.
+	if netOpts.SOCKS5Proxy != nil && opts.GitHTTPProxyURL == "" {
+		opts.GitHTTPProxyURL = netOpts.SOCKS5Proxy.String()
+	}
+
+	// Fall back to the first reachable mirror if git_url cannot be reached.
+	result.gitURL = opts.GitURL
+	if len(probeOpts.gitMirrorURLs) > 0 && localRepoPath == "" {
+		progress.setStage("Checking git_url and git_mirror_urls")
+		logf := func(format string, args ...any) {
+			tflog.Debug(ctx, fmt.Sprintf(format, args...))
+		}
+		gitURL, err := firstReachableGitURL(ctx, logf, opts, gitTr, append([]string{opts.GitURL}, probeOpts.gitMirrorURLs...))
+		if err != nil {
+			return result, classifyAccessError(fmt.Errorf("unable to reach git_url or any of git_mirror_urls: %w", err))
+		}
+		if gitURL != opts.GitURL {
+			tflog.Info(ctx, "git_url unreachable, using mirror", map[string]any{"git_url": gitURL})
+		}
+		opts.GitURL = gitURL
+		result.gitURL = gitURL
+	}
+
+	// Use the Docker config secret, or the local Docker config, if
+	// docker_config_base64 is not set.
+	progress.setStage("Resolving registry credentials")
+	dockerConfig, err := probeDockerConfigBase64(opts.DockerConfigBase64, probeOpts.registryAuth)
+	if err != nil {
+		return result, fmt.Errorf("unable to load the docker config: %w", err)
+	}
+	opts.DockerConfigBase64 = dockerConfig
+	// Use registry credentials from Podman in addition to the Docker config.
+	// An auth file set on the provider must be readable.
+	if dockerConfig, err := dockerConfigWithPodmanAuth(opts.DockerConfigBase64, probeOpts.registryAuth.authFile); err != nil {
+		if probeOpts.registryAuth.authFile != "" {
+			return result, fmt.Errorf("unable to load the registry auth file: %w", err)
+		}
+		tflog.Warn(ctx, "unable to add podman registry credentials, using the docker config only", map[string]any{"err": err})
+	} else {
+		opts.DockerConfigBase64 = dockerConfig
+	}
+	dockerConfig, err = probeCredentialHelpers(ctx, opts.DockerConfigBase64, probeOpts.registryAuth, probeOpts.executor != nil, opts.CacheRepo, builderImage)
+	if err != nil {
+		return result, fmt.Errorf("unable to get registry credentials: %w", err)
+	}
+	// Credentials from the registry credential process take precedence.
+	dockerConfig, err = dockerConfigWithProcessCredentials(ctx, dockerConfig, probeOpts.registryAuth.credentials, opts.CacheRepo, builderImage)
+	if err != nil {
+		return result, fmt.Errorf("unable to get registry credentials: %w", err)
+	}
+	// Cloud credentials are only used for registries without any others.
+	dockerConfig, err = dockerConfigWithCloudCredentials(ctx, dockerConfig, probeOpts.registryAuth.cloud, opts.CacheRepo, builderImage)
+	if err != nil {
+		return result, fmt.Errorf("unable to get registry credentials: %w", err)
+	}
+	opts.DockerConfigBase64 = dockerConfig
+
+	// The cache repo is accessed with the same credentials as kaniko would.
+	cacheRepoKeychain, err := dockerConfigKeychain(opts.DockerConfigBase64)
+	if err != nil {
+		return result, err
+	}
+	cacheRepoKeychain = authn.NewMultiKeychain(cacheRepoKeychain, probeOpts.registryAuth.keychain())
+	cacheRepoOpts := []remote.Option{
+		remote.WithTransport(tr),
+		remote.WithAuthFromKeychain(cacheRepoKeychain),
+	}
+	builderOpts := []remote.Option{remote.WithTransport(tr), remote.WithAuthFromKeychain(probeOpts.registryAuth.keychain())}
+	if probeOpts.platform != nil {
+		cacheRepoOpts = append(cacheRepoOpts, remote.WithPlatform(*probeOpts.platform))
+		builderOpts = append(builderOpts, remote.WithPlatform(*probeOpts.platform))
+	}
+
+	// Tag the cached image once it is found, if requested. Failing to tag it
+	// does not fail the probe.
+	if probeOpts.cacheTag != "" {
+		defer func() {
+			if err != nil || result.image == nil || result.candidateTag != "" || result.stale {
+				return
+			}
+			progress.setStage("Tagging the cached image")
+			result.cacheTagErr = tagCachedImage(ctx, opts.CacheRepo, probeOpts.cacheTag, opts.Insecure, result.image, cacheRepoOpts...)
+		}()
+	}
+
+	// Resolve the commit of the repository and the digest of the builder
+	// image, which are recorded in the probe metadata and key the probe
+	// result cache. The commit cannot be resolved without listing the refs of
+	// a remote. Failing to resolve them does not fail the probe.
+	var resolveErr error
+	if localRepoPath == "" && probeOpts.sourceDir == "" {
+		progress.setStage("Resolving the commit and the builder image")
+		logf := func(format string, args ...any) {
+			tflog.Debug(ctx, fmt.Sprintf(format, args...))
+		}
+		result.commit, result.builderDigest, resolveErr = resolveProbeInputs(ctx, logf, builderImage, opts, gitTr, cacheRepoOpts...)
+		if resolveErr != nil {
+			tflog.Warn(ctx, "unable to resolve the commit and the builder image", map[string]any{"err": resolveErr})
+		}
+	}
+
+	// Skip the probe if a probe with the same inputs, of the same commit and
+	// with the same builder image found an image before.
+	var resultKey string
+	inputsHash := probeInputsHash(builderImage, probeOpts.platform, opts, probeOpts.devcontainerEnv, probeOpts.devcontainerJSON)
+	// The repository is needed to evaluate a policy, check the registries of
+	// referenced images or the compliance of the base image, so results are
+	// not reused.
+	if probeOpts.resultCache.dir != "" && localRepoPath == "" && probeOpts.sourceDir == "" && resolveErr == nil && !probeOpts.policy.enabled() && len(probeOpts.allowedRegistries) == 0 && !probeOpts.compliance.enabled() {
+		progress.setStage("Checking the probe result cache")
+		resultKey = probeOpts.resultCache.key(inputsHash, result.commit, result.builderDigest)
+		if entry, ok := probeOpts.resultCache.get(resultKey, time.Now()); ok {
+			cached, err := entry.result(ctx, opts.CacheRepo, cacheRepoOpts...)
+			if err == nil {
+				tflog.Info(ctx, "using cached probe result", map[string]any{"digest": entry.Digest, "stored_at": entry.StoredAt})
+				cached.commit, cached.builderDigest = result.commit, result.builderDigest
+				return cached, nil
+			}
+			tflog.Info(ctx, "cached probe result is stale, probing", map[string]any{"err": err})
+			probeOpts.resultCache.remove(resultKey)
+		}
 	}
+
 	// Use the temporary directory as our 'magic dir'.
 	opts.MagicDirBase = tmpKanikoDir
 
+	// Probe the devcontainer.json given in place of the one in the
+	// repository. It is written outside of the workspace, which is cloned
+	// into, and is in the scratch directory that executors mount.
+	if probeOpts.devcontainerJSON != "" {
+		devcontainerPath := filepath.Join(tmpDir, "devcontainer.json")
+		if err := os.WriteFile(devcontainerPath, []byte(probeOpts.devcontainerJSON), 0o644); err != nil {
+			return result, fmt.Errorf("failed to write devcontainer_json_content: %w", err)
+		}
+		opts.DevcontainerJSONPath = devcontainerPath
+	}
+
 	// In order to correctly reproduce the final layer of the cached image, we
 	// need the envbuilder binary used to originally build the image!
-	envbuilderPath := filepath.Join(tmpDir, "envbuilder")
-	if err := imgutil.ExtractEnvbuilderFromImage(ctx, builderImage, envbuilderPath); err != nil {
-		tflog.Error(ctx, "failed to fetch envbuilder binary from builder image", map[string]any{"err": err})
-		return nil, fmt.Errorf("failed to fetch the envbuilder binary from the builder image: %s", err.Error())
+	// Executors that run the builder image as is use its own binary.
+	var envbuilderPath string
+	if probeOpts.executor == nil || probeOpts.executor.needsEnvbuilderBinary() {
+		envbuilderPath = filepath.Join(tmpDir, "envbuilder")
+		progress.setStage("Fetching envbuilder from " + builderImage)
+		if err := probeOpts.session.extractEnvbuilder(ctx, builderImage, envbuilderPath, builderOpts...); err != nil {
+			tflog.Error(ctx, "failed to fetch envbuilder binary from builder image", map[string]any{"err": err})
+			return result, fmt.Errorf("failed to fetch the envbuilder binary from the builder image: %s", err.Error())
+		}
+		opts.BinaryPath = envbuilderPath
 	}
-	opts.BinaryPath = envbuilderPath
 
 	// We need a filesystem to work with.
 	opts.Filesystem = osfs.New("/")
@@ -491,33 +2367,183 @@ func runCacheProbe(ctx context.Context, builderImage string, opts eboptions.Opti
 	// We always want to get the cached image.
 	opts.GetCachedImage = true
 	// Log to the Terraform logger.
-	opts.Logger = tfutil.TFLogFunc(ctx)
+	var missing missingLayers
+	opts.Logger = bundle.logFunc(missing.logFunc(progress.logFunc(tfutil.TFLogFunc(ctx))))
+
+	// Variables in devcontainer_resolved resolve to the workspace folder of
+	// the build, rather than that of the probe.
+	buildWorkspaceFolder := opts.WorkspaceFolder
+	if buildWorkspaceFolder == "" {
+		buildWorkspaceFolder = eboptions.DefaultWorkspaceFolder(opts.GitURL)
+	}
 
 	// We don't require users to set a workspace folder, but maybe there's a
 	// reason someone may need to.
 	if opts.WorkspaceFolder == "" {
 		opts.WorkspaceFolder = filepath.Join(tmpDir, "workspace")
 		if err := os.MkdirAll(opts.WorkspaceFolder, 0o755); err != nil {
-			return nil, fmt.Errorf("failed to create workspace folder: %w", err)
+			return result, fmt.Errorf("failed to create workspace folder: %w", err)
 		}
 		tflog.Debug(ctx, "workspace_folder not specified, using temp dir", map[string]any{"workspace_folder": opts.WorkspaceFolder})
 	}
 
-	// The below options are not relevant and are set to their zero value
-	// explicitly.
-	// They must be set by extra_env to be used in the final builder image.
-	opts.CoderAgentSubsystem = nil
-	opts.CoderAgentToken = ""
-	opts.CoderAgentURL = ""
-	opts.ExportEnvFile = ""
-	opts.InitArgs = ""
-	opts.InitCommand = ""
-	opts.InitScript = ""
-	opts.LayerCacheDir = ""
-	opts.PostStartScriptPath = ""
-	opts.PushImage = false
-	opts.SetupScript = ""
-	opts.SkipRebuild = false
+	// Copy source_dir into the workspace folder, as git_url would be cloned
+	// into it. Envbuilder writes to the build context while probing, so the
+	// directory itself is not used.
+	if probeOpts.sourceDir != "" {
+		progress.setStage("Copying source_dir")
+		if err := copySourceDir(probeOpts.sourceDir, opts.WorkspaceFolder); err != nil {
+			return result, fmt.Errorf("failed to copy source_dir: %w", err)
+		}
+	}
+
+	clearBuildOnlyOptions(&opts)
+
+	// In remote repo build mode, the probe already performs a shallow,
+	// single-branch clone. A blobless or path-limited partial clone is not
+	// possible: go-git does not support partial clone filters, and the
+	// contents of the whole build context are needed to compute the cache
+	// keys of COPY and ADD instructions.
+	//
+	// Envbuilder and kaniko use state of the whole process, so only one
+	// probe runs them at a time, unless they run in a subprocess or a
+	// container.
+	result.image, err = func() (v1.Image, error) {
+		if probeOpts.executor != nil {
+			return probeOpts.executor.run(ctx, remoteProbe{
+				builderImage:     builderImage,
+				envbuilderPath:   envbuilderPath,
+				scratchDir:       tmpDir,
+				magicDir:         tmpKanikoDir,
+				opts:             opts,
+				devcontainerEnv:  probeOpts.devcontainerEnv,
+				devcontainerJSON: probeOpts.devcontainerJSON,
+				hostAliases:      netOpts.HostAliases,
+			}, cacheRepoOpts...)
+		}
+		// The repository is cloned from the clone of an earlier probe of the
+		// session, if there is one.
+		opts := opts
+		opts.GitURL = probeOpts.session.gitURL(opts.GitURL)
+		if probeOpts.subprocess {
+			return runEnvbuilderSubprocess(ctx, opts, tmpKanikoDir, probeOpts, cacheRepoOpts...)
+		}
+		progress.setStage("Waiting for other cache probes to run envbuilder")
+		unlockEnv, err := lockProbeEnv(ctx, tmpKanikoDir, probeOpts.devcontainerEnv)
+		if err != nil {
+			return nil, err
+		}
+		// Deferred so that the environment is restored if the probe panics.
+		defer unlockEnv()
+		// Kaniko and go-git only use the default HTTP transport, so we need
+		// to swap it out while envbuilder runs.
+		restoreTransport, err := netutil.Install(ctx, tr, gitTr)
+		if err != nil {
+			return nil, err
+		}
+		defer restoreTransport()
+		tflog.Debug(ctx, "running envbuilder", map[string]any{"kaniko_dir": tmpKanikoDir})
+		return envbuilder.RunCacheProbe(ctx, opts)
+	}()
+	result.missingLayers = missing.list()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("cache probe cancelled: %w", context.Cause(ctx))
+	}
 
-	return envbuilder.RunCacheProbe(ctx, opts)
+	// The repository is left in place by the probe, so we can inspect it.
+	workspaceFolder := probeWorkspaceFolder(opts, tmpKanikoDir)
+	if probeOpts.executor == nil && localRepoPath == "" && probeOpts.sourceDir == "" {
+		probeOpts.session.keepRepo(ctx, workspaceFolder)
+	}
+	// The devcontainer is read whether or not the image was found, as
+	// unpinned features are a common cause of cache misses.
+	result.devcontainer = readProbedDevcontainer(workspaceFolder, opts)
+	dockerfile, user, dockerfileErr := compileDockerfile(workspaceFolder, filepath.Join(tmpDir, "compile"), opts)
+	if dockerfileErr != nil {
+		tflog.Debug(ctx, "unable to compile the Dockerfile", map[string]any{"err": dockerfileErr})
+	}
+	result.dockerfile = dockerfile
+	result.devcontainer.resolved = resolveDevcontainer(workspaceFolder, opts, buildWorkspaceFolder, probeOpts.lookupDevcontainerEnv, user)
+	if err != nil {
+		err = classifyProbeError(err, workspaceFolder, opts)
+		var configErr *probeConfigError
+		var accessErr *probeAccessError
+		if errors.As(err, &configErr) || errors.As(err, &accessErr) {
+			return result, err
+		}
+	}
+	// Referenced images are checked before any image is accepted, including
+	// those fallen back to. If they cannot be determined, neither can the
+	// image be built.
+	if len(probeOpts.allowedRegistries) > 0 {
+		source, images, refErr := referencedImages(workspaceFolder, opts)
+		if refErr != nil {
+			tflog.Debug(ctx, "unable to determine referenced images", map[string]any{"err": refErr})
+		} else if err := probeOpts.allowedRegistries.check(source, images...); err != nil {
+			return result, err
+		}
+	}
+	// The labels of the base image are checked for any image, as the image
+	// is either built from it or would have been.
+	if probeOpts.compliance.enabled() {
+		progress.setStage("Checking the compliance of the base image")
+		baseImage, baseErr := findBaseImage(workspaceFolder, opts)
+		result.compliance = probeOpts.compliance.check(ctx, baseImage, baseErr, cacheRepoOpts...)
+	}
+	// The policy is evaluated before any image is accepted, including those
+	// fallen back to.
+	if probeOpts.policy.enabled() {
+		progress.setStage("Evaluating the policy")
+		input, inputErr := newPolicyInput(workspaceFolder, result.gitURL, opts, result.devcontainer)
+		if inputErr != nil {
+			return result, fmt.Errorf("read the devcontainer for the policy: %w", inputErr)
+		}
+		policyResult, policyErr := probeOpts.policy.evaluate(ctx, input)
+		if policyErr != nil {
+			return result, fmt.Errorf("evaluate the policy: %w", policyErr)
+		}
+		result.policy = &policyResult
+		if len(policyResult.deny) > 0 && probeOpts.policy.denies() {
+			return result, errors.New("the devcontainer was denied by the policy")
+		}
+	}
+	if err != nil {
+		// Fall back to the image last found with the same inputs, then to
+		// the first candidate that exists. Their base images are not known,
+		// and they are not stored in the probe result cache as they are not
+		// the image the inputs would produce.
+		fallback := &probeFallback{
+			cacheRepo:  opts.CacheRepo,
+			insecure:   opts.Insecure,
+			inputsHash: inputsHash,
+			keychain:   cacheRepoKeychain,
+		}
+		if probeOpts.deferFallback {
+			result.fallback = fallback
+			return result, err
+		}
+		if probeOpts.staleFallback || len(probeOpts.candidateTags) > 0 {
+			progress.setStage("Checking for an image to fall back to")
+		}
+		for _, stale := range []bool{true, false} {
+			if fallback.apply(ctx, probeOpts, stale, &result) {
+				return result, nil
+			}
+		}
+		return result, err
+	}
+	result.baseImage, err = findBaseImage(workspaceFolder, opts)
+	if err != nil {
+		tflog.Debug(ctx, "unable to determine base image", map[string]any{"err": err})
+	}
+	if resultKey != "" {
+		entry, err := newProbeResultCacheEntry(result, inputsHash, time.Now())
+		if err == nil {
+			err = probeOpts.resultCache.put(resultKey, entry)
+		}
+		if err != nil {
+			tflog.Warn(ctx, "unable to store the probe result", map[string]any{"err": err})
+		}
+	}
+	return result, nil
 }
@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+var _ resource.ResourceWithMoveState = &CachedImageResource{}
+
+// MoveState allows moving cached image resources managed by another provider
+// address, such as a fork or a registry mirror, or by a release with a
+// different schema, into this resource with a moved block. Forks may have
+// another name, so any resource type named *_cached_image is accepted.
+// Data sources have no state, and cannot be the source of a moved block.
+func (r *CachedImageResource) MoveState(ctx context.Context) []resource.StateMover {
+	return []resource.StateMover{
+		{
+			// No source schema: the state is decoded from the raw state,
+			// so that it may have been written with any schema.
+			StateMover: r.moveCachedImageState,
+		},
+	}
+}
+
+func (r *CachedImageResource) moveCachedImageState(ctx context.Context, req resource.MoveStateRequest, resp *resource.MoveStateResponse) {
+	// Leave other resource types to other state movers, if any.
+	if !strings.HasSuffix(req.SourceTypeName, "_cached_image") {
+		return
+	}
+	if req.SourceRawState == nil {
+		resp.Diagnostics.AddError("Unable to move resource state",
+			"The source resource state is missing. Please report this issue to the provider developers.",
+		)
+		return
+	}
+
+	var schemaResp resource.SchemaResponse
+	r.Schema(ctx, resource.SchemaRequest{}, &schemaResp)
+	resp.Diagnostics.Append(schemaResp.Diagnostics...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Attributes that no longer exist are dropped, and attributes that did
+	// not exist yet are null.
+	raw, err := req.SourceRawState.UnmarshalWithOpts(schemaResp.Schema.Type().TerraformType(ctx), tfprotov6.UnmarshalOpts{
+		ValueFromJSONOpts: tftypes.ValueFromJSONOpts{
+			IgnoreUndefinedAttributes: true,
+		},
+	})
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to move resource state",
+			fmt.Sprintf("The state of the %s resource from %s could not be decoded: %s", req.SourceTypeName, req.SourceProviderAddress, err),
+		)
+		return
+	}
+
+	// Outputs that the source did not have are set to the zero value of
+	// their type, as Create would for an image that was not found, and
+	// those derived from other attributes are then set as Create would.
+	// The environment is recomputed on the next refresh.
+	raw, missing, err := fillMissingOutputs(ctx, schemaResp.Schema, raw)
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to move resource state",
+			fmt.Sprintf("The state of the %s resource from %s could not be decoded: %s", req.SourceTypeName, req.SourceProviderAddress, err),
+		)
+		return
+	}
+
+	var data CachedImageResourceModel
+	resp.Diagnostics.Append(tfsdk.State{Schema: schemaResp.Schema, Raw: raw}.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if missing["id"] {
+		data.ID = types.StringValue(uuid.Nil.String())
+	}
+	if missing["image"] {
+		data.Image = data.BuilderImage
+	}
+	if missing["exists"] {
+		data.Exists = types.BoolValue(!data.Image.Equal(data.BuilderImage))
+	}
+	if missing["customizations"] {
+		data.Customizations = types.StringValue("{}")
+	}
+	if missing["devcontainer_resolved"] {
+		data.DevcontainerResolved = types.StringValue("{}")
+	}
+	if missing["cache_repo_used"] && data.Exists.ValueBool() {
+		data.CacheRepoUsed = types.StringValue(data.cacheRepo())
+	}
+	if missing["image_registry"] {
+		data.setImageReference()
+	}
+	if missing["git_url_used"] {
+		data.GitURLUsed = data.GitURL
+	}
+	if missing["git_url_canonical"] {
+		data.GitURLCanonical = data.GitURL
+		if gitURL, err := normalizeGitURL(data.GitURL.ValueString()); err == nil {
+			data.GitURLCanonical = types.StringValue(gitURL)
+		}
+	}
+
+	resp.Diagnostics.Append(resp.TargetState.Set(ctx, &data)...)
+}
+
+// fillMissingOutputs returns state with the computed attributes of s that
+// are null, and cannot be set in the configuration, set to the zero value of
+// their type. It also returns the names of those attributes.
+func fillMissingOutputs(ctx context.Context, s schema.Schema, state tftypes.Value) (tftypes.Value, map[string]bool, error) {
+	var values map[string]tftypes.Value
+	if err := state.As(&values); err != nil {
+		return state, nil, err
+	}
+	missing := make(map[string]bool)
+	for name, a := range s.Attributes {
+		if !a.IsComputed() || a.IsOptional() || !values[name].IsNull() {
+			continue
+		}
+		values[name] = zeroValue(a.GetType().TerraformType(ctx))
+		missing[name] = true
+	}
+	return tftypes.NewValue(state.Type(), values), missing, nil
+}
+
+// zeroValue returns the zero value of typ: an empty string or collection,
+// false, 0, or an object of zero values. Other types are null.
+func zeroValue(typ tftypes.Type) tftypes.Value {
+	switch t := typ.(type) {
+	case tftypes.List:
+		return tftypes.NewValue(t, []tftypes.Value{})
+	case tftypes.Set:
+		return tftypes.NewValue(t, []tftypes.Value{})
+	case tftypes.Map:
+		return tftypes.NewValue(t, map[string]tftypes.Value{})
+	case tftypes.Object:
+		values := make(map[string]tftypes.Value, len(t.AttributeTypes))
+		for name, attrType := range t.AttributeTypes {
+			values[name] = zeroValue(attrType)
+		}
+		return tftypes.NewValue(t, values)
+	}
+	switch {
+	case typ.Is(tftypes.String):
+		return tftypes.NewValue(typ, "")
+	case typ.Is(tftypes.Bool):
+		return tftypes.NewValue(typ, false)
+	case typ.Is(tftypes.Number):
+		return tftypes.NewValue(typ, 0)
+	}
+	return tftypes.NewValue(typ, nil)
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedImageResourceMoveState(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	r := &CachedImageResource{}
+	var schemaResp resource.SchemaResponse
+	r.Schema(ctx, resource.SchemaRequest{}, &schemaResp)
+	require.False(t, schemaResp.Diagnostics.HasError())
+
+	for _, tc := range []struct {
+		name           string
+		sourceTypeName string
+		rawState       string
+		expectMoved    bool
+		expectErr      bool
+		expectImage    string
+		expectExists   bool
+	}{
+		{
+			name:           "older schema",
+			sourceTypeName: "envbuilder_cached_image",
+			// removed_attribute does not exist in the current schema, and
+			// attributes added since are missing.
+			rawState: `{
+				"builder_image": "envbuilder:latest",
+				"cache_repo": "localhost:5000/cache",
+				"git_url": "https://git.local/repo.git",
+				"id": "sha256:deadbeef",
+				"image": "localhost:5000/cache@sha256:deadbeef",
+				"exists": true,
+				"removed_attribute": "value"
+			}`,
+			expectMoved:  true,
+			expectImage:  "localhost:5000/cache@sha256:deadbeef",
+			expectExists: true,
+		},
+		{
+			name:           "missing outputs",
+			sourceTypeName: "envbuilder_cached_image",
+			rawState: `{
+				"builder_image": "envbuilder:latest",
+				"cache_repo": "localhost:5000/cache",
+				"git_url": "https://git.local/repo.git"
+			}`,
+			expectMoved: true,
+			expectImage: "envbuilder:latest",
+		},
+		{
+			name:           "fork",
+			sourceTypeName: "envbuilderfork_cached_image",
+			rawState: `{
+				"builder_image": "envbuilder:latest",
+				"cache_repo": "localhost:5000/cache",
+				"git_url": "https://git.local/repo.git",
+				"image": "localhost:5000/cache@sha256:deadbeef"
+			}`,
+			expectMoved:  true,
+			expectImage:  "localhost:5000/cache@sha256:deadbeef",
+			expectExists: true,
+		},
+		{
+			name:           "other resource type",
+			sourceTypeName: "docker_image",
+			rawState:       `{"name": "ubuntu"}`,
+		},
+		{
+			name:           "invalid state",
+			sourceTypeName: "envbuilder_cached_image",
+			rawState:       `{"git_url": ["not", "a", "string"]}`,
+			expectErr:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			req := resource.MoveStateRequest{
+				SourceProviderAddress: "registry.terraform.io/example/envbuilder",
+				SourceTypeName:        tc.sourceTypeName,
+				SourceRawState:        &tfprotov6.RawState{JSON: []byte(tc.rawState)},
+			}
+			resp := resource.MoveStateResponse{
+				TargetState: tfsdk.State{
+					Schema: schemaResp.Schema,
+					Raw:    tftypes.NewValue(schemaResp.Schema.Type().TerraformType(ctx), nil),
+				},
+			}
+			r.moveCachedImageState(ctx, req, &resp)
+			require.Equal(t, tc.expectErr, resp.Diagnostics.HasError(), resp.Diagnostics)
+			if !tc.expectMoved {
+				assert.True(t, resp.TargetState.Raw.IsNull())
+				return
+			}
+
+			var data CachedImageResourceModel
+			require.False(t, resp.TargetState.Get(ctx, &data).HasError())
+			assert.Equal(t, "https://git.local/repo.git", data.GitURL.ValueString())
+			assert.Equal(t, tc.expectImage, data.Image.ValueString())
+			assert.Equal(t, tc.expectExists, data.Exists.ValueBool())
+			assert.False(t, data.BaseImageUpdated.IsNull())
+
+			// No output is left null.
+			var values map[string]tftypes.Value
+			require.NoError(t, resp.TargetState.Raw.As(&values))
+			for name, a := range schemaResp.Schema.Attributes {
+				if a.IsComputed() && !a.IsOptional() {
+					assert.False(t, values[name].IsNull(), name)
+				}
+			}
+		})
+	}
+}
@@ -2,12 +2,19 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/uuid"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/plancheck"
+	"github.com/stretchr/testify/require"
 )
 
 // testEnvValue is a multi-line environment variable value that we use in
@@ -274,6 +281,20 @@ RUN date > /date.txt`,
 							resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
 							resource.TestCheckResourceAttrSet("envbuilder_cached_image.test", "image"),
 							resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "image", quotedPrefix(deps.CacheRepo)),
+							resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "image_digest", quotedPrefix("sha256:")),
+							resource.TestCheckResourceAttr("envbuilder_cached_image.test", "image_tag", ""),
+							resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "layer_count", func(value string) error {
+								if value == "0" {
+									return errors.New("expected a non-zero layer count")
+								}
+								return nil
+							}),
+							resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "image_size_bytes", func(value string) error {
+								if value == "0" {
+									return errors.New("expected a non-zero image size")
+								}
+								return nil
+							}),
 							// Environment variables
 							tc.assertEnv(t, deps),
 						),
@@ -322,3 +343,194 @@ func assertEnv(t *testing.T, kvs ...string) resource.TestCheckFunc {
 
 	return resource.ComposeAggregateTestCheckFunc(funcs...)
 }
+
+func TestAccCachedImageResourceCandidateTag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	deps := setup(ctx, t, nil, map[string]string{
+		".devcontainer/devcontainer.json": `{"image": "localhost:5000/test-ubuntu:latest"}`,
+	})
+	deps.Attributes = map[string]string{"candidate_tags": `["fallback"]`}
+	candidate := registrytest.WriteRandomImage(t, deps.CacheRepo+":fallback", remote.WithAuth(&authn.Basic{Username: testUsername, Password: testPassword}))
+	candidateDigest, err := candidate.Digest()
+	require.NoError(t, err)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			// 1) The cached image is not found, so the candidate is used.
+			// It is probed for again on refresh.
+			{
+				Config: deps.Config(t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "candidate_tag", "fallback"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "id", candidateDigest.String()),
+				),
+				ExpectNonEmptyPlan: true,
+			},
+			// 2) Once the cached image is built, it replaces the candidate.
+			{
+				PreConfig: func() {
+					seedCache(ctx, t, deps)
+				},
+				Config: deps.Config(t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "candidate_tag", ""),
+					resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "id", func(value string) error {
+						if value == candidateDigest.String() {
+							return errors.New("expected the cached image rather than the candidate")
+						}
+						return nil
+					}),
+				),
+			},
+			// 3) Should produce an empty plan after apply
+			{
+				Config:   deps.Config(t),
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+func TestAccCachedImageResourceStaleFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	deps := setup(ctx, t, nil, map[string]string{
+		".devcontainer/devcontainer.json": `{"build": {"dockerfile": "Dockerfile"}}`,
+		".devcontainer/Dockerfile":        "FROM localhost:5000/test-ubuntu:latest\nRUN date > /date.txt",
+	})
+	deps.Attributes = map[string]string{"stale_fallback": "true"}
+	deps.ProviderAttributes = map[string]string{"probe_result_cache_dir": quote(t.TempDir())}
+	var staleDigest string
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			// 1) The cached image is found, and stored in the probe result
+			// cache.
+			{
+				PreConfig: func() {
+					seedCache(ctx, t, deps)
+				},
+				Config: deps.Config(t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "stale", "false"),
+					resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "id", func(value string) error {
+						staleDigest = value
+						return nil
+					}),
+				),
+			},
+			// 2) The Dockerfile changes in a new commit, so the image found
+			// before is used as a stale image once the resource is probed
+			// again. It is probed for again on refresh.
+			{
+				PreConfig: func() {
+					gittest.Commit(t, deps.Repo.Dir, "change Dockerfile", map[string]string{
+						".devcontainer/Dockerfile": "FROM localhost:5000/test-ubuntu:latest\nRUN date > /date2.txt",
+					})
+				},
+				Taint:  []string{"envbuilder_cached_image.test"},
+				Config: deps.Config(t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "stale", "true"),
+					resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "id", func(value string) error {
+						if value != staleDigest {
+							return fmt.Errorf("expected the stale image %s, got %s", staleDigest, value)
+						}
+						return nil
+					}),
+				),
+				ExpectNonEmptyPlan: true,
+			},
+			// 3) Once the cached image of the new commit is built, it
+			// replaces the stale image.
+			{
+				PreConfig: func() {
+					seedCache(ctx, t, deps)
+				},
+				Config: deps.Config(t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "stale", "false"),
+					resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "id", func(value string) error {
+						if value == staleDigest {
+							return errors.New("expected the cached image of the new commit rather than the stale image")
+						}
+						return nil
+					}),
+				),
+			},
+			// 4) Should produce an empty plan after apply
+			{
+				Config:   deps.Config(t),
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+func TestAccCachedImageResourceUpdateInPlace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	deps := setup(ctx, t, nil, map[string]string{
+		".devcontainer/devcontainer.json": `{"image": "localhost:5000/test-ubuntu:latest"}`,
+	})
+	pushed := deps
+	pushed.Attributes = map[string]string{"push_image": "true"}
+	var cachedDigest string
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			// 1) The cached image is found.
+			{
+				PreConfig: func() {
+					seedCache(ctx, t, deps)
+				},
+				Config: deps.Config(t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckNoResourceAttr("envbuilder_cached_image.test", "env_map.ENVBUILDER_PUSH_IMAGE"),
+					resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "id", func(value string) error {
+						cachedDigest = value
+						return nil
+					}),
+				),
+			},
+			// 2) Options that only affect the computed environment update
+			// it in place, without probing again.
+			{
+				Config: pushed.Config(t),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("envbuilder_cached_image.test", plancheck.ResourceActionUpdate),
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "exists", "true"),
+					resource.TestCheckResourceAttr("envbuilder_cached_image.test", "env_map.ENVBUILDER_PUSH_IMAGE", "true"),
+					resource.TestCheckResourceAttrWith("envbuilder_cached_image.test", "id", func(value string) error {
+						if value != cachedDigest {
+							return fmt.Errorf("expected the cached image %s, got %s", cachedDigest, value)
+						}
+						return nil
+					}),
+				),
+			},
+			// 3) Should produce an empty plan after apply
+			{
+				Config:   pushed.Config(t),
+				PlanOnly: true,
+			},
+		},
+	})
+}
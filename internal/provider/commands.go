@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/provider"
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/hashicorp/terraform-plugin-log/tflogtest"
+)
+
+const cachedImageTypeName = "envbuilder_cached_image"
+
+// Diagnostic is a diagnostic returned by the provider outside of
+// Terraform, by a subcommand of the provider binary or by RunProbe and
+// ComputeEnv.
+type Diagnostic struct {
+	Severity  string `json:"severity"`
+	Summary   string `json:"summary"`
+	Detail    string `json:"detail,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+}
+
+// commandInput is the input of a subcommand of the provider binary: the
+// configuration of an envbuilder_cached_image resource and of the provider,
+// as JSON objects with the same attributes as in Terraform.
+type commandInput struct {
+	config         []byte
+	providerConfig []byte
+}
+
+// parseCommandArgs parses the arguments of the subcommand name, which is
+// described by description, and reads the configurations. The returned
+// context logs to stderr if requested. It returns false if the command
+// should exit with code 2.
+func parseCommandArgs(ctx context.Context, name, description string, args []string, stdin io.Reader, stderr io.Writer) (context.Context, commandInput, bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: terraform-provider-envbuilder %s -config <file> [-provider-config <file>] [-log]\n\n", name)
+		_, _ = fmt.Fprintln(stderr, description)
+		_, _ = fmt.Fprintln(stderr, "The configuration files contain the attributes of an envbuilder_cached_image resource and of the provider")
+		_, _ = fmt.Fprintln(stderr, `as JSON objects, for example {"builder_image": "...", "cache_repo": "...", "git_url": "..."}. Use "-" to read from stdin.`)
+		_, _ = fmt.Fprintln(stderr)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "", "Path to the resource configuration.")
+	providerConfigPath := flags.String("provider-config", "", "Path to the provider configuration. If not set, the defaults of the provider are used.")
+	logToStderr := flags.Bool("log", false, "Write the provider logs to stderr as JSON.")
+	if err := flags.Parse(args); err != nil {
+		return ctx, commandInput{}, false
+	}
+	if *configPath == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return ctx, commandInput{}, false
+	}
+
+	readJSON := func(path string) ([]byte, error) {
+		if path == "-" {
+			return io.ReadAll(stdin)
+		}
+		return os.ReadFile(path)
+	}
+	var in commandInput
+	var err error
+	if in.config, err = readJSON(*configPath); err != nil {
+		_, _ = fmt.Fprintf(stderr, "read resource configuration: %s\n", err)
+		return ctx, commandInput{}, false
+	}
+	in.providerConfig = []byte("{}")
+	if *providerConfigPath != "" {
+		if in.providerConfig, err = readJSON(*providerConfigPath); err != nil {
+			_, _ = fmt.Fprintf(stderr, "read provider configuration: %s\n", err)
+			return ctx, commandInput{}, false
+		}
+	}
+	if *logToStderr {
+		ctx = tflogtest.RootLogger(ctx, stderr)
+	}
+	return ctx, in, true
+}
+
+// writeCommandOutput writes out as indented JSON to stdout. It returns false
+// if it cannot be written.
+func writeCommandOutput(out any, stdout, stderr io.Writer) bool {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		_, _ = fmt.Fprintf(stderr, "write output: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// commandSession drives the provider through the plugin protocol, as
+// Terraform would, for a subcommand of the provider binary.
+type commandSession struct {
+	server       tfprotov6.ProviderServer
+	resourceType tftypes.Type
+	// config and providerConfig are the decoded configurations.
+	config         tftypes.Value
+	providerConfig tftypes.Value
+	configValue    *tfprotov6.DynamicValue
+	// diagnostics are the diagnostics returned so far.
+	diagnostics []Diagnostic
+}
+
+// newCommandSession validates in and configures the provider. It returns
+// false if there are error diagnostics. An error is returned if the
+// configurations cannot be decoded.
+func newCommandSession(ctx context.Context, version string, in commandInput) (*commandSession, bool, error) {
+	server, err := providerserver.NewProtocol6WithError(New(version)())()
+	if err != nil {
+		return nil, false, err
+	}
+	s := &commandSession{server: server, diagnostics: []Diagnostic{}}
+
+	schemaResp, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		return nil, false, err
+	}
+	if s.addDiags(schemaResp.Diagnostics) {
+		return s, false, nil
+	}
+	resourceSchema := schemaResp.ResourceSchemas[cachedImageTypeName]
+	s.resourceType = resourceSchema.ValueType()
+	var providerValue *tfprotov6.DynamicValue
+	var diags []*tfprotov6.Diagnostic
+	s.providerConfig, providerValue, diags, err = decodeJSONConfig(in.providerConfig, schemaResp.Provider)
+	if err != nil {
+		return nil, false, fmt.Errorf("decode provider configuration: %w", err)
+	}
+	if s.addDiags(diags) {
+		return s, false, nil
+	}
+	s.config, s.configValue, diags, err = decodeJSONConfig(in.config, resourceSchema)
+	if err != nil {
+		return nil, false, fmt.Errorf("decode resource configuration: %w", err)
+	}
+	if s.addDiags(diags) {
+		return s, false, nil
+	}
+
+	validateProviderResp, err := server.ValidateProviderConfig(ctx, &tfprotov6.ValidateProviderConfigRequest{Config: providerValue})
+	if err != nil {
+		return nil, false, err
+	}
+	if s.addDiags(validateProviderResp.Diagnostics) {
+		return s, false, nil
+	}
+	configureResp, err := server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{Config: providerValue})
+	if err != nil {
+		return nil, false, err
+	}
+	if s.addDiags(configureResp.Diagnostics) {
+		return s, false, nil
+	}
+	validateResp, err := server.ValidateResourceConfig(ctx, &tfprotov6.ValidateResourceConfigRequest{
+		TypeName: cachedImageTypeName,
+		Config:   s.configValue,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if s.addDiags(validateResp.Diagnostics) {
+		return s, false, nil
+	}
+	return s, true, nil
+}
+
+// decode returns the provider data and the resource model of the
+// configurations of the session, which must be valid, as the provider and
+// resource would get them from Terraform.
+func (s *commandSession) decode(ctx context.Context, version string) (*providerData, CachedImageResourceModel, error) {
+	p := &EnvbuilderProvider{version: version}
+	var providerSchemaResp provider.SchemaResponse
+	p.Schema(ctx, provider.SchemaRequest{}, &providerSchemaResp)
+	var configureResp provider.ConfigureResponse
+	p.Configure(ctx, provider.ConfigureRequest{
+		Config: tfsdk.Config{Schema: providerSchemaResp.Schema, Raw: s.providerConfig},
+	}, &configureResp)
+	if configureResp.Diagnostics.HasError() {
+		return nil, CachedImageResourceModel{}, fmt.Errorf("configure provider: %v", configureResp.Diagnostics)
+	}
+	pd, _ := configureResp.ResourceData.(*providerData)
+
+	var schemaResp resource.SchemaResponse
+	(&CachedImageResource{}).Schema(ctx, resource.SchemaRequest{}, &schemaResp)
+	var data CachedImageResourceModel
+	if diags := (tfsdk.Config{Schema: schemaResp.Schema, Raw: s.config}).Get(ctx, &data); diags.HasError() {
+		return nil, CachedImageResourceModel{}, fmt.Errorf("decode resource configuration: %v", diags)
+	}
+	return pd, data, nil
+}
+
+// addDiags adds diags to the session, and returns whether any are errors.
+func (s *commandSession) addDiags(diags []*tfprotov6.Diagnostic) bool {
+	hasError := false
+	for _, d := range diags {
+		cd := Diagnostic{Severity: d.Severity.String(), Summary: d.Summary, Detail: d.Detail}
+		if d.Attribute != nil {
+			cd.Attribute = d.Attribute.String()
+		}
+		s.diagnostics = append(s.diagnostics, cd)
+		hasError = hasError || d.Severity == tfprotov6.DiagnosticSeverityError
+	}
+	return hasError
+}
+
+// addFrameworkDiags adds diags returned by the provider outside of the plugin
+// protocol to the session, and returns whether any are errors.
+func (s *commandSession) addFrameworkDiags(diags diag.Diagnostics) bool {
+	for _, d := range diags {
+		cd := Diagnostic{Severity: tfprotov6.DiagnosticSeverityWarning.String(), Summary: d.Summary(), Detail: d.Detail()}
+		if d.Severity() == diag.SeverityError {
+			cd.Severity = tfprotov6.DiagnosticSeverityError.String()
+		}
+		if d, ok := d.(diag.DiagnosticWithPath); ok {
+			cd.Attribute = attributePath(d.Path()).String()
+		}
+		s.diagnostics = append(s.diagnostics, cd)
+	}
+	return diags.HasError()
+}
+
+// attributePath converts p to the form in which the plugin protocol reports
+// attribute paths.
+func attributePath(p path.Path) *tftypes.AttributePath {
+	ap := tftypes.NewAttributePath()
+	for _, step := range p.Steps() {
+		switch step := step.(type) {
+		case path.PathStepAttributeName:
+			ap = ap.WithAttributeName(string(step))
+		case path.PathStepElementKeyInt:
+			ap = ap.WithElementKeyInt(int(step))
+		case path.PathStepElementKeyString:
+			ap = ap.WithElementKeyString(string(step))
+		}
+	}
+	return ap
+}
+
+// hasErrors returns whether any of diags are errors.
+func hasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == tfprotov6.DiagnosticSeverityError.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSONConfig decodes the JSON object data as a value of the type of
+// schema. Attributes that are not set are null. As Terraform would, errors
+// are returned for required attributes that are not set, as the provider
+// does not check them itself.
+func decodeJSONConfig(data []byte, schema *tfprotov6.Schema) (tftypes.Value, *tfprotov6.DynamicValue, []*tfprotov6.Diagnostic, error) {
+	typ := schema.ValueType()
+	val, err := tftypes.ValueFromJSON(data, typ)
+	if err != nil {
+		return tftypes.Value{}, nil, nil, err
+	}
+	var attrs map[string]tftypes.Value
+	if err := val.As(&attrs); err != nil {
+		return tftypes.Value{}, nil, nil, err
+	}
+	var diags []*tfprotov6.Diagnostic
+	for _, attr := range schema.Block.Attributes {
+		if attr.Required && attrs[attr.Name].IsNull() {
+			diags = append(diags, &tfprotov6.Diagnostic{
+				Severity:  tfprotov6.DiagnosticSeverityError,
+				Summary:   "Missing required argument",
+				Detail:    fmt.Sprintf("The argument %q is required, but no definition was found.", attr.Name),
+				Attribute: tftypes.NewAttributePath().WithAttributeName(attr.Name),
+			})
+		}
+	}
+	dv, err := tfprotov6.NewDynamicValue(typ, val)
+	if err != nil {
+		return tftypes.Value{}, nil, nil, err
+	}
+	return val, &dv, diags, nil
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/envbuilder/devcontainer"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+// envbuilderWorkingDir is the working directory of envbuilder when it builds
+// a workspace, which features are extracted to.
+const envbuilderWorkingDir = "/.envbuilder"
+
+// compileDockerfile returns the Dockerfile that envbuilder builds for the
+// devcontainer or Dockerfile in workspaceFolder, with the directives of
+// devcontainer features added. It follows the same rules as envbuilder,
+// which does not expose the Dockerfile it compiles. Features are extracted
+// to scratchDir, so that the build context is left as the probe found it,
+// and its path is replaced with the one envbuilder extracts them to when
+// building, so that the result does not differ between probes. The user
+// the devcontainer runs as is also returned, if it is compiled.
+func compileDockerfile(workspaceFolder, scratchDir string, opts eboptions.Options) (dockerfile, user string, err error) {
+	if opts.DockerfilePath != "" {
+		content, err := os.ReadFile(filepath.Join(workspaceFolder, opts.DockerfilePath))
+		if err != nil {
+			return "", "", fmt.Errorf("read Dockerfile: %w", err)
+		}
+		return string(content), "", nil
+	}
+	if err := os.MkdirAll(scratchDir, 0o755); err != nil {
+		return "", "", err
+	}
+
+	// As in envbuilder, a devcontainer.json that is not found or cannot be
+	// parsed falls back to the fallback image.
+	devcontainerPath, devcontainerDir, err := findDevcontainerJSON(workspaceFolder, opts)
+	if errors.Is(err, os.ErrNotExist) {
+		dockerfile, err := fallbackDockerfile(opts)
+		return dockerfile, "", err
+	}
+	if err != nil {
+		return "", "", err
+	}
+	content, err := os.ReadFile(devcontainerPath)
+	if err != nil {
+		return "", "", fmt.Errorf("read devcontainer.json: %w", err)
+	}
+	spec, err := devcontainer.Parse(content)
+	if err != nil {
+		dockerfile, err := fallbackDockerfile(opts)
+		return dockerfile, "", err
+	}
+	var fallbackPath string
+	if !spec.HasImage() && !spec.HasDockerfile() {
+		fallback, err := fallbackDockerfile(opts)
+		if err != nil {
+			return "", "", err
+		}
+		fallbackPath = filepath.Join(scratchDir, "Dockerfile")
+		if err := os.WriteFile(fallbackPath, []byte(fallback), 0o644); err != nil {
+			return "", "", err
+		}
+	}
+	compiled, err := spec.Compile(osfs.New("/"), devcontainerDir, scratchDir, fallbackPath, opts.WorkspaceFolder, false, os.LookupEnv)
+	if err != nil {
+		return "", "", fmt.Errorf("compile devcontainer.json: %w", err)
+	}
+	return strings.ReplaceAll(compiled.DockerfileContent, scratchDir, envbuilderWorkingDir), compiled.User, nil
+}
+
+// fallbackDockerfile returns the Dockerfile envbuilder builds when there is
+// no devcontainer.json or Dockerfile.
+func fallbackDockerfile(opts eboptions.Options) (string, error) {
+	image, err := fallbackBaseImage(opts)
+	if err != nil {
+		return "", err
+	}
+	return "FROM " + image, nil
+}
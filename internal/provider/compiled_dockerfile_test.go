@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileDockerfile(t *testing.T) {
+	t.Parallel()
+
+	// containerUser is set, as the user of the base image is fetched from
+	// the registry otherwise.
+	const (
+		featureJSON    = `{"id": "hello", "version": "1.0.0", "name": "Hello", "options": {"greeting": {"type": "string", "default": "hi"}}}`
+		featureInstall = "#!/bin/sh\necho $GREETING"
+	)
+	for _, tc := range []struct {
+		name           string
+		files          map[string]string
+		opts           eboptions.Options
+		expectContains []string
+		expectErr      bool
+	}{
+		{
+			name: "devcontainer image",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": "ubuntu:22.04", "containerUser": "root"}`,
+			},
+			expectContains: []string{"FROM ubuntu:22.04"},
+		},
+		{
+			name: "devcontainer dockerfile",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"build": {"dockerfile": "Dockerfile"}, "containerUser": "root"}`,
+				".devcontainer/Dockerfile":        "FROM debian:12\nRUN date",
+			},
+			expectContains: []string{"FROM debian:12\nRUN date"},
+		},
+		{
+			name: "features",
+			files: map[string]string{
+				".devcontainer/devcontainer.json":               `{"image": "ubuntu:22.04", "containerUser": "root", "features": {"./hello": {"greeting": "hello"}}}`,
+				".devcontainer/hello/devcontainer-feature.json": featureJSON,
+				".devcontainer/hello/install.sh":                featureInstall,
+			},
+			expectContains: []string{"FROM ubuntu:22.04", "WORKDIR /.envbuilder/features/hello-", `RUN GREETING="hello" _CONTAINER_USER="root"`},
+		},
+		{
+			name: "features on fallback image",
+			files: map[string]string{
+				".devcontainer/devcontainer.json":               `{"containerUser": "root", "features": {"./hello": {}}}`,
+				".devcontainer/hello/devcontainer-feature.json": featureJSON,
+				".devcontainer/hello/install.sh":                featureInstall,
+			},
+			opts:           eboptions.Options{FallbackImage: "alpine:3.20"},
+			expectContains: []string{"FROM alpine:3.20", `GREETING="hi"`},
+		},
+		{
+			name: "dockerfile path",
+			files: map[string]string{
+				"build/Dockerfile": "FROM golang:1.22",
+			},
+			opts:           eboptions.Options{DockerfilePath: "build/Dockerfile"},
+			expectContains: []string{"FROM golang:1.22"},
+		},
+		{
+			name:           "fallback image",
+			opts:           eboptions.Options{FallbackImage: "alpine:3.20"},
+			expectContains: []string{"FROM alpine:3.20"},
+		},
+		{
+			name:      "nothing found",
+			expectErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for path, content := range tc.files {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644))
+			}
+			scratchDir := filepath.Join(t.TempDir(), "compile")
+			dockerfile, _, err := compileDockerfile(dir, scratchDir, tc.opts)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, s := range tc.expectContains {
+				assert.Contains(t, dockerfile, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// licensesLabel is the OCI label holding the SPDX license expression of an
+// image.
+const licensesLabel = "org.opencontainers.image.licenses"
+
+// complianceAttrTypes are the attribute types of the compliance output.
+var complianceAttrTypes = map[string]attr.Type{
+	"checked":    types.BoolType,
+	"compliant":  types.BoolType,
+	"base_image": types.StringType,
+	"labels":     types.MapType{ElemType: types.StringType},
+	"violations": types.ListType{ElemType: types.StringType},
+}
+
+// baseImageCompliance checks the labels of the base image of the probed
+// devcontainer or Dockerfile, configured by base_image_allowed_labels and
+// base_image_denied_labels.
+type baseImageCompliance struct {
+	// allowed maps labels to the values they must have one of.
+	allowed map[string][]string
+	// denied maps labels to values they must not have.
+	denied map[string][]string
+}
+
+// complianceResult is the result of checking the compliance of a base image.
+type complianceResult struct {
+	baseImage  string
+	labels     map[string]string
+	violations []string
+	// err is why the labels of the base image could not be checked, if
+	// they could not.
+	err error
+}
+
+// enabled returns whether any labels are checked.
+func (c baseImageCompliance) enabled() bool {
+	return len(c.allowed) > 0 || len(c.denied) > 0
+}
+
+// check checks the labels of baseImage, which could not be determined if
+// baseErr is set.
+func (c baseImageCompliance) check(ctx context.Context, baseImage string, baseErr error, remoteOpts ...remote.Option) *complianceResult {
+	result := &complianceResult{baseImage: baseImage}
+	if baseErr != nil {
+		result.err = fmt.Errorf("determine base image: %w", baseErr)
+		return result
+	}
+	ref, err := name.ParseReference(baseImage)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	img, err := remote.Image(ref, append(remoteOpts, remote.WithContext(ctx))...)
+	if err != nil {
+		result.err = fmt.Errorf("fetch base image %q: %w", baseImage, err)
+		return result
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		result.err = fmt.Errorf("get config of base image %q: %w", baseImage, err)
+		return result
+	}
+	result.labels = cfg.Config.Labels
+	result.violations = c.violations(result.labels)
+	return result
+}
+
+// violations returns the violations of the allow and deny lists by labels,
+// sorted by label.
+func (c baseImageCompliance) violations(labels map[string]string) []string {
+	var violations []string
+	for label, allowed := range c.allowed {
+		value, ok := labels[label]
+		if !ok {
+			violations = append(violations, fmt.Sprintf("Label %q is not set, but must be one of %s.", label, quoteList(allowed)))
+			continue
+		}
+		for _, v := range labelValues(label, value) {
+			if !slices.Contains(allowed, v) {
+				violations = append(violations, fmt.Sprintf("Label %q has value %q, which is not one of %s.", label, v, quoteList(allowed)))
+			}
+		}
+	}
+	for label, denied := range c.denied {
+		value, ok := labels[label]
+		if !ok {
+			continue
+		}
+		for _, v := range labelValues(label, value) {
+			if slices.Contains(denied, v) {
+				violations = append(violations, fmt.Sprintf("Label %q has denied value %q.", label, v))
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// labelValues returns the values in the value of label. The licenses label
+// holds an SPDX license expression, whose license identifiers are each
+// checked; other labels hold a single value.
+func labelValues(label, value string) []string {
+	if label != licensesLabel {
+		return []string{value}
+	}
+	var values []string
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(value))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "AND", "OR":
+		case "WITH":
+			// License exceptions are not licenses.
+			i++
+		default:
+			values = append(values, fields[i])
+		}
+	}
+	return values
+}
+
+// labelLists returns the map of labels to lists of values m.
+func labelLists(m types.Map) map[string][]string {
+	if m.IsNull() || m.IsUnknown() {
+		return nil
+	}
+	lists := make(map[string][]string, len(m.Elements()))
+	for label, values := range m.Elements() {
+		if list, ok := values.(types.List); ok {
+			lists[label] = tfutil.TFListToStringSlice(list)
+		}
+	}
+	return lists
+}
+
+// quoteList returns values quoted and separated by commas.
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// setCompliance sets data.Compliance to result, the result of checking
+// compliance in a probe that returned probeErr, and returns diagnostics for
+// its violations according to data.BaseImageCompliancePolicy. result is nil
+// if compliance was not checked, as the probe did not get that far.
+func (data *CachedImageResourceModel) setCompliance(ctx context.Context, compliance baseImageCompliance, result *complianceResult, probeErr error) diag.Diagnostics {
+	var diags diag.Diagnostics
+	checked := result != nil && result.err == nil
+	var baseImage string
+	var labels map[string]string
+	var violations []string
+	if result != nil {
+		baseImage, labels, violations = result.baseImage, result.labels, result.violations
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if violations == nil {
+		violations = []string{}
+	}
+	labelsValue, d := types.MapValueFrom(ctx, types.StringType, labels)
+	diags.Append(d...)
+	violationsValue, d := types.ListValueFrom(ctx, types.StringType, violations)
+	diags.Append(d...)
+	data.Compliance = types.ObjectValueMust(complianceAttrTypes, map[string]attr.Value{
+		"checked":    types.BoolValue(checked),
+		"compliant":  types.BoolValue(checked && len(violations) == 0),
+		"base_image": types.StringValue(baseImage),
+		"labels":     labelsValue,
+		"violations": violationsValue,
+	})
+	if !compliance.enabled() {
+		return diags
+	}
+	// An invalid devcontainer cannot be built, and a failed or cancelled
+	// probe is reported as such.
+	var configErr *probeConfigError
+	var accessErr *probeAccessError
+	var cancelledErr *probeCancelledError
+	if result == nil && (errors.As(probeErr, &configErr) || errors.As(probeErr, &accessErr) || errors.As(probeErr, &cancelledErr)) {
+		return diags
+	}
+
+	add := diags.AddAttributeError
+	if data.BaseImageCompliancePolicy.ValueString() == compliancePolicyWarn {
+		add = diags.AddAttributeWarning
+	}
+	attrPath := path.Root("base_image_allowed_labels")
+	if len(compliance.allowed) == 0 {
+		attrPath = path.Root("base_image_denied_labels")
+	}
+	switch {
+	case result == nil:
+		add(attrPath, "Unable to check base image compliance",
+			"The base image of the devcontainer or Dockerfile could not be determined, as the cache probe failed before reading it.")
+	case result.err != nil:
+		add(attrPath, "Unable to check base image compliance", result.err.Error())
+	case len(violations) > 0:
+		add(attrPath, "Base image is not compliant", fmt.Sprintf("The labels of the base image %q violate the compliance checks:\n\n%s",
+			baseImage, strings.Join(violations, "\n")))
+	}
+	return diags
+}
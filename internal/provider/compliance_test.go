@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelValues(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"MIT AND GPL-2.0"}, labelValues("org.opencontainers.image.vendor", "MIT AND GPL-2.0"))
+	assert.Equal(t, []string{"MIT"}, labelValues(licensesLabel, "MIT"))
+	assert.Equal(t, []string{"MIT", "Apache-2.0", "GPL-2.0-only"},
+		labelValues(licensesLabel, "(MIT OR Apache-2.0) AND GPL-2.0-only WITH Classpath-exception-2.0"))
+}
+
+func TestBaseImageComplianceViolations(t *testing.T) {
+	t.Parallel()
+
+	compliance := baseImageCompliance{
+		allowed: map[string][]string{
+			licensesLabel:                     {"MIT", "Apache-2.0"},
+			"org.opencontainers.image.vendor": {"Canonical"},
+		},
+		denied: map[string][]string{
+			"com.example.tier": {"experimental"},
+		},
+	}
+	assert.Empty(t, compliance.violations(map[string]string{
+		licensesLabel:                     "MIT OR Apache-2.0",
+		"org.opencontainers.image.vendor": "Canonical",
+		"com.example.tier":                "stable",
+	}))
+	assert.Equal(t, []string{
+		`Label "com.example.tier" has denied value "experimental".`,
+		`Label "org.opencontainers.image.licenses" has value "GPL-3.0-only", which is not one of "MIT", "Apache-2.0".`,
+		`Label "org.opencontainers.image.vendor" is not set, but must be one of "Canonical".`,
+	}, compliance.violations(map[string]string{
+		licensesLabel:      "MIT AND GPL-3.0-only",
+		"com.example.tier": "experimental",
+	}))
+}
+
+func TestBaseImageComplianceCheck(t *testing.T) {
+	t.Parallel()
+
+	reg := registrytest.New(t, t.TempDir())
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg.Config.Labels = map[string]string{licensesLabel: "GPL-3.0-only"}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	registrytest.WriteImage(t, reg+"/base:latest", img)
+
+	ctx := context.Background()
+	compliance := baseImageCompliance{allowed: map[string][]string{licensesLabel: {"MIT"}}}
+	result := compliance.check(ctx, reg+"/base:latest", nil)
+	require.NoError(t, result.err)
+	assert.Equal(t, map[string]string{licensesLabel: "GPL-3.0-only"}, result.labels)
+	assert.Len(t, result.violations, 1)
+
+	result = compliance.check(ctx, reg+"/missing:latest", nil)
+	assert.ErrorContains(t, result.err, "missing")
+
+	result = compliance.check(ctx, "", errors.New("no FROM directive found"))
+	assert.ErrorContains(t, result.err, "no FROM directive found")
+}
+
+func Test_setCompliance(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	compliance := baseImageCompliance{denied: map[string][]string{licensesLabel: {"GPL-3.0-only"}}}
+	violating := &complianceResult{
+		baseImage:  "ubuntu:22.04",
+		labels:     map[string]string{licensesLabel: "GPL-3.0-only"},
+		violations: []string{"denied"},
+	}
+	for _, tc := range []struct {
+		name            string
+		compliance      baseImageCompliance
+		result          *complianceResult
+		probeErr        error
+		policy          string
+		expectErrors    int
+		expectWarnings  int
+		expectChecked   bool
+		expectCompliant bool
+	}{
+		{name: "disabled"},
+		{name: "compliant", compliance: compliance, result: &complianceResult{baseImage: "ubuntu:22.04"}, expectChecked: true, expectCompliant: true},
+		{name: "violation", compliance: compliance, result: violating, expectErrors: 1, expectChecked: true},
+		{name: "violation warn policy", compliance: compliance, result: violating, policy: compliancePolicyWarn, expectWarnings: 1, expectChecked: true},
+		{name: "not checked", compliance: compliance, result: &complianceResult{err: errors.New("unauthorized")}, expectErrors: 1},
+		{name: "probe failed", compliance: compliance, probeErr: errors.New("clone failed"), expectErrors: 1},
+		{name: "config error", compliance: compliance, probeErr: &probeConfigError{}},
+		{name: "access error", compliance: compliance, probeErr: &probeAccessError{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			data := CachedImageResourceModel{BaseImageCompliancePolicy: basetypes.NewStringValue(tc.policy)}
+			diags := data.setCompliance(ctx, tc.compliance, tc.result, tc.probeErr)
+			assert.Equal(t, tc.expectErrors, diags.ErrorsCount(), diags)
+			assert.Equal(t, tc.expectWarnings, diags.WarningsCount(), diags)
+			attrs := data.Compliance.Attributes()
+			assert.Equal(t, types.BoolValue(tc.expectChecked), attrs["checked"])
+			assert.Equal(t, types.BoolValue(tc.expectCompliant), attrs["compliant"])
+		})
+	}
+}
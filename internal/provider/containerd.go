@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// defaultContainerdNamespace is the containerd namespace images are looked up
+// in by default, which is the one used by Kubernetes.
+const defaultContainerdNamespace = "k8s.io"
+
+// containerdOptions configures looking up cached images in the content store
+// of containerd, for deployments where the nodes that run workspaces and
+// Terraform share it.
+type containerdOptions struct {
+	// address is the path to the containerd API socket. If empty, containerd
+	// is not used.
+	address string
+	// namespace is the containerd namespace to look up images in.
+	namespace string
+}
+
+// imageConfig returns the config of an image with the manifest digest dgst in
+// the containerd namespace, and whether one was found.
+func (o containerdOptions) imageConfig(ctx context.Context, dgst string) (*v1.ConfigFile, bool, error) {
+	client, err := containerd.New(o.address, containerd.WithDefaultNamespace(o.namespace))
+	if err != nil {
+		return nil, false, fmt.Errorf("connect to containerd at %q: %w", o.address, err)
+	}
+	defer client.Close()
+	return findContainerdImageConfig(ctx, client.ImageService(), client.ContentStore(), dgst)
+}
+
+// findContainerdImageConfig returns the config of an image in is with the
+// manifest digest dgst, read from cs, and whether one was found. Images whose
+// target is an index are not considered, as envbuilder pushes single
+// manifests.
+func findContainerdImageConfig(ctx context.Context, is images.Store, cs content.Provider, dgst string) (*v1.ConfigFile, bool, error) {
+	parsed, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, false, err
+	}
+	imgs, err := is.List(ctx, "target.digest=="+parsed.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("list images: %w", err)
+	}
+	for _, img := range imgs {
+		if !images.IsManifestType(img.Target.MediaType) {
+			continue
+		}
+		manifestBlob, err := content.ReadBlob(ctx, cs, img.Target)
+		if err != nil {
+			// The image may be known without its content, for example if it
+			// was only partially pulled.
+			continue
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+			return nil, false, fmt.Errorf("decode manifest of %s: %w", img.Name, err)
+		}
+		configBlob, err := content.ReadBlob(ctx, cs, manifest.Config)
+		if err != nil {
+			continue
+		}
+		cfg, err := v1.ParseConfigFile(bytes.NewReader(configBlob))
+		if err != nil {
+			return nil, false, fmt.Errorf("decode config of %s: %w", img.Name, err)
+		}
+		return cfg, true, nil
+	}
+	return nil, false, nil
+}
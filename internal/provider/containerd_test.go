@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeImageStore is an images.Store that only supports listing images by
+// target digest.
+type fakeImageStore struct {
+	images.Store
+	images []images.Image
+}
+
+func (s fakeImageStore) List(_ context.Context, filters ...string) ([]images.Image, error) {
+	var matched []images.Image
+	for _, img := range s.images {
+		for _, f := range filters {
+			if f == "target.digest=="+img.Target.Digest.String() {
+				matched = append(matched, img)
+			}
+		}
+	}
+	return matched, nil
+}
+
+func TestFindContainerdImageConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+	require.NoError(t, err)
+	manifestBlob, err := img.RawManifest()
+	require.NoError(t, err)
+	configBlob, err := img.RawConfigFile()
+	require.NoError(t, err)
+	manifestDesc := writeContentBlob(ctx, t, cs, ocispec.MediaTypeImageManifest, manifestBlob)
+	writeContentBlob(ctx, t, cs, ocispec.MediaTypeImageConfig, configBlob)
+	// An image whose config was never pulled.
+	missingConfig, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	missingManifestBlob, err := missingConfig.RawManifest()
+	require.NoError(t, err)
+	missingDesc := writeContentBlob(ctx, t, cs, ocispec.MediaTypeImageManifest, missingManifestBlob)
+
+	is := fakeImageStore{images: []images.Image{
+		{Name: "localhost:5000/cache@" + manifestDesc.Digest.String(), Target: manifestDesc},
+		{Name: "localhost:5000/cache@" + missingDesc.Digest.String(), Target: missingDesc},
+	}}
+
+	cfg, found, err := findContainerdImageConfig(ctx, is, cs, manifestDesc.Digest.String())
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, created, cfg.Created.Time.UTC())
+
+	_, found, err = findContainerdImageConfig(ctx, is, cs, missingDesc.Digest.String())
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, found, err = findContainerdImageConfig(ctx, is, cs, digest.FromString("other").String())
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, _, err = findContainerdImageConfig(ctx, is, cs, "not-a-digest")
+	require.Error(t, err)
+}
+
+// writeContentBlob writes blob to cs and returns its descriptor.
+func writeContentBlob(ctx context.Context, t *testing.T, cs content.Store, mediaType string, blob []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	ref := strings.ReplaceAll(desc.Digest.String(), ":", "-")
+	require.NoError(t, content.WriteBlob(ctx, cs, ref, bytes.NewReader(blob), desc))
+	return desc
+}
@@ -0,0 +1,288 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/envbuilder/log"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	// debugBundleMaxEntries is the maximum number of entries of the kaniko
+	// directory that are listed in a debug bundle.
+	debugBundleMaxEntries = 10000
+	// debugBundleFetchTimeout bounds the time spent fetching manifests for a
+	// debug bundle.
+	debugBundleFetchTimeout = 30 * time.Second
+	// redacted replaces secrets in a debug bundle.
+	redacted = "[REDACTED]"
+)
+
+// secretOptions are the envbuilder options that hold credentials, by
+// environment variable. They are redacted in debug bundles, and are not
+// part of the inputs of a cached probe result.
+var secretOptions = map[string]bool{
+	"ENVBUILDER_DOCKER_CONFIG_BASE64":       true,
+	"ENVBUILDER_GIT_PASSWORD":               true,
+	"ENVBUILDER_GIT_SSH_PRIVATE_KEY_BASE64": true,
+	"CODER_AGENT_TOKEN":                     true,
+}
+
+// isSecretOption returns whether the envbuilder option with the environment
+// variable env holds credentials, including the deprecated variables without
+// the ENVBUILDER_ prefix.
+func isSecretOption(env string) bool {
+	return secretOptions[env] || secretOptions[eboptions.WithEnvPrefix(env)]
+}
+
+// urlUserinfoPassword matches the password in the userinfo of a URL.
+var urlUserinfoPassword = regexp.MustCompile(`(://[^:/@\s]*):[^@/\s]+@`)
+
+// debugBundle collects what is needed to debug a failed cache probe: the
+// logs of the probe, the resolved envbuilder options, a listing of the
+// kaniko directory and the manifests of the images involved. It is written
+// as a gzipped tarball, with secrets scrubbed, to the debug_bundle_path of
+// the cached image. A nil debugBundle collects nothing.
+type debugBundle struct {
+	path string
+
+	mu        sync.Mutex
+	logs      bytes.Buffer
+	kanikoDir string
+	manifests map[string]debugBundleManifest
+}
+
+// debugBundleManifest is a manifest in a debug bundle, or the error fetching
+// it.
+type debugBundleManifest struct {
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// newDebugBundle returns a debug bundle to be written to path, or nil if path
+// is empty.
+func newDebugBundle(path string) *debugBundle {
+	if path == "" {
+		return nil
+	}
+	return &debugBundle{path: path, manifests: make(map[string]debugBundleManifest)}
+}
+
+// logFunc returns a log function that records messages in the bundle and
+// passes them on to logf.
+func (b *debugBundle) logFunc(logf log.Func) log.Func {
+	if b == nil {
+		return logf
+	}
+	return func(level log.Level, format string, args ...any) {
+		b.logf(level, format, args...)
+		logf(level, format, args...)
+	}
+}
+
+// logf records a message in the bundle.
+func (b *debugBundle) logf(level log.Level, format string, args ...any) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, _ = fmt.Fprintf(&b.logs, "%s %s: %s\n", time.Now().UTC().Format(time.RFC3339), level, fmt.Sprintf(format, args...))
+}
+
+// snapshot lists kanikoDir and fetches the manifests of refs, as they are
+// removed or may change once the probe ends. Empty refs are skipped.
+func (b *debugBundle) snapshot(ctx context.Context, kanikoDir string, refs []string, remoteOpts ...remote.Option) {
+	if b == nil {
+		return
+	}
+	listing := listDir(kanikoDir, debugBundleMaxEntries)
+
+	ctx, cancel := context.WithTimeout(ctx, debugBundleFetchTimeout)
+	defer cancel()
+	manifests := make(map[string]debugBundleManifest)
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		manifests[ref] = fetchManifest(ctx, ref, remoteOpts...)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.kanikoDir = listing
+	for ref, m := range manifests {
+		b.manifests[ref] = m
+	}
+}
+
+// write writes the bundle for a probe with opts that failed with probeErr.
+// The bundle is written to a temporary file that replaces the path once it
+// is complete.
+func (b *debugBundle) write(opts eboptions.Options, probeErr error) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	scrub := newScrubber(opts)
+	optionsJSON, err := json.MarshalIndent(debugBundleOptions(opts, scrub), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode options: %w", err)
+	}
+	manifestsJSON, err := json.MarshalIndent(b.manifests, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifests: %w", err)
+	}
+	errText := "<nil>"
+	if probeErr != nil {
+		errText = probeErr.Error()
+	}
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"error.txt", scrub(errText) + "\n"},
+		{"probe.log", scrub(b.logs.String())},
+		{"options.json", string(optionsJSON) + "\n"},
+		{"kaniko_dir.txt", scrub(b.kanikoDir)},
+		{"manifests.json", scrub(string(manifestsJSON)) + "\n"},
+	}
+
+	dir := filepath.Dir(b.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".envbuilder-debug-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0o600,
+			Size:    int64(len(file.content)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), b.path)
+}
+
+// newScrubber returns a function that replaces the secrets in opts, and the
+// passwords in URLs, in a string.
+func newScrubber(opts eboptions.Options) func(string) string {
+	var secrets []string
+	for _, s := range []string{opts.GitPassword, opts.GitSSHPrivateKeyBase64, opts.DockerConfigBase64, opts.CoderAgentToken} {
+		if s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	// Replace longer secrets first, in case one contains another.
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	return func(s string) string {
+		for _, secret := range secrets {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+		return urlUserinfoPassword.ReplaceAllString(s, "$1:"+redacted+"@")
+	}
+}
+
+// debugBundleOptions returns the envbuilder options in opts that are set, by
+// environment variable, with secrets redacted.
+func debugBundleOptions(opts eboptions.Options, scrub func(string) string) map[string]string {
+	set := make(map[string]string)
+	for _, opt := range opts.CLI() {
+		if opt.Env == "" || opt.Value == nil {
+			continue
+		}
+		val := opt.Value.String()
+		if val == "" {
+			continue
+		}
+		if isSecretOption(opt.Env) {
+			val = redacted
+		}
+		set[opt.Env] = scrub(val)
+	}
+	return set
+}
+
+// listDir lists the entries under dir with their mode and size, one per
+// line, up to maxEntries.
+func listDir(dir string, maxEntries int) string {
+	var sb strings.Builder
+	n := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			_, _ = fmt.Fprintf(&sb, "error: %s\n", err)
+			return nil
+		}
+		if n >= maxEntries {
+			_, _ = fmt.Fprintf(&sb, "... truncated after %d entries\n", maxEntries)
+			return fs.SkipAll
+		}
+		n++
+		info, err := d.Info()
+		if err != nil {
+			_, _ = fmt.Fprintf(&sb, "error: %s\n", err)
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		_, _ = fmt.Fprintf(&sb, "%s %12d %s\n", info.Mode(), info.Size(), rel)
+		return nil
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(&sb, "error: %s\n", err)
+	}
+	return sb.String()
+}
+
+// fetchManifest fetches the manifest of ref for a debug bundle.
+func fetchManifest(ctx context.Context, ref string, remoteOpts ...remote.Option) debugBundleManifest {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return debugBundleManifest{Error: err.Error()}
+	}
+	desc, err := remote.Get(parsed, append(remoteOpts, remote.WithContext(ctx))...)
+	if err != nil {
+		return debugBundleManifest{Error: err.Error()}
+	}
+	return debugBundleManifest{Manifest: desc.Manifest}
+}
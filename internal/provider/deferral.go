@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+var _ resource.ResourceWithModifyPlan = &CachedImageResource{}
+
+// probeInputs are the attributes the cache probe cannot run without.
+var probeInputs = []string{"builder_image", "cache_repo", "cache_repos", "git_url", "source_dir"}
+
+// ModifyPlan defers the creation or replacement of the cached image until
+// all of probeInputs are known, for example when they are set from resources
+// created in the same run, if Terraform supports deferred actions. The probe
+// then runs against the real values in a follow-up plan, and the resources
+// that depend on the cached image are deferred with it. Otherwise, the probe
+// runs during apply, once the values are known.
+func (r *CachedImageResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if req.Plan.Raw.IsNull() || !req.ClientCapabilities.DeferralAllowed {
+		return
+	}
+	for _, name := range probeInputs {
+		var val attr.Value
+		resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root(name), &val)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		// Lists such as cache_repos may be known, but hold unknown values.
+		raw, err := val.ToTerraformValue(ctx)
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root(name), "Failed to read attribute", err.Error())
+			return
+		}
+		if !raw.IsFullyKnown() {
+			tflog.Debug(ctx, "deferring cached image until its inputs are known", map[string]any{"attribute": name})
+			resp.Deferred = &resource.Deferred{Reason: resource.DeferredReasonResourceConfigUnknown}
+			return
+		}
+	}
+}
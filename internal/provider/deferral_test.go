@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedImageResourceDeferral(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		unknown         string
+		deferralAllowed bool
+		expectDeferred  bool
+	}{
+		{name: "known", deferralAllowed: true},
+		{name: "unknown cache_repo", unknown: "cache_repo", deferralAllowed: true, expectDeferred: true},
+		{name: "unknown git_url", unknown: "git_url", deferralAllowed: true, expectDeferred: true},
+		{name: "unknown cache_repos", unknown: "cache_repos", deferralAllowed: true, expectDeferred: true},
+		{name: "unknown optional input", unknown: "git_username", deferralAllowed: true},
+		{name: "deferral not allowed", unknown: "cache_repo"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			config := []byte(`{"builder_image": "envbuilder:latest", "cache_repo": "localhost:5000/cache", "git_url": "https://git.local/repo.git"}`)
+			session, ok, err := newCommandSession(ctx, "test", commandInput{config: config, providerConfig: []byte(`{}`)})
+			require.NoError(t, err)
+			require.True(t, ok, session.diagnostics)
+
+			var attrs map[string]tftypes.Value
+			require.NoError(t, session.config.As(&attrs))
+			if tc.unknown != "" {
+				attrs[tc.unknown] = tftypes.NewValue(attrs[tc.unknown].Type(), tftypes.UnknownValue)
+			}
+			configValue, err := tfprotov6.NewDynamicValue(session.resourceType, tftypes.NewValue(session.resourceType, attrs))
+			require.NoError(t, err)
+			nullState, err := tfprotov6.NewDynamicValue(session.resourceType, tftypes.NewValue(session.resourceType, nil))
+			require.NoError(t, err)
+
+			resp, err := session.server.PlanResourceChange(ctx, &tfprotov6.PlanResourceChangeRequest{
+				TypeName:           cachedImageTypeName,
+				PriorState:         &nullState,
+				ProposedNewState:   &configValue,
+				Config:             &configValue,
+				ClientCapabilities: &tfprotov6.PlanResourceChangeClientCapabilities{DeferralAllowed: tc.deferralAllowed},
+			})
+			require.NoError(t, err)
+			require.Empty(t, resp.Diagnostics)
+			if tc.expectDeferred {
+				require.NotNil(t, resp.Deferred)
+				assert.Equal(t, tfprotov6.DeferredReasonResourceConfigUnknown, resp.Deferred.Reason)
+			} else {
+				assert.Nil(t, resp.Deferred)
+			}
+		})
+	}
+}
+
+func TestProviderDeferral(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	session, ok, err := newCommandSession(ctx, "test", commandInput{config: []byte(`{"builder_image": "envbuilder:latest", "cache_repo": "localhost:5000/cache", "git_url": "https://git.local/repo.git"}`), providerConfig: []byte(`{}`)})
+	require.NoError(t, err)
+	require.True(t, ok, session.diagnostics)
+
+	var attrs map[string]tftypes.Value
+	require.NoError(t, session.providerConfig.As(&attrs))
+	attrs["socks5_proxy"] = tftypes.NewValue(tftypes.String, tftypes.UnknownValue)
+	providerType := session.providerConfig.Type()
+	providerValue, err := tfprotov6.NewDynamicValue(providerType, tftypes.NewValue(providerType, attrs))
+	require.NoError(t, err)
+	resp, err := session.server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{
+		Config:             &providerValue,
+		ClientCapabilities: &tfprotov6.ConfigureProviderClientCapabilities{DeferralAllowed: true},
+	})
+	require.NoError(t, err)
+	require.Empty(t, resp.Diagnostics)
+
+	nullState, err := tfprotov6.NewDynamicValue(session.resourceType, tftypes.NewValue(session.resourceType, nil))
+	require.NoError(t, err)
+	planResp, err := session.server.PlanResourceChange(ctx, &tfprotov6.PlanResourceChangeRequest{
+		TypeName:           cachedImageTypeName,
+		PriorState:         &nullState,
+		ProposedNewState:   session.configValue,
+		Config:             session.configValue,
+		ClientCapabilities: &tfprotov6.PlanResourceChangeClientCapabilities{DeferralAllowed: true},
+	})
+	require.NoError(t, err)
+	require.Empty(t, planResp.Diagnostics)
+	require.NotNil(t, planResp.Deferred)
+	assert.Equal(t, tfprotov6.DeferredReasonProviderConfigUnknown, planResp.Deferred.Reason)
+}
@@ -0,0 +1,369 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coder/envbuilder/devcontainer"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/tailscale/hujson"
+)
+
+var (
+	_ resource.ResourceWithValidateConfig           = &CachedImageResource{}
+	_ ephemeral.EphemeralResourceWithValidateConfig = &CachedImageEphemeralResource{}
+)
+
+// ValidateConfig validates the source and the devcontainer.json at plan time,
+// so that problems with them are not only reported by the cache probe during
+// apply.
+func (r *CachedImageResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var data CachedImageResourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	resp.Diagnostics.Append(data.validateSource()...)
+	resp.Diagnostics.Append(data.validateDevcontainerJSON()...)
+}
+
+// ValidateConfig validates the source and the devcontainer.json before
+// opening, as for the resource.
+func (r *CachedImageEphemeralResource) ValidateConfig(ctx context.Context, req ephemeral.ValidateConfigRequest, resp *ephemeral.ValidateConfigResponse) {
+	var data CachedImageResourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	resp.Diagnostics.Append(data.validateSource()...)
+	resp.Diagnostics.Append(data.validateDevcontainerJSON()...)
+}
+
+// devcontainerProperties are the top-level properties of devcontainer.json
+// defined by the Dev Container specification.
+var devcontainerProperties = map[string]bool{
+	"$schema":                     true,
+	"appPort":                     true,
+	"build":                       true,
+	"capAdd":                      true,
+	"containerEnv":                true,
+	"containerUser":               true,
+	"context":                     true,
+	"customizations":              true,
+	"dockerComposeFile":           true,
+	"dockerFile":                  true,
+	"features":                    true,
+	"forwardPorts":                true,
+	"hostRequirements":            true,
+	"image":                       true,
+	"init":                        true,
+	"initializeCommand":           true,
+	"mounts":                      true,
+	"name":                        true,
+	"onCreateCommand":             true,
+	"otherPortsAttributes":        true,
+	"overrideCommand":             true,
+	"overrideFeatureInstallOrder": true,
+	"portsAttributes":             true,
+	"postAttachCommand":           true,
+	"postCreateCommand":           true,
+	"postStartCommand":            true,
+	"privileged":                  true,
+	"remoteEnv":                   true,
+	"remoteUser":                  true,
+	"runArgs":                     true,
+	"runServices":                 true,
+	"secrets":                     true,
+	"securityOpt":                 true,
+	"service":                     true,
+	"shutdownAction":              true,
+	"updateContentCommand":        true,
+	"updateRemoteUserUID":         true,
+	"userEnvProbe":                true,
+	"waitFor":                     true,
+	"workspaceFolder":             true,
+	"workspaceMount":              true,
+}
+
+// validateDevcontainerJSON validates the devcontainer.json that will be
+// probed, if it can be read before probing: that is, if it is set by
+// devcontainer_json_content, is in local_repo_path, or devcontainer_json_path
+// is an absolute path. Syntax and
+// type errors are reported as errors, and unknown properties as warnings.
+// Nothing is reported if the file cannot be found, as the repository may
+// only have a Dockerfile, or the file may only exist when probing.
+func (data *CachedImageResourceModel) validateDevcontainerJSON() diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !data.DevcontainerJSONContent.IsNull() {
+		return data.validateDevcontainerJSONContent()
+	}
+	for _, v := range []interface{ IsUnknown() bool }{data.LocalRepoPath, data.DevcontainerDir, data.DevcontainerJSONPath, data.DockerfilePath} {
+		if v.IsUnknown() {
+			return diags
+		}
+	}
+	if data.DockerfilePath.ValueString() != "" {
+		// The devcontainer.json is not used.
+		return diags
+	}
+
+	opts := eboptions.Options{
+		DevcontainerDir:      data.DevcontainerDir.ValueString(),
+		DevcontainerJSONPath: data.DevcontainerJSONPath.ValueString(),
+	}
+	attr := path.Root("devcontainer_json_path")
+	var devcontainerPath string
+	switch {
+	case data.LocalRepoPath.ValueString() != "":
+		p, _, err := findDevcontainerJSON(data.LocalRepoPath.ValueString(), opts)
+		if err != nil {
+			return diags
+		}
+		devcontainerPath = p
+		if opts.DevcontainerJSONPath == "" {
+			attr = path.Root("local_repo_path")
+		}
+	case filepath.IsAbs(opts.DevcontainerJSONPath):
+		devcontainerPath = opts.DevcontainerJSONPath
+	default:
+		return diags
+	}
+
+	content, err := os.ReadFile(devcontainerPath)
+	if err != nil {
+		return diags
+	}
+	return checkDevcontainerJSON(attr, devcontainerPath, content)
+}
+
+// validateDevcontainerJSONContent validates devcontainer_json_content, which
+// replaces the devcontainer.json given by devcontainer_json_path and is not
+// used with dockerfile_path.
+func (data *CachedImageResourceModel) validateDevcontainerJSONContent() diag.Diagnostics {
+	var diags diag.Diagnostics
+	attr := path.Root("devcontainer_json_content")
+	for _, other := range []struct {
+		name  string
+		value types.String
+	}{
+		{"devcontainer_json_path", data.DevcontainerJSONPath},
+		{"dockerfile_path", data.DockerfilePath},
+	} {
+		if !other.value.IsNull() {
+			diags.AddAttributeError(attr, "Conflicting devcontainer.json",
+				fmt.Sprintf("devcontainer_json_content cannot be set with %s.", other.name))
+		}
+	}
+	if diags.HasError() || data.DevcontainerJSONContent.IsUnknown() {
+		return diags
+	}
+	return checkDevcontainerJSON(attr, "devcontainer_json_content", []byte(data.DevcontainerJSONContent.ValueString()))
+}
+
+// checkDevcontainerJSON checks the content of the devcontainer.json file at
+// devcontainerPath, reporting problems for attr.
+func checkDevcontainerJSON(attr path.Path, devcontainerPath string, content []byte) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if _, err := devcontainer.Parse(content); err != nil {
+		cfgErr := devcontainerParseError(content, err)
+		cfgErr.file = devcontainerPath
+		diags.AddAttributeError(attr, cfgErr.summary, cfgErr.detail())
+		return diags
+	}
+	var properties map[string]json.RawMessage
+	standardized, err := hujson.Standardize(content)
+	if err == nil {
+		err = json.Unmarshal(standardized, &properties)
+	}
+	if err != nil {
+		diags.AddAttributeError(attr, "Invalid devcontainer.json.",
+			fmt.Sprintf("%s: must contain a JSON object: %s", devcontainerPath, err))
+		return diags
+	}
+
+	var unknown []string
+	for name := range properties {
+		if !devcontainerProperties[name] {
+			unknown = append(unknown, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		diags.AddAttributeWarning(attr, "Unknown devcontainer.json properties.",
+			fmt.Sprintf("%s has properties that are not defined by the Dev Container specification, and will be ignored: %s.", devcontainerPath, strings.Join(unknown, ", ")))
+	}
+	return diags
+}
+
+// probedDevcontainer is what the provider reads from the devcontainer.json
+// of the probed repository.
+type probedDevcontainer struct {
+	// features are the sorted references of the declared features.
+	features []string
+	// customizations is the customizations property as JSON, or "{}" if it
+	// is not set.
+	customizations string
+	// vscodeExtensions are the VS Code extensions in customizations.
+	vscodeExtensions []string
+	// resolved is the devcontainer.json as resolved by resolveDevcontainer.
+	resolved string
+}
+
+// readProbedDevcontainer reads the devcontainer.json in workspaceFolder. The
+// result is empty if a Dockerfile is used, or if there is no valid
+// devcontainer.json.
+func readProbedDevcontainer(workspaceFolder string, opts eboptions.Options) probedDevcontainer {
+	dc := probedDevcontainer{customizations: "{}"}
+	if opts.DockerfilePath != "" {
+		return dc
+	}
+	devcontainerPath, _, err := findDevcontainerJSON(workspaceFolder, opts)
+	if err != nil {
+		return dc
+	}
+	content, err := os.ReadFile(devcontainerPath)
+	if err != nil {
+		return dc
+	}
+	spec, err := devcontainer.Parse(content)
+	if err != nil {
+		return dc
+	}
+	for ref := range spec.Features {
+		dc.features = append(dc.features, ref)
+	}
+	sort.Strings(dc.features)
+
+	// The customizations are not part of the spec parsed by envbuilder.
+	standardized, err := hujson.Standardize(content)
+	if err != nil {
+		return dc
+	}
+	var raw struct {
+		Customizations map[string]any `json:"customizations"`
+	}
+	if err := json.Unmarshal(standardized, &raw); err != nil || raw.Customizations == nil {
+		return dc
+	}
+	// Marshalling sorts the keys, so that the output is stable.
+	if customizations, err := json.Marshal(raw.Customizations); err == nil {
+		dc.customizations = string(customizations)
+	}
+	var vscode struct {
+		VSCode struct {
+			Extensions []string `json:"extensions"`
+		} `json:"vscode"`
+	}
+	if err := json.Unmarshal([]byte(dc.customizations), &vscode); err == nil {
+		dc.vscodeExtensions = vscode.VSCode.Extensions
+	}
+	return dc
+}
+
+// resolveDevcontainer returns the devcontainer.json in workspaceFolder as
+// JSON, with variables in its values substituted as envbuilder substitutes
+// them in build.args: ${containerWorkspaceFolder} and similar resolve to
+// containerWorkspaceFolder, and ${localEnv:VAR} and similar to lookupEnv.
+// containerUser and remoteUser are set to user if they are not set, as
+// envbuilder runs as the user the Dockerfile or image ends with. The result
+// is "{}" if a Dockerfile is used, or if there is no valid devcontainer.json.
+//
+// Envbuilder does not support extends, and adds the properties of features
+// to the Dockerfile rather than to the devcontainer.json, so neither is
+// merged.
+func resolveDevcontainer(workspaceFolder string, opts eboptions.Options, containerWorkspaceFolder string, lookupEnv func(string) (string, bool), user string) string {
+	if opts.DockerfilePath != "" {
+		return "{}"
+	}
+	devcontainerPath, _, err := findDevcontainerJSON(workspaceFolder, opts)
+	if err != nil {
+		return "{}"
+	}
+	content, err := os.ReadFile(devcontainerPath)
+	if err != nil {
+		return "{}"
+	}
+	standardized, err := hujson.Standardize(content)
+	if err != nil {
+		return "{}"
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(standardized, &raw); err != nil || raw == nil {
+		return "{}"
+	}
+	resolved := substituteDevcontainerVars(raw, containerWorkspaceFolder, lookupEnv).(map[string]any)
+	if user != "" {
+		if _, ok := resolved["containerUser"]; !ok {
+			resolved["containerUser"] = user
+		}
+		if _, ok := resolved["remoteUser"]; !ok {
+			resolved["remoteUser"] = resolved["containerUser"]
+		}
+	}
+	// Marshalling sorts the keys, so that the output is stable.
+	out, err := json.Marshal(resolved)
+	if err != nil {
+		return "{}"
+	}
+	return string(out)
+}
+
+// substituteDevcontainerVars substitutes variables in the strings of v, a
+// value decoded from JSON. Object keys are left as they are.
+func substituteDevcontainerVars(v any, workspaceFolder string, lookupEnv func(string) (string, bool)) any {
+	switch v := v.(type) {
+	case string:
+		return devcontainer.SubstituteVars(v, workspaceFolder, lookupEnv)
+	case []any:
+		for i, elem := range v {
+			v[i] = substituteDevcontainerVars(elem, workspaceFolder, lookupEnv)
+		}
+		return v
+	case map[string]any:
+		for key, elem := range v {
+			v[key] = substituteDevcontainerVars(elem, workspaceFolder, lookupEnv)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// unpinnedFeaturesWarning returns a warning if any of features is not pinned
+// to a version: that is, it has no tag or digest, or its tag is "latest".
+// Local features and features that are not valid image references are not
+// reported here, as the probe fails for them anyway.
+func unpinnedFeaturesWarning(features []string) diag.Diagnostics {
+	var diags diag.Diagnostics
+	var unpinned []string
+	for _, feature := range features {
+		if !strings.Contains(feature, "/") || strings.HasPrefix(feature, ".") || strings.HasPrefix(feature, "/") {
+			continue
+		}
+		ref, err := name.ParseReference(feature)
+		if err != nil {
+			continue
+		}
+		if tag, ok := ref.(name.Tag); ok && tag.TagStr() == name.DefaultTag {
+			unpinned = append(unpinned, fmt.Sprintf("%q", feature))
+		}
+	}
+	if len(unpinned) > 0 {
+		diags.AddWarning("Unpinned devcontainer features.", fmt.Sprintf(
+			"The devcontainer declares features that are not pinned to a version: %s. A new release of a feature changes the layers of the image, so the cached image is not found even though the repository has not changed. Pin them to a version, such as \"ghcr.io/devcontainers/features/go:1\", or set suppress_unpinned_features_warning to silence this warning.",
+			strings.Join(unpinned, ", "),
+		))
+	}
+	return diags
+}
@@ -0,0 +1,262 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDevcontainerJSON(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name           string
+		files          map[string]string
+		data           CachedImageResourceModel
+		expectErrors   []string
+		expectWarnings []string
+		expectAttr     path.Path
+	}{
+		{
+			name: "valid",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{
+					// Comments and trailing commas are allowed.
+					"image": "ubuntu:22.04",
+					"customizations": {"vscode": {}},
+				}`,
+			},
+		},
+		{
+			name: "syntax error",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": }`,
+			},
+			expectErrors: []string{"Invalid devcontainer.json."},
+			expectAttr:   path.Root("local_repo_path"),
+		},
+		{
+			name: "not an object",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `["ubuntu:22.04"]`,
+			},
+			expectErrors: []string{"Invalid devcontainer.json."},
+			expectAttr:   path.Root("local_repo_path"),
+		},
+		{
+			name: "type error",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": 22}`,
+			},
+			expectErrors: []string{"Invalid devcontainer.json."},
+			expectAttr:   path.Root("local_repo_path"),
+		},
+		{
+			name: "unknown property",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": "ubuntu:22.04", "imag": "ubuntu:24.04"}`,
+			},
+			expectWarnings: []string{"Unknown devcontainer.json properties."},
+			expectAttr:     path.Root("local_repo_path"),
+		},
+		{
+			name: "custom path",
+			files: map[string]string{
+				".devcontainer/custom.json": `{"image": 22}`,
+			},
+			data:         CachedImageResourceModel{DevcontainerJSONPath: types.StringValue("custom.json")},
+			expectErrors: []string{"Invalid devcontainer.json."},
+			expectAttr:   path.Root("devcontainer_json_path"),
+		},
+		{
+			name: "dockerfile",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": 22}`,
+			},
+			data: CachedImageResourceModel{DockerfilePath: types.StringValue("Dockerfile")},
+		},
+		{
+			name: "unknown",
+			files: map[string]string{
+				".devcontainer/devcontainer.json": `{"image": 22}`,
+			},
+			data: CachedImageResourceModel{DevcontainerDir: types.StringUnknown()},
+		},
+		{
+			name: "not found",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for path, content := range tc.files {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644))
+			}
+			data := tc.data
+			data.LocalRepoPath = types.StringValue(dir)
+
+			diags := data.validateDevcontainerJSON()
+			assert.Equal(t, tc.expectErrors, summaries(diags.Errors()))
+			assert.Equal(t, tc.expectWarnings, summaries(diags.Warnings()))
+			for _, d := range diags {
+				withPath, ok := d.(diag.DiagnosticWithPath)
+				require.True(t, ok)
+				assert.Equal(t, tc.expectAttr, withPath.Path())
+			}
+		})
+	}
+}
+
+func TestValidateDevcontainerJSONAbsolutePath(t *testing.T) {
+	t.Parallel()
+
+	devcontainerPath := filepath.Join(t.TempDir(), "devcontainer.json")
+	require.NoError(t, os.WriteFile(devcontainerPath, []byte(`{"image": ["ubuntu:22.04"]}`), 0o644))
+	data := CachedImageResourceModel{DevcontainerJSONPath: types.StringValue(devcontainerPath)}
+
+	diags := data.validateDevcontainerJSON()
+	require.Len(t, diags.Errors(), 1)
+	assert.Contains(t, diags.Errors()[0].Detail(), `"image" must not be a JSON array`)
+}
+
+func TestValidateDevcontainerJSONContent(t *testing.T) {
+	t.Parallel()
+
+	data := CachedImageResourceModel{DevcontainerJSONContent: types.StringValue(`{"image": ["ubuntu:22.04"]}`)}
+	diags := data.validateDevcontainerJSON()
+	require.Len(t, diags.Errors(), 1)
+	assert.Contains(t, diags.Errors()[0].Detail(), `"image" must not be a JSON array`)
+
+	data = CachedImageResourceModel{DevcontainerJSONContent: types.StringValue(`{"image": "ubuntu:22.04"}`)}
+	assert.Empty(t, data.validateDevcontainerJSON())
+
+	data.DockerfilePath = types.StringValue("Dockerfile")
+	diags = data.validateDevcontainerJSON()
+	require.Len(t, diags.Errors(), 1)
+	assert.Equal(t, "devcontainer_json_content cannot be set with dockerfile_path.", diags.Errors()[0].Detail())
+
+	data = CachedImageResourceModel{
+		DevcontainerJSONContent: types.StringUnknown(),
+		DevcontainerJSONPath:    types.StringValue("custom.json"),
+	}
+	diags = data.validateDevcontainerJSON()
+	require.Len(t, diags.Errors(), 1)
+	assert.Equal(t, "devcontainer_json_content cannot be set with devcontainer_json_path.", diags.Errors()[0].Detail())
+}
+
+func summaries(diags diag.Diagnostics) []string {
+	var s []string
+	for _, d := range diags {
+		s = append(s, d.Summary())
+	}
+	return s
+}
+
+func TestReadProbedDevcontainer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".devcontainer"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".devcontainer", "devcontainer.json"), []byte(`{
+		"image": "ubuntu:22.04",
+		"features": {
+			"ghcr.io/devcontainers/features/node:1": {},
+			"ghcr.io/devcontainers/features/go": {"version": "1.22"},
+		},
+		"customizations": {
+			"vscode": {
+				"extensions": ["golang.go", "ms-azuretools.vscode-docker"],
+				"settings": {"go.useLanguageServer": true},
+			},
+			"codespaces": {"openFiles": ["README.md"]},
+		},
+	}`), 0o644))
+
+	dc := readProbedDevcontainer(dir, eboptions.Options{})
+	assert.Equal(t, []string{"ghcr.io/devcontainers/features/go", "ghcr.io/devcontainers/features/node:1"}, dc.features)
+	assert.JSONEq(t, `{
+		"vscode": {
+			"extensions": ["golang.go", "ms-azuretools.vscode-docker"],
+			"settings": {"go.useLanguageServer": true}
+		},
+		"codespaces": {"openFiles": ["README.md"]}
+	}`, dc.customizations)
+	assert.Equal(t, []string{"golang.go", "ms-azuretools.vscode-docker"}, dc.vscodeExtensions)
+
+	empty := probedDevcontainer{customizations: "{}"}
+	assert.Equal(t, empty, readProbedDevcontainer(dir, eboptions.Options{DockerfilePath: "Dockerfile"}))
+	assert.Equal(t, empty, readProbedDevcontainer(t.TempDir(), eboptions.Options{}))
+}
+
+func TestResolveDevcontainer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".devcontainer"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".devcontainer", "devcontainer.json"), []byte(`{
+		// Comments and trailing commas are allowed.
+		"image": "ubuntu:22.04",
+		"containerEnv": {
+			"${NOT_A_KEY}": "${localEnv:REGION}",
+			"PROJECT": "${containerWorkspaceFolderBasename}",
+			"TIER": "${localEnv:TIER:dev}",
+		},
+		"mounts": ["source=${localEnv:HOME}/.cache,target=/cache,type=bind"],
+		"runArgs": [1, true, null],
+	}`), 0o644))
+	env := map[string]string{"REGION": "eu", "HOME": "/home/coder"}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	resolved := resolveDevcontainer(dir, eboptions.Options{}, "/workspaces/repo", lookupEnv, "vscode")
+	assert.JSONEq(t, `{
+		"image": "ubuntu:22.04",
+		"containerEnv": {
+			"${NOT_A_KEY}": "eu",
+			"PROJECT": "repo",
+			"TIER": "dev"
+		},
+		"mounts": ["source=/home/coder/.cache,target=/cache,type=bind"],
+		"runArgs": [1, true, null],
+		"containerUser": "vscode",
+		"remoteUser": "vscode"
+	}`, resolved)
+
+	// The users set in devcontainer.json are kept, and remoteUser defaults
+	// to containerUser.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".devcontainer", "devcontainer.json"), []byte(`{"image": "ubuntu:22.04", "containerUser": "root"}`), 0o644))
+	assert.JSONEq(t, `{"image": "ubuntu:22.04", "containerUser": "root", "remoteUser": "root"}`, resolveDevcontainer(dir, eboptions.Options{}, "/workspaces/repo", lookupEnv, "vscode"))
+
+	assert.Equal(t, "{}", resolveDevcontainer(dir, eboptions.Options{DockerfilePath: "Dockerfile"}, "/workspaces/repo", lookupEnv, ""))
+	assert.Equal(t, "{}", resolveDevcontainer(t.TempDir(), eboptions.Options{}, "/workspaces/repo", lookupEnv, ""))
+}
+
+func TestUnpinnedFeaturesWarning(t *testing.T) {
+	t.Parallel()
+
+	assert.Empty(t, unpinnedFeaturesWarning(nil))
+	assert.Empty(t, unpinnedFeaturesWarning([]string{
+		"ghcr.io/devcontainers/features/go:1",
+		"ghcr.io/devcontainers/features/node@sha256:" + strings.Repeat("a", 64),
+		"./local-feature",
+	}))
+
+	diags := unpinnedFeaturesWarning([]string{
+		"ghcr.io/devcontainers/features/go",
+		"ghcr.io/devcontainers/features/node:1",
+		"ghcr.io/devcontainers/features/rust:latest",
+	})
+	require.Len(t, diags.Warnings(), 1)
+	assert.Contains(t, diags.Warnings()[0].Detail(), `"ghcr.io/devcontainers/features/go", "ghcr.io/devcontainers/features/rust:latest".`)
+}
@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// probeContainerLabel is set on the containers that run cache probes, so that
+// they can be found if the provider is interrupted.
+const probeContainerLabel = "terraform-provider-envbuilder-probe"
+
+// probeContainerMagicDir is where the working directory of envbuilder is
+// mounted in the container of a probe. Envbuilder always uses it.
+const probeContainerMagicDir = "/.envbuilder"
+
+// dockerExecutor runs the dry-run builds of cache probes in containers of the
+// builder image, with a Docker daemon on the machine running Terraform.
+type dockerExecutor struct {
+	// host is the address of the Docker daemon. If empty, it is taken from
+	// the DOCKER_HOST environment variable, or the default.
+	host string
+	// networkMode is the network mode of the containers. If empty, the
+	// default network is used.
+	networkMode string
+}
+
+// needsEnvbuilderBinary is true, as the container runs the binary extracted
+// into the scratch directory with the user of the provider.
+func (*dockerExecutor) needsEnvbuilderBinary() bool {
+	return true
+}
+
+// client returns a client of the Docker daemon.
+func (e *dockerExecutor) client() (*client.Client, error) {
+	clientOpts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if e.host != "" {
+		clientOpts = append(clientOpts, client.WithHost(e.host))
+	}
+	return client.NewClientWithOpts(clientOpts...)
+}
+
+// run runs envbuilder in a container of the builder image. The scratch
+// directory of the probe is mounted at the same path in the container, and
+// its magic dir as the working directory of envbuilder. Unlike the provider process, the container runs the envbuilder of the
+// builder image as a workspace would, including its version of kaniko. The
+// files of the probe stay in the scratch directory, so that they can be
+// inspected once the container is removed.
+func (e *dockerExecutor) run(ctx context.Context, probe remoteProbe, remoteOpts ...remote.Option) (v1.Image, error) {
+	cli, err := e.client()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to docker: %w", err)
+	}
+	defer cli.Close()
+	if err := pullImage(ctx, cli, probe.builderImage); err != nil {
+		return nil, err
+	}
+
+	opts := probe.opts
+	opts.GetCachedImage = true
+	opts.BinaryPath = probe.envbuilderPath
+	env := tfutil.DockerEnv(computeEnvFromOptions(opts, probe.devcontainerEnv, legacyEnvNamesNone))
+	// Kaniko must not need root to create its working directory.
+	env = append(env, "KANIKO_DIR="+filepath.Join(probeContainerMagicDir, "kaniko"))
+	binds := []string{
+		probe.scratchDir + ":" + probe.scratchDir,
+		probe.magicDir + ":" + probeContainerMagicDir,
+	}
+	if ws := opts.WorkspaceFolder; ws != "" && !strings.HasPrefix(ws, probe.scratchDir+string(filepath.Separator)) {
+		binds = append(binds, ws+":"+ws)
+	}
+	var extraHosts []string
+	for host, ip := range probe.hostAliases {
+		extraHosts = append(extraHosts, host+":"+ip)
+	}
+	cfg := &container.Config{
+		Image:      probe.builderImage,
+		Entrypoint: []string{probe.envbuilderPath},
+		Env:        env,
+		Labels: map[string]string{
+			probeContainerLabel: "true",
+		},
+	}
+	// Files created in the mounted directories must be removable by the
+	// provider.
+	if uid := os.Getuid(); uid > 0 {
+		cfg.User = fmt.Sprintf("%d:%d", uid, os.Getgid())
+	}
+	ctr, err := cli.ContainerCreate(ctx, cfg, &container.HostConfig{
+		NetworkMode: container.NetworkMode(e.networkMode),
+		Binds:       binds,
+		ExtraHosts:  extraHosts,
+	}, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("create probe container: %w", err)
+	}
+	defer func() {
+		// The container is removed even if ctx was cancelled.
+		if err := cli.ContainerRemove(context.Background(), ctr.ID, container.RemoveOptions{RemoveVolumes: true, Force: true}); err != nil {
+			tflog.Warn(ctx, "unable to remove probe container", map[string]any{"id": ctr.ID, "err": err})
+		}
+	}()
+	if err := cli.ContainerStart(ctx, ctr.ID, container.StartOptions{}); err != nil {
+		return nil, fmt.Errorf("start probe container: %w", err)
+	}
+	tflog.Debug(ctx, "running envbuilder in a container", map[string]any{"id": ctr.ID, "builder_image": probe.builderImage})
+
+	logs, err := cli.ContainerLogs(ctx, ctr.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return nil, fmt.Errorf("read probe container logs: %w", err)
+	}
+	defer logs.Close()
+	var stdout bytes.Buffer
+	stderrReader, stderrWriter := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(&stdout, stderrWriter, logs)
+		_ = stderrWriter.CloseWithError(err)
+	}()
+	lastError := scanContainerLogs(stderrReader, probe.opts.Logger, nil)
+
+	waitCh, errCh := cli.ContainerWait(ctx, ctr.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return nil, fmt.Errorf("wait for probe container: %w", err)
+	case res := <-waitCh:
+		if res.StatusCode != 0 {
+			if lastError != "" {
+				return nil, errors.New(lastError)
+			}
+			return nil, fmt.Errorf("envbuilder exited with status %d:\n\n%s", res.StatusCode, containerLogsTail(ctx, cli, ctr.ID))
+		}
+	}
+	return cachedImageFromOutput(stdout.String(), remoteOpts...)
+}
+
+// pullImage pulls ref with cli.
+func pullImage(ctx context.Context, cli *client.Client, ref string) error {
+	pull, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("pull builder image: %w", err)
+	}
+	_, err = io.Copy(io.Discard, pull)
+	_ = pull.Close()
+	if err != nil {
+		return fmt.Errorf("pull builder image: %w", err)
+	}
+	return nil
+}
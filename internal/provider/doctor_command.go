@@ -0,0 +1,250 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Statuses of a doctor check.
+const (
+	doctorCheckPass = "pass"
+	doctorCheckFail = "fail"
+	doctorCheckSkip = "skip"
+)
+
+// doctorReport is the output of the doctor command.
+type doctorReport struct {
+	// Checks is empty if the configuration is invalid.
+	Checks      []doctorCheck `json:"checks"`
+	Diagnostics []Diagnostic  `json:"diagnostics"`
+}
+
+// doctorCheck is the result of checking that one remote can be reached with
+// the configured options.
+type doctorCheck struct {
+	// Name is the attribute that configures the remote, for example
+	// builder_image or git_mirror_urls[0].
+	Name       string `json:"name"`
+	Target     string `json:"target"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// DoctorCommand checks that the builder image can be pulled, that the cache
+// repo can be pushed to, and that the Git repository can be cloned with the
+// options of an envbuilder_cached_image resource, and prints a report as
+// JSON to stdout. It is meant to validate the environment Terraform runs in
+// before rolling out templates that use the provider. It returns the exit
+// code of the command: 0 if all checks pass, 1 if any fail or there are
+// error diagnostics, and 2 for usage errors.
+func DoctorCommand(ctx context.Context, version string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	ctx, in, ok := parseCommandArgs(ctx, "doctor",
+		"Checks that the builder image, the cache repo and the Git repository of an envbuilder_cached_image resource can be reached, and prints a report as JSON.",
+		args, stdin, stderr)
+	if !ok {
+		return 2
+	}
+
+	report, err := runDoctorCommand(ctx, version, in)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if !writeCommandOutput(report, stdout, stderr) {
+		return 2
+	}
+	if hasErrors(report.Diagnostics) {
+		return 1
+	}
+	for _, check := range report.Checks {
+		if check.Status == doctorCheckFail {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runDoctorCommand validates and configures the provider, validates the
+// cached image resource and runs the doctor checks with its options. An
+// error is returned if the configurations cannot be decoded; all other
+// problems are reported as diagnostics or failed checks.
+func runDoctorCommand(ctx context.Context, version string, in commandInput) (*doctorReport, error) {
+	session, ok, err := newCommandSession(ctx, version, in)
+	if err != nil {
+		return nil, err
+	}
+	report := &doctorReport{Checks: []doctorCheck{}, Diagnostics: session.diagnostics}
+	if !ok {
+		return report, nil
+	}
+
+	// The configurations are valid, so the provider and resource options are
+	// taken from them directly rather than through the plugin protocol.
+	pd, data, err := session.decode(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	opts, diags := optionsFromDataModel(data, (&CachedImageResource{data: pd}).overridePolicy())
+	hasError := session.addFrameworkDiags(diags)
+	probeOpts, diags := data.cacheProbeOptions(pd)
+	hasError = session.addFrameworkDiags(diags) || hasError
+	if !hasError {
+		report.Checks = runDoctorChecks(ctx, data.BuilderImage.ValueString(), opts, probeOpts)
+	}
+	report.Diagnostics = session.diagnostics
+	return report, nil
+}
+
+// runDoctorChecks checks that each remote used by a cache probe with opts
+// and probeOpts can be reached, in the same way as the probe would reach it.
+func runDoctorChecks(ctx context.Context, builderImage string, opts eboptions.Options, probeOpts cacheProbeOptions) []doctorCheck {
+	probeOpts.secrets.apply(&opts)
+	tr, gitTr := probeOpts.transports()
+	defer netutil.CancelOnDone(ctx, tr)()
+	defer netutil.CancelOnDone(ctx, gitTr)()
+	if probeOpts.netOpts.SOCKS5Proxy != nil && opts.GitHTTPProxyURL == "" {
+		opts.GitHTTPProxyURL = probeOpts.netOpts.SOCKS5Proxy.String()
+	}
+
+	var checks []doctorCheck
+	run := func(name, target string, check func() (string, error)) {
+		start := time.Now()
+		detail, err := check()
+		status := doctorCheckPass
+		if err != nil {
+			status, detail = doctorCheckFail, err.Error()
+		}
+		checks = append(checks, doctorCheck{
+			Name:       name,
+			Target:     target,
+			Status:     status,
+			Detail:     detail,
+			DurationMS: time.Since(start).Milliseconds(),
+		})
+		tflog.Info(ctx, "doctor check", map[string]any{"name": name, "target": target, "status": status})
+	}
+
+	// Credentials from Vault are used by the checks below, as when probing.
+	if probeOpts.vault != nil {
+		run("vault_address", probeOpts.vault.address, func() (string, error) {
+			secrets, err := probeOpts.vault.secrets(ctx)
+			if err != nil {
+				return "", err
+			}
+			secrets.apply(&opts)
+			return "Fetched credentials.", nil
+		})
+	}
+
+	// The builder image is pulled with the credentials of the provider, and
+	// the cache repo is accessed by kaniko with the Docker config.
+	run("builder_image", builderImage, func() (string, error) {
+		ref, err := name.ParseReference(builderImage)
+		if err != nil {
+			return "", err
+		}
+		desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithTransport(tr), remote.WithAuthFromKeychain(probeOpts.registryAuth.keychain()))
+		if err != nil {
+			return "", err
+		}
+		return "Pulled manifest " + desc.Digest.String() + ".", nil
+	})
+	run("cache_repo", opts.CacheRepo, func() (string, error) {
+		dockerConfig, err := probeDockerConfigBase64(opts.DockerConfigBase64, probeOpts.registryAuth)
+		if err != nil {
+			return "", fmt.Errorf("unable to load the docker config: %w", err)
+		}
+		if withPodman, err := dockerConfigWithPodmanAuth(dockerConfig, probeOpts.registryAuth.authFile); err != nil {
+			if probeOpts.registryAuth.authFile != "" {
+				return "", fmt.Errorf("unable to load the registry auth file: %w", err)
+			}
+			tflog.Warn(ctx, "unable to add podman registry credentials, using the docker config only", map[string]any{"err": err})
+		} else {
+			dockerConfig = withPodman
+		}
+		dockerConfig, err = probeCredentialHelpers(ctx, dockerConfig, probeOpts.registryAuth, false, opts.CacheRepo, builderImage)
+		if err != nil {
+			return "", fmt.Errorf("unable to get registry credentials: %w", err)
+		}
+		dockerConfig, err = dockerConfigWithProcessCredentials(ctx, dockerConfig, probeOpts.registryAuth.credentials, opts.CacheRepo, builderImage)
+		if err != nil {
+			return "", fmt.Errorf("unable to get registry credentials: %w", err)
+		}
+		dockerConfig, err = dockerConfigWithCloudCredentials(ctx, dockerConfig, probeOpts.registryAuth.cloud, opts.CacheRepo, builderImage)
+		if err != nil {
+			return "", fmt.Errorf("unable to get registry credentials: %w", err)
+		}
+		kc, err := dockerConfigKeychain(dockerConfig)
+		if err != nil {
+			return "", err
+		}
+		var nameOpts []name.Option
+		if opts.Insecure {
+			nameOpts = append(nameOpts, name.Insecure)
+		}
+		repo, err := name.NewRepository(opts.CacheRepo, nameOpts...)
+		if err != nil {
+			return "", err
+		}
+		if err := remote.CheckPushPermission(repo.Tag("envbuilder-doctor"), kc, tr); err != nil {
+			return "", err
+		}
+		return "Push permitted.", nil
+	})
+
+	if probeOpts.sourceDir != "" {
+		run("source_dir", probeOpts.sourceDir, func() (string, error) {
+			info, err := os.Stat(probeOpts.sourceDir)
+			if err != nil {
+				return "", err
+			}
+			if !info.IsDir() {
+				return "", errors.New("not a directory")
+			}
+			return "Found the directory.", nil
+		})
+		return checks
+	}
+	if probeOpts.localRepoPath != "" {
+		run("local_repo_path", probeOpts.localRepoPath, func() (string, error) {
+			if err := checkLocalRepo(probeOpts.localRepoPath); err != nil {
+				return "", err
+			}
+			return "Found a git repository.", nil
+		})
+		checks = append(checks, doctorCheck{
+			Name:   "git_url",
+			Target: opts.GitURL,
+			Status: doctorCheckSkip,
+			Detail: "local_repo_path is set, so git_url is not cloned.",
+		})
+		return checks
+	}
+	logf := func(format string, args ...any) {
+		tflog.Debug(ctx, fmt.Sprintf(format, args...))
+	}
+	checkGitURL := func(gitURL string) func() (string, error) {
+		return func() (string, error) {
+			if _, err := firstReachableGitURL(ctx, logf, opts, gitTr, []string{gitURL}); err != nil {
+				return "", err
+			}
+			return "Listed refs.", nil
+		}
+	}
+	run("git_url", opts.GitURL, checkGitURL(opts.GitURL))
+	for i, mirrorURL := range probeOpts.gitMirrorURLs {
+		run(fmt.Sprintf("git_mirror_urls[%d]", i), mirrorURL, checkGitURL(mirrorURL))
+	}
+	return checks
+}
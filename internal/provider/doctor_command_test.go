@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoctorCommand(t *testing.T) {
+	t.Parallel()
+
+	builderReg := registrytest.New(t, t.TempDir())
+	builderImage := builderReg + "/envbuilder:latest"
+	registrytest.WriteRandomImage(t, builderImage)
+
+	cacheReg := registrytest.New(t, t.TempDir(), registrytest.BasicAuthMW(t, "testuser", "testpassword"))
+	dockerConfig := registrytest.DockerConfigBase64(cacheReg, "testuser", "testpassword")
+	gitURL := "file://" + gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM scratch"})
+	missingGitURL := "file://" + filepath.Join(t.TempDir(), "missing")
+
+	for _, tc := range []struct {
+		name            string
+		config          map[string]any
+		expectCode      int
+		expectStatuses  map[string]string
+		expectSummaries []string
+	}{
+		{
+			name: "pass",
+			config: map[string]any{
+				"builder_image":        builderImage,
+				"cache_repo":           cacheReg + "/cache",
+				"git_url":              gitURL,
+				"docker_config_base64": dockerConfig,
+			},
+			expectStatuses: map[string]string{"builder_image": "pass", "cache_repo": "pass", "git_url": "pass"},
+		},
+		{
+			name: "fail",
+			config: map[string]any{
+				"builder_image":   builderReg + "/missing:latest",
+				"cache_repo":      cacheReg + "/cache",
+				"git_url":         gitURL,
+				"git_mirror_urls": []string{missingGitURL},
+			},
+			expectCode: 1,
+			expectStatuses: map[string]string{
+				"builder_image":      "fail",
+				"cache_repo":         "fail",
+				"git_url":            "pass",
+				"git_mirror_urls[0]": "fail",
+			},
+		},
+		{
+			name: "local repo",
+			config: map[string]any{
+				"builder_image":        builderImage,
+				"cache_repo":           cacheReg + "/cache",
+				"git_url":              "https://git.local/repo.git",
+				"local_repo_path":      strings.TrimPrefix(gitURL, "file://"),
+				"docker_config_base64": dockerConfig,
+			},
+			expectStatuses: map[string]string{"builder_image": "pass", "cache_repo": "pass", "local_repo_path": "pass", "git_url": "skip"},
+		},
+		{
+			name:            "missing required attributes",
+			config:          map[string]any{"builder_image": builderImage},
+			expectCode:      1,
+			expectSummaries: []string{"Missing required argument"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			config, err := json.Marshal(tc.config)
+			require.NoError(t, err)
+
+			var stdout, stderr bytes.Buffer
+			// The local Docker config must not be used for the cache repo.
+			providerConfig := `{"use_local_docker_config": false}`
+			dir := t.TempDir()
+			gittest.WriteFiles(t, dir, map[string]string{"provider.json": providerConfig})
+			args := []string{"-config", "-", "-provider-config", filepath.Join(dir, "provider.json")}
+			code := DoctorCommand(context.Background(), "test", args, bytes.NewReader(config), &stdout, &stderr)
+			assert.Equal(t, tc.expectCode, code, stderr.String())
+
+			var report doctorReport
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &report), stdout.String())
+			statuses := make(map[string]string)
+			for _, check := range report.Checks {
+				statuses[check.Name] = check.Status
+			}
+			if tc.expectStatuses == nil {
+				tc.expectStatuses = map[string]string{}
+			}
+			assert.Equal(t, tc.expectStatuses, statuses, stdout.String())
+			var summaries []string
+			for _, d := range report.Diagnostics {
+				summaries = append(summaries, d.Summary)
+			}
+			assert.Equal(t, tc.expectSummaries, summaries)
+		})
+	}
+
+	t.Run("no config", func(t *testing.T) {
+		t.Parallel()
+		var stdout, stderr bytes.Buffer
+		code := DoctorCommand(context.Background(), "test", nil, strings.NewReader(""), &stdout, &stderr)
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr.String(), "Usage: terraform-provider-envbuilder doctor")
+	})
+}
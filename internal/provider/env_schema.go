@@ -0,0 +1,181 @@
+package provider
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/serpent"
+)
+
+// envSchema is a JSON schema of the env_map attribute of
+// envbuilder_cached_image, and so of the env attribute once split on the
+// first "=". It only uses the subset of JSON Schema that is needed here.
+type envSchema struct {
+	Schema      string `json:"$schema"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	// EnvbuilderVersion is the version of envbuilder whose options the
+	// provider computes the environment from.
+	EnvbuilderVersion    string                       `json:"x-envbuilder-version,omitempty"`
+	Properties           map[string]envSchemaProperty `json:"properties"`
+	PropertyNames        envSchemaPropertyNames       `json:"propertyNames"`
+	AdditionalProperties envSchemaProperty            `json:"additionalProperties"`
+}
+
+type envSchemaProperty struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Deprecated  bool     `json:"deprecated,omitempty"`
+	// Flag is the envbuilder command line flag of the option.
+	Flag string `json:"x-envbuilder-flag,omitempty"`
+	// LegacyNameOf is the ENVBUILDER_ prefixed name of a legacy name.
+	LegacyNameOf string `json:"x-legacy-name-of,omitempty"`
+}
+
+// envSchemaPropertyNames allows any of the properties, or any name that
+// extra_env can set.
+type envSchemaPropertyNames struct {
+	AnyOf []envSchemaNameRule `json:"anyOf"`
+}
+
+type envSchemaNameRule struct {
+	Enum []string           `json:"enum,omitempty"`
+	Not  *envSchemaNameRule `json:"not,omitempty"`
+	// Pattern is only used within Not.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// newEnvSchema returns the schema of the environment that
+// computeEnvFromOptions can produce: the envbuilder options with their
+// ENVBUILDER_ prefixed and legacy names, CODER_AGENT_SUBSYSTEM, and any
+// variable from extra_env that is not an envbuilder option.
+func newEnvSchema() envSchema {
+	s := envSchema{
+		Schema:      "https://json-schema.org/draft/2020-12/schema",
+		Title:       "envbuilder_cached_image env_map",
+		Description: "The environment computed by the envbuilder_cached_image resource of the envbuilder Terraform provider. Options with their zero value, false or 0 are not set. Legacy names are only set if legacy_env_names is \"both\" or \"only\", and ENVBUILDER_ prefixed names are not set if it is \"only\".",
+		Type:        "object",
+		Properties:  make(map[string]envSchemaProperty),
+		AdditionalProperties: envSchemaProperty{
+			Type:        "string",
+			Description: "Set from extra_env.",
+		},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/coder/envbuilder" {
+				s.EnvbuilderVersion = dep.Version
+			}
+		}
+	}
+
+	var opts eboptions.Options
+	cliOpts := opts.CLI()
+	envs := make(map[string]bool)
+	for _, opt := range cliOpts {
+		envs[opt.Env] = true
+	}
+	for _, opt := range cliOpts {
+		// envbuilder only reads CODER_AGENT_SUBSYSTEM without the ENVBUILDER_
+		// prefix, so it is set under that name.
+		if opt.Env == "CODER_AGENT_SUBSYSTEM" {
+			s.Properties[opt.Env] = envSchemaProperty{
+				Type:        "string",
+				Description: opt.Description + " A comma-separated list.",
+				Flag:        "--" + opt.Flag,
+			}
+			continue
+		}
+		if !strings.HasPrefix(opt.Env, envbuilderOptionPrefix) {
+			continue
+		}
+		prop := envSchemaProperty{
+			Type:        "string",
+			Description: opt.Description,
+			Flag:        "--" + opt.Flag,
+		}
+		switch opt.Value.(type) {
+		case *serpent.Bool:
+			prop.Enum = []string{"true"}
+		case *serpent.Int64:
+			prop.Pattern = "^-?[0-9]+$"
+		case *serpent.StringArray:
+			prop.Description += " A comma-separated list."
+		}
+		s.Properties[opt.Env] = prop
+
+		if legacyName := strings.TrimPrefix(opt.Env, envbuilderOptionPrefix); envs[legacyName] {
+			legacy := prop
+			legacy.Description = fmt.Sprintf("The legacy name of %s.", opt.Env)
+			legacy.Deprecated = true
+			legacy.Flag = ""
+			legacy.LegacyNameOf = opt.Env
+			s.Properties[legacyName] = legacy
+		}
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s.PropertyNames.AnyOf = []envSchemaNameRule{
+		{Enum: names},
+		// Variables in extra_env that are envbuilder options are ignored.
+		{Not: &envSchemaNameRule{Pattern: "^" + envbuilderOptionPrefix}},
+	}
+	return s
+}
+
+// EnvSchemaCommand prints a JSON schema of the environment computed by the
+// envbuilder_cached_image resource to stdout, or to the file given by -o, so
+// that consumers of the environment can validate it. It returns the exit
+// code of the command: 0 on success, and 2 otherwise.
+func EnvSchemaCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("env-schema", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(stderr, "Usage: terraform-provider-envbuilder env-schema [-o <file>]")
+		_, _ = fmt.Fprintln(stderr)
+		_, _ = fmt.Fprintln(stderr, "Prints a JSON schema of the environment computed by the envbuilder_cached_image resource.")
+		_, _ = fmt.Fprintln(stderr)
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Path to write the schema to. If not set, it is written to stdout.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if *output == "" {
+		if !writeCommandOutput(newEnvSchema(), stdout, stderr) {
+			return 2
+		}
+		return 0
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "create output: %s\n", err)
+		return 2
+	}
+	ok := writeCommandOutput(newEnvSchema(), f, stderr)
+	if err := f.Close(); err != nil {
+		_, _ = fmt.Fprintf(stderr, "write output: %s\n", err)
+		return 2
+	}
+	if !ok {
+		return 2
+	}
+	return 0
+}
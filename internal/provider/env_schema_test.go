@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"regexp"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/serpent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvSchema(t *testing.T) {
+	t.Parallel()
+
+	// Set every option, so that the computed environment has every key.
+	var opts eboptions.Options
+	for _, opt := range opts.CLI() {
+		val := "value"
+		switch opt.Value.(type) {
+		case *serpent.Bool:
+			val = "true"
+		case *serpent.Int64:
+			val = "42"
+		case *serpent.Duration:
+			val = "1s"
+		}
+		require.NoError(t, opt.Value.Set(val), opt.Env)
+	}
+	env := computeEnvFromOptions(opts, map[string]string{"FOO": "bar", "ENVBUILDER_IGNORED": "x"}, legacyEnvNamesBoth)
+
+	s := newEnvSchema()
+	allowedNames := make(map[string]bool)
+	for _, name := range s.PropertyNames.AnyOf[0].Enum {
+		allowedNames[name] = true
+	}
+	for key, val := range env {
+		prop, ok := s.Properties[key]
+		if !ok {
+			assert.False(t, regexp.MustCompile(s.PropertyNames.AnyOf[1].Not.Pattern).MatchString(key), "%s is not in the schema", key)
+			continue
+		}
+		assert.True(t, allowedNames[key], key)
+		if len(prop.Enum) > 0 {
+			assert.Contains(t, prop.Enum, val, key)
+		}
+		if prop.Pattern != "" {
+			assert.Regexp(t, prop.Pattern, val, key)
+		}
+	}
+	assert.Contains(t, env, "FOO")
+	assert.Equal(t, "ENVBUILDER_GIT_URL", s.Properties["GIT_URL"].LegacyNameOf)
+	assert.True(t, s.Properties["GIT_URL"].Deprecated)
+	assert.Equal(t, "--git-url", s.Properties["ENVBUILDER_GIT_URL"].Flag)
+}
@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// gcpCloudPlatformScope is the OAuth scope of the access tokens used to
+	// authenticate to Google registries.
+	gcpCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// gcpAccessTokenUsername is the username Google registries expect with
+	// an OAuth access token as the password.
+	gcpAccessTokenUsername = "oauth2accesstoken"
+)
+
+// gcpCredentials gets credentials for Google Artifact Registry and Container
+// Registry from Google Application Default Credentials, configured by
+// gcp_auth. These are found in GOOGLE_APPLICATION_CREDENTIALS, the gcloud
+// configuration, or the metadata server, which provides those of the attached
+// service account or workload identity. Access tokens are refreshed as they
+// expire. A nil *gcpCredentials has no credentials.
+type gcpCredentials struct {
+	// netOpts configures the connections made to get access tokens.
+	netOpts netutil.Options
+
+	mu sync.Mutex
+	// source returns access tokens. It is created when first needed.
+	source oauth2.TokenSource
+}
+
+var _ cloudCredentials = &gcpCredentials{}
+
+// isGCPRegistry reports whether host is a Google Artifact Registry or
+// Container Registry host, e.g. us-docker.pkg.dev or gcr.io.
+func isGCPRegistry(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	return strings.HasSuffix(host, ".pkg.dev") || host == "gcr.io" || strings.HasSuffix(host, ".gcr.io")
+}
+
+func (*gcpCredentials) registry(host string) bool {
+	return isGCPRegistry(host)
+}
+
+// credentials returns the credentials of host. The returned config is empty
+// if host is not a Google registry.
+func (g *gcpCredentials) credentials(_ context.Context, host string) (authn.AuthConfig, error) {
+	if g == nil || !isGCPRegistry(host) {
+		return authn.AuthConfig{}, nil
+	}
+	g.mu.Lock()
+	if g.source == nil {
+		// The token source refreshes tokens with this context, so it must
+		// outlive the request that first needs them.
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: g.netOpts.Transport()})
+		source, err := google.DefaultTokenSource(ctx, gcpCloudPlatformScope)
+		if err != nil {
+			g.mu.Unlock()
+			return authn.AuthConfig{}, fmt.Errorf("find google application default credentials: %w", err)
+		}
+		g.source = source
+	}
+	source := g.source
+	g.mu.Unlock()
+
+	token, err := source.Token()
+	if err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("get google access token for %q: %w", host, err)
+	}
+	return authn.AuthConfig{Username: gcpAccessTokenUsername, Password: token.AccessToken}, nil
+}
+
+func (g *gcpCredentials) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return g.ResolveContext(context.Background(), target)
+}
+
+func (g *gcpCredentials) ResolveContext(ctx context.Context, target authn.Resource) (authn.Authenticator, error) {
+	cfg, err := g.credentials(ctx, target.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	if cfg == (authn.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(cfg), nil
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestIsGCPRegistry(t *testing.T) {
+	t.Parallel()
+
+	for host, want := range map[string]bool{
+		"us-docker.pkg.dev":      true,
+		"europe-west1.pkg.dev":   true,
+		"gcr.io":                 true,
+		"eu.gcr.io":              true,
+		"GCR.IO:443":             true,
+		"ghcr.io":                false,
+		"index.docker.io":        false,
+		"pkg.dev.example.com":    false,
+		"registry.internal:5000": false,
+	} {
+		assert.Equal(t, want, isGCPRegistry(host), host)
+	}
+}
+
+func TestGCPCredentials(t *testing.T) {
+	t.Parallel()
+
+	g := &gcpCredentials{source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access-token"})}
+	repo, err := name.NewRepository("us-docker.pkg.dev/project/cache")
+	require.NoError(t, err)
+	auth, err := g.Resolve(repo)
+	require.NoError(t, err)
+	cfg, err := auth.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &authn.AuthConfig{Username: "oauth2accesstoken", Password: "access-token"}, cfg)
+
+	// Other registries get no credentials.
+	repo, err = name.NewRepository("ghcr.io/coder/cache")
+	require.NoError(t, err)
+	auth, err = g.Resolve(repo)
+	require.NoError(t, err)
+	assert.Equal(t, authn.Anonymous, auth)
+
+	// Credentials already in the Docker config are kept.
+	dockerConfig := base64.StdEncoding.EncodeToString([]byte(`{"auths": {"europe-docker.pkg.dev": {"auth": "b2xkOm9sZA=="}}}`))
+	got, err := dockerConfigWithCloudCredentials(context.Background(), dockerConfig, []cloudCredentials{g}, "us-docker.pkg.dev/project/cache", "europe-docker.pkg.dev/project/envbuilder:latest", "ghcr.io/coder/envbuilder")
+	require.NoError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {
+		"us-docker.pkg.dev": {"auth": "b2F1dGgyYWNjZXNzdG9rZW46YWNjZXNzLXRva2Vu"},
+		"europe-docker.pkg.dev": {"auth": "b2xkOm9sZA=="}
+	}}`, string(decoded))
+
+	// Without cloud credentials, the config is unchanged.
+	got, err = dockerConfigWithCloudCredentials(context.Background(), dockerConfig, nil, "us-docker.pkg.dev/project/cache")
+	require.NoError(t, err)
+	assert.Equal(t, dockerConfig, got)
+}
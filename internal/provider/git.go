@@ -0,0 +1,180 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	giturls "github.com/chainguard-dev/git-urls"
+	ebgit "github.com/coder/envbuilder/git"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitclient "github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// commitSHA matches a full commit SHA.
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// firstReachableGitURL returns the first of gitURLs whose refs can be listed
+// using the credentials and settings in opts, in the same way that
+// envbuilder would clone it, and gitTr for remotes over HTTP(S). If none can
+// be listed, the returned error describes why for each URL.
+func firstReachableGitURL(ctx context.Context, logf func(string, ...any), opts eboptions.Options, gitTr *http.Transport, gitURLs []string) (string, error) {
+	var errs []error
+	for _, gitURL := range gitURLs {
+		opts.GitURL = gitURL
+		cloneOpts, err := ebgit.CloneOptionsFromOptions(logf, opts)
+		if err != nil {
+			return "", fmt.Errorf("git clone options: %w", err)
+		}
+		// The ref is not part of the remote URL.
+		remoteURL, _, _ := strings.Cut(gitURL, "#")
+		_, err = listRemoteRefs(ctx, remoteURL, cloneOpts, gitTr)
+		if err == nil {
+			return gitURL, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", remoteURL, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", errors.Join(errs...)
+}
+
+// normalizeGitURL returns gitURL in the form in which envbuilder clones it.
+// envbuilder converts scp-style URLs such as git@github.com:org/repo.git to
+// ssh://git@github.com/org/repo.git, but does not handle a "#ref" suffix on
+// them, so they are normalized up front to keep the probe and the workspace
+// in agreement. Other URLs and absolute paths are returned unchanged, and an
+// error is returned for anything else.
+func normalizeGitURL(gitURL string) (string, error) {
+	base, ref, hasRef := strings.Cut(gitURL, "#")
+	if base == "" {
+		return "", errors.New("the URL must not be empty")
+	}
+	if hasRef && ref == "" {
+		return "", errors.New("the ref after \"#\" must not be empty")
+	}
+
+	if strings.Contains(base, "://") {
+		u, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		if !giturls.Transports.Valid(u.Scheme) {
+			return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+		}
+		if u.Host == "" && u.Scheme != "file" {
+			return "", errors.New("the URL has no host")
+		}
+		return gitURL, nil
+	}
+	if strings.HasPrefix(base, "/") {
+		return gitURL, nil
+	}
+
+	u, err := giturls.ParseScp(base)
+	if err != nil || u.RawQuery != "" {
+		return "", errors.New("expected a URL such as https://host/org/repo.git, an scp-style URL such as git@host:org/repo.git, or an absolute path")
+	}
+	if hasRef {
+		u.Fragment = ref
+	}
+	return u.String(), nil
+}
+
+// resolveGitCommit returns the commit that the git URL in opts resolves to,
+// with its ref or the default branch, by listing the refs of the remote as
+// envbuilder would clone it, using gitTr for remotes over HTTP(S).
+func resolveGitCommit(ctx context.Context, logf func(string, ...any), opts eboptions.Options, gitTr *http.Transport) (string, error) {
+	remoteURL, ref, _ := strings.Cut(opts.GitURL, "#")
+	if commitSHA.MatchString(ref) {
+		return ref, nil
+	}
+	cloneOpts, err := ebgit.CloneOptionsFromOptions(logf, opts)
+	if err != nil {
+		return "", fmt.Errorf("git clone options: %w", err)
+	}
+	refs, err := listRemoteRefs(ctx, remoteURL, cloneOpts, gitTr)
+	if err != nil {
+		return "", err
+	}
+	candidates := []plumbing.ReferenceName{plumbing.HEAD}
+	if ref != "" {
+		candidates = []plumbing.ReferenceName{
+			plumbing.ReferenceName(ref),
+			plumbing.NewBranchReferenceName(ref),
+			plumbing.NewTagReferenceName(ref),
+		}
+	}
+	for _, name := range candidates {
+		r, ok := refs[name]
+		// Follow symbolic references, such as HEAD, one level.
+		if ok && r.Type() == plumbing.SymbolicReference {
+			r, ok = refs[r.Target()]
+		}
+		if ok && r.Type() == plumbing.HashReference {
+			// Annotated tags are peeled to the commit they point to.
+			if peeled, ok := refs[plumbing.ReferenceName(string(name)+"^{}")]; ok {
+				return peeled.Hash().String(), nil
+			}
+			return r.Hash().String(), nil
+		}
+	}
+	return "", errors.New("the ref was not found on the remote")
+}
+
+// listRemoteRefs lists the refs of the remote at remoteURL with cloneOpts,
+// by name, as git.Remote.ListContext does. Remotes over HTTP(S) are reached
+// with gitTr, rather than the transport installed in go-git, which is only
+// replaced while envbuilder runs. If gitTr is nil, the installed one is used.
+func listRemoteRefs(ctx context.Context, remoteURL string, cloneOpts ebgit.CloneRepoOptions, gitTr *http.Transport) (refs map[plumbing.ReferenceName]*plumbing.Reference, err error) {
+	ep, err := transport.NewEndpoint(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	ep.InsecureSkipTLS = cloneOpts.Insecure
+	ep.CaBundle = cloneOpts.CABundle
+	ep.Proxy = cloneOpts.ProxyOptions
+
+	var client transport.Transport
+	if gitTr != nil && (ep.Protocol == "http" || ep.Protocol == "https") {
+		client = githttp.NewClient(&http.Client{Transport: gitTr})
+	} else {
+		client, err = gitclient.NewClient(ep)
+		if err != nil {
+			return nil, err
+		}
+	}
+	session, err := client.NewUploadPackSession(ep, cloneOpts.RepoAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := ar.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs = make(map[plumbing.ReferenceName]*plumbing.Reference, len(all)+len(ar.Peeled))
+	for name, ref := range all {
+		refs[name] = ref
+	}
+	for name, hash := range ar.Peeled {
+		refs[plumbing.ReferenceName(name+"^{}")] = plumbing.NewHashReference(plumbing.ReferenceName(name+"^{}"), hash)
+	}
+	return refs, nil
+}
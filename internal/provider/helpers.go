@@ -1,19 +1,57 @@
 package provider
 
 import (
+	"context"
 	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	eboptions "github.com/coder/envbuilder/options"
 	"github.com/coder/serpent"
 	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/spf13/pflag"
 )
 
 const (
 	envbuilderOptionPrefix = "ENVBUILDER_"
+
+	// Values of legacy_env_names, which selects the environment variable
+	// names emitted for envbuilder options.
+	legacyEnvNamesNone = "none"
+	legacyEnvNamesBoth = "both"
+	legacyEnvNamesOnly = "only"
+
+	// Values of required_labels_policy.
+	requiredLabelsPolicyMiss  = "miss"
+	requiredLabelsPolicyError = "error"
+
+	// Values of max_image_size_policy.
+	maxImageSizePolicyError = "error"
+	maxImageSizePolicyWarn  = "warn"
+
+	// Values of base_image_compliance_policy.
+	compliancePolicyError = "error"
+	compliancePolicyWarn  = "warn"
+
+	// Values of git_bitbucket_auth_type.
+	bitbucketAuthAppPassword = "app_password"
+	bitbucketAuthAccessToken = "access_token"
+
+	// bitbucketAccessTokenUsername is the username Bitbucket Cloud requires
+	// for repository, project and workspace access tokens.
+	bitbucketAccessTokenUsername = "x-token-auth"
 )
 
 // nonOverrideOptions are options that cannot be overridden by extra_env.
@@ -22,15 +60,88 @@ var nonOverrideOptions = map[string]bool{
 	"ENVBUILDER_GIT_URL":    true,
 }
 
+// overridePolicy configures how options set by attributes may be overridden
+// by the options attribute and extra_env. The zero value allows overriding
+// any option except nonOverrideOptions, with a warning.
+type overridePolicy struct {
+	// lockedOptions are the environment variable names of options that
+	// cannot be overridden, in addition to nonOverrideOptions.
+	lockedOptions map[string]bool
+	// errorOnOverride reports overrides, and attempts to override locked
+	// options, as errors instead of warnings.
+	errorOnOverride bool
+	// preferAttributes gives options set by attributes precedence over
+	// extra_env.
+	preferAttributes bool
+	// suppressedWarnings are the environment variable names of options
+	// that may be overridden without a warning. Overrides are still
+	// reported if errorOnOverride is set.
+	suppressedWarnings map[string]bool
+}
+
+// locked returns whether the option with the given environment variable
+// name cannot be overridden. Legacy names without the ENVBUILDER_ prefix are
+// locked along with their prefixed counterparts.
+func (p overridePolicy) locked(key string) bool {
+	return nonOverrideOptions[key] || p.lockedOptions[key] || p.lockedOptions[envbuilderOptionPrefix+key]
+}
+
+// report adds a diagnostic about an override with the configured severity.
+func (p overridePolicy) report(diags *diag.Diagnostics, attrPath path.Path, summary, detail string) {
+	if p.errorOnOverride {
+		diags.AddAttributeError(attrPath, summary, detail)
+		return
+	}
+	diags.AddAttributeWarning(attrPath, summary, detail)
+}
+
+// reportOverride reports that the option with the given environment variable
+// name was overridden, unless warnings for the option are suppressed.
+func (p overridePolicy) reportOverride(diags *diag.Diagnostics, attrPath path.Path, key, summary, detail string) {
+	if !p.errorOnOverride && p.suppressedWarnings[key] {
+		return
+	}
+	p.report(diags, attrPath, summary, detail)
+}
+
 // optionsFromDataModel converts a CachedImageResourceModel into a corresponding set of
-// Envbuilder options. It returns the options and any diagnostics encountered.
-func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, diag.Diagnostics) {
+// Envbuilder options, applying overrides according to policy. It returns the
+// options and any diagnostics encountered.
+func optionsFromDataModel(data CachedImageResourceModel, policy overridePolicy) (eboptions.Options, diag.Diagnostics) {
 	var diags diag.Diagnostics
 	var opts eboptions.Options
 
+	if !data.SuppressOverrideWarnings.IsNull() {
+		knownOptions := make(map[string]bool)
+		for _, opt := range opts.CLI() {
+			knownOptions[opt.Env] = true
+		}
+		policy.suppressedWarnings = make(map[string]bool)
+		for idx, key := range tfutil.TFListToStringSlice(data.SuppressOverrideWarnings) {
+			if !knownOptions[key] {
+				diags.AddAttributeError(path.Root("suppress_override_warnings").AtListIndex(idx),
+					"Unknown envbuilder option",
+					fmt.Sprintf("%q is not the environment variable name of an envbuilder option.", key),
+				)
+				continue
+			}
+			policy.suppressedWarnings[key] = true
+		}
+	}
+
 	// Required options. Cannot be overridden by extra_env.
-	opts.CacheRepo = data.CacheRepo.ValueString()
-	opts.GitURL = data.GitURL.ValueString()
+	opts.CacheRepo = data.cacheRepo()
+	opts.GitURL = data.gitURL()
+	if !data.GitRef.IsNull() && strings.Contains(data.GitURL.ValueString(), "#") {
+		diags.AddAttributeError(path.Root("git_ref"),
+			"Conflicting git ref",
+			fmt.Sprintf("git_url %q already has a ref after \"#\", so git_ref must not be set.", data.GitURL.ValueString()),
+		)
+	}
+	// Invalid URLs are reported by the validator of git_url.
+	if gitURL, err := normalizeGitURL(opts.GitURL); err == nil {
+		opts.GitURL = gitURL
+	}
 
 	// Other options can be overridden by extra_env, with a warning.
 	// Keep track of which options are set from the data model so we
@@ -52,6 +163,11 @@ func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, dia
 		opts.CacheTTLDays = data.CacheTTLDays.ValueInt64()
 	}
 
+	if !data.CoderAgentSubsystem.IsNull() {
+		providerOpts["CODER_AGENT_SUBSYSTEM"] = true
+		opts.CoderAgentSubsystem = tfutil.TFListToStringSlice(data.CoderAgentSubsystem)
+	}
+
 	if !data.DevcontainerDir.IsNull() {
 		providerOpts["ENVBUILDER_DEVCONTAINER_DIR"] = true
 		opts.DevcontainerDir = data.DevcontainerDir.ValueString()
@@ -77,6 +193,11 @@ func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, dia
 		opts.ExitOnBuildFailure = data.ExitOnBuildFailure.ValueBool()
 	}
 
+	if !data.ExportEnvFile.IsNull() {
+		providerOpts["ENVBUILDER_EXPORT_ENV_FILE"] = true
+		opts.ExportEnvFile = data.ExportEnvFile.ValueString()
+	}
+
 	if !data.FallbackImage.IsNull() {
 		providerOpts["ENVBUILDER_FALLBACK_IMAGE"] = true
 		opts.FallbackImage = data.FallbackImage.ValueString()
@@ -122,11 +243,26 @@ func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, dia
 		opts.IgnorePaths = tfutil.TFListToStringSlice(data.IgnorePaths)
 	}
 
+	if !data.InitArgs.IsNull() {
+		providerOpts["ENVBUILDER_INIT_ARGS"] = true
+		opts.InitArgs = data.InitArgs.ValueString()
+	}
+
+	if !data.InitCommand.IsNull() {
+		providerOpts["ENVBUILDER_INIT_COMMAND"] = true
+		opts.InitCommand = data.InitCommand.ValueString()
+	}
+
 	if !data.Insecure.IsNull() {
 		providerOpts["ENVBUILDER_INSECURE"] = true
 		opts.Insecure = data.Insecure.ValueBool()
 	}
 
+	if !data.PushImage.IsNull() {
+		providerOpts["ENVBUILDER_PUSH_IMAGE"] = true
+		opts.PushImage = data.PushImage.ValueBool()
+	}
+
 	if data.RemoteRepoBuildMode.IsNull() {
 		opts.RemoteRepoBuildMode = true
 	} else {
@@ -134,6 +270,16 @@ func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, dia
 		opts.RemoteRepoBuildMode = data.RemoteRepoBuildMode.ValueBool()
 	}
 
+	if !data.RuntimeLayerCacheDir.IsNull() {
+		providerOpts["ENVBUILDER_LAYER_CACHE_DIR"] = true
+		opts.LayerCacheDir = data.RuntimeLayerCacheDir.ValueString()
+	}
+
+	if !data.SkipRebuild.IsNull() {
+		providerOpts["ENVBUILDER_SKIP_REBUILD"] = true
+		opts.SkipRebuild = data.SkipRebuild.ValueBool()
+	}
+
 	if !data.SSLCertBase64.IsNull() {
 		providerOpts["ENVBUILDER_SSL_CERT_BASE64"] = true
 		opts.SSLCertBase64 = data.SSLCertBase64.ValueString()
@@ -149,12 +295,19 @@ func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, dia
 		opts.WorkspaceFolder = data.WorkspaceFolder.ValueString()
 	}
 
+	// Typed options override the attributes above, and are themselves
+	// overridden by extra_env.
+	diags = append(diags, overrideOptionsFromTyped(&opts, data.Options, providerOpts, policy)...)
+
 	// convert extraEnv to a map for ease of use.
 	extraEnv := make(map[string]string)
 	for k, v := range data.ExtraEnv.Elements() {
 		extraEnv[k] = tfutil.TFValueToString(v)
 	}
-	diags = append(diags, overrideOptionsFromExtraEnv(&opts, extraEnv, providerOpts)...)
+	diags = append(diags, overrideOptionsFromExtraEnv(&opts, extraEnv, providerOpts, policy)...)
+
+	diags = append(diags, checkIgnorePaths(path.Root("ignore_paths"), opts.IgnorePaths)...)
+	diags = append(diags, checkBitbucketAuth(&opts, data.GitBitbucketAuthType.ValueString())...)
 
 	if opts.GitSSHPrivateKeyPath != "" && opts.GitSSHPrivateKeyBase64 != "" {
 		diags.AddError("Cannot set more than one git ssh private key option",
@@ -164,10 +317,108 @@ func optionsFromDataModel(data CachedImageResourceModel) (eboptions.Options, dia
 	return opts, diags
 }
 
+// checkIgnorePaths warns about ignore paths that do not match what they
+// appear to. Kaniko matches each segment of an ignore path against the same
+// segment of the absolute paths in the filesystem with filepath.Match, both
+// when building and when probing the cache, and ignores what is below a
+// matching path. Patterns within a segment, such as /var/cache/*, therefore
+// work as they do in the real build, but "**" matches a single segment, and
+// relative or malformed ignore paths never match.
+func checkIgnorePaths(attrPath path.Path, ignorePaths []string) diag.Diagnostics {
+	var diags diag.Diagnostics
+	for _, p := range ignorePaths {
+		var problem string
+		switch {
+		case !strings.HasPrefix(p, "/"):
+			problem = "is relative, so it never matches: ignore paths are matched against absolute paths in the filesystem of the workspace. Use an absolute path, such as /workspaces/repo/node_modules, or a pattern for each segment, such as /workspaces/*/node_modules."
+		case strings.Contains(p, "**"):
+			problem = "contains \"**\", which matches within a single path segment like \"*\", not any number of directories. Use a pattern for each segment instead, such as /workspaces/*/node_modules."
+		default:
+			for _, segment := range strings.Split(p, "/") {
+				if _, err := filepath.Match(segment, ""); err != nil {
+					problem = fmt.Sprintf("is not a valid pattern, so it never matches: %s.", err)
+					break
+				}
+			}
+		}
+		if problem == "" {
+			continue
+		}
+		diags.AddAttributeWarning(attrPath,
+			"Ignore path does not match",
+			fmt.Sprintf("The ignore path %q %s", p, problem),
+		)
+	}
+	return diags
+}
+
+// checkBitbucketAuth validates the git credentials in opts for the given
+// git_bitbucket_auth_type, and defaults the username for access tokens.
+// Bitbucket Cloud only responds with a generic 403 to a wrong username, so
+// without an auth type it warns about credentials that look like a
+// common mistake for a bitbucket.org git_url.
+func checkBitbucketAuth(opts *eboptions.Options, authType string) diag.Diagnostics {
+	var diags diag.Diagnostics
+	switch authType {
+	case bitbucketAuthAppPassword:
+		if opts.GitUsername == "" || opts.GitPassword == "" {
+			diags.AddAttributeError(path.Root("git_bitbucket_auth_type"), "Missing Bitbucket app password credentials",
+				"Bitbucket app passwords require both git_username, set to your Bitbucket username, and git_password, set to the app password.")
+		} else if strings.Contains(opts.GitUsername, "@") {
+			diags.AddAttributeError(path.Root("git_username"), "Invalid Bitbucket username",
+				fmt.Sprintf("Bitbucket app passwords must be used with your Bitbucket username, not the email address %q. Your username is shown under Personal settings in Bitbucket.", opts.GitUsername))
+		}
+	case bitbucketAuthAccessToken:
+		if opts.GitPassword == "" {
+			diags.AddAttributeError(path.Root("git_bitbucket_auth_type"), "Missing Bitbucket access token",
+				"Set git_password to the repository, project or workspace access token.")
+		}
+		switch opts.GitUsername {
+		case "":
+			opts.GitUsername = bitbucketAccessTokenUsername
+		case bitbucketAccessTokenUsername:
+		default:
+			diags.AddAttributeError(path.Root("git_username"), "Invalid Bitbucket username",
+				fmt.Sprintf("Bitbucket access tokens must be used with the username %q, not %q. Unset git_username to use it by default.", bitbucketAccessTokenUsername, opts.GitUsername))
+		}
+	default:
+		if opts.GitPassword == "" || !isBitbucketCloudURL(opts.GitURL) {
+			break
+		}
+		if opts.GitUsername == "" || strings.Contains(opts.GitUsername, "@") {
+			diags.AddAttributeWarning(path.Root("git_username"), "Bitbucket credentials may be rejected",
+				"Bitbucket Cloud requires your Bitbucket username, not your email address, with an app password, and the username \"x-token-auth\" with an access token. "+
+					"Set git_bitbucket_auth_type to validate the credentials.")
+		}
+	}
+	return diags
+}
+
+// isBitbucketCloudURL returns whether gitURL is an HTTP(S) URL of a
+// repository hosted on Bitbucket Cloud.
+func isBitbucketCloudURL(gitURL string) bool {
+	u, err := url.Parse(gitURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return u.Hostname() == "bitbucket.org"
+}
+
+// addDefaultIgnorePaths adds the ignore paths configured on the provider to
+// opts, after those already set and skipping duplicates.
+func addDefaultIgnorePaths(opts *eboptions.Options, defaultIgnorePaths []string) {
+	for _, p := range defaultIgnorePaths {
+		if !slices.Contains(opts.IgnorePaths, p) {
+			opts.IgnorePaths = append(opts.IgnorePaths, p)
+		}
+	}
+}
+
 // overrideOptionsFromExtraEnv overrides the options in opts with values from extraEnv.
 // It returns any diagnostics encountered.
-// It will not override certain options, such as ENVBUILDER_CACHE_REPO and ENVBUILDER_GIT_URL.
-func overrideOptionsFromExtraEnv(opts *eboptions.Options, extraEnv map[string]string, providerOpts map[string]bool) diag.Diagnostics {
+// It will not override certain options, such as ENVBUILDER_CACHE_REPO and ENVBUILDER_GIT_URL,
+// nor any options locked by policy.
+func overrideOptionsFromExtraEnv(opts *eboptions.Options, extraEnv map[string]string, providerOpts map[string]bool, policy overridePolicy) diag.Diagnostics {
 	var diags diag.Diagnostics
 	// Make a map of the options for easy lookup.
 	optsMap := make(map[string]pflag.Value)
@@ -181,17 +432,41 @@ func overrideOptionsFromExtraEnv(opts *eboptions.Options, extraEnv map[string]st
 			continue
 		}
 
-		if nonOverrideOptions[key] {
+		// Legacy options share their value with the ENVBUILDER_ prefixed
+		// option, so treat them as the prefixed option.
+		if newKey := envbuilderOptionPrefix + key; isLegacyOptionName(optsMap, key) {
+			if _, ok := extraEnv[newKey]; ok {
+				diags.AddAttributeWarning(path.Root("extra_env"),
+					"Ignoring deprecated environment variable",
+					fmt.Sprintf("The key %q in extra_env is deprecated and ignored, as %q is also set.", key, newKey),
+				)
+				continue
+			}
 			diags.AddAttributeWarning(path.Root("extra_env"),
+				"Deprecated environment variable",
+				fmt.Sprintf("The key %q in extra_env is deprecated. Use %q instead.", key, newKey),
+			)
+			key = newKey
+		}
+
+		if policy.locked(key) {
+			policy.report(&diags, path.Root("extra_env"),
 				"Cannot override required environment variable",
 				fmt.Sprintf("The key %q in extra_env cannot be overridden.", key),
 			)
 			continue
 		}
 
-		// Check if the option was set on the provider data model and generate a warning if so.
+		// Check if the option was set on the provider data model and generate a diagnostic if so.
 		if providerOpts[key] {
-			diags.AddAttributeWarning(path.Root("extra_env"),
+			if policy.preferAttributes {
+				policy.reportOverride(&diags, path.Root("extra_env"), key,
+					"Ignoring provider environment variable override",
+					fmt.Sprintf("The key %q in extra_env is ignored as the option is set on the provider.", key),
+				)
+				continue
+			}
+			policy.reportOverride(&diags, path.Root("extra_env"), key,
 				"Overriding provider environment variable",
 				fmt.Sprintf("The key %q in extra_env overrides an option set on the provider.", key),
 			)
@@ -199,7 +474,7 @@ func overrideOptionsFromExtraEnv(opts *eboptions.Options, extraEnv map[string]st
 
 		// XXX: workaround for serpent behaviour where calling Set() on a
 		// string slice will append instead of replace: set to empty first.
-		if key == "ENVBUILDER_IGNORE_PATHS" {
+		if key == "ENVBUILDER_IGNORE_PATHS" || key == "CODER_AGENT_SUBSYSTEM" {
 			_ = optsMap[key].Set("")
 		}
 
@@ -213,28 +488,176 @@ func overrideOptionsFromExtraEnv(opts *eboptions.Options, extraEnv map[string]st
 	return diags
 }
 
-// computeEnvFromOptions computes the environment variables to set based on the
-// options in opts and the extra environment variables in extraEnv.
-// It returns the computed environment variables as a map.
-// It will not set certain options, such as ENVBUILDER_CACHE_REPO and ENVBUILDER_GIT_URL.
-// It will also not handle legacy Envbuilder options (i.e. those not prefixed with ENVBUILDER_).
-func computeEnvFromOptions(opts eboptions.Options, extraEnv map[string]string) map[string]string {
+// typedOptionName returns the name of the given option in the options
+// attribute, e.g. git_clone_depth for ENVBUILDER_GIT_CLONE_DEPTH.
+func typedOptionName(opt serpent.Option) string {
+	return strings.ReplaceAll(opt.Flag, "-", "_")
+}
+
+// overrideOptionsFromTyped overrides the options in opts with values from the
+// options attribute, which maps option names to values of the option's type.
+// It returns any diagnostics encountered.
+// Like overrideOptionsFromExtraEnv, it will not override certain options, such
+// as ENVBUILDER_CACHE_REPO and ENVBUILDER_GIT_URL, nor any options locked by
+// policy.
+func overrideOptionsFromTyped(opts *eboptions.Options, options types.Dynamic, providerOpts map[string]bool, policy overridePolicy) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if options.IsNull() || options.IsUnknown() || options.IsUnderlyingValueNull() || options.IsUnderlyingValueUnknown() {
+		return diags
+	}
+
+	var vals map[string]attr.Value
+	switch v := options.UnderlyingValue().(type) {
+	case basetypes.ObjectValue:
+		vals = v.Attributes()
+	case basetypes.MapValue:
+		vals = v.Elements()
+	default:
+		diags.AddAttributeError(path.Root("options"),
+			"Invalid value for options",
+			fmt.Sprintf("Expected an object mapping envbuilder option names to values, got %s.", v.Type(context.Background())),
+		)
+		return diags
+	}
+
+	// Make a map of the options for easy lookup. Only options with the
+	// ENVBUILDER_ prefix are supported; hidden options are internal.
+	optsMap := make(map[string]serpent.Option)
 	for _, opt := range opts.CLI() {
-		if opt.Env == "" {
+		if opt.Hidden || !strings.HasPrefix(opt.Env, envbuilderOptionPrefix) {
+			continue
+		}
+		optsMap[typedOptionName(opt)] = opt
+	}
+
+	names := make([]string, 0, len(vals))
+	for name := range vals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		val := vals[name]
+		attrPath := path.Root("options").AtMapKey(name)
+		opt, found := optsMap[name]
+		if !found {
+			diags.AddAttributeError(attrPath,
+				"Unknown envbuilder option",
+				fmt.Sprintf("%q is not a known envbuilder option. Option names are the envbuilder flag names with underscores, e.g. git_clone_depth.", name),
+			)
+			continue
+		}
+		if val.IsNull() || val.IsUnknown() {
 			continue
 		}
+
+		if policy.locked(opt.Env) {
+			policy.report(&diags, attrPath,
+				"Cannot override required option",
+				fmt.Sprintf("The option %q cannot be overridden.", name),
+			)
+			continue
+		}
+
+		if providerOpts[opt.Env] {
+			policy.reportOverride(&diags, attrPath, opt.Env,
+				"Overriding provider option",
+				fmt.Sprintf("The option %q overrides an option set on the provider.", name),
+			)
+		}
+
+		if err := setTypedOption(opt.Value, val); err != nil {
+			diags.AddAttributeError(attrPath,
+				"Invalid value for envbuilder option",
+				fmt.Sprintf("The option %q has an invalid value: %s", name, err),
+			)
+			continue
+		}
+		providerOpts[opt.Env] = true
 	}
+	return diags
+}
 
+// setTypedOption sets the option value dst to val, which must be of the
+// Terraform type corresponding to the type of dst.
+func setTypedOption(dst pflag.Value, val attr.Value) error {
+	switch dst := dst.(type) {
+	case *serpent.Bool:
+		v, ok := val.(basetypes.BoolValue)
+		if !ok {
+			return fmt.Errorf("expected a bool, got %s", val.Type(context.Background()))
+		}
+		*dst = serpent.Bool(v.ValueBool())
+	case *serpent.Int64:
+		v, ok := val.(basetypes.NumberValue)
+		if !ok {
+			return fmt.Errorf("expected a number, got %s", val.Type(context.Background()))
+		}
+		i, acc := v.ValueBigFloat().Int64()
+		if acc != big.Exact {
+			return fmt.Errorf("expected a whole number, got %s", v.ValueBigFloat().Text('f', -1))
+		}
+		*dst = serpent.Int64(i)
+	case *serpent.String:
+		v, ok := val.(basetypes.StringValue)
+		if !ok {
+			return fmt.Errorf("expected a string, got %s", val.Type(context.Background()))
+		}
+		*dst = serpent.String(v.ValueString())
+	case *serpent.StringArray:
+		var elems []attr.Value
+		switch v := val.(type) {
+		case basetypes.ListValue:
+			elems = v.Elements()
+		case basetypes.TupleValue:
+			elems = v.Elements()
+		case basetypes.SetValue:
+			elems = v.Elements()
+		default:
+			return fmt.Errorf("expected a list of strings, got %s", val.Type(context.Background()))
+		}
+		ss := make([]string, 0, len(elems))
+		for _, elem := range elems {
+			s, ok := elem.(basetypes.StringValue)
+			if !ok {
+				return fmt.Errorf("expected a list of strings, got an element of type %s", elem.Type(context.Background()))
+			}
+			ss = append(ss, s.ValueString())
+		}
+		*dst = serpent.StringArray(ss)
+	default:
+		return fmt.Errorf("unsupported option type %s", dst.Type())
+	}
+	return nil
+}
+
+// isLegacyOptionName reports whether key is the legacy name of an envbuilder
+// option, without the ENVBUILDER_ prefix. optsMap must contain the options
+// keyed by their environment variable names.
+func isLegacyOptionName(optsMap map[string]pflag.Value, key string) bool {
+	if strings.HasPrefix(key, envbuilderOptionPrefix) {
+		return false
+	}
+	_, ok := optsMap[envbuilderOptionPrefix+key]
+	return ok
+}
+
+// computeEnvFromOptions computes the environment variables to set based on the
+// options in opts and the extra environment variables in extraEnv.
+// It returns the computed environment variables as a map.
+// It will not set certain options, such as ENVBUILDER_CACHE_REPO and ENVBUILDER_GIT_URL.
+// Options are set using their ENVBUILDER_ prefixed names, their legacy names
+// without the prefix, or both, depending on legacyEnvNames.
+func computeEnvFromOptions(opts eboptions.Options, extraEnv map[string]string, legacyEnvNames string) map[string]string {
 	computed := make(map[string]string)
+	optsMap := make(map[string]pflag.Value)
 	for _, opt := range opts.CLI() {
+		optsMap[opt.Env] = opt.Value
 		if opt.Env == "" {
 			continue
 		}
-		// TODO: remove this check once support for legacy options is removed.
-		// Only set the environment variables from opts that are not legacy options.
 		// Legacy options are those that are not prefixed with ENVBUILDER_.
-		// While we can detect when a legacy option is set, overriding it becomes
-		// problematic. Erring on the side of caution, we will not override legacy options.
+		// They share their value with the prefixed option, so only the
+		// prefixed options are considered here.
 		if !strings.HasPrefix(opt.Env, envbuilderOptionPrefix) {
 			continue
 		}
@@ -250,16 +673,89 @@ func computeEnvFromOptions(opts eboptions.Options, extraEnv map[string]string) m
 			// Skip zero values.
 			continue
 		}
-		computed[opt.Env] = val
+		if legacyEnvNames != legacyEnvNamesOnly {
+			computed[opt.Env] = val
+		}
+		if legacyEnvNames == legacyEnvNamesBoth || legacyEnvNames == legacyEnvNamesOnly {
+			computed[strings.TrimPrefix(opt.Env, envbuilderOptionPrefix)] = val
+		}
+	}
+
+	// CODER_AGENT_SUBSYSTEM is not a legacy option, but envbuilder only reads
+	// it without the ENVBUILDER_ prefix.
+	if len(opts.CoderAgentSubsystem) > 0 {
+		computed["CODER_AGENT_SUBSYSTEM"] = strings.Join(opts.CoderAgentSubsystem, ",")
 	}
 
 	// Merge in extraEnv, which may override values from opts.
 	// Skip any keys that are envbuilder options.
+	// CODER_AGENT_SUBSYSTEM is set from opts above, which already reflects
+	// any override from extraEnv allowed by the override policy.
 	for key, val := range extraEnv {
-		if strings.HasPrefix(key, envbuilderOptionPrefix) {
+		if strings.HasPrefix(key, envbuilderOptionPrefix) || key == "CODER_AGENT_SUBSYSTEM" {
+			continue
+		}
+		// Legacy option names in extraEnv have been migrated to their
+		// ENVBUILDER_ prefixed equivalents.
+		if isLegacyOptionName(optsMap, key) {
 			continue
 		}
 		computed[key] = val
 	}
 	return computed
 }
+
+// localRepoURL returns a file:// URL for the git repository at localRepoPath
+// that envbuilder can clone in place of gitURL. The ref in gitURL is kept.
+// Without one, envbuilder would clone the default branch, so the currently
+// checked out commit is used instead.
+func localRepoURL(localRepoPath, gitURL string) string {
+	ref := "HEAD"
+	if _, fragment, ok := strings.Cut(gitURL, "#"); ok && fragment != "" {
+		ref = fragment
+	}
+	return "file://" + filepath.ToSlash(localRepoPath) + "#" + ref
+}
+
+// checkLocalRepo returns a *probeConfigError if the repository at
+// localRepoPath cannot be cloned from by localRepoURL: cloning from the
+// local filesystem runs git-upload-pack, so git must be installed.
+func checkLocalRepo(localRepoPath string) error {
+	if _, err := os.Stat(filepath.Join(localRepoPath, ".git")); err != nil {
+		return &probeConfigError{
+			summary: "Invalid local repository.",
+			hint:    "local_repo_path must be the root of a git working tree, containing a .git directory.",
+			err:     fmt.Errorf("local_repo_path %q is not a git repository: %w", localRepoPath, err),
+		}
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return &probeConfigError{
+			summary: "Git is not installed.",
+			hint:    "local_repo_path requires the git executable in the PATH of Terraform. Install git, or unset local_repo_path to clone git_url over the network.",
+			err:     fmt.Errorf("unable to clone local_repo_path %q: %w", localRepoPath, err),
+		}
+	}
+	return nil
+}
+
+// defaultCacheTTLDays is the number of days envbuilder uses cached layers
+// for if ENVBUILDER_CACHE_TTL_DAYS is not set.
+const defaultCacheTTLDays = 7
+
+// cacheExpired reports whether an image created at created would be
+// considered expired by envbuilder at now, given cacheTTLDays.
+func cacheExpired(created time.Time, cacheTTLDays int64, now time.Time) bool {
+	if cacheTTLDays == 0 {
+		cacheTTLDays = defaultCacheTTLDays
+	}
+	return created.Add(time.Duration(cacheTTLDays) * 24 * time.Hour).Before(now)
+}
+
+// joinCacheNamespace returns the repository for the cache namespace
+// namespace within cacheRepo, or cacheRepo if namespace is empty.
+func joinCacheNamespace(cacheRepo, namespace string) string {
+	if namespace == "" {
+		return cacheRepo
+	}
+	return strings.TrimSuffix(cacheRepo, "/") + "/" + namespace
+}
@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// setImageConfig sets user, workdir, entrypoint, cmd, exposed_ports and
+// labels from the config cfg of the cached image, or to empty values if cfg
+// is nil.
+func (data *CachedImageResourceModel) setImageConfig(cfg *v1.ConfigFile) {
+	var config v1.Config
+	if cfg != nil {
+		config = cfg.Config
+	}
+	ports := make([]string, 0, len(config.ExposedPorts))
+	for port := range config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	data.User = types.StringValue(config.User)
+	data.Workdir = types.StringValue(config.WorkingDir)
+	data.Entrypoint = stringListValue(config.Entrypoint)
+	data.Cmd = stringListValue(config.Cmd)
+	data.ExposedPorts = stringListValue(ports)
+	data.Labels = stringMapValue(config.Labels)
+}
+
+// setManifest sets annotations and layer_count from the manifest of the
+// cached image, or to empty values if manifest is nil.
+func (data *CachedImageResourceModel) setManifest(manifest *v1.Manifest) {
+	var (
+		annotations map[string]string
+		layers      int
+	)
+	if manifest != nil {
+		annotations, layers = manifest.Annotations, len(manifest.Layers)
+	}
+	data.Annotations = stringMapValue(annotations)
+	data.LayerCount = types.Int64Value(int64(layers))
+}
+
+// stringListValue returns a list of the strings in s, which is empty rather
+// than null if s is.
+func stringListValue(s []string) types.List {
+	elems := make([]attr.Value, 0, len(s))
+	for _, v := range s {
+		elems = append(elems, types.StringValue(v))
+	}
+	return types.ListValueMust(types.StringType, elems)
+}
+
+// stringMapValue returns a map of the strings in m, which is empty rather
+// than null if m is.
+func stringMapValue(m map[string]string) types.Map {
+	elems := make(map[string]attr.Value, len(m))
+	for k, v := range m {
+		elems[k] = types.StringValue(v)
+	}
+	return types.MapValueMust(types.StringType, elems)
+}
@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API versions of the ExecCredential objects of exec credential plugins.
+const (
+	execCredentialV1      = "client.authentication.k8s.io/v1"
+	execCredentialV1beta1 = "client.authentication.k8s.io/v1beta1"
+)
+
+// execCredentialRefreshMargin is how long before their expiry credentials
+// from an exec credential plugin are refreshed.
+const execCredentialRefreshMargin = time.Minute
+
+// kubeconfigExec is the exec credential plugin of a kubeconfig user, as
+// generated for EKS (aws eks get-token), GKE (gke-gcloud-auth-plugin) and AKS
+// (kubelogin).
+type kubeconfigExec struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+	InstallHint        string `yaml:"installHint"`
+	ProvideClusterInfo bool   `yaml:"provideClusterInfo"`
+}
+
+// execCluster is the cluster passed to an exec credential plugin that
+// requests it with provideClusterInfo.
+type execCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthorityData string `json:"certificate-authority-data,omitempty"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify,omitempty"`
+}
+
+// execCredentialPlugin runs an exec credential plugin to authenticate to the
+// Kubernetes API, caching the credentials until they expire.
+type execCredentialPlugin struct {
+	apiVersion  string
+	command     string
+	args        []string
+	env         []string
+	installHint string
+	// cluster is passed to the plugin if not nil.
+	cluster *execCluster
+
+	mu     sync.Mutex
+	token  string
+	cert   *tls.Certificate
+	expiry time.Time
+}
+
+// newExecCredentialPlugin returns the plugin configured by cfg. Relative
+// command paths are relative to dir, the directory of the kubeconfig.
+func newExecCredentialPlugin(cfg *kubeconfigExec, dir string, cluster *execCluster) (*execCredentialPlugin, error) {
+	switch cfg.APIVersion {
+	case execCredentialV1, execCredentialV1beta1:
+	default:
+		return nil, fmt.Errorf("exec credential plugin has unsupported apiVersion %q, use %q", cfg.APIVersion, execCredentialV1)
+	}
+	if cfg.Command == "" {
+		return nil, errors.New("exec credential plugin has no command")
+	}
+	p := &execCredentialPlugin{
+		apiVersion:  cfg.APIVersion,
+		command:     cfg.Command,
+		args:        cfg.Args,
+		installHint: cfg.InstallHint,
+	}
+	// As with kubectl, a command with a path separator is relative to the
+	// kubeconfig, and any other is looked up in the PATH.
+	if strings.ContainsRune(p.command, filepath.Separator) && !filepath.IsAbs(p.command) {
+		p.command = filepath.Join(dir, p.command)
+	}
+	for _, e := range cfg.Env {
+		p.env = append(p.env, e.Name+"="+e.Value)
+	}
+	if cfg.ProvideClusterInfo {
+		p.cluster = cluster
+	}
+	return p, nil
+}
+
+// credentials returns the token or client certificate returned by the
+// plugin, running it if there are no cached credentials or they expire soon.
+func (p *execCredentialPlugin) credentials(ctx context.Context) (string, *tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if (p.token != "" || p.cert != nil) && (p.expiry.IsZero() || time.Until(p.expiry) > execCredentialRefreshMargin) {
+		return p.token, p.cert, nil
+	}
+	token, cert, expiry, err := p.run(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	p.token, p.cert, p.expiry = token, cert, expiry
+	return token, cert, nil
+}
+
+// reset drops the cached credentials, for example when they were rejected,
+// so that the plugin is run again for the next request.
+func (p *execCredentialPlugin) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.token, p.cert, p.expiry = "", nil, time.Time{}
+}
+
+// run runs the plugin and returns the credentials it printed.
+func (p *execCredentialPlugin) run(ctx context.Context) (string, *tls.Certificate, time.Time, error) {
+	spec := map[string]any{"interactive": false}
+	if p.cluster != nil {
+		spec["cluster"] = p.cluster
+	}
+	info, err := json.Marshal(map[string]any{
+		"apiVersion": p.apiVersion,
+		"kind":       "ExecCredential",
+		"spec":       spec,
+	})
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	cmd := exec.CommandContext(ctx, p.command, p.args...)
+	cmd.Env = append(append(os.Environ(), p.env...), "KUBERNETES_EXEC_INFO="+string(info))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) && p.installHint != "" {
+			return "", nil, time.Time{}, fmt.Errorf("run exec credential plugin %q: %w\n\n%s", p.command, err, p.installHint)
+		}
+		return "", nil, time.Time{}, fmt.Errorf("run exec credential plugin %q: %w: %s", p.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Status     *struct {
+			ExpirationTimestamp   *time.Time `json:"expirationTimestamp"`
+			Token                 string     `json:"token"`
+			ClientCertificateData string     `json:"clientCertificateData"`
+			ClientKeyData         string     `json:"clientKeyData"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("parse output of exec credential plugin %q: %w", p.command, err)
+	}
+	if out.Kind != "ExecCredential" || out.APIVersion != p.apiVersion {
+		return "", nil, time.Time{}, fmt.Errorf("exec credential plugin %q returned %s %s, expected ExecCredential %s", p.command, out.APIVersion, out.Kind, p.apiVersion)
+	}
+	if out.Status == nil || (out.Status.Token == "" && out.Status.ClientCertificateData == "") {
+		return "", nil, time.Time{}, fmt.Errorf("exec credential plugin %q returned no credentials", p.command)
+	}
+	var cert *tls.Certificate
+	if out.Status.ClientCertificateData != "" {
+		pair, err := tls.X509KeyPair([]byte(out.Status.ClientCertificateData), []byte(out.Status.ClientKeyData))
+		if err != nil {
+			return "", nil, time.Time{}, fmt.Errorf("load client certificate of exec credential plugin %q: %w", p.command, err)
+		}
+		cert = &pair
+	}
+	var expiry time.Time
+	if out.Status.ExpirationTimestamp != nil {
+		expiry = *out.Status.ExpirationTimestamp
+	}
+	return out.Status.Token, cert, expiry, nil
+}
+
+// clientCertificate returns the client certificate returned by the plugin
+// for a TLS handshake, or no certificate if it returned a token.
+func (p *execCredentialPlugin) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, cert, err := p.credentials(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return cert, nil
+}
+
+// execClusterInfo returns the cluster passed to exec credential plugins for
+// a cluster of a kubeconfig, whose CA is ca, if any.
+func execClusterInfo(server string, ca []byte, insecure bool) *execCluster {
+	cluster := &execCluster{Server: server, InsecureSkipTLSVerify: insecure}
+	if ca != nil {
+		cluster.CertificateAuthorityData = base64.StdEncoding.EncodeToString(ca)
+	}
+	return cluster
+}
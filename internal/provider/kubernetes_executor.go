@@ -0,0 +1,643 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// kubernetesServiceAccountDir is where Kubernetes mounts the credentials
+	// of the service account in pods.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubernetesProbeContainer is the name of the container of probe pods.
+	kubernetesProbeContainer = "envbuilder"
+	// kubernetesDevcontainerDir is where the devcontainer.json set by
+	// devcontainer_json_content is mounted in probe pods.
+	kubernetesDevcontainerDir = "/envbuilder-devcontainer"
+)
+
+// kubernetesPollInterval is how often the pod of a probe job is checked
+// while waiting for it to start or finish.
+var kubernetesPollInterval = time.Second
+
+// kubernetesExecutor runs the dry-run builds of cache probes in Kubernetes
+// jobs running the builder image. Only the manifest and config of the cached
+// image are then fetched by the provider, so the machine running Terraform
+// needs no access to the builder image or the layers in the cache repo.
+type kubernetesExecutor struct {
+	// kubeconfig is the path to the kubeconfig file. If empty, the
+	// KUBECONFIG environment variable, the service account of the pod
+	// Terraform runs in, or ~/.kube/config is used, in this order.
+	kubeconfig string
+	// namespace is the namespace of the jobs. If empty, the namespace of
+	// the kubeconfig context or service account is used.
+	namespace string
+	// nodeSelector constrains the nodes the jobs run on.
+	nodeSelector map[string]string
+	// netOpts configures the connections to the Kubernetes API.
+	netOpts netutil.Options
+}
+
+// kubernetesExecutorFromObject returns the Kubernetes executor configured by
+// the kubernetes block of probe_executor.
+func kubernetesExecutorFromObject(obj types.Object, netOpts netutil.Options) *kubernetesExecutor {
+	e := &kubernetesExecutor{netOpts: netOpts}
+	if kubeconfig, ok := obj.Attributes()["kubeconfig"].(types.String); ok {
+		e.kubeconfig = kubeconfig.ValueString()
+	}
+	if namespace, ok := obj.Attributes()["namespace"].(types.String); ok {
+		e.namespace = namespace.ValueString()
+	}
+	if nodeSelector, ok := obj.Attributes()["node_selector"].(types.Map); ok && !nodeSelector.IsNull() {
+		e.nodeSelector = tfutil.TFMapToStringMap(nodeSelector)
+	}
+	return e
+}
+
+// needsEnvbuilderBinary is false, as the job runs the entrypoint of the
+// builder image.
+func (*kubernetesExecutor) needsEnvbuilderBinary() bool {
+	return false
+}
+
+// run runs envbuilder in a job of the builder image, and follows the logs of
+// its pod. The options of envbuilder are passed in a secret, so that
+// credentials are not part of the job spec. Both are deleted once the probe
+// ends. Files referenced by options, such as an SSH private key path, must
+// exist in the builder image.
+func (e *kubernetesExecutor) run(ctx context.Context, probe remoteProbe, remoteOpts ...remote.Option) (v1.Image, error) {
+	// The pod cannot read the workspace folder source_dir is copied into.
+	if probe.opts.GitURL == "" {
+		return nil, errors.New("the kubernetes probe executor cannot probe source_dir, as the probe pod cannot read it: set git_url instead")
+	}
+	kc, err := e.client()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to kubernetes: %w", err)
+	}
+
+	opts := probe.opts
+	opts.GetCachedImage = true
+	// The default workspace folder in the scratch directory only exists on
+	// the machine running Terraform.
+	if strings.HasPrefix(opts.WorkspaceFolder, probe.scratchDir+string(filepath.Separator)) {
+		opts.WorkspaceFolder = ""
+	}
+	// Neither is the devcontainer.json written there, so it is mounted from
+	// a config map instead.
+	if probe.devcontainerJSON != "" {
+		opts.DevcontainerJSONPath = kubernetesDevcontainerDir + "/devcontainer.json"
+	}
+	env := computeEnvFromOptions(opts, probe.devcontainerEnv, legacyEnvNamesNone)
+
+	suffix := make([]byte, 5)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	name := "envbuilder-probe-" + hex.EncodeToString(suffix)
+	labels := map[string]string{probeContainerLabel: "true"}
+	ns := kc.namespace
+	// The job and secret are deleted even if ctx was cancelled.
+	cleanupCtx := context.WithoutCancel(ctx)
+	err = kc.do(ctx, http.MethodPost, "/api/v1/namespaces/"+ns+"/secrets", map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"name": name, "labels": labels},
+		"type":       "Opaque",
+		"stringData": env,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create probe secret: %w", err)
+	}
+	defer func() {
+		if err := kc.do(cleanupCtx, http.MethodDelete, "/api/v1/namespaces/"+ns+"/secrets/"+name, nil, nil); err != nil {
+			tflog.Warn(ctx, "unable to delete probe secret", map[string]any{"name": name, "err": err})
+		}
+	}()
+
+	container := map[string]any{
+		"name":    kubernetesProbeContainer,
+		"image":   probe.builderImage,
+		"envFrom": []map[string]any{{"secretRef": map[string]any{"name": name}}},
+	}
+	var volumes []map[string]any
+	if probe.devcontainerJSON != "" {
+		err = kc.do(ctx, http.MethodPost, "/api/v1/namespaces/"+ns+"/configmaps", map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]any{"name": name, "labels": labels},
+			"data":       map[string]string{"devcontainer.json": probe.devcontainerJSON},
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("create probe config map: %w", err)
+		}
+		defer func() {
+			if err := kc.do(cleanupCtx, http.MethodDelete, "/api/v1/namespaces/"+ns+"/configmaps/"+name, nil, nil); err != nil {
+				tflog.Warn(ctx, "unable to delete probe config map", map[string]any{"name": name, "err": err})
+			}
+		}()
+		volumes = []map[string]any{{"name": "devcontainer", "configMap": map[string]any{"name": name}}}
+		container["volumeMounts"] = []map[string]any{{"name": "devcontainer", "mountPath": kubernetesDevcontainerDir, "readOnly": true}}
+	}
+
+	hosts := make([]string, 0, len(probe.hostAliases))
+	for host := range probe.hostAliases {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var hostAliases []map[string]any
+	for _, host := range hosts {
+		hostAliases = append(hostAliases, map[string]any{"ip": probe.hostAliases[host], "hostnames": []string{host}})
+	}
+	err = kc.do(ctx, http.MethodPost, "/apis/batch/v1/namespaces/"+ns+"/jobs", map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]any{"name": name, "labels": labels},
+		"spec": map[string]any{
+			"backoffLimit": 0,
+			// Clean up after the job if the provider is interrupted.
+			"ttlSecondsAfterFinished": 600,
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": labels},
+				"spec": map[string]any{
+					"restartPolicy": "Never",
+					"nodeSelector":  e.nodeSelector,
+					"hostAliases":   hostAliases,
+					"volumes":       volumes,
+					"containers":    []map[string]any{container},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create probe job: %w", err)
+	}
+	defer func() {
+		err := kc.do(cleanupCtx, http.MethodDelete, "/apis/batch/v1/namespaces/"+ns+"/jobs/"+name+"?propagationPolicy=Background", nil, nil)
+		if err != nil {
+			tflog.Warn(ctx, "unable to delete probe job", map[string]any{"name": name, "err": err})
+		}
+	}()
+	tflog.Debug(ctx, "running envbuilder in a kubernetes job", map[string]any{"namespace": ns, "name": name, "builder_image": probe.builderImage})
+
+	pod, err := kc.waitForProbePod(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := kc.stream(ctx, "/api/v1/namespaces/"+ns+"/pods/"+pod.Metadata.Name+"/log?follow=true&container="+kubernetesProbeContainer)
+	if err != nil {
+		return nil, fmt.Errorf("read probe pod logs: %w", err)
+	}
+	defer logs.Close()
+	// The logs of a pod interleave stdout and stderr.
+	var output bytes.Buffer
+	lastError := scanContainerLogs(logs, probe.opts.Logger, &output)
+
+	pod, err = kc.waitForProbePod(ctx, name, true)
+	if err != nil {
+		return nil, err
+	}
+	if pod.Status.Phase != "Succeeded" {
+		if lastError != "" {
+			return nil, errors.New(lastError)
+		}
+		return nil, fmt.Errorf("probe pod %s: %s", pod.Metadata.Name, pod.failure())
+	}
+	return cachedImageFromOutput(output.String(), remoteOpts...)
+}
+
+// kubernetesPod is the part of a pod read by the executor.
+type kubernetesPod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase             string `json:"phase"`
+		Message           string `json:"message"`
+		ContainerStatuses []struct {
+			State struct {
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Terminated *struct {
+					ExitCode int    `json:"exitCode"`
+					Reason   string `json:"reason"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// finished reports whether the pod ran to completion.
+func (p kubernetesPod) finished() bool {
+	return p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed"
+}
+
+// failure describes why the pod failed, or cannot start.
+func (p kubernetesPod) failure() string {
+	for _, cs := range p.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil {
+			return fmt.Sprintf("envbuilder exited with status %d (%s)", t.ExitCode, t.Reason)
+		}
+		if w := cs.State.Waiting; w != nil && w.Reason != "" {
+			return strings.TrimSuffix(w.Reason+": "+w.Message, ": ")
+		}
+	}
+	if p.Status.Message != "" {
+		return p.Status.Message
+	}
+	return "phase " + p.Status.Phase
+}
+
+// stuck reports whether the pod cannot start, e.g. as its image cannot be
+// pulled.
+func (p kubernetesPod) stuck() bool {
+	for _, cs := range p.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			switch w.Reason {
+			case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// waitForProbePod waits for the pod of the job to start or, if finished is
+// true, to finish, and returns it.
+func (kc *kubernetesClient) waitForProbePod(ctx context.Context, job string, finished bool) (kubernetesPod, error) {
+	path := "/api/v1/namespaces/" + kc.namespace + "/pods?labelSelector=" + url.QueryEscape("job-name="+job)
+	for {
+		var pods struct {
+			Items []kubernetesPod `json:"items"`
+		}
+		if err := kc.do(ctx, http.MethodGet, path, nil, &pods); err != nil {
+			return kubernetesPod{}, fmt.Errorf("get probe pod: %w", err)
+		}
+		if len(pods.Items) > 0 {
+			pod := pods.Items[0]
+			if pod.stuck() {
+				return kubernetesPod{}, fmt.Errorf("probe pod %s cannot start: %s", pod.Metadata.Name, pod.failure())
+			}
+			if pod.finished() || (!finished && pod.Status.Phase == "Running") {
+				return pod, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return kubernetesPod{}, context.Cause(ctx)
+		case <-time.After(kubernetesPollInterval):
+		}
+	}
+}
+
+// kubernetesClient makes requests to the Kubernetes API.
+type kubernetesClient struct {
+	// server is the URL of the API server.
+	server string
+	// namespace is the namespace of probe jobs.
+	namespace string
+	// token authenticates requests, if not empty. tokenFile is read for
+	// every request instead if it is set, as it is rotated.
+	token, tokenFile string
+	// username and password authenticate requests with basic auth, if set.
+	username, password string
+	// exec authenticates requests with the token or client certificate of
+	// an exec credential plugin, if set.
+	exec   *execCredentialPlugin
+	client *http.Client
+}
+
+// kubeconfig is the part of a kubeconfig file read by the executor.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string          `yaml:"token"`
+			TokenFile             string          `yaml:"tokenFile"`
+			ClientCertificate     string          `yaml:"client-certificate"`
+			ClientCertificateData string          `yaml:"client-certificate-data"`
+			ClientKey             string          `yaml:"client-key"`
+			ClientKeyData         string          `yaml:"client-key-data"`
+			Username              string          `yaml:"username"`
+			Password              string          `yaml:"password"`
+			Exec                  *kubeconfigExec `yaml:"exec"`
+			AuthProvider          *yaml.Node      `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// client returns a client of the Kubernetes API configured by the kubeconfig
+// file or the service account of the pod Terraform runs in.
+func (e *kubernetesExecutor) client() (*kubernetesClient, error) {
+	path := e.kubeconfig
+	if path == "" {
+		path, _, _ = strings.Cut(os.Getenv("KUBECONFIG"), string(filepath.ListSeparator))
+	}
+	if path == "" {
+		if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+			return e.inClusterClient(host, os.Getenv("KUBERNETES_SERVICE_PORT"))
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no kubeconfig: %w", err)
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig: %w", err)
+	}
+	return e.kubeconfigClient(content, filepath.Dir(path))
+}
+
+// inClusterClient returns a client using the service account of the pod
+// Terraform runs in.
+func (e *kubernetesExecutor) inClusterClient(host, port string) (*kubernetesClient, error) {
+	ca, err := os.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA contains no certificates")
+	}
+	namespace := e.namespace
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	if port == "" {
+		port = "443"
+	}
+	return &kubernetesClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		tokenFile: filepath.Join(kubernetesServiceAccountDir, "token"),
+		client:    e.httpClient(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}),
+	}, nil
+}
+
+// kubeconfigClient returns a client for the current context of the
+// kubeconfig file content. Relative paths in it are relative to dir. Exec
+// credential plugins are supported, but the auth provider plugins removed
+// from kubectl are not.
+func (e *kubernetesExecutor) kubeconfigClient(content []byte, dir string) (*kubernetesClient, error) {
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("parse kubeconfig: %w", err)
+	}
+	kc := &kubernetesClient{namespace: e.namespace}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	var clusterName, userName string
+	var cluster *execCluster
+	for _, c := range cfg.Contexts {
+		if c.Name == cfg.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if kc.namespace == "" {
+				kc.namespace = c.Context.Namespace
+			}
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("kubeconfig has no context %q", cfg.CurrentContext)
+	}
+	if kc.namespace == "" {
+		kc.namespace = "default"
+	}
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	pemData := func(data, file string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if file != "" {
+			return os.ReadFile(resolve(file))
+		}
+		return nil, nil
+	}
+
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		kc.server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify //nolint:gosec
+		ca, err := pemData(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("read cluster CA: %w", err)
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("cluster CA contains no certificates")
+			}
+		}
+		cluster = execClusterInfo(c.Cluster.Server, ca, c.Cluster.InsecureSkipTLSVerify)
+	}
+	if kc.server == "" {
+		return nil, fmt.Errorf("kubeconfig has no server for cluster %q", clusterName)
+	}
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.AuthProvider != nil {
+			return nil, fmt.Errorf("user %q of the kubeconfig uses an auth provider plugin, which is not supported: use an exec credential plugin, such as gke-gcloud-auth-plugin or kubelogin, or a token", userName)
+		}
+		if u.User.Exec != nil {
+			plugin, err := newExecCredentialPlugin(u.User.Exec, dir, cluster)
+			if err != nil {
+				return nil, fmt.Errorf("user %q of the kubeconfig: %w", userName, err)
+			}
+			kc.exec = plugin
+			tlsConfig.GetClientCertificate = plugin.clientCertificate
+		}
+		kc.token = u.User.Token
+		kc.tokenFile = resolve(u.User.TokenFile)
+		kc.username, kc.password = u.User.Username, u.User.Password
+		cert, err := pemData(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("read client certificate: %w", err)
+		}
+		key, err := pemData(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("read client key: %w", err)
+		}
+		if cert != nil || key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	kc.client = e.httpClient(tlsConfig)
+	return kc, nil
+}
+
+// httpClient returns an HTTP client connecting with tlsConfig, which takes the
+// place of the TLS settings of netOpts.
+func (e *kubernetesExecutor) httpClient(tlsConfig *tls.Config) *http.Client {
+	tr := e.netOpts.Transport()
+	tr.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: tr}
+}
+
+// request returns a request to the Kubernetes API at path, with body encoded
+// as JSON if not nil.
+func (kc *kubernetesClient) request(ctx context.Context, method, path string, body any) (*http.Request, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(kc.server, "/")+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token := kc.token
+	if kc.tokenFile != "" {
+		b, err := os.ReadFile(kc.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read token: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if kc.exec != nil && token == "" {
+		execToken, _, err := kc.exec.credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		token = execToken
+	}
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case kc.username != "":
+		req.SetBasicAuth(kc.username, kc.password)
+	}
+	return req, nil
+}
+
+// do makes a request to the Kubernetes API at path with body encoded as JSON,
+// if not nil, and decodes the response into out, if not nil.
+func (kc *kubernetesClient) do(ctx context.Context, method, path string, body, out any) error {
+	req, err := kc.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		kc.rejected(resp.StatusCode)
+		return kubernetesStatusError(resp.Status, respBody)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// stream makes a GET request to the Kubernetes API at path, and returns the
+// body of the response.
+func (kc *kubernetesClient) stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := kc.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		kc.rejected(resp.StatusCode)
+		return nil, kubernetesStatusError(resp.Status, respBody)
+	}
+	return resp.Body, nil
+}
+
+// rejected drops the credentials of the exec credential plugin, if any, if
+// a request was unauthorized, so that they are refreshed for the next one.
+func (kc *kubernetesClient) rejected(statusCode int) {
+	if statusCode == http.StatusUnauthorized && kc.exec != nil {
+		kc.exec.reset()
+	}
+}
+
+// kubernetesStatusError returns an error with the message of the Status
+// object in body, if any.
+func kubernetesStatusError(status string, body []byte) error {
+	var s struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &s); err == nil && s.Message != "" {
+		return fmt.Errorf("%s: %s", status, s.Message)
+	}
+	return errors.New(status)
+}
@@ -0,0 +1,296 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/envbuilder/log"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKubernetesExecutor(t *testing.T) {
+	t.Parallel()
+
+	reg := httptest.NewServer(registry.New())
+	t.Cleanup(reg.Close)
+	regURL, err := url.Parse(reg.URL)
+	require.NoError(t, err)
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(regURL.Host + "/cache:latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	var (
+		mu        sync.Mutex
+		requests  []string
+		secret    map[string]any
+		configMap map[string]any
+		job       map[string]any
+		podPolls  int
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "Bearer kube-token", r.Header.Get("Authorization"))
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/probes/secrets":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&secret))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/probes/configmaps":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&configMap))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/apis/batch/v1/namespaces/probes/jobs":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&job))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/probes/pods":
+			assert.True(t, strings.HasPrefix(r.URL.Query().Get("labelSelector"), "job-name=envbuilder-probe-"))
+			podPolls++
+			phase := "Running"
+			if podPolls > 1 {
+				phase = "Succeeded"
+			}
+			_, _ = fmt.Fprintf(w, `{"items": [{"metadata": {"name": "probe-pod"}, "status": {"phase": %q}}]}`, phase)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/probes/pods/probe-pod/log":
+			assert.Equal(t, "true", r.URL.Query().Get("follow"))
+			_, _ = fmt.Fprintf(w, "#1: Cloning repository\nENVBUILDER_CACHED_IMAGE=%s@%s\n", ref.Context().String(), digest)
+		case r.Method == http.MethodDelete:
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind": "Status", "message": "not found"}`))
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	kubeconfigPath := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(kubeconfigPath, []byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: probes
+clusters:
+- name: cluster
+  cluster:
+    server: %s
+contexts:
+- name: probes
+  context:
+    cluster: cluster
+    user: user
+    namespace: probes
+users:
+- name: user
+  user:
+    token: kube-token
+`, api.URL)), 0o600))
+
+	var logs []string
+	scratchDir := t.TempDir()
+	e := &kubernetesExecutor{kubeconfig: kubeconfigPath, nodeSelector: map[string]string{"pool": "builders"}}
+	got, err := e.run(context.Background(), remoteProbe{
+		builderImage: "ghcr.io/coder/envbuilder:latest",
+		scratchDir:   scratchDir,
+		opts: eboptions.Options{
+			CacheRepo:       ref.Context().String(),
+			GitURL:          "https://example.com/repo.git",
+			GitPassword:     "secret",
+			WorkspaceFolder: filepath.Join(scratchDir, "workspace"),
+			Logger: func(_ log.Level, format string, args ...any) {
+				logs = append(logs, fmt.Sprintf(format, args...))
+			},
+		},
+		hostAliases:      map[string]string{"example.com": "127.0.0.1"},
+		devcontainerJSON: `{"image": "ubuntu"}`,
+	})
+	require.NoError(t, err)
+	gotDigest, err := got.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, digest, gotDigest)
+	assert.Contains(t, logs, "#1: Cloning repository")
+
+	// Credentials are passed in the secret, not the job.
+	env, _ := secret["stringData"].(map[string]any)
+	assert.Equal(t, "true", env["ENVBUILDER_GET_CACHED_IMAGE"])
+	assert.Equal(t, "secret", env["ENVBUILDER_GIT_PASSWORD"])
+	assert.NotContains(t, env, "ENVBUILDER_WORKSPACE_FOLDER")
+	assert.Equal(t, "/envbuilder-devcontainer/devcontainer.json", env["ENVBUILDER_DEVCONTAINER_JSON_PATH"])
+	assert.Equal(t, map[string]any{"devcontainer.json": `{"image": "ubuntu"}`}, configMap["data"])
+	jobJSON, err := json.Marshal(job)
+	require.NoError(t, err)
+	assert.NotContains(t, string(jobJSON), `"secret"`)
+	assert.Contains(t, string(jobJSON), `"image":"ghcr.io/coder/envbuilder:latest"`)
+	assert.Contains(t, string(jobJSON), `"nodeSelector":{"pool":"builders"}`)
+	assert.Contains(t, string(jobJSON), `"hostAliases":[{"hostnames":["example.com"],"ip":"127.0.0.1"}]`)
+	assert.Contains(t, string(jobJSON), `"volumeMounts":[{"mountPath":"/envbuilder-devcontainer","name":"devcontainer","readOnly":true}]`)
+
+	// The job, secret and config map are deleted.
+	var deletes []string
+	for _, r := range requests {
+		if strings.HasPrefix(r, http.MethodDelete) {
+			deletes = append(deletes, r)
+		}
+	}
+	assert.Len(t, deletes, 3)
+}
+
+func TestKubernetesPodFailure(t *testing.T) {
+	t.Parallel()
+
+	var pod kubernetesPod
+	require.NoError(t, json.Unmarshal([]byte(`{"status": {"phase": "Pending", "containerStatuses": [{"state": {"waiting": {"reason": "ImagePullBackOff", "message": "back-off pulling image"}}}]}}`), &pod))
+	assert.True(t, pod.stuck())
+	assert.Equal(t, "ImagePullBackOff: back-off pulling image", pod.failure())
+
+	pod = kubernetesPod{}
+	require.NoError(t, json.Unmarshal([]byte(`{"status": {"phase": "Failed", "containerStatuses": [{"state": {"terminated": {"exitCode": 1, "reason": "Error"}}}]}}`), &pod))
+	assert.False(t, pod.stuck())
+	assert.True(t, pod.finished())
+	assert.Equal(t, "envbuilder exited with status 1 (Error)", pod.failure())
+}
+
+func TestKubeconfigClient(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0o600))
+	e := &kubernetesExecutor{}
+	kc, err := e.kubeconfigClient([]byte(`
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://kubernetes.example.com
+    insecure-skip-tls-verify: true
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+users:
+- name: dev
+  user:
+    tokenFile: token
+`), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "https://kubernetes.example.com", kc.server)
+	assert.Equal(t, "default", kc.namespace)
+	req, err := kc.request(context.Background(), http.MethodGet, "/api", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer file-token", req.Header.Get("Authorization"))
+
+	_, err = e.kubeconfigClient([]byte(`
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://kubernetes.example.com
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+users:
+- name: dev
+  user:
+    auth-provider:
+      name: gcp
+`), dir)
+	assert.ErrorContains(t, err, "auth provider plugin")
+
+	_, err = e.kubeconfigClient([]byte(`current-context: missing`), dir)
+	assert.ErrorContains(t, err, `no context "missing"`)
+}
+
+func TestKubeconfigExecCredentialPlugin(t *testing.T) {
+	t.Parallel()
+
+	// The plugin counts its runs, and returns a token that expires in an
+	// hour if the cluster of the kubeconfig was passed to it.
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plugin.sh"), []byte(`#!/bin/sh
+echo run >> "$RUNS"
+case "$KUBERNETES_EXEC_INFO" in
+*'"server":"https://kubernetes.example.com"'*) ;;
+*) echo "no cluster info" >&2; exit 1 ;;
+esac
+echo '{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"exec-token","expirationTimestamp":"'"$EXPIRY"'"}}'
+`), 0o755))
+	kubeconfig := func(apiVersion string) []byte {
+		return []byte(`
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://kubernetes.example.com
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+users:
+- name: dev
+  user:
+    exec:
+      apiVersion: ` + apiVersion + `
+      command: ./plugin.sh
+      provideClusterInfo: true
+      env:
+      - name: RUNS
+        value: ` + runs + `
+      - name: EXPIRY
+        value: ` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `
+`)
+	}
+
+	e := &kubernetesExecutor{}
+	kc, err := e.kubeconfigClient(kubeconfig(execCredentialV1), dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+	for range 2 {
+		req, err := kc.request(ctx, http.MethodGet, "/api", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer exec-token", req.Header.Get("Authorization"))
+	}
+	content, err := os.ReadFile(runs)
+	require.NoError(t, err)
+	assert.Equal(t, "run\n", string(content), "the token should be cached until it expires")
+
+	// Rejected credentials are refreshed.
+	kc.rejected(http.StatusUnauthorized)
+	_, err = kc.request(ctx, http.MethodGet, "/api", nil)
+	require.NoError(t, err)
+	content, err = os.ReadFile(runs)
+	require.NoError(t, err)
+	assert.Equal(t, "run\nrun\n", string(content))
+
+	// The API version of the output must match that of the kubeconfig.
+	kc, err = e.kubeconfigClient(kubeconfig(execCredentialV1beta1), dir)
+	require.NoError(t, err)
+	_, err = kc.request(ctx, http.MethodGet, "/api", nil)
+	assert.ErrorContains(t, err, "expected ExecCredential "+execCredentialV1beta1)
+
+	_, err = e.kubeconfigClient(kubeconfig("client.authentication.k8s.io/v1alpha1"), dir)
+	assert.ErrorContains(t, err, "unsupported apiVersion")
+}
@@ -0,0 +1,185 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// The functions in this file run the provider outside of Terraform. They are
+// used by the subcommands of the provider binary, and are exported to other
+// programs by pkg/probe. The configurations are JSON objects with the same
+// attributes as the provider and envbuilder_cached_image resource in
+// Terraform. An error is returned if they cannot be decoded; all other
+// problems are reported as diagnostics.
+
+// ProbeResult is the state of an envbuilder_cached_image resource created by
+// RunProbe.
+type ProbeResult struct {
+	Image                string
+	Exists               bool
+	ID                   string
+	CreatedAt            string
+	BaseImage            string
+	BaseImageDigest      string
+	GitURLCanonical      string
+	GitURLUsed           string
+	CacheRepoUsed        string
+	CacheTag             string
+	CandidateTag         string
+	CompiledDockerfile   string
+	Stale                bool
+	ImageRegistry        string
+	ImageRepository      string
+	ImageTag             string
+	ImageDigest          string
+	LastProbedAt         string
+	ImageSizeBytes       int64
+	LayerCount           int64
+	GitCommit            string
+	PlatformImages       map[string]string
+	MissingLayers        []string
+	UsesFeatures         bool
+	Customizations       string
+	DevcontainerResolved string
+	VSCodeExtensions     []string
+	User                 string
+	Workdir              string
+	Entrypoint           []string
+	Cmd                  []string
+	ExposedPorts         []string
+	Labels               map[string]string
+	Annotations          map[string]string
+	Env                  map[string]string
+}
+
+// RunProbe validates and configures the provider, then validates, plans and
+// applies the creation of a cached image resource through the plugin
+// protocol, as Terraform would. The result is nil if there are error
+// diagnostics.
+func RunProbe(ctx context.Context, version string, config, providerConfig []byte) (*ProbeResult, []Diagnostic, error) {
+	session, ok, err := newCommandSession(ctx, version, commandInput{config: config, providerConfig: providerConfig})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, session.diagnostics, nil
+	}
+	server, resourceType, configValue := session.server, session.resourceType, session.configValue
+	nullState, err := tfprotov6.NewDynamicValue(resourceType, tftypes.NewValue(resourceType, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	planResp, err := server.PlanResourceChange(ctx, &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         cachedImageTypeName,
+		PriorState:       &nullState,
+		ProposedNewState: configValue,
+		Config:           configValue,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.addDiags(planResp.Diagnostics) {
+		return nil, session.diagnostics, nil
+	}
+	applyResp, err := server.ApplyResourceChange(ctx, &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:       cachedImageTypeName,
+		PriorState:     &nullState,
+		PlannedState:   planResp.PlannedState,
+		Config:         configValue,
+		PlannedPrivate: planResp.PlannedPrivate,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.addDiags(applyResp.Diagnostics) || applyResp.NewState == nil {
+		return nil, session.diagnostics, nil
+	}
+
+	state, err := applyResp.NewState.Unmarshal(resourceType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode resource state: %w", err)
+	}
+	var schemaResp resource.SchemaResponse
+	(&CachedImageResource{}).Schema(ctx, resource.SchemaRequest{}, &schemaResp)
+	var data CachedImageResourceModel
+	if diags := (tfsdk.State{Schema: schemaResp.Schema, Raw: state}).Get(ctx, &data); diags.HasError() {
+		return nil, nil, fmt.Errorf("decode resource state: %v", diags)
+	}
+	customizations := data.Customizations.ValueString()
+	if customizations == "" {
+		customizations = "{}"
+	}
+	devcontainerResolved := data.DevcontainerResolved.ValueString()
+	if devcontainerResolved == "" {
+		devcontainerResolved = "{}"
+	}
+	return &ProbeResult{
+		Image:                data.Image.ValueString(),
+		Exists:               data.Exists.ValueBool(),
+		ID:                   data.ID.ValueString(),
+		CreatedAt:            data.CreatedAt.ValueString(),
+		BaseImage:            data.BaseImage.ValueString(),
+		BaseImageDigest:      data.BaseImageDigest.ValueString(),
+		GitURLCanonical:      data.GitURLCanonical.ValueString(),
+		GitURLUsed:           data.GitURLUsed.ValueString(),
+		CacheRepoUsed:        data.CacheRepoUsed.ValueString(),
+		CacheTag:             data.CacheTag.ValueString(),
+		CandidateTag:         data.CandidateTag.ValueString(),
+		CompiledDockerfile:   data.CompiledDockerfile.ValueString(),
+		Stale:                data.Stale.ValueBool(),
+		ImageRegistry:        data.ImageRegistry.ValueString(),
+		ImageRepository:      data.ImageRepository.ValueString(),
+		ImageTag:             data.ImageTag.ValueString(),
+		ImageDigest:          data.ImageDigest.ValueString(),
+		LastProbedAt:         data.LastProbedAt.ValueString(),
+		ImageSizeBytes:       data.ImageSizeBytes.ValueInt64(),
+		LayerCount:           data.LayerCount.ValueInt64(),
+		GitCommit:            data.GitCommit.ValueString(),
+		PlatformImages:       tfutil.TFMapToStringMap(data.PlatformImages),
+		MissingLayers:        tfutil.TFListToStringSlice(data.MissingLayers),
+		UsesFeatures:         data.UsesFeatures.ValueBool(),
+		Customizations:       customizations,
+		DevcontainerResolved: devcontainerResolved,
+		VSCodeExtensions:     tfutil.TFListToStringSlice(data.VSCodeExtensions),
+		User:                 data.User.ValueString(),
+		Workdir:              data.Workdir.ValueString(),
+		Entrypoint:           tfutil.TFListToStringSlice(data.Entrypoint),
+		Cmd:                  tfutil.TFListToStringSlice(data.Cmd),
+		ExposedPorts:         tfutil.TFListToStringSlice(data.ExposedPorts),
+		Labels:               tfutil.TFMapToStringMap(data.Labels),
+		Annotations:          tfutil.TFMapToStringMap(data.Annotations),
+		Env:                  tfutil.TFMapToStringMap(data.EnvMap),
+	}, session.diagnostics, nil
+}
+
+// ComputeEnv validates and configures the provider, validates the cached
+// image resource, and returns the environment that it would compute for
+// envbuilder, without probing. The environment is nil if there are error
+// diagnostics.
+func ComputeEnv(ctx context.Context, version string, config, providerConfig []byte) (map[string]string, []Diagnostic, error) {
+	session, ok, err := newCommandSession(ctx, version, commandInput{config: config, providerConfig: providerConfig})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, session.diagnostics, nil
+	}
+	pd, data, err := session.decode(ctx, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &CachedImageResource{data: pd}
+	opts, diags := optionsFromDataModel(data, r.overridePolicy())
+	if session.addFrameworkDiags(diags) {
+		return nil, session.diagnostics, nil
+	}
+	addDefaultIgnorePaths(&opts, r.defaultIgnorePaths())
+	return computeEnvFromOptions(opts, tfutil.TFMapToStringMap(data.ExtraEnv), data.LegacyEnvNames.ValueString()), session.diagnostics, nil
+}
@@ -0,0 +1,158 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ function.Function = &MergeEnvFunction{}
+
+func NewMergeEnvFunction() function.Function {
+	return &MergeEnvFunction{}
+}
+
+// MergeEnvFunction defines the merge_env function implementation.
+type MergeEnvFunction struct{}
+
+// mergeEnvReturnAttrTypes are the attribute types of the object returned by
+// merge_env.
+var mergeEnvReturnAttrTypes = map[string]attr.Type{
+	"map":  types.MapType{ElemType: types.StringType},
+	"list": types.ListType{ElemType: types.StringType},
+}
+
+func (f *MergeEnvFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "merge_env"
+}
+
+func (f *MergeEnvFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+	resp.Definition = function.Definition{
+		Summary: "Merge environment variables",
+		MarkdownDescription: "Merges any number of sets of environment variables into one. Each argument may either be a map of names to values " +
+			"(such as the `env_map` attribute of `envbuilder_cached_image`) or a list of strings of the form `KEY=value` (such as the `env` attribute). " +
+			"Values from later arguments take precedence over values from earlier arguments. Only the first `=` of a `KEY=value` string separates " +
+			"the name from the value, so values may themselves contain `=` or span multiple lines. Null arguments are ignored.\n\n" +
+			"Returns an object with a `map` attribute containing the merged environment variables as a map, and a `list` attribute containing " +
+			"them as a list of strings of the form `KEY=value` sorted by name.",
+		VariadicParameter: function.DynamicParameter{
+			Name:                "envs",
+			MarkdownDescription: "Maps of environment variable names to values, or lists of strings of the form `KEY=value`.",
+			AllowNullValue:      true,
+		},
+		Return: function.ObjectReturn{
+			AttributeTypes: mergeEnvReturnAttrTypes,
+		},
+	}
+}
+
+func (f *MergeEnvFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var envs []types.Dynamic
+
+	resp.Error = function.ConcatFuncErrors(req.Arguments.Get(ctx, &envs))
+	if resp.Error != nil {
+		return
+	}
+
+	merged := make(map[string]string)
+	for idx, env := range envs {
+		if env.IsNull() || env.IsUnderlyingValueNull() {
+			continue
+		}
+		if err := mergeEnv(merged, env.UnderlyingValue()); err != nil {
+			resp.Error = function.NewArgumentFuncError(int64(idx), fmt.Sprintf("Invalid environment at position %d: %s", idx, err))
+			return
+		}
+	}
+
+	envMap, diags := types.MapValueFrom(ctx, types.StringType, merged)
+	resp.Error = function.FuncErrorFromDiags(ctx, diags)
+	if resp.Error != nil {
+		return
+	}
+	envList, diags := types.ListValueFrom(ctx, types.StringType, tfutil.DockerEnv(merged))
+	resp.Error = function.FuncErrorFromDiags(ctx, diags)
+	if resp.Error != nil {
+		return
+	}
+	result, diags := types.ObjectValue(mergeEnvReturnAttrTypes, map[string]attr.Value{
+		"map":  envMap,
+		"list": envList,
+	})
+	resp.Error = function.FuncErrorFromDiags(ctx, diags)
+	if resp.Error != nil {
+		return
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Result.Set(ctx, result))
+}
+
+// mergeEnv merges the environment variables in val into dst, overriding
+// any existing values. val may be a map or object of names to values, or a
+// list, tuple or set of strings of the form KEY=value.
+func mergeEnv(dst map[string]string, val attr.Value) error {
+	var (
+		kvs   map[string]attr.Value
+		pairs []attr.Value
+	)
+	switch v := val.(type) {
+	case basetypes.MapValue:
+		kvs = v.Elements()
+	case basetypes.ObjectValue:
+		kvs = v.Attributes()
+	case basetypes.ListValue:
+		pairs = v.Elements()
+	case basetypes.TupleValue:
+		pairs = v.Elements()
+	case basetypes.SetValue:
+		pairs = v.Elements()
+	default:
+		return fmt.Errorf("expected a map or a list of strings, got %s", val.Type(context.Background()))
+	}
+
+	for k, v := range kvs {
+		s, err := envValueToString(v)
+		if err != nil {
+			return fmt.Errorf("value of %q: %w", k, err)
+		}
+		dst[k] = s
+	}
+
+	for _, p := range pairs {
+		s, err := envValueToString(p)
+		if err != nil {
+			return err
+		}
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("%q is not of the form KEY=value", s)
+		}
+		dst[k] = v
+	}
+	return nil
+}
+
+// envValueToString converts a primitive value to a string in the same way
+// Terraform would when converting it to a string.
+func envValueToString(val attr.Value) (string, error) {
+	if val.IsUnknown() || val.IsNull() {
+		return "", nil
+	}
+	switch v := val.(type) {
+	case basetypes.StringValue:
+		return v.ValueString(), nil
+	case basetypes.BoolValue:
+		return fmt.Sprintf("%t", v.ValueBool()), nil
+	case basetypes.NumberValue:
+		return v.ValueBigFloat().Text('f', -1), nil
+	default:
+		return "", fmt.Errorf("expected a string, got %s", val.Type(context.Background()))
+	}
+}
@@ -0,0 +1,125 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeEnvFunction(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		envs        []attr.Value
+		expectMap   map[string]string
+		expectList  []string
+		expectError string
+	}{
+		{
+			name:       "empty",
+			expectMap:  map[string]string{},
+			expectList: []string{},
+		},
+		{
+			name: "map and list",
+			envs: []attr.Value{
+				extraEnvMap(t, "FOO", "foo", "BAR", "bar"),
+				listValue("BAZ=baz", "FOO=override"),
+			},
+			expectMap:  map[string]string{"FOO": "override", "BAR": "bar", "BAZ": "baz"},
+			expectList: []string{"BAR=bar", "BAZ=baz", "FOO=override"},
+		},
+		{
+			name: "later takes precedence",
+			envs: []attr.Value{
+				listValue("FOO=first"),
+				extraEnvMap(t, "FOO", "second"),
+			},
+			expectMap:  map[string]string{"FOO": "second"},
+			expectList: []string{"FOO=second"},
+		},
+		{
+			name: "multi-line values and equals signs",
+			envs: []attr.Value{
+				listValue("FOO="+testEnvValue, "BAR=a=b"),
+			},
+			expectMap:  map[string]string{"FOO": "bar\nbaz", "BAR": "a=b"},
+			expectList: []string{"BAR=a=b", "FOO=bar\nbaz"},
+		},
+		{
+			name: "object and tuple literals",
+			envs: []attr.Value{
+				types.ObjectValueMust(
+					map[string]attr.Type{"FOO": types.StringType, "ENABLED": types.BoolType},
+					map[string]attr.Value{"FOO": types.StringValue("foo"), "ENABLED": types.BoolValue(true)},
+				),
+				types.TupleValueMust([]attr.Type{types.StringType}, []attr.Value{types.StringValue("BAR=bar")}),
+			},
+			expectMap:  map[string]string{"FOO": "foo", "ENABLED": "true", "BAR": "bar"},
+			expectList: []string{"BAR=bar", "ENABLED=true", "FOO=foo"},
+		},
+		{
+			name: "null ignored",
+			envs: []attr.Value{
+				types.MapNull(types.StringType),
+				listValue("FOO=foo"),
+			},
+			expectMap:  map[string]string{"FOO": "foo"},
+			expectList: []string{"FOO=foo"},
+		},
+		{
+			name:        "invalid pair",
+			envs:        []attr.Value{listValue("FOO")},
+			expectError: `"FOO" is not of the form KEY=value`,
+		},
+		{
+			name:        "invalid type",
+			envs:        []attr.Value{types.StringValue("FOO=bar")},
+			expectError: "expected a map or a list of strings",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			dyns := make([]attr.Value, len(tc.envs))
+			dynTypes := make([]attr.Type, len(tc.envs))
+			for i, env := range tc.envs {
+				dyns[i] = types.DynamicValue(env)
+				dynTypes[i] = types.DynamicType
+			}
+			req := function.RunRequest{
+				Arguments: function.NewArgumentsData([]attr.Value{
+					types.TupleValueMust(dynTypes, dyns),
+				}),
+			}
+			resp := function.RunResponse{
+				Result: function.NewResultData(types.ObjectUnknown(mergeEnvReturnAttrTypes)),
+			}
+			NewMergeEnvFunction().Run(ctx, req, &resp)
+			if tc.expectError != "" {
+				require.NotNil(t, resp.Error)
+				assert.Contains(t, resp.Error.Error(), tc.expectError)
+				return
+			}
+			require.Nil(t, resp.Error)
+
+			result, ok := resp.Result.Value().(basetypes.ObjectValue)
+			require.True(t, ok)
+			var actual struct {
+				Map  map[string]string `tfsdk:"map"`
+				List []string          `tfsdk:"list"`
+			}
+			require.False(t, result.As(ctx, &actual, basetypes.ObjectAsOptions{}).HasError())
+			assert.Equal(t, tc.expectMap, actual.Map)
+			assert.Equal(t, tc.expectList, actual.List)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// missingLayerPrefix starts the message kaniko logs for the first instruction
+// of a build stage whose layer is not in the cache. The layers of the
+// instructions after it are not looked up, as their cache keys depend on it.
+const missingLayerPrefix = "No cached layer found for cmd "
+
+// ansiEscape matches the ANSI color codes envbuilder wraps kaniko logs in.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// missingLayers collects the instructions whose layers kaniko did not find in
+// the cache while probing.
+type missingLayers struct {
+	mu           sync.Mutex
+	instructions []string
+}
+
+// logFunc returns logf, recording the instructions with missing layers
+// logged by kaniko.
+func (m *missingLayers) logFunc(logf log.Func) log.Func {
+	return func(level log.Level, format string, args ...any) {
+		// Envbuilder logs the messages of kaniko as "#<n>: <message>".
+		if format == "#%d: %s" && len(args) == 2 {
+			line := strings.TrimSpace(ansiEscape.ReplaceAllString(fmt.Sprint(args[1]), ""))
+			if instruction, ok := strings.CutPrefix(line, missingLayerPrefix); ok {
+				m.mu.Lock()
+				m.instructions = append(m.instructions, instruction)
+				m.mu.Unlock()
+			}
+		}
+		logf(level, format, args...)
+	}
+}
+
+// list returns the instructions recorded so far, in the order they were
+// logged.
+func (m *missingLayers) list() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.instructions...)
+}
+
+// setMissingLayers sets missing_layers to layers if the cached image was not
+// found with probeErr, or to an empty list if it was.
+func (data *CachedImageResourceModel) setMissingLayers(layers []string, probeErr error) {
+	elems := []attr.Value{}
+	if probeErr != nil {
+		for _, layer := range layers {
+			elems = append(elems, types.StringValue(layer))
+		}
+	}
+	data.MissingLayers = types.ListValueMust(types.StringType, elems)
+}
+
+// missingLayersDetail describes the instructions whose layers are missing
+// from the cache, to be appended to the detail of a cache miss warning.
+func missingLayersDetail(layers []string) string {
+	if len(layers) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\nThe layers of these instructions, and of the instructions after them, were not found in the cache:")
+	for _, layer := range layers {
+		sb.WriteString("\n  - ")
+		sb.WriteString(layer)
+	}
+	return sb.String()
+}
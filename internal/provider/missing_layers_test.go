@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingLayers(t *testing.T) {
+	t.Parallel()
+
+	var missing missingLayers
+	var logged []string
+	logf := missing.logFunc(func(_ log.Level, format string, _ ...any) {
+		logged = append(logged, format)
+	})
+	logf(log.LevelInfo, "#%d: %s", 1, "\x1b[90mChecking for cached layer localhost:5000/cache:abc...\x1b[0m")
+	logf(log.LevelInfo, "#%d: %s", 1, "\x1b[90mNo cached layer found for cmd RUN apt-get update\x1b[0m")
+	logf(log.LevelInfo, "No cached layer found for cmd RUN ignored")
+	logf(log.LevelInfo, "#%d: %s", 2, "No cached layer found for cmd COPY . /app")
+
+	// Every message is still logged.
+	assert.Len(t, logged, 4)
+	assert.Equal(t, []string{"RUN apt-get update", "COPY . /app"}, missing.list())
+
+	// The layers are only set on a cache miss.
+	var data CachedImageResourceModel
+	data.setMissingLayers(missing.list(), nil)
+	assert.Empty(t, tfutil.TFListToStringSlice(data.MissingLayers))
+	data.setMissingLayers(missing.list(), errors.New("not found"))
+	assert.Equal(t, []string{"RUN apt-get update", "COPY . /app"}, tfutil.TFListToStringSlice(data.MissingLayers))
+
+	assert.Empty(t, missingLayersDetail(nil))
+	assert.Contains(t, missingLayersDetail(missing.list()), "\n  - RUN apt-get update\n  - COPY . /app")
+}
@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	eboptions "github.com/coder/envbuilder/options"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// hostPlatformWarning warns about the platform p set at attrPath if it
+// differs from the platform of the host, as envbuilder resolves base images
+// for the latter.
+func hostPlatformWarning(attrPath path.Path, p v1.Platform) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if p.OS != runtime.GOOS || p.Architecture != runtime.GOARCH {
+		diags.AddAttributeWarning(attrPath, "Platform differs from the host",
+			fmt.Sprintf("Envbuilder resolves multi-platform base images for the platform of the host the provider runs on, %s/%s, instead of %s, so the layers built from them are not found.",
+				runtime.GOOS, runtime.GOARCH, p.String()))
+	}
+	return diags
+}
+
+// probePlatforms runs the cache probe for each of probeOpts.platforms after
+// the first, which the probe that returned result and probeErr ran for, and
+// sets data.PlatformImages to the cached image for each platform, or the
+// builder image if it was not found. It returns why the cached image was not
+// found for the other platforms, if it was not for any of them. They are
+// only probed if the cached image was found for the first platform.
+func (data *CachedImageResourceModel) probePlatforms(ctx context.Context, builderImage string, opts eboptions.Options, probeOpts cacheProbeOptions, result cacheProbeResult, probeErr error) error {
+	images := make(map[string]string, len(probeOpts.platforms))
+	for _, p := range probeOpts.platforms {
+		images[p.String()] = builderImage
+	}
+	defer func() {
+		elems := make(map[string]attr.Value, len(images))
+		for p, image := range images {
+			elems[p] = types.StringValue(image)
+		}
+		data.PlatformImages = types.MapValueMust(types.StringType, elems)
+	}()
+	if len(probeOpts.platforms) == 0 || probeErr != nil || result.image == nil {
+		return nil
+	}
+	digest, err := result.image.Digest()
+	if err != nil {
+		return err
+	}
+	images[probeOpts.platforms[0].String()] = fmt.Sprintf("%s@%s", data.imageRepo(), digest)
+
+	var errs []error
+	for _, p := range probeOpts.platforms[1:] {
+		platformOpts := probeOpts
+		platformOpts.platform = &p
+		// Only the image of the first platform is tagged, or replaced by a
+		// fallback.
+		platformOpts.cacheTag, platformOpts.candidateTags, platformOpts.staleFallback = "", nil, false
+		platformResult, err := runCacheProbe(ctx, builderImage, opts, platformOpts)
+		if err == nil {
+			digest, err = platformResult.image.Digest()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("platform %s: %w", p.String(), err))
+			continue
+		}
+		images[p.String()] = fmt.Sprintf("%s@%s", data.imageRepo(), digest)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbePlatforms(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	data := CachedImageResourceModel{CacheRepo: types.StringValue("localhost:5000/cache")}
+
+	// Without platforms, there are no platform images.
+	require.NoError(t, data.probePlatforms(ctx, "envbuilder:latest", eboptions.Options{}, cacheProbeOptions{}, cacheProbeResult{}, nil))
+	assert.Empty(t, tfutil.TFMapToStringMap(data.PlatformImages))
+
+	// If the first platform is not found, the others are not probed.
+	probeOpts := cacheProbeOptions{platforms: []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}}
+	require.NoError(t, data.probePlatforms(ctx, "envbuilder:latest", eboptions.Options{}, probeOpts, cacheProbeResult{}, errors.New("not found")))
+	assert.Equal(t, map[string]string{
+		"linux/amd64": "envbuilder:latest",
+		"linux/arm64": "envbuilder:latest",
+	}, tfutil.TFMapToStringMap(data.PlatformImages))
+
+	// A single platform needs no other probes.
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	probeOpts.platforms = probeOpts.platforms[:1]
+	require.NoError(t, data.probePlatforms(ctx, "envbuilder:latest", eboptions.Options{}, probeOpts, cacheProbeResult{image: img}, nil))
+	assert.Equal(t, map[string]string{
+		"linux/amd64": "localhost:5000/cache@" + digest.String(),
+	}, tfutil.TFMapToStringMap(data.PlatformImages))
+}
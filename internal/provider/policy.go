@@ -0,0 +1,295 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	eschema "github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/objectplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/tailscale/hujson"
+)
+
+// policyPackage is the Rego package whose deny and warn rules are evaluated.
+const policyPackage = "envbuilder"
+
+const (
+	// policyEnforcementError reports the messages of deny rules as errors,
+	// and uses no image.
+	policyEnforcementError = "error"
+	// policyEnforcementWarn reports the messages of deny rules as warnings,
+	// and uses the image as if the devcontainer was allowed.
+	policyEnforcementWarn = "warn"
+)
+
+// probePolicy is a Rego policy that the probed devcontainer is evaluated
+// against, configured by the policy block.
+type probePolicy struct {
+	// bundlePath is a policy file, a directory of policy and data files, or
+	// a bundle archive.
+	bundlePath string
+	// rego is an inline policy.
+	rego string
+	// enforcement is how deny rules are reported, as one of the
+	// policyEnforcement constants.
+	enforcement string
+}
+
+// enabled returns whether a policy is configured.
+func (p probePolicy) enabled() bool {
+	return p.bundlePath != "" || p.rego != ""
+}
+
+// denies returns whether the messages of deny rules fail the probe.
+func (p probePolicy) denies() bool {
+	return p.enforcement != policyEnforcementWarn
+}
+
+// policyInput is the input document the policy is evaluated against.
+type policyInput struct {
+	GitURL string `json:"git_url"`
+	// Devcontainer is the parsed devcontainer.json, or nil if a Dockerfile
+	// is used.
+	Devcontainer map[string]any `json:"devcontainer"`
+	Features     []string       `json:"features"`
+	BaseImage    string         `json:"base_image"`
+}
+
+// policyResult holds the messages of the deny and warn rules of a policy.
+type policyResult struct {
+	deny []string
+	warn []string
+}
+
+// newPolicyInput returns the input document for the devcontainer or
+// Dockerfile in workspaceFolder, cloned from gitURL.
+func newPolicyInput(workspaceFolder, gitURL string, opts eboptions.Options, dc probedDevcontainer) (policyInput, error) {
+	input := policyInput{GitURL: gitURL, Features: dc.features}
+	if input.Features == nil {
+		input.Features = []string{}
+	}
+	baseImage, err := findBaseImage(workspaceFolder, opts)
+	if err != nil {
+		return input, fmt.Errorf("determine base image: %w", err)
+	}
+	input.BaseImage = baseImage
+	if opts.DockerfilePath != "" {
+		return input, nil
+	}
+	devcontainerPath, _, err := findDevcontainerJSON(workspaceFolder, opts)
+	if err != nil {
+		return input, err
+	}
+	content, err := os.ReadFile(devcontainerPath)
+	if err != nil {
+		return input, err
+	}
+	standardized, err := hujson.Standardize(content)
+	if err != nil {
+		return input, fmt.Errorf("parse %s: %w", devcontainerPath, err)
+	}
+	if err := json.Unmarshal(standardized, &input.Devcontainer); err != nil {
+		return input, fmt.Errorf("parse %s: %w", devcontainerPath, err)
+	}
+	return input, nil
+}
+
+// evaluate evaluates the policy against input.
+func (p probePolicy) evaluate(ctx context.Context, input policyInput) (policyResult, error) {
+	opts := []func(*rego.Rego){
+		rego.Query("data." + policyPackage),
+		rego.Input(input),
+	}
+	if p.bundlePath != "" {
+		info, err := os.Stat(p.bundlePath)
+		if err != nil {
+			return policyResult{}, err
+		}
+		// Bundle archives are loaded as such, while policy files and
+		// directories are loaded with any data files they have.
+		if info.Mode().IsRegular() && filepath.Ext(p.bundlePath) != ".rego" {
+			opts = append(opts, rego.LoadBundle(p.bundlePath))
+		} else {
+			opts = append(opts, rego.Load([]string{p.bundlePath}, nil))
+		}
+	}
+	if p.rego != "" {
+		opts = append(opts, rego.Module("policy.rego", p.rego))
+	}
+	rs, err := rego.New(opts...).Eval(ctx)
+	if err != nil {
+		return policyResult{}, err
+	}
+	return parsePolicyResults(rs)
+}
+
+// parsePolicyResults parses the results of evaluating the policy package.
+// A policy without the package has no messages.
+func parsePolicyResults(rs rego.ResultSet) (policyResult, error) {
+	var result policyResult
+	for _, r := range rs {
+		for _, expr := range r.Expressions {
+			doc, ok := expr.Value.(map[string]any)
+			if !ok {
+				continue
+			}
+			deny, err := policyMessages(doc["deny"])
+			if err != nil {
+				return policyResult{}, fmt.Errorf("parse deny: %w", err)
+			}
+			warn, err := policyMessages(doc["warn"])
+			if err != nil {
+				return policyResult{}, fmt.Errorf("parse warn: %w", err)
+			}
+			result.deny = append(result.deny, deny...)
+			result.warn = append(result.warn, warn...)
+		}
+	}
+	return result, nil
+}
+
+// policyMessages returns the messages of a deny or warn rule, whose value is
+// a set of strings or objects with a msg, as with conftest. Any other value
+// is used as JSON.
+func policyMessages(value any) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	values, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("must be a set of messages")
+	}
+	msgs := make([]string, 0, len(values))
+	for _, v := range values {
+		if msg, ok := v.(string); ok {
+			msgs = append(msgs, msg)
+			continue
+		}
+		if obj, ok := v.(map[string]any); ok {
+			if msg, ok := obj["msg"].(string); ok && msg != "" {
+				msgs = append(msgs, msg)
+				continue
+			}
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, string(raw))
+	}
+	return msgs, nil
+}
+
+// policyDiagnostics returns the diagnostics of the policy of a probe that
+// returned result and err. They have errors if the devcontainer is denied or
+// the policy could not be evaluated, in which case no image must be used.
+func policyDiagnostics(policy probePolicy, result cacheProbeResult, err error) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !policy.enabled() {
+		return diags
+	}
+	// An invalid devcontainer cannot be built, and a failed or cancelled
+	// probe is reported as such.
+	var configErr *probeConfigError
+	var accessErr *probeAccessError
+	var cancelledErr *probeCancelledError
+	if errors.As(err, &configErr) || errors.As(err, &accessErr) || errors.As(err, &cancelledErr) {
+		return diags
+	}
+	if result.policy == nil {
+		detail := "The devcontainer could not be evaluated against the policy, so no image is used."
+		if err != nil {
+			detail += " Error: " + err.Error()
+		}
+		diags.AddError("Unable to evaluate the policy.", detail)
+		return diags
+	}
+	for _, msg := range result.policy.warn {
+		diags.AddWarning("Policy warning.", msg)
+	}
+	for _, msg := range result.policy.deny {
+		if !policy.denies() {
+			diags.AddWarning("Policy violation.", fmt.Sprintf("The devcontainer was denied by the policy, but the image is used as its enforcement is %q: %s", policyEnforcementWarn, msg))
+			continue
+		}
+		diags.AddError("Policy violation.", fmt.Sprintf("The devcontainer was denied by the policy, so no image is used: %s", msg))
+	}
+	return diags
+}
+
+// policyBlock returns the policy block of the cached image resource.
+func policyBlock() schema.Block {
+	return schema.SingleNestedBlock{
+		MarkdownDescription: "A Rego policy that the devcontainer is evaluated against before the probe result is used, for example to deny devcontainers that are `privileged` or use unapproved base images. The policy is evaluated in the provider against an input document with the `git_url`, the parsed `devcontainer` (`null` if a Dockerfile is used), its `features`, and the `base_image` of the devcontainer or Dockerfile. Rules `deny` and `warn` in package `envbuilder` produce messages, as strings or objects with a `msg`. The messages of `warn` rules become warnings, and those of `deny` rules errors or warnings according to `enforcement`. If the devcontainer is denied and `enforcement` is `error`, or the policy cannot be evaluated, neither the cached image nor the builder image is used. Probe results are not reused from `probe_result_cache_dir` when a policy is set. Changing this block forces recreation.",
+		Attributes: map[string]schema.Attribute{
+			"bundle_path": schema.StringAttribute{
+				MarkdownDescription: "The absolute path to a Rego policy file, a directory of policy and data files such as an unpacked OPA bundle, or an OPA bundle archive.",
+				Optional:            true,
+				Validators:          []validator.String{absolutePath()},
+			},
+			"enforcement": schema.StringAttribute{
+				MarkdownDescription: "How the messages of `deny` rules are reported: as errors with `error`, in which case no image is used, or as warnings with `warn`, in which case the image is used as if the devcontainer was allowed, for example while rolling out a policy. Defaults to `error`.",
+				Optional:            true,
+				Validators:          []validator.String{oneOf(policyEnforcementError, policyEnforcementWarn)},
+			},
+			"rego": schema.StringAttribute{
+				MarkdownDescription: "An inline Rego policy. If `bundle_path` is also set, their rules are combined.",
+				Optional:            true,
+			},
+		},
+		PlanModifiers: []planmodifier.Object{
+			objectplanmodifier.RequiresReplace(),
+		},
+	}
+}
+
+// ephemeralPolicyBlock returns the policy block of the cached image
+// ephemeral resource.
+func ephemeralPolicyBlock() eschema.Block {
+	return eschema.SingleNestedBlock{
+		MarkdownDescription: "A Rego policy that the devcontainer is evaluated against before the probe result is used, for example to deny devcontainers that are `privileged` or use unapproved base images. The policy is evaluated in the provider against an input document with the `git_url`, the parsed `devcontainer` (`null` if a Dockerfile is used), its `features`, and the `base_image` of the devcontainer or Dockerfile. Rules `deny` and `warn` in package `envbuilder` produce messages, as strings or objects with a `msg`. The messages of `warn` rules become warnings, and those of `deny` rules errors or warnings according to `enforcement`. If the devcontainer is denied and `enforcement` is `error`, or the policy cannot be evaluated, neither the cached image nor the builder image is used. Probe results are not reused from `probe_result_cache_dir` when a policy is set.",
+		Attributes: map[string]eschema.Attribute{
+			"bundle_path": eschema.StringAttribute{
+				MarkdownDescription: "The absolute path to a Rego policy file, a directory of policy and data files such as an unpacked OPA bundle, or an OPA bundle archive.",
+				Optional:            true,
+				Validators:          []validator.String{absolutePath()},
+			},
+			"enforcement": eschema.StringAttribute{
+				MarkdownDescription: "How the messages of `deny` rules are reported: as errors with `error`, in which case no image is used, or as warnings with `warn`, in which case the image is used as if the devcontainer was allowed, for example while rolling out a policy. Defaults to `error`.",
+				Optional:            true,
+				Validators:          []validator.String{oneOf(policyEnforcementError, policyEnforcementWarn)},
+			},
+			"rego": eschema.StringAttribute{
+				MarkdownDescription: "An inline Rego policy. If `bundle_path` is also set, their rules are combined.",
+				Optional:            true,
+			},
+		},
+	}
+}
+
+// probePolicy returns the policy configured by the policy block of data.
+func (data *CachedImageResourceModel) probePolicy() probePolicy {
+	if data.Policy.IsNull() || data.Policy.IsUnknown() {
+		return probePolicy{}
+	}
+	attrs := data.Policy.Attributes()
+	value := func(name string) string {
+		v, _ := attrs[name].(types.String)
+		return v.ValueString()
+	}
+	return probePolicy{
+		bundlePath:  value("bundle_path"),
+		rego:        value("rego"),
+		enforcement: value("enforcement"),
+	}
+}
@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyMessages(t *testing.T) {
+	t.Parallel()
+
+	msgs, err := policyMessages([]any{"privileged is not allowed", map[string]any{"msg": "unapproved base image"}, map[string]any{"code": json.Number("1")}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"privileged is not allowed", "unapproved base image", `{"code":1}`}, msgs)
+
+	// The rule is not defined.
+	msgs, err = policyMessages(nil)
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	_, err = policyMessages(true)
+	assert.ErrorContains(t, err, "set of messages")
+}
+
+func TestNewPolicyInput(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".devcontainer"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".devcontainer", "devcontainer.json"), []byte(`{
+		// Comments are allowed.
+		"image": "ubuntu:22.04",
+		"privileged": true,
+	}`), 0o644))
+
+	input, err := newPolicyInput(dir, "https://git.local/repo.git", eboptions.Options{}, probedDevcontainer{})
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu:22.04", input.BaseImage)
+	assert.Equal(t, true, input.Devcontainer["privileged"])
+	assert.Equal(t, []string{}, input.Features)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM debian:12\n"), 0o644))
+	input, err = newPolicyInput(dir, "https://git.local/repo.git", eboptions.Options{DockerfilePath: "Dockerfile"}, probedDevcontainer{})
+	require.NoError(t, err)
+	assert.Equal(t, "debian:12", input.BaseImage)
+	assert.Nil(t, input.Devcontainer)
+}
+
+func TestProbePolicyEvaluate(t *testing.T) {
+	t.Parallel()
+
+	// A directory of policy and data files, as an unpacked bundle.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base_images.rego"), []byte(`package envbuilder
+
+import rego.v1
+
+deny contains msg if {
+	not input.base_image in data.approved_base_images
+	msg := sprintf("unapproved base image %s", [input.base_image])
+}
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"approved_base_images": ["ubuntu:22.04"]}`), 0o644))
+	inline := `package envbuilder
+
+import rego.v1
+
+deny contains {"msg": "privileged is not allowed"} if input.devcontainer.privileged
+
+warn contains "no features" if count(input.features) == 0
+`
+
+	policy := probePolicy{bundlePath: dir, rego: inline}
+	result, err := policy.evaluate(context.Background(), policyInput{
+		GitURL:       "https://git.local/repo.git",
+		Devcontainer: map[string]any{"privileged": true},
+		Features:     []string{},
+		BaseImage:    "debian:12",
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"unapproved base image debian:12", "privileged is not allowed"}, result.deny)
+	assert.Equal(t, []string{"no features"}, result.warn)
+
+	result, err = policy.evaluate(context.Background(), policyInput{Features: []string{"ghcr.io/devcontainers/features/go:1"}, BaseImage: "ubuntu:22.04"})
+	require.NoError(t, err)
+	assert.Empty(t, result.deny)
+	assert.Empty(t, result.warn)
+
+	// A policy file without the package has no messages.
+	other := filepath.Join(t.TempDir(), "other.rego")
+	require.NoError(t, os.WriteFile(other, []byte("package other\n\nallow := true\n"), 0o644))
+	result, err = probePolicy{bundlePath: other}.evaluate(context.Background(), policyInput{})
+	require.NoError(t, err)
+	assert.Empty(t, result.deny)
+
+	_, err = probePolicy{rego: "package envbuilder\n\ndeny := true\n"}.evaluate(context.Background(), policyInput{})
+	assert.ErrorContains(t, err, "parse deny")
+
+	_, err = probePolicy{rego: "not rego"}.evaluate(context.Background(), policyInput{})
+	assert.Error(t, err)
+
+	_, err = probePolicy{bundlePath: filepath.Join(dir, "missing")}.evaluate(context.Background(), policyInput{})
+	assert.Error(t, err)
+}
+
+func TestPolicyDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	policy := probePolicy{rego: "package envbuilder"}
+	diags := policyDiagnostics(probePolicy{}, cacheProbeResult{}, errors.New("not found"))
+	assert.False(t, diags.HasError())
+
+	diags = policyDiagnostics(policy, cacheProbeResult{}, errors.New("clone failed"))
+	require.True(t, diags.HasError())
+	assert.Contains(t, diags[0].Detail(), "clone failed")
+
+	diags = policyDiagnostics(policy, cacheProbeResult{}, &probeConfigError{})
+	assert.False(t, diags.HasError())
+
+	diags = policyDiagnostics(policy, cacheProbeResult{}, &probeAccessError{})
+	assert.False(t, diags.HasError())
+
+	diags = policyDiagnostics(policy, cacheProbeResult{policy: &policyResult{warn: []string{"unpinned"}}}, nil)
+	assert.False(t, diags.HasError())
+	assert.Equal(t, 1, diags.WarningsCount())
+
+	diags = policyDiagnostics(policy, cacheProbeResult{policy: &policyResult{deny: []string{"privileged"}}}, errors.New("denied"))
+	require.True(t, diags.HasError())
+	assert.Contains(t, diags[0].Detail(), "privileged")
+
+	policy.enforcement = policyEnforcementWarn
+	diags = policyDiagnostics(policy, cacheProbeResult{policy: &policyResult{deny: []string{"privileged"}}}, nil)
+	assert.False(t, diags.HasError())
+	require.Equal(t, 1, diags.WarningsCount())
+	assert.Contains(t, diags[0].Detail(), "privileged")
+}
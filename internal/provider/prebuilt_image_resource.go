@@ -0,0 +1,517 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/boolplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// prebuiltImageContainerLabel is set on the containers that build prebuilt
+// images, so that they can be found if the provider is interrupted.
+const prebuiltImageContainerLabel = "terraform-provider-envbuilder-prebuild"
+
+// prebuiltImageLogLines is the number of lines of the logs of a failed build
+// included in the error.
+const prebuiltImageLogLines = 50
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &PrebuiltImageResource{}
+var _ resource.ResourceWithConfigure = &PrebuiltImageResource{}
+
+func NewPrebuiltImageResource() resource.Resource {
+	return &PrebuiltImageResource{}
+}
+
+// PrebuiltImageResource defines the resource implementation.
+type PrebuiltImageResource struct {
+	data *providerData
+}
+
+// PrebuiltImageResourceModel describes an envbuilder prebuilt image resource.
+type PrebuiltImageResourceModel struct {
+	// Required "inputs".
+	BuilderImage types.String `tfsdk:"builder_image"`
+	CacheRepo    types.String `tfsdk:"cache_repo"`
+	GitURL       types.String `tfsdk:"git_url"`
+	// Optional "inputs".
+	BuildContextPath       types.String `tfsdk:"build_context_path"`
+	DevcontainerDir        types.String `tfsdk:"devcontainer_dir"`
+	DevcontainerJSONPath   types.String `tfsdk:"devcontainer_json_path"`
+	DockerConfigBase64     types.String `tfsdk:"docker_config_base64"`
+	DockerfilePath         types.String `tfsdk:"dockerfile_path"`
+	ExtraEnv               types.Map    `tfsdk:"extra_env"`
+	GitPassword            types.String `tfsdk:"git_password"`
+	GitSSHPrivateKeyBase64 types.String `tfsdk:"git_ssh_private_key_base64"`
+	GitUsername            types.String `tfsdk:"git_username"`
+	Insecure               types.Bool   `tfsdk:"insecure"`
+	NetworkMode            types.String `tfsdk:"network_mode"`
+	SBOMFormat             types.String `tfsdk:"sbom_format"`
+	Verbose                types.Bool   `tfsdk:"verbose"`
+	// Computed "outputs".
+	ID          types.String `tfsdk:"id"`
+	Image       types.String `tfsdk:"image"`
+	ImageDigest types.String `tfsdk:"image_digest"`
+	SBOMDigest  types.String `tfsdk:"sbom_digest"`
+}
+
+func (r *PrebuiltImageResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_prebuilt_image"
+}
+
+func (r *PrebuiltImageResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	requiresReplace := []planmodifier.String{stringplanmodifier.RequiresReplace()}
+	resp.Schema = schema.Schema{
+		// This description is used by the documentation generator and the language server.
+		MarkdownDescription: "The prebuilt image resource builds the devcontainer of a Git repository with envbuilder and pushes the image to the cache repo, so that a configuration can both seed the cache and consume it with `envbuilder_cached_image`. Creating this resource runs the builder image in a Docker container, configured by the `DOCKER_HOST` environment variable and related variables, until the build has finished and the image was pushed, which may take a long time. The image is then found with a cache probe, as `envbuilder_cached_image` would. The image is rebuilt if it no longer exists in the cache repo. Destroying this resource does not delete the image.",
+
+		Attributes: map[string]schema.Attribute{
+			// Required "inputs".
+			"builder_image": schema.StringAttribute{
+				MarkdownDescription: "The envbuilder image to build with.",
+				Required:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"cache_repo": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The name of the container registry to push the image to and cache the layers of the build in.",
+				Required:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"git_url": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The URL of a Git repository containing a Devcontainer or Docker image to build.",
+				Required:            true,
+				Validators: []validator.String{
+					gitURL(),
+				},
+				PlanModifiers: requiresReplace,
+			},
+
+			// Optional "inputs".
+			"build_context_path": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) Can be specified when a DockerfilePath is specified outside the base WorkspaceFolder. This path MUST be relative to the WorkspaceFolder path into which the repo is cloned.",
+				Optional:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"devcontainer_dir": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The path to the folder containing the devcontainer.json file that will be used to build the workspace and can either be an absolute path or a path relative to the workspace folder. If not provided, defaults to `.devcontainer`.",
+				Optional:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"devcontainer_json_path": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The path to a devcontainer.json file that is either an absolute path or a path relative to DevcontainerDir. This can be used in cases where one wants to substitute an edited devcontainer.json file for the one that exists in the repo.",
+				Optional:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"docker_config_base64": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The base64 encoded Docker config file that will be used to pull images from private container registries and push to the cache repo. Defaults to `docker_config_base64` of the provider, if set.",
+				Optional:            true,
+				Sensitive:           true,
+				PlanModifiers:       requiresReplace,
+			},
+			"dockerfile_path": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The relative path to the Dockerfile that will be used to build the workspace. This is an alternative to using a devcontainer that some might find simpler.",
+				Optional:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"extra_env": schema.MapAttribute{
+				MarkdownDescription: "Extra environment variables to set for the build container. Envbuilder options set here, such as `ENVBUILDER_DEVCONTAINER_DIR`, override those set by other attributes, as for `envbuilder_cached_image`, except for `ENVBUILDER_CACHE_REPO` and `ENVBUILDER_GIT_URL`.",
+				ElementType:         types.StringType,
+				Optional:            true,
+				Sensitive:           true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
+			"git_password": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The password to use for Git authentication. This is optional. Defaults to `git_password` of the provider, if set.",
+				Optional:            true,
+				Sensitive:           true,
+				PlanModifiers:       requiresReplace,
+			},
+			"git_ssh_private_key_base64": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) Base64 encoded SSH private key to be used for Git authentication. Defaults to `git_ssh_private_key_base64` of the provider, if set.",
+				Optional:            true,
+				Sensitive:           true,
+				PlanModifiers:       requiresReplace,
+			},
+			"git_username": schema.StringAttribute{
+				MarkdownDescription: "(Envbuilder option) The username to use for Git authentication. This is optional. Defaults to `git_username` of the provider, if set.",
+				Optional:            true,
+				PlanModifiers:       requiresReplace,
+			},
+			"insecure": schema.BoolAttribute{
+				MarkdownDescription: "(Envbuilder option) Bypass TLS verification when cloning and pulling from container registries.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"network_mode": schema.StringAttribute{
+				MarkdownDescription: "The Docker network mode of the build container, for example `host` to reach a registry on `localhost`. Defaults to the default of the Docker daemon.",
+				Optional:            true,
+				Validators: []validator.String{
+					nonEmptyString(),
+				},
+				PlanModifiers: requiresReplace,
+			},
+			"sbom_format": schema.StringAttribute{
+				MarkdownDescription: "The format of a software bill of materials (SBOM) to generate for the built image and attach to it in the cache repo as an OCI referrer, for attestation policies to verify: `spdx-json` for SPDX 2.3, or `cyclonedx-json` for CycloneDX 1.5. The SBOM lists the operating system packages installed with dpkg or apk, read from the pushed image, which is downloaded to read them. Packages installed otherwise, for example with rpm or a language package manager, are not listed. The referrer is pushed with the credentials used to find the image, or those in `docker_config_base64`. Registries without the OCI referrers API get the referrer added to an index tagged `sha256-<digest>`. If not set, no SBOM is generated.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(sbomFormatSPDX, sbomFormatCycloneDX),
+				},
+				PlanModifiers: requiresReplace,
+			},
+			"verbose": schema.BoolAttribute{
+				MarkdownDescription: "(Envbuilder option) Enable verbose output.",
+				Optional:            true,
+			},
+
+			// Computed "outputs".
+			"id": schema.StringAttribute{
+				MarkdownDescription: "The digest of the built image.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image": schema.StringAttribute{
+				MarkdownDescription: "The built image in the cache repo, as `cache_repo@digest`.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image_digest": schema.StringAttribute{
+				MarkdownDescription: "The digest of the built image.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"sbom_digest": schema.StringAttribute{
+				MarkdownDescription: "The digest of the manifest of the SBOM referrer attached to the built image, if `sbom_format` is set. Empty otherwise.",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+	}
+}
+
+func (r *PrebuiltImageResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	data, ok := req.ProviderData.(*providerData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *providerData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.data = data
+}
+
+// options returns the envbuilder options of the build, without any
+// credentials set on the provider, with the options in extra_env applied
+// according to policy.
+func (data *PrebuiltImageResourceModel) options(policy overridePolicy) (eboptions.Options, diag.Diagnostics) {
+	opts := eboptions.Options{
+		CacheRepo:              data.CacheRepo.ValueString(),
+		GitURL:                 data.GitURL.ValueString(),
+		BuildContextPath:       data.BuildContextPath.ValueString(),
+		DevcontainerDir:        data.DevcontainerDir.ValueString(),
+		DevcontainerJSONPath:   data.DevcontainerJSONPath.ValueString(),
+		DockerConfigBase64:     data.DockerConfigBase64.ValueString(),
+		DockerfilePath:         data.DockerfilePath.ValueString(),
+		GitPassword:            data.GitPassword.ValueString(),
+		GitSSHPrivateKeyBase64: data.GitSSHPrivateKeyBase64.ValueString(),
+		GitUsername:            data.GitUsername.ValueString(),
+		Insecure:               data.Insecure.ValueBool(),
+		Verbose:                data.Verbose.ValueBool(),
+	}
+	diags := overrideOptionsFromExtraEnv(&opts, tfutil.TFMapToStringMap(data.ExtraEnv), nil, policy)
+	return opts, diags
+}
+
+// prebuildEnv returns the environment of the container that builds and
+// pushes the image with opts and the other variables in extraEnv, sorted by
+// name.
+func prebuildEnv(opts eboptions.Options, extraEnv map[string]string) []string {
+	opts.PushImage = true
+	opts.ExitOnBuildFailure = true
+	// Exit once the image has been pushed, instead of running the
+	// workspace.
+	opts.InitScript = "exit"
+	return tfutil.DockerEnv(computeEnvFromOptions(opts, extraEnv, legacyEnvNamesNone))
+}
+
+func (r *PrebuiltImageResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data PrebuiltImageResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	pd := r.data
+	if pd == nil {
+		pd = &providerData{}
+	}
+	opts, diags := data.options(pd.overridePolicy)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	pd.probeSecrets.apply(&opts)
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to connect to Docker.", err.Error())
+		return
+	}
+	defer cli.Close()
+	if err := runPrebuild(ctx, cli, data.BuilderImage.ValueString(), prebuildEnv(opts, tfutil.TFMapToStringMap(data.ExtraEnv)), data.NetworkMode.ValueString()); err != nil {
+		resp.Diagnostics.AddError("Failed to build the image.", fmt.Sprintf(
+			"Building the image of %q with %q failed: %s",
+			data.GitURL.ValueString(),
+			data.BuilderImage.ValueString(),
+			err,
+		))
+		return
+	}
+
+	// Find the image that was pushed as envbuilder_cached_image would.
+	probeOpts := cacheProbeOptions{
+		netOpts:      pd.netOpts,
+		registryAuth: pd.registryAuth,
+		progress:     pd.progress,
+		scratchLimit: pd.scratchLimit,
+		limiter:      pd.probeLimiter,
+		subprocess:   pd.probeMode == probeModeSubprocess,
+		executor:     pd.probeExecutor,
+		secrets:      pd.probeSecrets,
+		vault:        pd.vault,
+	}
+	opts.RemoteRepoBuildMode = true
+	result, err := runCacheProbe(ctx, data.BuilderImage.ValueString(), opts, probeOpts)
+	if err != nil {
+		resp.Diagnostics.AddError("Built image not found.", fmt.Sprintf(
+			"The image was built and pushed, but a cache probe did not find it in repository %q: %s",
+			data.CacheRepo.ValueString(),
+			err,
+		))
+		return
+	}
+	digest, err := result.image.Digest()
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to get built image digest", err.Error())
+		return
+	}
+	tflog.Info(ctx, fmt.Sprintf("built image: %s@%s", data.CacheRepo.ValueString(), digest))
+	data.ID = types.StringValue(digest.String())
+	data.Image = types.StringValue(fmt.Sprintf("%s@%s", data.CacheRepo.ValueString(), digest))
+	data.ImageDigest = types.StringValue(digest.String())
+
+	data.SBOMDigest = types.StringValue("")
+	if format := data.SBOMFormat.ValueString(); format != "" {
+		sbomDigest, err := data.attachSBOM(ctx, pd, opts, digest, format)
+		if err != nil {
+			resp.Diagnostics.AddError("Failed to attach the SBOM.", fmt.Sprintf(
+				"The image %q was built and pushed, but its SBOM could not be attached: %s",
+				data.Image.ValueString(),
+				err,
+			))
+			return
+		}
+		tflog.Info(ctx, fmt.Sprintf("attached SBOM: %s@%s", data.CacheRepo.ValueString(), sbomDigest))
+		data.SBOMDigest = types.StringValue(sbomDigest.String())
+	}
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// attachSBOM attaches the SBOM in format of the image with digest built
+// with opts to it, with the credentials used to find it or those in the
+// Docker config of opts. It returns the digest of the SBOM referrer.
+func (data *PrebuiltImageResourceModel) attachSBOM(ctx context.Context, pd *providerData, opts eboptions.Options, digest v1.Hash, format string) (v1.Hash, error) {
+	var nameOpts []name.Option
+	if opts.Insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	ref, err := name.NewDigest(fmt.Sprintf("%s@%s", data.CacheRepo.ValueString(), digest), nameOpts...)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	kc := pd.registryAuth.keychain()
+	if opts.DockerConfigBase64 != "" {
+		dockerConfig, err := dockerConfigKeychain(opts.DockerConfigBase64)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		kc = authn.NewMultiKeychain(dockerConfig, kc)
+	}
+	remoteOpts := []remote.Option{
+		remote.WithTransport(pd.netOpts.Transport()),
+		remote.WithAuthFromKeychain(kc),
+	}
+	img, err := remote.Image(ref, append(remoteOpts, remote.WithContext(ctx))...)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("fetch built image: %w", err)
+	}
+	return attachSBOM(ctx, ref, img, format, remoteOpts...)
+}
+
+// runPrebuild runs builderImage with env in a container until it exits,
+// pulling it first. It returns an error including the last lines of the
+// logs if the build failed.
+func runPrebuild(ctx context.Context, cli *client.Client, builderImage string, env []string, networkMode string) error {
+	if err := pullImage(ctx, cli, builderImage); err != nil {
+		return err
+	}
+
+	ctr, err := cli.ContainerCreate(ctx, &container.Config{
+		Image: builderImage,
+		Env:   env,
+		Labels: map[string]string{
+			prebuiltImageContainerLabel: "true",
+		},
+	}, &container.HostConfig{
+		NetworkMode: container.NetworkMode(networkMode),
+	}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("create build container: %w", err)
+	}
+	defer func() {
+		// The container is removed even if ctx was cancelled.
+		if err := cli.ContainerRemove(context.Background(), ctr.ID, container.RemoveOptions{RemoveVolumes: true, Force: true}); err != nil {
+			tflog.Warn(ctx, "unable to remove build container", map[string]any{"id": ctr.ID, "err": err})
+		}
+	}()
+	if err := cli.ContainerStart(ctx, ctr.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("start build container: %w", err)
+	}
+	waitCh, errCh := cli.ContainerWait(ctx, ctr.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("wait for build container: %w", err)
+	case res := <-waitCh:
+		if res.StatusCode == 0 {
+			return nil
+		}
+		return fmt.Errorf("envbuilder exited with status %d:\n\n%s", res.StatusCode, containerLogsTail(ctx, cli, ctr.ID))
+	}
+}
+
+// containerLogsTail returns the last lines of the logs of the container id,
+// or why they could not be read.
+func containerLogsTail(ctx context.Context, cli *client.Client, id string) string {
+	logs, err := cli.ContainerLogs(ctx, id, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       fmt.Sprint(prebuiltImageLogLines),
+	})
+	if err != nil {
+		return fmt.Sprintf("(unable to read logs: %s)", err)
+	}
+	defer logs.Close()
+	var buf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&buf, &buf, logs); err != nil {
+		return fmt.Sprintf("(unable to read logs: %s)", err)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func (r *PrebuiltImageResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data PrebuiltImageResourceModel
+
+	// Read prior state into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	pd := r.data
+	if pd == nil {
+		pd = &providerData{}
+	}
+	_, err := imgutil.GetRemoteImage(ctx, data.Image.ValueString(), remoteOptions(pd.netOpts, pd.registryAuth)...)
+	if err != nil {
+		if !strings.Contains(err.Error(), "MANIFEST_UNKNOWN") {
+			// Explicitly not making this an error diag.
+			resp.Diagnostics.AddWarning("Unable to check remote image.",
+				fmt.Sprintf("The repository %q returned the following error while checking for the built image %q: %q",
+					data.CacheRepo.ValueString(),
+					data.Image.ValueString(),
+					err.Error(),
+				))
+			return
+		}
+		resp.Diagnostics.AddWarning("Previously built image not found, rebuilding.",
+			fmt.Sprintf("The repository %q does not contain the built image %q. It will be rebuilt in the next apply.",
+				data.CacheRepo.ValueString(),
+				data.Image.ValueString(),
+			))
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *PrebuiltImageResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	// Updates are a no-op, as all inputs but verbose require replacement.
+	var data PrebuiltImageResourceModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *PrebuiltImageResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	// Deletes are a no-op, as the image may still be used.
+	var data PrebuiltImageResourceModel
+
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
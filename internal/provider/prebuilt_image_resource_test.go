@@ -0,0 +1,44 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrebuildEnv(t *testing.T) {
+	t.Parallel()
+
+	data := PrebuiltImageResourceModel{
+		BuilderImage: types.StringValue("envbuilder:latest"),
+		CacheRepo:    types.StringValue("localhost:5000/cache"),
+		GitURL:       types.StringValue("https://git.local/repo.git"),
+		Verbose:      types.BoolValue(true),
+		ExtraEnv: basetypes.NewMapValueMust(types.StringType, map[string]attr.Value{
+			"ENVBUILDER_DEVCONTAINER_DIR": types.StringValue("build"),
+			"ENVBUILDER_CACHE_REPO":       types.StringValue("localhost:5000/other"),
+			"FOO":                         types.StringValue("bar"),
+		}),
+	}
+	opts, diags := data.options(overridePolicy{})
+	require.False(t, diags.HasError(), diags)
+	assert.Equal(t, "build", opts.DevcontainerDir)
+	assert.Equal(t, "localhost:5000/cache", opts.CacheRepo)
+
+	assert.Equal(t, []string{
+		"ENVBUILDER_CACHE_REPO=localhost:5000/cache",
+		"ENVBUILDER_DEVCONTAINER_DIR=build",
+		"ENVBUILDER_EXIT_ON_BUILD_FAILURE=true",
+		"ENVBUILDER_GIT_URL=https://git.local/repo.git",
+		"ENVBUILDER_INIT_SCRIPT=exit",
+		"ENVBUILDER_PUSH_IMAGE=true",
+		"ENVBUILDER_VERBOSE=true",
+		"FOO=bar",
+	}, prebuildEnv(opts, tfutil.TFMapToStringMap(data.ExtraEnv)))
+}
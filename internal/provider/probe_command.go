@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// probeReport is the output of the probe command.
+type probeReport struct {
+	// Result is the state of the cached image resource, without the
+	// computed environment as it may contain secrets. It is omitted if the
+	// probe could not be run.
+	Result      *probeReportResult `json:"result,omitempty"`
+	Diagnostics []Diagnostic       `json:"diagnostics"`
+}
+
+type probeReportResult struct {
+	Image                string            `json:"image"`
+	Exists               bool              `json:"exists"`
+	ID                   string            `json:"id"`
+	CreatedAt            string            `json:"created_at"`
+	BaseImage            string            `json:"base_image"`
+	BaseImageDigest      string            `json:"base_image_digest"`
+	GitURLCanonical      string            `json:"git_url_canonical"`
+	GitURLUsed           string            `json:"git_url_used"`
+	CacheRepoUsed        string            `json:"cache_repo_used"`
+	CacheTag             string            `json:"cache_tag"`
+	CandidateTag         string            `json:"candidate_tag"`
+	CompiledDockerfile   string            `json:"compiled_dockerfile"`
+	Stale                bool              `json:"stale"`
+	ImageRegistry        string            `json:"image_registry"`
+	ImageRepository      string            `json:"image_repository"`
+	ImageTag             string            `json:"image_tag"`
+	ImageDigest          string            `json:"image_digest"`
+	LastProbedAt         string            `json:"last_probed_at"`
+	ImageSizeBytes       int64             `json:"image_size_bytes"`
+	LayerCount           int64             `json:"layer_count"`
+	GitCommit            string            `json:"git_commit"`
+	PlatformImages       map[string]string `json:"platform_images"`
+	MissingLayers        []string          `json:"missing_layers"`
+	UsesFeatures         bool              `json:"uses_features"`
+	Customizations       json.RawMessage   `json:"customizations"`
+	DevcontainerResolved json.RawMessage   `json:"devcontainer_resolved"`
+	VSCodeExtensions     []string          `json:"vscode_extensions"`
+	User                 string            `json:"user"`
+	Workdir              string            `json:"workdir"`
+	Entrypoint           []string          `json:"entrypoint"`
+	Cmd                  []string          `json:"cmd"`
+	ExposedPorts         []string          `json:"exposed_ports"`
+	Labels               map[string]string `json:"labels"`
+	Annotations          map[string]string `json:"annotations"`
+}
+
+// ProbeCommand runs the cache probe of an envbuilder_cached_image resource
+// outside of Terraform, and prints the result and diagnostics as JSON to
+// stdout. The resource and provider configurations are read from JSON files
+// with the same attributes as in Terraform. The provider is driven through
+// the plugin protocol, so the configuration is validated, planned and
+// applied as Terraform would. It returns the exit code of the command: 0 on
+// success, 1 if there are error diagnostics, and 2 for usage errors.
+func ProbeCommand(ctx context.Context, version string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	ctx, in, ok := parseCommandArgs(ctx, "probe",
+		"Runs the cache probe of an envbuilder_cached_image resource and prints the result as JSON.",
+		args, stdin, stderr)
+	if !ok {
+		return 2
+	}
+	// The summary of the probe is always reported, unless disabled.
+	var err error
+	in.providerConfig, err = withDefaultAttribute(in.providerConfig, "probe_progress_diagnostics", true)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "parse provider configuration: %s\n", err)
+		return 2
+	}
+
+	result, diags, err := RunProbe(ctx, version, in.config, in.providerConfig)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+	report := &probeReport{Diagnostics: diags}
+	if result != nil {
+		report.Result = &probeReportResult{
+			Image:                result.Image,
+			Exists:               result.Exists,
+			ID:                   result.ID,
+			CreatedAt:            result.CreatedAt,
+			BaseImage:            result.BaseImage,
+			BaseImageDigest:      result.BaseImageDigest,
+			GitURLCanonical:      result.GitURLCanonical,
+			GitURLUsed:           result.GitURLUsed,
+			CacheRepoUsed:        result.CacheRepoUsed,
+			CacheTag:             result.CacheTag,
+			CandidateTag:         result.CandidateTag,
+			CompiledDockerfile:   result.CompiledDockerfile,
+			Stale:                result.Stale,
+			ImageRegistry:        result.ImageRegistry,
+			ImageRepository:      result.ImageRepository,
+			ImageTag:             result.ImageTag,
+			ImageDigest:          result.ImageDigest,
+			LastProbedAt:         result.LastProbedAt,
+			ImageSizeBytes:       result.ImageSizeBytes,
+			LayerCount:           result.LayerCount,
+			GitCommit:            result.GitCommit,
+			PlatformImages:       result.PlatformImages,
+			MissingLayers:        result.MissingLayers,
+			UsesFeatures:         result.UsesFeatures,
+			Customizations:       json.RawMessage(result.Customizations),
+			DevcontainerResolved: json.RawMessage(result.DevcontainerResolved),
+			VSCodeExtensions:     result.VSCodeExtensions,
+			User:                 result.User,
+			Workdir:              result.Workdir,
+			Entrypoint:           result.Entrypoint,
+			Cmd:                  result.Cmd,
+			ExposedPorts:         result.ExposedPorts,
+			Labels:               result.Labels,
+			Annotations:          result.Annotations,
+		}
+	}
+	if !writeCommandOutput(report, stdout, stderr) {
+		return 2
+	}
+	if hasErrors(report.Diagnostics) {
+		return 1
+	}
+	return 0
+}
+
+// withDefaultAttribute sets the attribute name of the JSON object config to
+// value, unless it is already set.
+func withDefaultAttribute(config []byte, name string, value any) ([]byte, error) {
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(config, &attrs); err != nil {
+		return nil, err
+	}
+	if _, ok := attrs[name]; ok {
+		return config, nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if attrs == nil {
+		attrs = make(map[string]json.RawMessage)
+	}
+	attrs[name] = raw
+	return json.Marshal(attrs)
+}
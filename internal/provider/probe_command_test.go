@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name             string
+		args             []string
+		config           string
+		providerConfig   string
+		expectCode       int
+		expectSummaries  []string
+		expectAttributes []string
+		expectStderr     string
+	}{
+		{
+			name:         "no config",
+			expectCode:   2,
+			expectStderr: "Usage:",
+		},
+		{
+			name:         "invalid config",
+			config:       `{"builder_image": "ghcr.io/coder/envbuilder:latest", "no_such_attribute": true}`,
+			expectCode:   2,
+			expectStderr: "decode resource configuration",
+		},
+		{
+			name:             "missing required attributes",
+			config:           `{"builder_image": "ghcr.io/coder/envbuilder:latest"}`,
+			expectCode:       1,
+			expectSummaries:  []string{"Missing required argument"},
+			expectAttributes: []string{`AttributeName("cache_repo")`},
+		},
+		{
+			name:             "missing source",
+			config:           `{"builder_image": "ghcr.io/coder/envbuilder:latest", "cache_repo": "localhost:5000/cache"}`,
+			expectCode:       1,
+			expectSummaries:  []string{"Missing source"},
+			expectAttributes: []string{`AttributeName("git_url")`},
+		},
+		{
+			name:             "invalid attribute",
+			config:           `{"builder_image": "ghcr.io/coder/envbuilder:latest", "cache_repo": "localhost:5000/cache", "git_url": "git.local:"}`,
+			expectCode:       1,
+			expectSummaries:  []string{"Invalid attribute value"},
+			expectAttributes: []string{`AttributeName("git_url")`},
+		},
+		{
+			name:             "invalid provider config",
+			config:           `{"builder_image": "ghcr.io/coder/envbuilder:latest", "cache_repo": "localhost:5000/cache", "git_url": "https://git.local/repo.git"}`,
+			providerConfig:   `{"probe_memory_limit": "lots"}`,
+			expectCode:       1,
+			expectSummaries:  []string{"Invalid size"},
+			expectAttributes: []string{`AttributeName("probe_memory_limit")`},
+		},
+		{
+			name:             "memory limit in process",
+			config:           `{"builder_image": "ghcr.io/coder/envbuilder:latest", "cache_repo": "localhost:5000/cache", "git_url": "https://git.local/repo.git"}`,
+			providerConfig:   `{"probe_memory_limit": "512MiB"}`,
+			expectCode:       1,
+			expectSummaries:  []string{"Invalid probe memory limit"},
+			expectAttributes: []string{`AttributeName("probe_memory_limit")`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			args := tc.args
+			if tc.config != "" {
+				path := filepath.Join(dir, "config.json")
+				require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+				args = append(args, "-config", path)
+			}
+			if tc.providerConfig != "" {
+				path := filepath.Join(dir, "provider.json")
+				require.NoError(t, os.WriteFile(path, []byte(tc.providerConfig), 0o644))
+				args = append(args, "-provider-config", path)
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := ProbeCommand(context.Background(), "test", args, strings.NewReader(""), &stdout, &stderr)
+			assert.Equal(t, tc.expectCode, code, stderr.String())
+			assert.Contains(t, stderr.String(), tc.expectStderr)
+			if tc.expectCode == 2 {
+				return
+			}
+
+			var report probeReport
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &report))
+			assert.Nil(t, report.Result)
+			var summaries, attributes []string
+			for _, d := range report.Diagnostics {
+				summaries = append(summaries, d.Summary)
+				attributes = append(attributes, d.Attribute)
+			}
+			assert.Equal(t, tc.expectSummaries, summaries)
+			assert.ElementsMatch(t, tc.expectAttributes, attributes)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	kconfig "github.com/GoogleContainerTools/kaniko/pkg/config"
+)
+
+// probeEnvLock guards the state of the provider process used by envbuilder and
+// kaniko while probing. Kaniko runs in the provider process, and keeps its
+// working directory in the package variable kconfig.KanikoDir and the paths
+// it ignores in a package-level list. Envbuilder unsets the environment
+// variables of its options once done, and resolves ${localEnv:VAR} and
+// similar variables in devcontainer.json from the process environment. Both
+// use http.DefaultTransport and the transports of go-git, which the probe
+// replaces with its own using netutil.Install. None of this is safe for
+// concurrent use, so only one probe runs envbuilder at a time. Everything
+// before and after that, such as checking mirrors, fetching credentials and
+// checking images, runs concurrently, and passes the transports of the probe
+// explicitly. It is a channel rather than a mutex so that waiting for it can
+// be cancelled.
+var probeEnvLock = make(chan struct{}, 1)
+
+// lockProbeEnv waits for any other probe to finish running envbuilder, or
+// for ctx to be done, then sets kanikoDir as the working directory of kaniko
+// and env in the environment of the provider process. The returned function
+// restores both and must be called once envbuilder is done.
+func lockProbeEnv(ctx context.Context, kanikoDir string, env map[string]string) (unlock func(), err error) {
+	select {
+	case probeEnvLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for other cache probes to run envbuilder: %w", context.Cause(ctx))
+	}
+	oldKanikoDir := kconfig.KanikoDir
+	kconfig.KanikoDir = kanikoDir
+	type prevValue struct {
+		value string
+		ok    bool
+	}
+	prev := make(map[string]prevValue, len(env))
+	restore := func() {
+		for key, p := range prev {
+			if p.ok {
+				_ = os.Setenv(key, p.value)
+			} else {
+				_ = os.Unsetenv(key)
+			}
+		}
+		kconfig.KanikoDir = oldKanikoDir
+		<-probeEnvLock
+	}
+	for key, value := range env {
+		v, ok := os.LookupEnv(key)
+		prev[key] = prevValue{value: v, ok: ok}
+		if err := os.Setenv(key, value); err != nil {
+			restore()
+			return nil, fmt.Errorf("set devcontainer_env %q: %w", key, err)
+		}
+	}
+	return restore, nil
+}
@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	kconfig "github.com/GoogleContainerTools/kaniko/pkg/config"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	gitclient "github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockProbeEnv(t *testing.T) {
+	// Not parallel, as this modifies the environment.
+	t.Setenv("PROBE_ENV_TEST_SET", "before")
+	oldKanikoDir := kconfig.KanikoDir
+
+	kanikoDir := t.TempDir()
+	unlock, err := lockProbeEnv(context.Background(), kanikoDir, map[string]string{
+		"PROBE_ENV_TEST_SET":   "during",
+		"PROBE_ENV_TEST_UNSET": "during",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "during", os.Getenv("PROBE_ENV_TEST_SET"))
+	assert.Equal(t, "during", os.Getenv("PROBE_ENV_TEST_UNSET"))
+	assert.Equal(t, kanikoDir, kconfig.KanikoDir)
+
+	// Other probes wait until the environment is restored, or until they
+	// are cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = lockProbeEnv(ctx, t.TempDir(), nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, kanikoDir, kconfig.KanikoDir)
+	unlock()
+
+	assert.Equal(t, "before", os.Getenv("PROBE_ENV_TEST_SET"))
+	_, ok := os.LookupEnv("PROBE_ENV_TEST_UNSET")
+	assert.False(t, ok)
+	assert.Equal(t, oldKanikoDir, kconfig.KanikoDir)
+
+	// Probes without variables also take turns.
+	unlock, err = lockProbeEnv(context.Background(), kanikoDir, nil)
+	require.NoError(t, err)
+	unlock()
+}
+
+// Not parallel, as the cache probe replaces process-wide state. Run with
+// -race to check that concurrent probes take turns to replace it.
+func TestRunCacheProbeConcurrent(t *testing.T) {
+	reg := registrytest.New(t, t.TempDir())
+	// The base image does not exist, so envbuilder runs but does not find
+	// the image.
+	repo := gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM " + reg + "/base:latest"})
+	builderImage := reg + "/envbuilder:latest"
+	writeBuilderImage(t, builderImage)
+	oldDefaultTransport := http.DefaultTransport
+	oldGitHTTPS := gitclient.Protocols["https"]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := runCacheProbe(context.Background(), builderImage, eboptions.Options{
+				CacheRepo:      reg + "/cache",
+				GitURL:         "file://" + repo,
+				DockerfilePath: "Dockerfile",
+			}, cacheProbeOptions{registryAuth: registryAuth{skipLocalDockerConfig: true}})
+			assert.Error(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Same(t, oldDefaultTransport, http.DefaultTransport)
+	assert.Same(t, oldGitHTTPS, gitclient.Protocols["https"])
+}
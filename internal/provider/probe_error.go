@@ -0,0 +1,257 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/envbuilder/devcontainer"
+	eboptions "github.com/coder/envbuilder/options"
+	gittransport "github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// probeConfigError is a cache probe failure caused by the devcontainer.json
+// or Dockerfile of the probed repository, rather than by the cache.
+type probeConfigError struct {
+	// summary is the summary of the diagnostic reporting the error.
+	summary string
+	// file is the path of the file at fault, relative to the repository. It
+	// is empty if there is no such file.
+	file string
+	// line and column are the position of the error in file, if known.
+	line, column int
+	// hint tells the user how to fix the error.
+	hint string
+	err  error
+}
+
+func (e *probeConfigError) Error() string {
+	return e.err.Error()
+}
+
+func (e *probeConfigError) Unwrap() error {
+	return e.err
+}
+
+// detail returns the detail of the diagnostic reporting the error.
+func (e *probeConfigError) detail() string {
+	var sb strings.Builder
+	switch {
+	case e.file != "" && e.line > 0:
+		_, _ = fmt.Fprintf(&sb, "%s, line %d, column %d: ", e.file, e.line, e.column)
+	case e.file != "":
+		_, _ = fmt.Fprintf(&sb, "%s: ", e.file)
+	}
+	sb.WriteString(e.err.Error())
+	if e.hint != "" {
+		sb.WriteString("\n\n")
+		sb.WriteString(e.hint)
+	}
+	return sb.String()
+}
+
+// probeAccessError is a cache probe failure caused by credentials that were
+// refused, or by a git server or registry that could not be reached, rather
+// than by layers missing from the cache.
+type probeAccessError struct {
+	// summary is the summary of the diagnostic reporting the error.
+	summary string
+	// hint tells the user how to fix the error.
+	hint string
+	err  error
+}
+
+func (e *probeAccessError) Error() string {
+	return e.err.Error()
+}
+
+func (e *probeAccessError) Unwrap() error {
+	return e.err
+}
+
+// detail returns the detail of the diagnostic reporting the error.
+func (e *probeAccessError) detail() string {
+	return e.err.Error() + "\n\n" + e.hint
+}
+
+// classifyAccessError returns err as a *probeAccessError if it was caused by
+// refused credentials or an unreachable host. Envbuilder only keeps the
+// message of clone errors, so they are also recognized by their message.
+// Registry errors are checked first, as their messages may also mention
+// that authentication is required.
+// Other errors are returned unchanged.
+func classifyAccessError(err error) error {
+	msg := err.Error()
+	var transportErr *transport.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &transportErr) && registryAuthFailed(transportErr),
+		strings.Contains(msg, string(transport.UnauthorizedErrorCode)),
+		strings.Contains(msg, string(transport.DeniedErrorCode)):
+		return &probeAccessError{
+			summary: "Registry authentication failed.",
+			hint:    "Check docker_config_base64, or the registry_auth of the provider, and that the credentials grant read access to the base image and cache_repo.",
+			err:     err,
+		}
+	case errors.Is(err, gittransport.ErrAuthenticationRequired),
+		errors.Is(err, gittransport.ErrAuthorizationFailed),
+		strings.Contains(msg, gittransport.ErrAuthenticationRequired.Error()),
+		strings.Contains(msg, gittransport.ErrAuthorizationFailed.Error()):
+		return &probeAccessError{
+			summary: "Git authentication failed.",
+			hint:    "Check git_username and git_password, or git_ssh_private_key_path or git_ssh_private_key_base64, and that they grant read access to git_url.",
+			err:     err,
+		}
+	case errors.Is(err, gittransport.ErrRepositoryNotFound),
+		strings.Contains(msg, gittransport.ErrRepositoryNotFound.Error()):
+		return &probeAccessError{
+			summary: "Git repository not found.",
+			hint:    "Check git_url. Some git servers also report private repositories as not found if no credentials are given.",
+			err:     err,
+		}
+	case errors.As(err, &dnsErr), errors.As(err, &opErr),
+		strings.Contains(msg, "no such host"),
+		strings.Contains(msg, "connection refused"):
+		return &probeAccessError{
+			summary: "Unable to connect.",
+			hint:    "Check that git_url, the registry of the base image and cache_repo can be reached with the proxy and TLS settings of the provider.",
+			err:     err,
+		}
+	}
+	return err
+}
+
+// registryAuthFailed returns whether a registry refused the credentials of a
+// request, or the lack thereof.
+func registryAuthFailed(err *transport.Error) bool {
+	if err.StatusCode == http.StatusUnauthorized || err.StatusCode == http.StatusForbidden {
+		return true
+	}
+	for _, diagnostic := range err.Errors {
+		if diagnostic.Code == transport.UnauthorizedErrorCode || diagnostic.Code == transport.DeniedErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyProbeError returns err as a *probeConfigError if it was caused by
+// the devcontainer.json or Dockerfile in workspaceFolder, the repository
+// cloned by the probe. Envbuilder does not return its parse errors, so the
+// devcontainer.json is parsed again to find them. Errors classified by
+// classifyAccessError are returned as a *probeAccessError, and other errors
+// are returned unchanged.
+func classifyProbeError(err error, workspaceFolder string, opts eboptions.Options) error {
+	var accessErr *probeAccessError
+	if err := classifyAccessError(err); errors.As(err, &accessErr) {
+		return err
+	}
+	msg := err.Error()
+	notFound := strings.Contains(msg, "no Dockerfile or devcontainer.json found")
+	compile := strings.Contains(msg, "compile devcontainer.json")
+	if !notFound && !compile {
+		return err
+	}
+	rel := func(path string) string {
+		if r, err := filepath.Rel(workspaceFolder, path); err == nil && !strings.HasPrefix(r, "..") {
+			return r
+		}
+		return path
+	}
+
+	if opts.DockerfilePath != "" {
+		return &probeConfigError{
+			summary: "Dockerfile not found.",
+			file:    opts.DockerfilePath,
+			hint:    "dockerfile_path must be relative to the root of the repository.",
+			err:     err,
+		}
+	}
+
+	devcontainerPath, _, findErr := findDevcontainerJSON(workspaceFolder, opts)
+	if findErr != nil {
+		return &probeConfigError{
+			summary: "No devcontainer.json found.",
+			hint:    "Add a devcontainer.json to the .devcontainer directory of the repository, or set devcontainer_dir, devcontainer_json_path or dockerfile_path.",
+			err:     err,
+		}
+	}
+	content, readErr := os.ReadFile(devcontainerPath)
+	if readErr != nil {
+		if notFound && errors.Is(readErr, fs.ErrNotExist) {
+			return &probeConfigError{
+				summary: "No devcontainer.json found.",
+				file:    rel(devcontainerPath),
+				hint:    "devcontainer_json_path must be relative to devcontainer_dir, which must be relative to the root of the repository.",
+				err:     err,
+			}
+		}
+		return err
+	}
+	if _, parseErr := devcontainer.Parse(content); parseErr != nil {
+		cfgErr := devcontainerParseError(content, parseErr)
+		cfgErr.file = rel(devcontainerPath)
+		// Envbuilder ignores a devcontainer.json that it cannot parse.
+		cfgErr.err = fmt.Errorf("%w, so %w", parseErr, err)
+		return cfgErr
+	}
+
+	switch {
+	case strings.Contains(msg, "open dockerfile") && errors.Is(err, fs.ErrNotExist):
+		return &probeConfigError{
+			summary: "Dockerfile not found.",
+			file:    rel(devcontainerPath),
+			hint:    "The Dockerfile referenced by build.dockerfile in devcontainer.json must exist in the repository. Its path is relative to the directory containing devcontainer.json.",
+			err:     err,
+		}
+	case strings.Contains(msg, "feature"):
+		return &probeConfigError{
+			summary: "Unsupported devcontainer feature.",
+			file:    rel(devcontainerPath),
+			hint:    "Features must be published to an OCI registry, referenced as e.g. ghcr.io/devcontainers/features/go:1, and readable with the configured registry credentials. Local features are not supported.",
+			err:     err,
+		}
+	}
+	return err
+}
+
+// devcontainerParseError returns the error returned by devcontainer.Parse for
+// content as a *probeConfigError, with the position of the error in content
+// if it is known.
+func devcontainerParseError(content []byte, err error) *probeConfigError {
+	cfgErr := &probeConfigError{
+		summary: "Invalid devcontainer.json.",
+		hint:    "devcontainer.json may contain comments and trailing commas, but must otherwise be valid JSON.",
+		err:     err,
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// hujson.Standardize preserves byte offsets, so the offset is also
+		// that in content.
+		cfgErr.line, cfgErr.column = lineColumn(content, typeErr.Offset)
+		cfgErr.hint = fmt.Sprintf("Property %q must not be a JSON %s.", typeErr.Field, typeErr.Value)
+		if typeErr.Field == "" {
+			cfgErr.hint = "devcontainer.json must contain a JSON object."
+		}
+		return cfgErr
+	}
+	// The message of syntax errors already includes their position.
+	return cfgErr
+}
+
+// lineColumn returns the 1-based line and column of offset in b.
+func lineColumn(b []byte, offset int64) (line, column int) {
+	n := int(min(max(offset, 0), int64(len(b))))
+	line = 1 + bytes.Count(b[:n], []byte("\n"))
+	column = 1 + n - (bytes.LastIndexByte(b[:n], '\n') + 1)
+	return line, column
+}
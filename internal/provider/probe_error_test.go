@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coder/envbuilder"
+	eboptions "github.com/coder/envbuilder/options"
+	gittransport "github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyProbeError(t *testing.T) {
+	t.Parallel()
+
+	errNotFound := errors.New("no Dockerfile or devcontainer.json found")
+	for _, tc := range []struct {
+		name          string
+		files         map[string]string
+		opts          eboptions.Options
+		err           error
+		expectSummary string
+		expectDetail  string
+	}{
+		{
+			name:          "syntax error",
+			files:         map[string]string{".devcontainer/devcontainer.json": "{\n  \"image\": \n}"},
+			err:           errNotFound,
+			expectSummary: "Invalid devcontainer.json.",
+			expectDetail:  ".devcontainer/devcontainer.json: standardize json: hujson: line 3",
+		},
+		{
+			name:          "type error",
+			files:         map[string]string{".devcontainer/devcontainer.json": "{\n  // The image.\n  \"image\": 22\n}"},
+			err:           errNotFound,
+			expectSummary: "Invalid devcontainer.json.",
+			expectDetail:  ".devcontainer/devcontainer.json, line 3, column 14: ",
+		},
+		{
+			name:          "no devcontainer",
+			err:           errNotFound,
+			expectSummary: "No devcontainer.json found.",
+		},
+		{
+			name:          "missing dockerfile_path",
+			opts:          eboptions.Options{DockerfilePath: "Dockerfile"},
+			err:           errNotFound,
+			expectSummary: "Dockerfile not found.",
+			expectDetail:  "Dockerfile: ",
+		},
+		{
+			name:          "missing dockerfile",
+			files:         map[string]string{".devcontainer/devcontainer.json": `{"build": {"dockerfile": "Dockerfile"}}`},
+			err:           fmt.Errorf("compile devcontainer.json: open dockerfile %q: %w", "Dockerfile", fs.ErrNotExist),
+			expectSummary: "Dockerfile not found.",
+			expectDetail:  ".devcontainer/devcontainer.json: ",
+		},
+		{
+			name:          "feature",
+			files:         map[string]string{".devcontainer/devcontainer.json": `{"image": "ubuntu", "features": {"./local": {}}}`},
+			err:           errors.New("compile devcontainer.json: compile features: parse feature ref ./local: invalid reference"),
+			expectSummary: "Unsupported devcontainer feature.",
+		},
+		{
+			name: "other",
+			err:  errors.New("uncached RUN command is not supported in cache probe mode"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for path, content := range tc.files {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644))
+			}
+
+			err := classifyProbeError(tc.err, dir, tc.opts)
+			require.ErrorIs(t, err, tc.err)
+			var configErr *probeConfigError
+			if tc.expectSummary == "" {
+				assert.False(t, errors.As(err, &configErr))
+				return
+			}
+			require.ErrorAs(t, err, &configErr)
+			assert.Equal(t, tc.expectSummary, configErr.summary)
+			assert.Contains(t, configErr.detail(), tc.expectDetail)
+		})
+	}
+}
+
+func TestClassifyAccessError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		err           error
+		expectSummary string
+	}{
+		{
+			name:          "git authentication",
+			err:           fmt.Errorf("get cached image: %s: %w", gittransport.ErrAuthenticationRequired.Error(), envbuilder.ErrNoFallbackImage),
+			expectSummary: "Git authentication failed.",
+		},
+		{
+			name:          "git authorization",
+			err:           fmt.Errorf("unable to reach git_url or any of git_mirror_urls: %w", gittransport.ErrAuthorizationFailed),
+			expectSummary: "Git authentication failed.",
+		},
+		{
+			name:          "git repository not found",
+			err:           fmt.Errorf("%s: %w", gittransport.ErrRepositoryNotFound.Error(), envbuilder.ErrNoFallbackImage),
+			expectSummary: "Git repository not found.",
+		},
+		{
+			name: "registry unauthorized",
+			err: fmt.Errorf("get cached image: %w", &transport.Error{
+				StatusCode: http.StatusUnauthorized,
+				Errors:     []transport.Diagnostic{{Code: transport.UnauthorizedErrorCode, Message: "authentication required"}},
+			}),
+			expectSummary: "Registry authentication failed.",
+		},
+		{
+			name:          "registry denied message",
+			err:           errors.New("get cached image: retrieving image: DENIED: requested access to the resource is denied"),
+			expectSummary: "Registry authentication failed.",
+		},
+		{
+			name:          "unreachable",
+			err:           fmt.Errorf("get cached image: %w", &net.DNSError{Err: "no such host", Name: "registry.invalid"}),
+			expectSummary: "Unable to connect.",
+		},
+		{
+			name: "manifest unknown",
+			err: fmt.Errorf("get cached image: %w", &transport.Error{
+				StatusCode: http.StatusNotFound,
+				Errors:     []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode}},
+			}),
+		},
+		{
+			name: "uncached layer",
+			err:  errors.New("get cached image: uncached RUN command is not supported in cache probe mode"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := classifyAccessError(tc.err)
+			require.ErrorIs(t, err, tc.err)
+			var accessErr *probeAccessError
+			if tc.expectSummary == "" {
+				assert.False(t, errors.As(err, &accessErr))
+				return
+			}
+			require.ErrorAs(t, err, &accessErr)
+			assert.Equal(t, tc.expectSummary, accessErr.summary)
+			assert.Contains(t, accessErr.detail(), tc.err.Error())
+
+			// Access errors take precedence over configuration errors.
+			err = classifyProbeError(tc.err, t.TempDir(), eboptions.Options{})
+			assert.ErrorAs(t, err, &accessErr)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// cachedImageOutputPrefix starts the line envbuilder prints with the cached
+// image it found.
+const cachedImageOutputPrefix = "ENVBUILDER_CACHED_IMAGE="
+
+// stageLogLine matches the lines envbuilder logs within a build stage.
+var stageLogLine = regexp.MustCompile(`^#(\d+): (.*)$`)
+
+// probeExecutor runs the dry-run build of cache probes outside of the
+// provider, in a container of the builder image, as configured by the
+// probe_executor block of the provider.
+type probeExecutor interface {
+	// needsEnvbuilderBinary reports whether the envbuilder binary of the
+	// builder image must be extracted into the scratch directory of the
+	// probe for run.
+	needsEnvbuilderBinary() bool
+	// run runs envbuilder for probe, and returns the cached image it found
+	// fetched from the cache repo with remoteOpts.
+	run(ctx context.Context, probe remoteProbe, remoteOpts ...remote.Option) (v1.Image, error)
+}
+
+// remoteProbe is a cache probe run by a probeExecutor.
+type remoteProbe struct {
+	// builderImage is the image the container runs.
+	builderImage string
+	// envbuilderPath is the envbuilder binary extracted from the builder
+	// image, in scratchDir. It is empty if the executor does not need it.
+	envbuilderPath string
+	// scratchDir is the scratch directory of the probe. magicDir, within it,
+	// is the working directory of envbuilder.
+	scratchDir, magicDir string
+	// opts are the options of envbuilder. Messages are passed to
+	// opts.Logger.
+	opts eboptions.Options
+	// devcontainerEnv is set in the environment of the container.
+	devcontainerEnv map[string]string
+	// devcontainerJSON is the content of the devcontainer.json at
+	// opts.DevcontainerJSONPath, in scratchDir, if it is set by
+	// devcontainer_json_content.
+	devcontainerJSON string
+	// hostAliases are added to /etc/hosts in the container.
+	hostAliases map[string]string
+}
+
+// probeExecutorFromDataModel returns the probe executor configured in data,
+// or nil if none is.
+func probeExecutorFromDataModel(data EnvbuilderProviderModel, netOpts netutil.Options, diags *diag.Diagnostics) probeExecutor {
+	if data.ProbeExecutor.IsNull() || data.ProbeExecutor.IsUnknown() {
+		return nil
+	}
+	docker, _ := data.ProbeExecutor.Attributes()["docker"].(types.Object)
+	kubernetes, _ := data.ProbeExecutor.Attributes()["kubernetes"].(types.Object)
+	if docker.IsNull() == kubernetes.IsNull() {
+		diags.AddAttributeError(path.Root("probe_executor"),
+			"Invalid probe executor",
+			"probe_executor must contain exactly one of the docker or kubernetes blocks.",
+		)
+		return nil
+	}
+	if data.ProbeMode.ValueString() == probeModeSubprocess {
+		diags.AddAttributeError(path.Root("probe_mode"),
+			"Conflicting probe executor",
+			"probe_mode cannot be \"subprocess\" if probe_executor is set, as envbuilder then runs in a container.",
+		)
+		return nil
+	}
+	if !kubernetes.IsNull() {
+		return kubernetesExecutorFromObject(kubernetes, netOpts)
+	}
+	e := &dockerExecutor{}
+	if host, ok := docker.Attributes()["host"].(types.String); ok {
+		e.host = host.ValueString()
+	}
+	if networkMode, ok := docker.Attributes()["network_mode"].(types.String); ok {
+		e.networkMode = networkMode.ValueString()
+	}
+	return e
+}
+
+// scanContainerLogs passes the lines envbuilder logged in a container, read
+// from r, to logf, and writes them to output if it is not nil. It returns the
+// last error envbuilder logged, if any.
+func scanContainerLogs(r io.Reader, logf log.Func, output io.Writer) string {
+	var lastError string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if msg, ok := strings.CutPrefix(line, "error: "); ok {
+			lastError = msg
+		}
+		if output != nil {
+			_, _ = fmt.Fprintln(output, line)
+		}
+		logContainerLine(logf, line)
+	}
+	// Drain the logs if they could not be scanned, so that the container is
+	// not blocked writing them.
+	_, _ = io.Copy(io.Discard, r)
+	return lastError
+}
+
+// cachedImageFromOutput fetches the cached image printed by envbuilder in
+// output with remoteOpts.
+func cachedImageFromOutput(output string, remoteOpts ...remote.Option) (v1.Image, error) {
+	for _, line := range strings.Split(output, "\n") {
+		ref, ok := strings.CutPrefix(strings.TrimSpace(line), cachedImageOutputPrefix)
+		if !ok {
+			continue
+		}
+		digest, err := name.NewDigest(ref)
+		if err != nil {
+			return nil, fmt.Errorf("parse cached image %q: %w", ref, err)
+		}
+		img, err := remote.Image(digest, remoteOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("get cached image %q: %w", ref, err)
+		}
+		return img, nil
+	}
+	return nil, errors.New("envbuilder did not print the cached image")
+}
+
+// logContainerLine passes a line logged by envbuilder in a container to
+// logf, as envbuilder logged it.
+func logContainerLine(logf log.Func, line string) {
+	if m := stageLogLine.FindStringSubmatch(line); m != nil {
+		if stage, err := strconv.Atoi(m[1]); err == nil {
+			logf(log.LevelInfo, "#%d: %s", stage, m[2])
+			return
+		}
+	}
+	logf(log.LevelInfo, "%s", line)
+}
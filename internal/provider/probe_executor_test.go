@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeExecutorFromDataModel(t *testing.T) {
+	t.Parallel()
+
+	dockerTypes := map[string]attr.Type{"host": types.StringType, "network_mode": types.StringType}
+	kubernetesTypes := map[string]attr.Type{"kubeconfig": types.StringType, "namespace": types.StringType, "node_selector": types.MapType{ElemType: types.StringType}}
+	executorTypes := map[string]attr.Type{
+		"docker":     types.ObjectType{AttrTypes: dockerTypes},
+		"kubernetes": types.ObjectType{AttrTypes: kubernetesTypes},
+	}
+	docker := types.ObjectValueMust(dockerTypes, map[string]attr.Value{
+		"host":         types.StringValue("tcp://docker:2375"),
+		"network_mode": types.StringNull(),
+	})
+	kubernetes := types.ObjectValueMust(kubernetesTypes, map[string]attr.Value{
+		"kubeconfig":    types.StringNull(),
+		"namespace":     types.StringValue("probes"),
+		"node_selector": types.MapValueMust(types.StringType, map[string]attr.Value{"pool": types.StringValue("builders")}),
+	})
+	executor := func(docker, kubernetes types.Object) types.Object {
+		return types.ObjectValueMust(executorTypes, map[string]attr.Value{"docker": docker, "kubernetes": kubernetes})
+	}
+	netOpts := netutil.Options{HostAliases: map[string]string{"example.com": "127.0.0.1"}}
+
+	var diags diag.Diagnostics
+	assert.Nil(t, probeExecutorFromDataModel(EnvbuilderProviderModel{ProbeExecutor: types.ObjectNull(executorTypes)}, netOpts, &diags))
+	assert.False(t, diags.HasError())
+
+	e := probeExecutorFromDataModel(EnvbuilderProviderModel{ProbeExecutor: executor(docker, types.ObjectNull(kubernetesTypes))}, netOpts, &diags)
+	require.False(t, diags.HasError())
+	assert.Equal(t, &dockerExecutor{host: "tcp://docker:2375"}, e)
+
+	e = probeExecutorFromDataModel(EnvbuilderProviderModel{ProbeExecutor: executor(types.ObjectNull(dockerTypes), kubernetes)}, netOpts, &diags)
+	require.False(t, diags.HasError())
+	assert.Equal(t, &kubernetesExecutor{namespace: "probes", nodeSelector: map[string]string{"pool": "builders"}, netOpts: netOpts}, e)
+
+	assert.Nil(t, probeExecutorFromDataModel(EnvbuilderProviderModel{ProbeExecutor: executor(types.ObjectNull(dockerTypes), types.ObjectNull(kubernetesTypes))}, netOpts, &diags))
+	assert.True(t, diags.HasError())
+
+	diags = nil
+	assert.Nil(t, probeExecutorFromDataModel(EnvbuilderProviderModel{ProbeExecutor: executor(docker, kubernetes)}, netOpts, &diags))
+	assert.True(t, diags.HasError())
+
+	diags = nil
+	assert.Nil(t, probeExecutorFromDataModel(EnvbuilderProviderModel{
+		ProbeExecutor: executor(docker, types.ObjectNull(kubernetesTypes)),
+		ProbeMode:     types.StringValue(probeModeSubprocess),
+	}, netOpts, &diags))
+	assert.True(t, diags.HasError())
+}
+
+func TestLogContainerLine(t *testing.T) {
+	t.Parallel()
+
+	var lines []string
+	logf := func(_ log.Level, format string, args ...any) {
+		lines = append(lines, format+"|"+fmt.Sprintf(format, args...))
+	}
+	logContainerLine(logf, "#2: 🏗️ Building image...")
+	logContainerLine(logf, "envbuilder v1.0.4 - Build development environments from repositories in a container")
+	assert.Equal(t, []string{
+		"#%d: %s|#2: 🏗️ Building image...",
+		"%s|envbuilder v1.0.4 - Build development environments from repositories in a container",
+	}, lines)
+}
+
+func TestCachedImageFromOutput(t *testing.T) {
+	t.Parallel()
+
+	_, err := cachedImageFromOutput("")
+	assert.ErrorContains(t, err, "did not print the cached image")
+	_, err = cachedImageFromOutput("ENVBUILDER_CACHED_IMAGE=localhost:5000/cache:latest\n")
+	assert.ErrorContains(t, err, "parse cached image")
+}
@@ -0,0 +1,36 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+)
+
+// probeLimiter limits the number of cache probes that run at once across all
+// resources and data sources of a provider. A nil *probeLimiter does not
+// limit them.
+type probeLimiter struct {
+	slots chan struct{}
+}
+
+// newProbeLimiter returns a limiter allowing n probes at once, or nil if n is
+// not positive.
+func newProbeLimiter(n int64) *probeLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &probeLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire waits until a probe may run, or until ctx is done. The returned
+// function must be called once the probe is done.
+func (l *probeLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for other cache probes to finish: %w", context.Cause(ctx))
+	}
+}
@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeLimiter(t *testing.T) {
+	t.Parallel()
+
+	// A nil limiter does not limit.
+	assert.Nil(t, newProbeLimiter(0))
+	release, err := (*probeLimiter)(nil).acquire(context.Background())
+	require.NoError(t, err)
+	release()
+
+	l := newProbeLimiter(2)
+	release1, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	release2, err := l.acquire(context.Background())
+	require.NoError(t, err)
+
+	// A third probe waits until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Or until another probe is done.
+	acquired := make(chan struct{})
+	go func() {
+		release3, err := l.acquire(context.Background())
+		assert.NoError(t, err)
+		close(acquired)
+		release3()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more slots than the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release1()
+	<-acquired
+	release2()
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// probeMetadataKey is the key of the probeMetadata of the last cache probe in
+// the private state of an envbuilder_cached_image resource.
+const probeMetadataKey = "probe_metadata"
+
+// probeMetadata records what the last cache probe of a resource was run
+// with, so that refreshing the resource can tell whether probing again could
+// find a different image.
+type probeMetadata struct {
+	// InputsHash is the probeInputsHash of the builder image and options.
+	InputsHash string `json:"inputs_hash"`
+	// Commit is the commit of the probed repository, and BuilderDigest the
+	// digest of the builder image. Either is empty if it was not resolved.
+	Commit        string    `json:"commit,omitempty"`
+	BuilderDigest string    `json:"builder_digest,omitempty"`
+	ProbedAt      time.Time `json:"probed_at"`
+}
+
+// probeHistoryLength is the number of probes kept in the probe history.
+const probeHistoryLength = 10
+
+// probeHistoryEntry is the outcome of a cache probe.
+type probeHistoryEntry struct {
+	ProbedAt time.Time `json:"probed_at"`
+	Hit      bool      `json:"hit"`
+}
+
+// probeHistoryAttrTypes are the attribute types of the elements of
+// probe_history.
+var probeHistoryAttrTypes = map[string]attr.Type{
+	"probed_at": types.StringType,
+	"hit":       types.BoolType,
+}
+
+// privateStateGetter and privateStateSetter are implemented by the private
+// state of resource requests and responses.
+type (
+	privateStateGetter interface {
+		GetKey(ctx context.Context, key string) ([]byte, diag.Diagnostics)
+	}
+	privateStateSetter interface {
+		SetKey(ctx context.Context, key string, value []byte) diag.Diagnostics
+	}
+)
+
+// getProbeMetadata returns the probe metadata in private. It returns false
+// if there is none, e.g. as the resource was created by an older version of
+// the provider.
+func getProbeMetadata(ctx context.Context, private privateStateGetter) (probeMetadata, bool, diag.Diagnostics) {
+	b, diags := private.GetKey(ctx, probeMetadataKey)
+	if diags.HasError() || len(b) == 0 {
+		return probeMetadata{}, false, diags
+	}
+	var meta probeMetadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		// The metadata only avoids needless probes, so it is not an error if
+		// it cannot be read.
+		diags.AddWarning("Unable to read probe metadata.", err.Error())
+		return probeMetadata{}, false, diags
+	}
+	return meta, true, diags
+}
+
+// setProbeMetadata stores meta in private.
+func setProbeMetadata(ctx context.Context, private privateStateSetter, meta probeMetadata) diag.Diagnostics {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		var diags diag.Diagnostics
+		diags.AddError("Unable to store probe metadata.", err.Error())
+		return diags
+	}
+	return private.SetKey(ctx, probeMetadataKey, b)
+}
@@ -0,0 +1,208 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/go-git/go-git/v5"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPrivateState is an in-memory private state.
+type testPrivateState map[string][]byte
+
+func (p testPrivateState) GetKey(_ context.Context, key string) ([]byte, diag.Diagnostics) {
+	return p[key], nil
+}
+
+func (p testPrivateState) SetKey(_ context.Context, key string, value []byte) diag.Diagnostics {
+	p[key] = value
+	return nil
+}
+
+func TestProbeMetadata(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	private := testPrivateState{}
+	_, ok, diags := getProbeMetadata(ctx, private)
+	require.False(t, diags.HasError())
+	assert.False(t, ok)
+
+	meta := probeMetadata{
+		InputsHash:    "hash",
+		Commit:        "0123456789abcdef0123456789abcdef01234567",
+		BuilderDigest: "sha256:abc",
+		ProbedAt:      time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC),
+	}
+	require.False(t, setProbeMetadata(ctx, private, meta).HasError())
+	got, ok, diags := getProbeMetadata(ctx, private)
+	require.False(t, diags.HasError())
+	require.True(t, ok)
+	assert.Equal(t, meta, got)
+
+	// Unreadable metadata is ignored with a warning.
+	private[probeMetadataKey] = []byte(`{"probed_at": 1}`)
+	_, ok, diags = getProbeMetadata(ctx, private)
+	assert.False(t, ok)
+	assert.False(t, diags.HasError())
+	assert.Equal(t, 1, diags.WarningsCount())
+}
+
+func TestProbeOutdated(t *testing.T) {
+	t.Parallel()
+
+	reg := registrytest.New(t, t.TempDir())
+	builderImage := reg + "/envbuilder:latest"
+	builder := registrytest.WriteRandomImage(t, builderImage)
+	builderDigest, err := builder.Digest()
+	require.NoError(t, err)
+
+	r := &CachedImageResource{}
+	data := CachedImageResourceModel{
+		BuilderImage: types.StringValue(builderImage),
+		CacheRepo:    types.StringValue(reg + "/cache"),
+		GitURL:       types.StringValue("https://git.local/repo.git"),
+	}
+	opts, diags := optionsFromDataModel(data, r.overridePolicy())
+	require.False(t, diags.HasError())
+	ctx := context.Background()
+	private := testPrivateState{}
+
+	// Without metadata, the probe is not known to be outdated.
+	assert.Empty(t, r.probeOutdated(ctx, &data, opts, private, nil))
+
+	meta := probeMetadata{
+		InputsHash:    probeInputsHash(builderImage, nil, opts, nil, ""),
+		BuilderDigest: builderDigest.String(),
+		ProbedAt:      time.Now(),
+	}
+	require.False(t, setProbeMetadata(ctx, private, meta).HasError())
+	assert.Empty(t, r.probeOutdated(ctx, &data, opts, private, nil))
+
+	// Changed options.
+	changed := opts
+	changed.DockerfilePath = "Dockerfile"
+	assert.Contains(t, r.probeOutdated(ctx, &data, changed, private, nil), "The options of the cache probe")
+
+	// A new builder image.
+	registrytest.WriteRandomImage(t, builderImage)
+	assert.Contains(t, r.probeOutdated(ctx, &data, opts, private, nil), "now resolves to")
+}
+
+func TestProbeRefMoved(t *testing.T) {
+	t.Parallel()
+
+	dir := gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM scratch"})
+	repo, err := git.PlainOpen(dir)
+	require.NoError(t, err)
+	head, err := repo.Head()
+	require.NoError(t, err)
+
+	data := CachedImageResourceModel{
+		BuilderImage: types.StringValue("envbuilder:latest"),
+		CacheRepo:    types.StringValue("localhost:5000/cache"),
+		GitURL:       types.StringValue("file://" + dir),
+		GitRef:       types.StringValue("main"),
+	}
+	opts, diags := optionsFromDataModel(data, overridePolicy{})
+	require.False(t, diags.HasError())
+	ctx := context.Background()
+	meta := probeMetadata{Commit: head.Hash().String(), ProbedAt: time.Now()}
+	assert.Empty(t, probeRefMoved(ctx, &data, opts, cacheProbeOptions{}, meta))
+
+	// Without git_ref, the default branch is not compared.
+	withoutRef := data
+	withoutRef.GitRef = types.StringNull()
+	meta.Commit = "0000000000000000000000000000000000000000"
+	assert.Empty(t, probeRefMoved(ctx, &withoutRef, opts, cacheProbeOptions{}, meta))
+	assert.Contains(t, probeRefMoved(ctx, &data, opts, cacheProbeOptions{}, meta), "now resolves to commit "+head.Hash().String())
+}
+
+func TestCachedImageResourceRequiresReplace(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// The attributes that are updated in place, as they cannot change the
+	// cached image found. Any other attribute changes the probe inputs hash,
+	// and must force recreation so that Read does not find the probe
+	// outdated.
+	inPlace := map[string]bool{
+		"coder_agent_subsystem":              true,
+		"debug_bundle_path":                  true,
+		"docker_config_base64":               true,
+		"enforce_cache_ttl":                  true,
+		"export_env_file":                    true,
+		"git_mirror_urls":                    true,
+		"git_password":                       true,
+		"git_ssh_private_key_base64":         true,
+		"git_tls_client_cert":                true,
+		"git_tls_client_key":                 true,
+		"init_args":                          true,
+		"init_command":                       true,
+		"legacy_env_names":                   true,
+		"local_repo_path":                    true,
+		"push_image":                         true,
+		"recreate_on_base_image_update":      true,
+		"runtime_layer_cache_dir":            true,
+		"skip_rebuild":                       true,
+		"suppress_override_warnings":         true,
+		"suppress_unpinned_features_warning": true,
+		"tls_skip_verify_registries":         true,
+		"verbose":                            true,
+	}
+
+	var resp resource.SchemaResponse
+	NewCachedImageResource().Schema(ctx, resource.SchemaRequest{}, &resp)
+	require.False(t, resp.Diagnostics.HasError())
+	for name, attr := range resp.Schema.Attributes {
+		if !attr.IsOptional() && !attr.IsRequired() {
+			continue
+		}
+		var descriptions []string
+		switch attr := attr.(type) {
+		case schema.StringAttribute:
+			for _, m := range attr.PlanModifiers {
+				descriptions = append(descriptions, m.Description(ctx))
+			}
+		case schema.BoolAttribute:
+			for _, m := range attr.PlanModifiers {
+				descriptions = append(descriptions, m.Description(ctx))
+			}
+		case schema.Int64Attribute:
+			for _, m := range attr.PlanModifiers {
+				descriptions = append(descriptions, m.Description(ctx))
+			}
+		case schema.ListAttribute:
+			for _, m := range attr.PlanModifiers {
+				descriptions = append(descriptions, m.Description(ctx))
+			}
+		case schema.MapAttribute:
+			for _, m := range attr.PlanModifiers {
+				descriptions = append(descriptions, m.Description(ctx))
+			}
+		case schema.DynamicAttribute:
+			for _, m := range attr.PlanModifiers {
+				descriptions = append(descriptions, m.Description(ctx))
+			}
+		default:
+			t.Errorf("unexpected type %T of attribute %q", attr, name)
+		}
+		requiresReplace := false
+		for _, d := range descriptions {
+			if strings.Contains(d, "destroy and recreate") {
+				requiresReplace = true
+			}
+		}
+		assert.Equal(t, !inPlace[name], requiresReplace, name)
+	}
+}
@@ -0,0 +1,348 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kconfig "github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/coder/envbuilder"
+	"github.com/coder/envbuilder/log"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/serpent"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+const (
+	// probeModeInProcess runs envbuilder in the provider process.
+	probeModeInProcess = "in_process"
+	// probeModeSubprocess runs envbuilder in a subprocess of the provider.
+	probeModeSubprocess = "subprocess"
+)
+
+// envbuilderSubprocessCommand is the subcommand of the provider binary that
+// runs envbuilder for a cache probe in subprocess mode. It is not meant to be
+// run by users.
+const envbuilderSubprocessCommand = "probe-envbuilder"
+
+// envbuilderSubprocessRequest is written to the stdin of the subprocess. It
+// is not passed in the environment or arguments, as it contains credentials.
+type envbuilderSubprocessRequest struct {
+	// Options are the envbuilder options, by their environment variable.
+	Options map[string]string `json:"options"`
+	// MagicDir is the working directory of envbuilder, and KanikoDir that of
+	// kaniko.
+	MagicDir  string `json:"magic_dir"`
+	KanikoDir string `json:"kaniko_dir"`
+	// Net configures all outbound connections of the subprocess.
+	Net envbuilderSubprocessNet `json:"net"`
+	// GitClientCert and GitClientKey are the PEM encoded client certificate
+	// presented to HTTPS git remotes, if any.
+	GitClientCert []byte `json:"git_client_cert,omitempty"`
+	GitClientKey  []byte `json:"git_client_key,omitempty"`
+}
+
+// envbuilderSubprocessNet is netutil.Options in a form that can be encoded
+// as JSON.
+type envbuilderSubprocessNet struct {
+	SOCKS5Proxy        string                `json:"socks5_proxy,omitempty"`
+	HostAliases        map[string]string     `json:"host_aliases,omitempty"`
+	Nameserver         string                `json:"nameserver,omitempty"`
+	PreferredFamily    netutil.AddressFamily `json:"preferred_family,omitempty"`
+	DialTimeoutIPv4    time.Duration         `json:"dial_timeout_ipv4,omitempty"`
+	DialTimeoutIPv6    time.Duration         `json:"dial_timeout_ipv6,omitempty"`
+	TLSSkipVerifyHosts []string              `json:"tls_skip_verify_hosts,omitempty"`
+}
+
+// envbuilderSubprocessMessage is a line written to the stdout of the
+// subprocess: either a log message, or the result once envbuilder is done.
+type envbuilderSubprocessMessage struct {
+	// Level, Stage and Message are set for log messages. Stage is the number
+	// of the build stage a message was logged in, if any.
+	Level   log.Level `json:"level,omitempty"`
+	Stage   int       `json:"stage,omitempty"`
+	Message string    `json:"message,omitempty"`
+
+	// Done is set for the result, along with either Error or the image.
+	Done      bool            `json:"done,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	MediaType types.MediaType `json:"media_type,omitempty"`
+	Manifest  []byte          `json:"manifest,omitempty"`
+	Config    []byte          `json:"config,omitempty"`
+}
+
+// newEnvbuilderSubprocessRequest returns the request to probe with opts and
+// probeOpts in a subprocess, using kanikoDir as the working directory of
+// envbuilder and kaniko.
+func newEnvbuilderSubprocessRequest(opts eboptions.Options, kanikoDir string, probeOpts cacheProbeOptions) (envbuilderSubprocessRequest, error) {
+	netOpts := probeOpts.netOpts
+	req := envbuilderSubprocessRequest{
+		Options:   computeEnvFromOptions(opts, nil, legacyEnvNamesNone),
+		MagicDir:  kanikoDir,
+		KanikoDir: kanikoDir,
+		Net: envbuilderSubprocessNet{
+			HostAliases:        netOpts.HostAliases,
+			Nameserver:         netOpts.Nameserver,
+			PreferredFamily:    netOpts.PreferredFamily,
+			DialTimeoutIPv4:    netOpts.DialTimeoutIPv4,
+			DialTimeoutIPv6:    netOpts.DialTimeoutIPv6,
+			TLSSkipVerifyHosts: netOpts.TLSSkipVerifyHosts,
+		},
+	}
+	if netOpts.SOCKS5Proxy != nil {
+		req.Net.SOCKS5Proxy = netOpts.SOCKS5Proxy.String()
+	}
+	if cert := probeOpts.gitClientCert; cert != nil {
+		for _, der := range cert.Certificate {
+			req.GitClientCert = append(req.GitClientCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			return req, fmt.Errorf("encode git client key: %w", err)
+		}
+		req.GitClientKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	}
+	return req, nil
+}
+
+// decode returns the envbuilder options of the request, and the probe
+// options to create its transports from.
+func (req envbuilderSubprocessRequest) decode() (eboptions.Options, cacheProbeOptions, error) {
+	var opts eboptions.Options
+	var probeOpts cacheProbeOptions
+	optSet := opts.CLI()
+	envs := make([]serpent.EnvVar, 0, len(req.Options))
+	for name, value := range req.Options {
+		envs = append(envs, serpent.EnvVar{Name: name, Value: value})
+	}
+	if err := optSet.ParseEnv(envs); err != nil {
+		return opts, probeOpts, fmt.Errorf("parse options: %w", err)
+	}
+	probeOpts.netOpts = netutil.Options{
+		HostAliases:        req.Net.HostAliases,
+		Nameserver:         req.Net.Nameserver,
+		PreferredFamily:    req.Net.PreferredFamily,
+		DialTimeoutIPv4:    req.Net.DialTimeoutIPv4,
+		DialTimeoutIPv6:    req.Net.DialTimeoutIPv6,
+		TLSSkipVerifyHosts: req.Net.TLSSkipVerifyHosts,
+	}
+	if req.Net.SOCKS5Proxy != "" {
+		proxyURL, err := url.Parse(req.Net.SOCKS5Proxy)
+		if err != nil {
+			return opts, probeOpts, fmt.Errorf("parse socks5 proxy: %w", err)
+		}
+		probeOpts.netOpts.SOCKS5Proxy = proxyURL
+	}
+	if len(req.GitClientCert) > 0 {
+		cert, err := tls.X509KeyPair(req.GitClientCert, req.GitClientKey)
+		if err != nil {
+			return opts, probeOpts, fmt.Errorf("parse git client certificate: %w", err)
+		}
+		probeOpts.gitClientCert = &cert
+	}
+	return opts, probeOpts, nil
+}
+
+// runEnvbuilderSubprocess runs envbuilder.RunCacheProbe with opts in a
+// subprocess of the provider, in the scratch directory containing kanikoDir.
+// The subprocess does not share the process-global state of envbuilder and
+// kaniko with other probes, so it need not wait for them. Its messages are
+// passed to opts.Logger, and devcontainerEnv is set in its environment. The
+// layers of the returned image are fetched from the cache repo with
+// remoteOpts if needed.
+func runEnvbuilderSubprocess(ctx context.Context, opts eboptions.Options, kanikoDir string, probeOpts cacheProbeOptions, remoteOpts ...remote.Option) (v1.Image, error) {
+	req, err := newEnvbuilderSubprocessRequest(opts, kanikoDir, probeOpts)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encode subprocess request: %w", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find the provider executable: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, exe, envbuilderSubprocessCommand)
+	cmd.Dir = kanikoDir
+	cmd.Env = os.Environ()
+	for key, value := range probeOpts.devcontainerEnv {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	if probeOpts.memoryLimit > 0 {
+		cmd.Env = append(cmd.Env, "GOMEMLIMIT="+strconv.FormatInt(probeOpts.memoryLimit, 10))
+	}
+	cmd.Stdin = strings.NewReader(string(stdin))
+	cmd.WaitDelay = 10 * time.Second
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start envbuilder subprocess: %w", err)
+	}
+	tflog.Debug(ctx, "running envbuilder in a subprocess", map[string]any{"pid": cmd.Process.Pid, "kaniko_dir": kanikoDir})
+
+	var result *envbuilderSubprocessMessage
+	scanner := bufio.NewScanner(stdout)
+	// The result contains the manifest and config of the image.
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var msg envbuilderSubprocessMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			tflog.Debug(ctx, "envbuilder subprocess: "+scanner.Text())
+			continue
+		}
+		switch {
+		case msg.Done:
+			result = &msg
+		case msg.Stage > 0:
+			opts.Logger(msg.Level, "#%d: %s", msg.Stage, msg.Message)
+		default:
+			opts.Logger(msg.Level, "%s", msg.Message)
+		}
+	}
+	scanErr := scanner.Err()
+	waitErr := cmd.Wait()
+	switch {
+	case result != nil && result.Error != "":
+		return nil, errors.New(result.Error)
+	case result != nil:
+		var nameOpts []name.Option
+		if opts.Insecure {
+			nameOpts = append(nameOpts, name.Insecure)
+		}
+		repo, err := name.NewRepository(opts.CacheRepo, nameOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return partial.CompressedToImage(&subprocessImage{repo: repo, result: result, remoteOpts: remoteOpts})
+	case scanErr != nil:
+		return nil, fmt.Errorf("read envbuilder subprocess output: %w", scanErr)
+	case waitErr != nil:
+		return nil, fmt.Errorf("envbuilder subprocess failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	return nil, errors.New("envbuilder subprocess exited without a result")
+}
+
+// subprocessImage is the image found by envbuilder in a subprocess. Its
+// manifest and config were passed from the subprocess, and its layers are
+// fetched from the cache repo.
+type subprocessImage struct {
+	repo       name.Repository
+	result     *envbuilderSubprocessMessage
+	remoteOpts []remote.Option
+}
+
+func (i *subprocessImage) MediaType() (types.MediaType, error) {
+	return i.result.MediaType, nil
+}
+
+func (i *subprocessImage) RawManifest() ([]byte, error) {
+	return i.result.Manifest, nil
+}
+
+func (i *subprocessImage) RawConfigFile() ([]byte, error) {
+	return i.result.Config, nil
+}
+
+func (i *subprocessImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	return remote.Layer(i.repo.Digest(h.String()), i.remoteOpts...)
+}
+
+// EnvbuilderSubprocessCommand runs envbuilder for a cache probe in subprocess
+// mode, as requested on stdin, and writes its messages and result to stdout.
+// It is run by the provider itself and is not meant to be run by users. It
+// returns the exit code of the command: 0 if envbuilder ran, whether or not
+// it found the image, and 2 if the request is invalid.
+func EnvbuilderSubprocessCommand(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) int {
+	var req envbuilderSubprocessRequest
+	if err := json.NewDecoder(stdin).Decode(&req); err != nil {
+		_, _ = fmt.Fprintf(stderr, "decode request: %s\n", err)
+		return 2
+	}
+	opts, probeOpts, err := req.decode()
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "decode request: %s\n", err)
+		return 2
+	}
+	tr, gitTr := probeOpts.transports()
+
+	// Messages are also logged from the goroutines of kaniko.
+	var mu sync.Mutex
+	enc := json.NewEncoder(stdout)
+	write := func(msg envbuilderSubprocessMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(msg)
+	}
+	opts.Logger = func(level log.Level, format string, args ...any) {
+		msg := envbuilderSubprocessMessage{Level: level}
+		if stage, ok := stageNumber(format, args); ok {
+			msg.Stage, msg.Message = stage, fmt.Sprint(args[1])
+		} else {
+			msg.Message = fmt.Sprintf(format, args...)
+		}
+		write(msg)
+	}
+	opts.Filesystem = osfs.New("/")
+	opts.MagicDirBase = req.MagicDir
+	kconfig.KanikoDir = req.KanikoDir
+
+	restoreTransport, err := netutil.Install(ctx, tr, gitTr)
+	if err != nil {
+		write(envbuilderSubprocessMessage{Done: true, Error: err.Error()})
+		return 0
+	}
+	defer restoreTransport()
+
+	result := envbuilderSubprocessMessage{Done: true}
+	img, err := envbuilder.RunCacheProbe(ctx, opts)
+	if err == nil {
+		result.MediaType, err = img.MediaType()
+	}
+	if err == nil {
+		result.Manifest, err = img.RawManifest()
+	}
+	if err == nil {
+		result.Config, err = img.RawConfigFile()
+	}
+	if err != nil {
+		result = envbuilderSubprocessMessage{Done: true, Error: err.Error()}
+	}
+	write(result)
+	return 0
+}
+
+// stageNumber returns the number of the build stage a message was logged in
+// by envbuilder, as "#<stage>: <message>", if any.
+func stageNumber(format string, args []any) (int, bool) {
+	if format != "#%d: %s" || len(args) != 2 {
+		return 0, false
+	}
+	stage, ok := args[0].(int)
+	return stage, ok
+}
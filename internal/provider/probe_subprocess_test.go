@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvbuilderSubprocessRequest(t *testing.T) {
+	t.Parallel()
+
+	certPEM, keyPEM := testClientCertificate(t)
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	require.NoError(t, err)
+	opts := eboptions.Options{
+		CacheRepo:           "localhost:5000/cache",
+		GitURL:              "https://example.com/repo.git#main",
+		GitPassword:         "secret",
+		IgnorePaths:         []string{"/var/run", "/tmp"},
+		RemoteRepoBuildMode: true,
+		BinaryPath:          "/tmp/envbuilder",
+	}
+	probeOpts := cacheProbeOptions{
+		netOpts: netutil.Options{
+			SOCKS5Proxy:        &url.URL{Scheme: "socks5", Host: "proxy:1080", User: url.UserPassword("user", "pass")},
+			HostAliases:        map[string]string{"example.com": "127.0.0.1"},
+			DialTimeoutIPv4:    time.Second,
+			TLSSkipVerifyHosts: []string{"localhost"},
+		},
+		gitClientCert: &cert,
+	}
+
+	req, err := newEnvbuilderSubprocessRequest(opts, "/tmp/scratch/.envbuilder", probeOpts)
+	require.NoError(t, err)
+	// The request is passed as JSON.
+	raw, err := json.Marshal(req)
+	require.NoError(t, err)
+	var decoded envbuilderSubprocessRequest
+	require.NoError(t, json.Unmarshal(raw, &decoded))
+	assert.Equal(t, "/tmp/scratch/.envbuilder", decoded.MagicDir)
+	assert.Equal(t, "/tmp/scratch/.envbuilder", decoded.KanikoDir)
+
+	gotOpts, gotProbeOpts, err := decoded.decode()
+	require.NoError(t, err)
+	assert.Equal(t, opts.CacheRepo, gotOpts.CacheRepo)
+	assert.Equal(t, opts.GitURL, gotOpts.GitURL)
+	assert.Equal(t, opts.GitPassword, gotOpts.GitPassword)
+	assert.Equal(t, opts.IgnorePaths, gotOpts.IgnorePaths)
+	assert.Equal(t, opts.RemoteRepoBuildMode, gotOpts.RemoteRepoBuildMode)
+	assert.Equal(t, opts.BinaryPath, gotOpts.BinaryPath)
+	assert.Equal(t, probeOpts.netOpts, gotProbeOpts.netOpts)
+	require.NotNil(t, gotProbeOpts.gitClientCert)
+	assert.Equal(t, cert.Certificate, gotProbeOpts.gitClientCert.Certificate)
+}
+
+func TestEnvbuilderSubprocessCommandInvalidRequest(t *testing.T) {
+	t.Parallel()
+
+	var stdout, stderr bytes.Buffer
+	code := EnvbuilderSubprocessCommand(context.Background(), strings.NewReader("not json"), &stdout, &stderr)
+	assert.Equal(t, 2, code)
+	assert.Empty(t, stdout.String())
+	assert.Contains(t, stderr.String(), "decode request")
+}
+
+func TestStageNumber(t *testing.T) {
+	t.Parallel()
+
+	stage, ok := stageNumber("#%d: %s", []any{3, "Checking for cached image..."})
+	assert.True(t, ok)
+	assert.Equal(t, 3, stage)
+	_, ok = stageNumber("%s %s", []any{"envbuilder", "v1.0.4"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// defaultHeartbeatInterval is the default interval at which the progress of a
+// cache probe is logged.
+const defaultHeartbeatInterval = 30 * time.Second
+
+// progressOptions configures how the progress of a cache probe is reported.
+type progressOptions struct {
+	// heartbeatInterval is the interval at which progress is logged. If zero,
+	// defaultHeartbeatInterval is used.
+	heartbeatInterval time.Duration
+	// diagnostics adds a summary of the progress of each probe as a warning
+	// diagnostic.
+	diagnostics bool
+}
+
+// probeStage is a stage of a cache probe.
+type probeStage struct {
+	name  string
+	start time.Time
+}
+
+// probeProgress tracks the progress of a cache probe, so that a slow probe
+// can be told apart from a hung one.
+type probeProgress struct {
+	start time.Time
+	// bytesRead is the number of bytes read from network connections made
+	// while probing.
+	bytesRead atomic.Int64
+
+	mu     sync.Mutex
+	stages []probeStage
+}
+
+func newProbeProgress() *probeProgress {
+	return &probeProgress{start: time.Now()}
+}
+
+// setStage records the start of the named stage.
+func (p *probeProgress) setStage(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stages = append(p.stages, probeStage{name: name, start: time.Now()})
+}
+
+// currentStage returns the name of the current stage, or the empty string if
+// no stage has started.
+func (p *probeProgress) currentStage() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.stages) == 0 {
+		return ""
+	}
+	return p.stages[len(p.stages)-1].name
+}
+
+// logFunc returns logf, recording the stages logged by envbuilder.
+func (p *probeProgress) logFunc(logf log.Func) log.Func {
+	return func(level log.Level, format string, args ...any) {
+		// Envbuilder logs the start of each stage as "#<n>: <stage>".
+		if format == "#%d: %s" && len(args) == 2 {
+			p.setStage(fmt.Sprint(args[1]))
+		}
+		logf(level, format, args...)
+	}
+}
+
+// fields returns the current progress as tflog fields.
+func (p *probeProgress) fields() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fields := map[string]any{
+		"elapsed":          time.Since(p.start).Round(time.Second).String(),
+		"bytes_downloaded": p.bytesRead.Load(),
+	}
+	if len(p.stages) > 0 {
+		stage := p.stages[len(p.stages)-1]
+		fields["stage"] = stage.name
+		fields["stage_elapsed"] = time.Since(stage.start).Round(time.Second).String()
+	}
+	return fields
+}
+
+// heartbeat logs the progress every interval until the returned function is
+// called or ctx is done.
+func (p *probeProgress) heartbeat(ctx context.Context, interval time.Duration) func() {
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tflog.Info(ctx, "cache probe in progress", p.fields())
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// summary returns a human readable summary of the progress, including the
+// duration of each stage.
+func (p *probeProgress) summary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "The cache probe took %s and downloaded %d bytes.",
+		now.Sub(p.start).Round(time.Millisecond), p.bytesRead.Load())
+	for i, stage := range p.stages {
+		end := now
+		if i+1 < len(p.stages) {
+			end = p.stages[i+1].start
+		}
+		_, _ = fmt.Fprintf(&sb, "\n- %s [%s]", stage.name, end.Sub(stage.start).Round(time.Millisecond))
+	}
+	return sb.String()
+}
+
+// probeCancelledError is returned by a cache probe that was cancelled, or
+// timed out, before it completed. It records how far the probe got.
+type probeCancelledError struct {
+	// cause is the cause of the cancellation, such as
+	// context.DeadlineExceeded.
+	cause error
+	// stage is the stage the probe was in, or empty if none had started.
+	stage string
+	// progress summarizes the progress of the probe up to the cancellation.
+	progress string
+}
+
+// cancelled returns a probeCancelledError for a probe that was stopped with
+// cause in its current stage.
+func (p *probeProgress) cancelled(cause error) *probeCancelledError {
+	return &probeCancelledError{cause: cause, stage: p.currentStage(), progress: p.summary()}
+}
+
+func (e *probeCancelledError) timedOut() bool {
+	return errors.Is(e.cause, context.DeadlineExceeded)
+}
+
+func (e *probeCancelledError) Error() string {
+	verb := "cancelled"
+	if e.timedOut() {
+		verb = "timed out"
+	}
+	if e.stage == "" {
+		return fmt.Sprintf("cache probe %s before it started: %s", verb, e.cause)
+	}
+	return fmt.Sprintf("cache probe %s during stage %q: %s", verb, e.stage, e.cause)
+}
+
+func (e *probeCancelledError) Unwrap() error {
+	return e.cause
+}
+
+// summary returns the summary of the diagnostic for the error.
+func (e *probeCancelledError) summary() string {
+	if e.timedOut() {
+		return "Cache probe timed out."
+	}
+	return "Cache probe cancelled."
+}
+
+// detail returns the detail of the diagnostic for the error, for a probe of
+// cacheRepo.
+func (e *probeCancelledError) detail(cacheRepo string) string {
+	stage := "before it started"
+	if e.stage != "" {
+		stage = fmt.Sprintf("during stage %q", e.stage)
+	}
+	return fmt.Sprintf("Probing for a cached image in repository %q was stopped %s (%s), so the builder image is used instead.\n\n%s",
+		cacheRepo, stage, e.cause, e.progress)
+}
@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/envbuilder/log"
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeProgress(t *testing.T) {
+	t.Parallel()
+
+	p := newProbeProgress()
+	p.setStage("Fetching envbuilder")
+	var logged []string
+	logf := p.logFunc(func(_ log.Level, format string, _ ...any) {
+		logged = append(logged, format)
+	})
+	logf(log.LevelInfo, "#%d: %s", 1, "🏗️ Checking for cached image...")
+	logf(log.LevelInfo, "#%d: %s [%s]", 1, "🏗️ Checked for cached image!", time.Second)
+	logf(log.LevelInfo, "unrelated %s", "message")
+	p.bytesRead.Add(42)
+
+	// All messages are passed through, but only the start of stages is
+	// recorded.
+	assert.Len(t, logged, 3)
+	fields := p.fields()
+	assert.Equal(t, "🏗️ Checking for cached image...", fields["stage"])
+	assert.Equal(t, int64(42), fields["bytes_downloaded"])
+
+	summary := p.summary()
+	assert.Contains(t, summary, "downloaded 42 bytes")
+	assert.Contains(t, summary, "\n- Fetching envbuilder [")
+	assert.Contains(t, summary, "\n- 🏗️ Checking for cached image... [")
+
+	// The heartbeat stops when requested.
+	stop := p.heartbeat(context.Background(), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	stop()
+}
+
+// Not parallel, as the cache probe replaces process-wide state.
+func TestRunCacheProbeTimeout(t *testing.T) {
+	// The registry holds requests for manifests until they are cancelled.
+	reg := registrytest.New(t, t.TempDir(), func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				<-r.Context().Done()
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	builderImage := reg + "/envbuilder:latest"
+	result, err := runCacheProbe(ctx, builderImage, eboptions.Options{
+		CacheRepo: reg + "/cache",
+		GitURL:    "https://git.local/repo.git",
+	}, cacheProbeOptions{registryAuth: registryAuth{skipLocalDockerConfig: true}})
+	var cancelledErr *probeCancelledError
+	require.True(t, errors.As(err, &cancelledErr), err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "Fetching envbuilder from "+builderImage, cancelledErr.stage)
+	assert.Equal(t, fmt.Sprintf("cache probe timed out during stage %q: context deadline exceeded", cancelledErr.stage), err.Error())
+	assert.Equal(t, "Cache probe timed out.", cancelledErr.summary())
+	assert.Contains(t, cancelledErr.detail(reg+"/cache"), "- Resolving registry credentials")
+	assert.Equal(t, result.progress, cancelledErr.progress)
+}
+
+func TestProbeCancelledError(t *testing.T) {
+	t.Parallel()
+
+	err := (&probeProgress{start: time.Now()}).cancelled(context.Canceled)
+	assert.Equal(t, "cache probe cancelled before it started: context canceled", err.Error())
+	assert.Equal(t, "Cache probe cancelled.", err.summary())
+	assert.Contains(t, err.detail("localhost:5000/cache"), `repository "localhost:5000/cache" was stopped before it started (context canceled)`)
+}
@@ -2,19 +2,34 @@ package provider
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"time"
 
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	"github.com/docker/go-units"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
 	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
 // Ensure EnvbuilderProvider satisfies various provider interfaces.
 var (
-	_ provider.Provider              = &EnvbuilderProvider{}
-	_ provider.ProviderWithFunctions = &EnvbuilderProvider{}
+	_ provider.Provider                       = &EnvbuilderProvider{}
+	_ provider.ProviderWithFunctions          = &EnvbuilderProvider{}
+	_ provider.ProviderWithEphemeralResources = &EnvbuilderProvider{}
 )
 
 // EnvbuilderProvider defines the provider implementation.
@@ -26,7 +41,104 @@ type EnvbuilderProvider struct {
 }
 
 // EnvbuilderProviderModel describes the provider data model.
-type EnvbuilderProviderModel struct{}
+type EnvbuilderProviderModel struct {
+	SOCKS5Proxy     types.String `tfsdk:"socks5_proxy"`
+	SOCKS5Username  types.String `tfsdk:"socks5_username"`
+	SOCKS5Password  types.String `tfsdk:"socks5_password"`
+	HostAliases     types.Map    `tfsdk:"host_aliases"`
+	DNSResolver     types.String `tfsdk:"dns_resolver"`
+	IPFamily        types.String `tfsdk:"ip_family"`
+	DialTimeoutIPv4 types.String `tfsdk:"dial_timeout_ipv4"`
+	DialTimeoutIPv6 types.String `tfsdk:"dial_timeout_ipv6"`
+
+	ExtraEnvLockedKeys       types.List   `tfsdk:"extra_env_locked_keys"`
+	ExtraEnvOverrideSeverity types.String `tfsdk:"extra_env_override_severity"`
+	ExtraEnvPrecedence       types.String `tfsdk:"extra_env_precedence"`
+
+	DefaultIgnorePaths types.List `tfsdk:"default_ignore_paths"`
+
+	RegistryCredentialProcess types.List   `tfsdk:"registry_credential_process"`
+	RegistryCredentialHosts   types.List   `tfsdk:"registry_credential_hosts"`
+	UseLocalDockerConfig      types.Bool   `tfsdk:"use_local_docker_config"`
+	UseCredentialHelpers      types.Bool   `tfsdk:"use_docker_credential_helpers"`
+	DockerConfigSecretPath    types.String `tfsdk:"docker_config_secret_path"`
+	RegistryAuthFile          types.String `tfsdk:"registry_auth_file"`
+	GCPAuth                   types.Bool   `tfsdk:"gcp_auth"`
+	AzureAuth                 types.Bool   `tfsdk:"azure_auth"`
+
+	ContainerdAddress   types.String `tfsdk:"containerd_address"`
+	ContainerdNamespace types.String `tfsdk:"containerd_namespace"`
+
+	ProbeHeartbeatInterval   types.String `tfsdk:"probe_heartbeat_interval"`
+	ProbeProgressDiagnostics types.Bool   `tfsdk:"probe_progress_diagnostics"`
+	ProbeMemoryLimit         types.String `tfsdk:"probe_memory_limit"`
+	ProbeScratchLimit        types.String `tfsdk:"probe_scratch_limit"`
+	MaxConcurrentProbes      types.Int64  `tfsdk:"max_concurrent_probes"`
+	ProbeMode                types.String `tfsdk:"probe_mode"`
+	ProbeExecutor            types.Object `tfsdk:"probe_executor"`
+
+	ProbeResultCacheDir types.String `tfsdk:"probe_result_cache_dir"`
+	ProbeResultCacheTTL types.String `tfsdk:"probe_result_cache_ttl"`
+
+	ProbeGitPassword            types.String `tfsdk:"probe_git_password"`
+	ProbeGitSSHPrivateKeyBase64 types.String `tfsdk:"probe_git_ssh_private_key_base64"`
+	ProbeDockerConfigBase64     types.String `tfsdk:"probe_docker_config_base64"`
+
+	VaultAddress            types.String `tfsdk:"vault_address"`
+	VaultNamespace          types.String `tfsdk:"vault_namespace"`
+	VaultAuthMethod         types.String `tfsdk:"vault_auth_method"`
+	VaultAuthMount          types.String `tfsdk:"vault_auth_mount"`
+	VaultRole               types.String `tfsdk:"vault_role"`
+	VaultToken              types.String `tfsdk:"vault_token"`
+	VaultGitSecretPath      types.String `tfsdk:"vault_git_secret_path"`
+	VaultRegistrySecretPath types.String `tfsdk:"vault_registry_secret_path"`
+
+	AuditWebhookURL    types.String `tfsdk:"audit_webhook_url"`
+	AuditWebhookSecret types.String `tfsdk:"audit_webhook_secret"`
+}
+
+// providerData is passed by the provider to data sources, resources and
+// ephemeral resources.
+type providerData struct {
+	// netOpts configures all outbound connections made while probing.
+	netOpts netutil.Options
+	// overridePolicy configures how extra_env and options may override
+	// options set by attributes.
+	overridePolicy overridePolicy
+	// defaultIgnorePaths are added to the ignore paths of every cached image.
+	defaultIgnorePaths []string
+	// registryAuth configures where registry credentials come from.
+	registryAuth registryAuth
+	// progress configures how the progress of cache probes is reported.
+	progress progressOptions
+	// scratchLimit is the maximum size in bytes of the temporary directory
+	// used by each cache probe. If zero, there is no limit.
+	scratchLimit int64
+	// probeLimiter limits the number of cache probes that run at once. It
+	// is nil if they are not limited.
+	probeLimiter *probeLimiter
+	// probeMode is where cache probes run envbuilder: probeModeInProcess or
+	// probeModeSubprocess.
+	probeMode string
+	// memoryLimit is the soft memory limit in bytes of probe subprocesses.
+	// If zero, they inherit GOMEMLIMIT from the provider.
+	memoryLimit int64
+	// probeExecutor runs cache probes in containers. It is nil if they run
+	// in the provider or a subprocess, as set by probeMode.
+	probeExecutor probeExecutor
+	// probeSecrets are credentials that are only used for probing.
+	probeSecrets probeSecrets
+	// containerd configures looking up cached images in containerd.
+	containerd containerdOptions
+	// resultCache stores the results of cache probes across runs.
+	resultCache probeResultCache
+	// vault fetches credentials for probing from Vault. It is nil if Vault
+	// is not configured.
+	vault *vaultCredentials
+	// audit sends an event for every cache probe. It is nil if no webhook
+	// is configured.
+	audit *auditWebhook
+}
 
 func (p *EnvbuilderProvider) Metadata(ctx context.Context, req provider.MetadataRequest, resp *provider.MetadataResponse) {
 	resp.TypeName = "envbuilder"
@@ -35,7 +147,250 @@ func (p *EnvbuilderProvider) Metadata(ctx context.Context, req provider.Metadata
 
 func (p *EnvbuilderProvider) Schema(ctx context.Context, req provider.SchemaRequest, resp *provider.SchemaResponse) {
 	resp.Schema = schema.Schema{
-		Attributes: map[string]schema.Attribute{},
+		Attributes: map[string]schema.Attribute{
+			"socks5_proxy": schema.StringAttribute{
+				MarkdownDescription: "The address of a SOCKS5 proxy through which all outbound connections made while probing are routed, including cloning the Git repository and fetching images from container registries. Either a `host:port` pair or a `socks5://` URL.",
+				Optional:            true,
+			},
+			"socks5_username": schema.StringAttribute{
+				MarkdownDescription: "The username to use for authenticating with the SOCKS5 proxy. This is optional.",
+				Optional:            true,
+			},
+			"socks5_password": schema.StringAttribute{
+				MarkdownDescription: "The password to use for authenticating with the SOCKS5 proxy. This is optional.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"host_aliases": schema.MapAttribute{
+				MarkdownDescription: "A map of hostnames to IP addresses to use when connecting to those hosts while probing, similar to entries in `/etc/hosts`. This is useful when a registry's DNS name is not resolvable from where Terraform runs.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"dns_resolver": schema.StringAttribute{
+				MarkdownDescription: "The IP address (with an optional port) of a DNS server to use for resolving hostnames while probing, instead of the system resolver.",
+				Optional:            true,
+			},
+			"ip_family": schema.StringAttribute{
+				MarkdownDescription: "The IP address family to try first when a hostname resolves to both IPv4 and IPv6 addresses. One of `ipv4` or `ipv6`. If not set, the system default behavior is used.",
+				Optional:            true,
+			},
+			"dial_timeout_ipv4": schema.StringAttribute{
+				MarkdownDescription: "The timeout for connecting to a single IPv4 address, as a duration string (e.g. `5s`). Defaults to `30s`.",
+				Optional:            true,
+			},
+			"dial_timeout_ipv6": schema.StringAttribute{
+				MarkdownDescription: "The timeout for connecting to a single IPv6 address, as a duration string (e.g. `5s`). Defaults to `30s`. Lowering this helps when a host advertises IPv6 addresses that are not reachable.",
+				Optional:            true,
+			},
+			"extra_env_locked_keys": schema.ListAttribute{
+				MarkdownDescription: "Envbuilder options, by environment variable name, that may not be overridden by `extra_env` or `options` of `envbuilder_cached_image`, in addition to `ENVBUILDER_CACHE_REPO` and `ENVBUILDER_GIT_URL`. For example, `[\"ENVBUILDER_GIT_SSH_PRIVATE_KEY_PATH\", \"ENVBUILDER_FALLBACK_IMAGE\"]`.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"extra_env_override_severity": schema.StringAttribute{
+				MarkdownDescription: "The severity of diagnostics reported when `extra_env` or `options` of `envbuilder_cached_image` override an option set by another attribute, or attempt to override a locked option. One of `warning` or `error`. Defaults to `warning`.",
+				Optional:            true,
+			},
+			"extra_env_precedence": schema.StringAttribute{
+				MarkdownDescription: "Whether `extra_env` or the other attributes of `envbuilder_cached_image` take precedence when both set the same envbuilder option. One of `extra_env` or `attributes`. Defaults to `extra_env`.",
+				Optional:            true,
+			},
+			"default_ignore_paths": schema.ListAttribute{
+				MarkdownDescription: "Paths to ignore when building the workspace that are added to `ignore_paths` of every `envbuilder_cached_image`, for example output directories that should never end up in an image. Like in `ignore_paths`, paths must be absolute, and each segment of a path may be a pattern, such as `/workspaces/*/node_modules`.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"registry_credential_process": schema.ListAttribute{
+				MarkdownDescription: "A command, and its arguments, that is run to get the credentials for a container registry. The registry host (e.g. `ghcr.io`, or `index.docker.io` for Docker Hub) is appended as the last argument, and the command must print the credentials to stdout as JSON in the format used by Docker credential helpers: `{\"Username\": \"...\", \"Secret\": \"...\"}`. A `Username` of `<token>` means `Secret` is an identity token. Printing nothing, or `{}`, means there are no credentials for the registry. Credentials from this command take precedence over `docker_config_base64` and the local Docker config. The command is run once per registry host, before probing for the registries of `cache_repo`, `builder_image` and `registry_credential_hosts`, and when fetching images otherwise.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"registry_credential_hosts": schema.ListAttribute{
+				MarkdownDescription: "Additional registry hosts to get credentials for with `registry_credential_process` before probing, for example the registries of base images referenced by the devcontainer. The registries of `cache_repo` and `builder_image` are always included.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"use_local_docker_config": schema.BoolAttribute{
+				MarkdownDescription: "Whether to use the registry credentials in the local Docker config, `$DOCKER_CONFIG/config.json` or `~/.docker/config.json`, when `docker_config_base64` of `envbuilder_cached_image` is not set, as `docker pull` would. Credential helpers configured in the local Docker config are used as well. Defaults to `true`. This does not affect the Podman auth file, or `registry_auth_file`.",
+				Optional:            true,
+			},
+			"gcp_auth": schema.BoolAttribute{
+				MarkdownDescription: "Whether to authenticate to Google Artifact Registry (`*.pkg.dev`) and Container Registry (`gcr.io`) with Google Application Default Credentials: the service account key in `GOOGLE_APPLICATION_CREDENTIALS`, the credentials of `gcloud auth application-default login`, or the service account attached to the machine or workload identity of the pod running Terraform. An access token is passed to envbuilder when probing, and refreshed as it expires, for the registries of `cache_repo` and `builder_image` that `docker_config_base64`, the registry credential process and the Docker config have no credentials for. Defaults to `false`.",
+				Optional:            true,
+			},
+			"azure_auth": schema.BoolAttribute{
+				MarkdownDescription: "Whether to authenticate to Azure Container Registry (`*.azurecr.io`, and the registries of the national clouds) with the Azure identity of the machine running Terraform, as found in the environment: a service principal with `AZURE_CLIENT_ID`, `AZURE_CLIENT_SECRET` and `AZURE_TENANT_ID`, a federated token with `AZURE_FEDERATED_TOKEN_FILE` such as that of workload identity, or the managed identity of the machine, selected by `AZURE_CLIENT_ID` if set. The Azure AD token is exchanged for a registry refresh token, which is passed to envbuilder when probing, for the registries of `cache_repo` and `builder_image` that `docker_config_base64`, the registry credential process and the Docker config have no credentials for. This takes the place of `az acr login`, which is not available in Terraform Cloud. Defaults to `false`.",
+				Optional:            true,
+			},
+			"use_docker_credential_helpers": schema.BoolAttribute{
+				MarkdownDescription: "Whether to run the Docker credential helpers configured by `credHelpers` and `credsStore` in the Docker config, e.g. `docker-credential-ecr-login`, `docker-credential-gcloud` or `docker-credential-osxkeychain`, for the local Docker config, `docker_config_secret_path` and `docker_config_base64` alike. The helpers run on the machine running Terraform, both for the registry requests of the provider and for the dry-run build of probes. When `probe_executor` is set, the credentials they return for the registries of `cache_repo` and `builder_image` are resolved before the probe and passed to envbuilder, as the helpers cannot run in its container. If `false`, only the credentials stored in the Docker config are used. Defaults to `true`.",
+				Optional:            true,
+			},
+			"docker_config_secret_path": schema.StringAttribute{
+				MarkdownDescription: "The path to a mounted Kubernetes `kubernetes.io/dockerconfigjson` secret, such as an image pull secret, either the directory it is mounted in or its `.dockerconfigjson` file. The registry credentials in it are used when probing for `envbuilder_cached_image` resources that do not set `docker_config_base64`, as if it were set to the base64 encoded contents of the file, and when fetching images otherwise. The file is read whenever it is used, so a rotated secret is picked up without restarting Terraform.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+			},
+			"registry_auth_file": schema.StringAttribute{
+				MarkdownDescription: "The path to a registry auth file in the format of the Podman `auth.json`, which is also that of the Docker config, such as one written by `podman login --authfile` or `docker login` in CI. It is used in place of the Podman auth file of the host running Terraform, `$REGISTRY_AUTH_FILE`, `$XDG_RUNTIME_DIR/containers/auth.json` or `~/.config/containers/auth.json`, for registries that the Docker config has no credentials for. The local Docker config is still found with `$DOCKER_CONFIG`. The file is read whenever it is used, and it is an error if it does not exist.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+			},
+			"containerd_address": schema.StringAttribute{
+				MarkdownDescription: "The path to a containerd API socket, e.g. `/run/containerd/containerd.sock`. If set, an `envbuilder_cached_image` that was found is looked up by digest in the containerd content store when it is refreshed, and the remote registry is only checked if it is not there. This is for deployments where the nodes that run workspaces and Terraform share a containerd content store. The cache probe itself always uses `cache_repo`, as the layer cache is only stored there.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+			},
+			"containerd_namespace": schema.StringAttribute{
+				MarkdownDescription: "The containerd namespace to look up cached images in when `containerd_address` is set. Defaults to `k8s.io`, the namespace used by Kubernetes. nerdctl uses `default`.",
+				Optional:            true,
+			},
+			"probe_heartbeat_interval": schema.StringAttribute{
+				MarkdownDescription: "The interval at which the progress of a running cache probe (the current stage, the time elapsed and the number of bytes downloaded) is logged, as a duration string (e.g. `10s`). Defaults to `30s`. The progress is logged at the `INFO` level, and is visible with `TF_LOG=INFO`.",
+				Optional:            true,
+			},
+			"probe_progress_diagnostics": schema.BoolAttribute{
+				MarkdownDescription: "Whether to report a summary of each cache probe, including the duration of each stage and the number of bytes downloaded, as a warning once it completes. Defaults to `false`.",
+				Optional:            true,
+			},
+			"probe_memory_limit": schema.StringAttribute{
+				MarkdownDescription: "A soft limit on the memory used by each cache probe subprocess, as a size (e.g. `512MiB` or `2g`, in binary units). When the limit is approached, memory is reclaimed more aggressively at the expense of speed. It does not stop a probe that needs more memory than the limit. It can only be set if `probe_mode` is `subprocess`, as it would otherwise apply to the provider process as a whole. If not set, the subprocess honors the `GOMEMLIMIT` environment variable of the provider.",
+				Optional:            true,
+			},
+			"probe_scratch_limit": schema.StringAttribute{
+				MarkdownDescription: "The maximum size of the temporary directory used by each cache probe, which holds the cloned repository in remote repo build mode, the envbuilder binary and kaniko's working files, as a size (e.g. `5GiB` or `500m`, in binary units). A probe that exceeds it fails with an error. This does not include `workspace_folder` of `envbuilder_cached_image` if it is set. If not set, there is no limit.",
+				Optional:            true,
+			},
+			"max_concurrent_probes": schema.Int64Attribute{
+				MarkdownDescription: "The maximum number of cache probes that run at once, across all resources and ephemeral resources of this provider. The builds of `envbuilder_prebuilt_image` are not limited, only the probes that find their images. Each probe clones the repository and fetches the layers of the image, so probing many resources at once, for example with `for_each`, can exhaust the memory or bandwidth of the machine running Terraform. Probes beyond the limit wait for a running probe to finish, and the time spent waiting counts towards their `timeouts`. If not set, probes are only limited by the parallelism of Terraform. Unless `probe_mode` is `subprocess` or `probe_executor` is set, the dry-run build of each probe, in which envbuilder and kaniko run in the provider process, runs for one probe at a time whatever the limit, as they are not safe for concurrent use; the other stages of probes run concurrently.",
+				Optional:            true,
+				Validators: []validator.Int64{
+					positive(),
+				},
+			},
+			"probe_mode": schema.StringAttribute{
+				MarkdownDescription: "Where cache probes run envbuilder and kaniko for their dry-run build. One of `in_process`, to run them in the provider process, or `subprocess`, to run them in a separate process of the provider binary. Envbuilder and kaniko change the state of the process they run in, so only one probe runs them at a time in the provider process. In a subprocess, they do not affect the provider or other probes, probes run them concurrently up to `max_concurrent_probes`, and their working files are confined to the scratch directory of the probe, including the Docker config holding registry credentials. Stopping a probe in a subprocess, for example when it times out, kills the subprocess. The bytes downloaded by the subprocess are not counted in the summary of the probe. Defaults to `in_process`.",
+				Optional:            true,
+				Validators: []validator.String{
+					oneOf(probeModeInProcess, probeModeSubprocess),
+				},
+			},
+			"probe_result_cache_dir": schema.StringAttribute{
+				MarkdownDescription: "A directory in which the results of cache probes that found an image are stored, so that a later probe with the same inputs is skipped, even across Terraform runs. A result is keyed by the inputs of the probe, excluding credentials, the commit that `git_url` resolves to and the digest of `builder_image`, so a new commit or builder image is always probed. The image is still fetched from `cache_repo` to check that it exists. Resolving the commit requires listing the refs of the remote, so results are not cached with `local_repo_path`. The outcomes of recent probes, shown in the `probe_history` of `envbuilder_cached_image`, are also stored in this directory. If not set, results are not cached.",
+				Optional:            true,
+				Validators: []validator.String{
+					absolutePath(),
+				},
+			},
+			"probe_result_cache_ttl": schema.StringAttribute{
+				MarkdownDescription: "How long a result in `probe_result_cache_dir` is reused, as a duration string (e.g. `12h`). Defaults to `24h`.",
+				Optional:            true,
+			},
+			"probe_git_password": schema.StringAttribute{
+				MarkdownDescription: "The password to clone the repository with when probing, for `envbuilder_cached_image` resources that do not set `git_password`. Unlike `git_password`, it is not included in `env`, so it is never written to the plan or state, and it can be set to an ephemeral value with Terraform 1.10 or later. The workspace needs to be given the credentials in another way.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"probe_git_ssh_private_key_base64": schema.StringAttribute{
+				MarkdownDescription: "The base64 encoded SSH private key to clone the repository with when probing, for `envbuilder_cached_image` resources that set neither `git_ssh_private_key_path` nor `git_ssh_private_key_base64`. Like `probe_git_password`, it is never written to the plan or state, and it can be set to an ephemeral value.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"probe_docker_config_base64": schema.StringAttribute{
+				MarkdownDescription: "The base64 encoded Docker config to authenticate with registries when probing, for `envbuilder_cached_image` resources that do not set `docker_config_base64`. It takes the place of the local Docker config. Like `probe_git_password`, it is never written to the plan or state, and it can be set to an ephemeral value.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"vault_address": schema.StringAttribute{
+				MarkdownDescription: "The address of a HashiCorp Vault server to fetch credentials for probing from, e.g. `https://vault.example.com:8200`. Defaults to the `VAULT_ADDR` environment variable. Vault is only used if `vault_git_secret_path` or `vault_registry_secret_path` is set. The secrets are read when they are first needed by a probe, and held in memory for the rest of the Terraform run, so they are never written to the plan or state. Credentials set on `envbuilder_cached_image`, or by the other `probe_*` attributes, take precedence.",
+				Optional:            true,
+			},
+			"vault_namespace": schema.StringAttribute{
+				MarkdownDescription: "The Vault Enterprise namespace of the secrets and the auth method. Defaults to the `VAULT_NAMESPACE` environment variable.",
+				Optional:            true,
+			},
+			"vault_auth_method": schema.StringAttribute{
+				MarkdownDescription: "How to authenticate to Vault. One of `token`, to use `vault_token`, or `kubernetes`, to log in with `vault_role` and the service account token of the pod Terraform runs in. Defaults to `token`.",
+				Optional:            true,
+			},
+			"vault_auth_mount": schema.StringAttribute{
+				MarkdownDescription: "The path the Vault auth method is mounted at. Defaults to the name of `vault_auth_method`, e.g. `kubernetes`.",
+				Optional:            true,
+			},
+			"vault_role": schema.StringAttribute{
+				MarkdownDescription: "The Vault role to log in with when `vault_auth_method` is `kubernetes`.",
+				Optional:            true,
+			},
+			"vault_token": schema.StringAttribute{
+				MarkdownDescription: "The Vault token to use when `vault_auth_method` is `token`. Defaults to the `VAULT_TOKEN` environment variable.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"vault_git_secret_path": schema.StringAttribute{
+				MarkdownDescription: "The API path of a Vault secret with the git credentials to probe with, e.g. `secret/data/envbuilder/git` for a KV version 2 secret. The `username`, `password` and `ssh_private_key` keys of the secret are used for `git_username`, `git_password` and `git_ssh_private_key_base64` of `envbuilder_cached_image` resources that do not set them. `ssh_private_key` is the PEM encoded key, not base64 encoded.",
+				Optional:            true,
+			},
+			"vault_registry_secret_path": schema.StringAttribute{
+				MarkdownDescription: "The API path of a Vault secret with the registry credentials to probe with, e.g. `secret/data/envbuilder/registry` for a KV version 2 secret. The Docker config JSON in its `.dockerconfigjson` key is used for `envbuilder_cached_image` resources that do not set `docker_config_base64`.",
+				Optional:            true,
+			},
+			"audit_webhook_url": schema.StringAttribute{
+				MarkdownDescription: "An HTTP(S) URL that a JSON event is posted to for every cache probe of `envbuilder_cached_image`, as an audit trail of the images handed to workspaces. " +
+					"The event has the `time` and `duration_ms` of the probe, the `resource` type that probed, the `git_url`, `cache_repo`, `builder_image`, `inputs_hash` and `commit` probed, whether it was a `hit`, and the `image` and its `digest`. " +
+					"Its `environment` has those of the `CODER_WORKSPACE_OWNER`, `CODER_WORKSPACE_NAME`, `CODER_WORKSPACE_TEMPLATE_NAME`, `CODER_WORKSPACE_TEMPLATE_VERSION`, `TFC_RUN_ID`, `TFC_WORKSPACE_NAME` and `TF_WORKSPACE` environment variables that are set, to identify who applied which template. " +
+					"Failing to send an event produces a warning. Connections are made as configured by the other attributes of the provider.",
+				Optional: true,
+			},
+			"audit_webhook_secret": schema.StringAttribute{
+				MarkdownDescription: "A secret that every event sent to `audit_webhook_url` is signed with. The hex encoded HMAC-SHA256 of the request body is sent in the `X-Envbuilder-Signature-256` header, prefixed with `sha256=`.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"probe_executor": schema.SingleNestedBlock{
+				MarkdownDescription: "Runs the dry-run builds of cache probes elsewhere than in the provider. It must contain exactly one executor block, e.g. `probe_executor { docker {} }`. It cannot be set if `probe_mode` is `subprocess`.",
+				Blocks: map[string]schema.Block{
+					"docker": schema.SingleNestedBlock{
+						MarkdownDescription: "Runs envbuilder in a container of the `builder_image` of each probe, with a Docker daemon reachable from the machine running Terraform, as a workspace would run it. The cache probe then uses the version of envbuilder and kaniko of the builder image rather than those built into the provider, and does not change the state of the provider process, so probes run concurrently up to `max_concurrent_probes`. The scratch directory of each probe is mounted in its container, so the daemon must run on the same machine as Terraform. The bytes downloaded in the container are not counted in the summary of the probe.",
+						Attributes: map[string]schema.Attribute{
+							"host": schema.StringAttribute{
+								MarkdownDescription: "The address of the Docker daemon, e.g. `unix:///var/run/docker.sock`. Defaults to the `DOCKER_HOST` environment variable, or the default socket of Docker.",
+								Optional:            true,
+							},
+							"network_mode": schema.StringAttribute{
+								MarkdownDescription: "The network mode of the containers, e.g. `host`. Defaults to the default network of the daemon.",
+								Optional:            true,
+							},
+						},
+					},
+					"kubernetes": schema.SingleNestedBlock{
+						MarkdownDescription: "Runs envbuilder in a Kubernetes job of the `builder_image` of each probe, with `ENVBUILDER_GET_CACHED_IMAGE` set, and follows the logs of its pod. The repository is cloned and the layers of the image are checked from the cluster, so the machine running Terraform only needs access to the Kubernetes API and to the manifest and config of the cached image in `cache_repo`. The options of envbuilder, including credentials, are passed to the job in a secret, which is deleted with the job once the probe ends. Options that reference files, such as `git_ssh_private_key_path`, must reference files in the builder image. Outputs read from the cloned repository, such as `customizations`, are empty for probes run in a job. The cluster is authenticated to with the token, client certificate or basic auth of the kubeconfig user, or with its exec credential plugin, such as `aws eks get-token`, `gke-gcloud-auth-plugin` or `kubelogin`, which must be installed where Terraform runs. The legacy `auth-provider` plugins are not supported.",
+						Attributes: map[string]schema.Attribute{
+							"kubeconfig": schema.StringAttribute{
+								MarkdownDescription: "The path to the kubeconfig file to use, with its current context. Exec credential plugins in it are run with `interactive` set to false, so they must not prompt for input. Defaults to the first path in the `KUBECONFIG` environment variable, the service account of the pod Terraform runs in, or `~/.kube/config`, in this order.",
+								Optional:            true,
+							},
+							"namespace": schema.StringAttribute{
+								MarkdownDescription: "The namespace to run the jobs in. The credentials must allow creating and deleting jobs and secrets, and listing pods and reading their logs, in it. Defaults to the namespace of the kubeconfig context, or of the service account.",
+								Optional:            true,
+							},
+							"node_selector": schema.MapAttribute{
+								MarkdownDescription: "Labels of the nodes the jobs may run on.",
+								ElementType:         types.StringType,
+								Optional:            true,
+							},
+						},
+					},
+				},
+			},
+		},
 		MarkdownDescription: `
 The Envbuilder provider can be used to check for the presence of a container image previously built by [Envbuilder](https://github.com/coder/envbuilder).
 This allows re-using a previously built image pushed to a container registry without having to rebuild it.`,
@@ -43,6 +398,14 @@ This allows re-using a previously built image pushed to a container registry wit
 }
 
 func (p *EnvbuilderProvider) Configure(ctx context.Context, req provider.ConfigureRequest, resp *provider.ConfigureResponse) {
+	// Defer everything until the provider configuration is known, rather
+	// than probing with the parts of it that are.
+	if req.ClientCapabilities.DeferralAllowed && !req.Config.Raw.IsFullyKnown() {
+		tflog.Debug(ctx, "deferring until the provider configuration is known")
+		resp.Deferred = &provider.Deferred{Reason: provider.DeferredReasonProviderConfigUnknown}
+		return
+	}
+
 	var data EnvbuilderProviderModel
 
 	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
@@ -51,25 +414,353 @@ func (p *EnvbuilderProvider) Configure(ctx context.Context, req provider.Configu
 		return
 	}
 
-	// Configuration values are now available.
-	// if data.Endpoint.IsNull() { /* ... */ }
+	var netOpts netutil.Options
+	if !data.SOCKS5Proxy.IsNull() {
+		proxyURL, err := netutil.SOCKS5ProxyURL(data.SOCKS5Proxy.ValueString(), data.SOCKS5Username.ValueString(), data.SOCKS5Password.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("socks5_proxy"),
+				"Invalid SOCKS5 proxy",
+				err.Error(),
+			)
+			return
+		}
+		netOpts.SOCKS5Proxy = proxyURL
+	} else if !data.SOCKS5Username.IsNull() || !data.SOCKS5Password.IsNull() {
+		resp.Diagnostics.AddAttributeWarning(path.Root("socks5_proxy"),
+			"SOCKS5 proxy credentials set without a proxy",
+			"socks5_username and socks5_password have no effect unless socks5_proxy is also set.",
+		)
+	}
+
+	if !data.HostAliases.IsNull() {
+		aliases, err := netutil.ParseHostAliases(tfutil.TFMapToStringMap(data.HostAliases))
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("host_aliases"),
+				"Invalid host alias",
+				err.Error(),
+			)
+			return
+		}
+		netOpts.HostAliases = aliases
+	}
+
+	if !data.DNSResolver.IsNull() {
+		nameserver, err := netutil.ParseNameserver(data.DNSResolver.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("dns_resolver"),
+				"Invalid DNS resolver",
+				err.Error(),
+			)
+			return
+		}
+		netOpts.Nameserver = nameserver
+	}
+
+	if !data.IPFamily.IsNull() {
+		family, err := netutil.ParseAddressFamily(data.IPFamily.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("ip_family"),
+				"Invalid IP address family",
+				err.Error(),
+			)
+			return
+		}
+		netOpts.PreferredFamily = family
+	}
+
+	netOpts.DialTimeoutIPv4 = parseDuration(data.DialTimeoutIPv4, path.Root("dial_timeout_ipv4"), &resp.Diagnostics)
+	netOpts.DialTimeoutIPv6 = parseDuration(data.DialTimeoutIPv6, path.Root("dial_timeout_ipv6"), &resp.Diagnostics)
+
+	memoryLimit := parseSize(data.ProbeMemoryLimit, path.Root("probe_memory_limit"), &resp.Diagnostics)
+	if memoryLimit > 0 && data.ProbeMode.ValueString() != probeModeSubprocess {
+		resp.Diagnostics.AddAttributeError(path.Root("probe_memory_limit"),
+			"Invalid probe memory limit",
+			"probe_memory_limit can only be set if probe_mode is \"subprocess\", as the provider process is shared with other probes and resources.",
+		)
+	}
+	scratchLimit := parseSize(data.ProbeScratchLimit, path.Root("probe_scratch_limit"), &resp.Diagnostics)
+
+	resultCache := probeResultCache{
+		dir: data.ProbeResultCacheDir.ValueString(),
+		ttl: parseDuration(data.ProbeResultCacheTTL, path.Root("probe_result_cache_ttl"), &resp.Diagnostics),
+	}
+	if !data.ProbeResultCacheTTL.IsNull() && data.ProbeResultCacheDir.IsNull() {
+		resp.Diagnostics.AddAttributeWarning(path.Root("probe_result_cache_ttl"),
+			"Probe result cache TTL set without a directory",
+			"probe_result_cache_ttl has no effect unless probe_result_cache_dir is also set.",
+		)
+	}
+	if resultCache.ttl == 0 {
+		resultCache.ttl = defaultProbeResultCacheTTL
+	}
+
+	if !data.ContainerdNamespace.IsNull() && data.ContainerdAddress.IsNull() {
+		resp.Diagnostics.AddAttributeWarning(path.Root("containerd_namespace"),
+			"containerd namespace set without an address",
+			"containerd_namespace has no effect unless containerd_address is also set.",
+		)
+	}
+	if data.ContainerdNamespace.IsNull() {
+		data.ContainerdNamespace = types.StringValue(defaultContainerdNamespace)
+	}
+
+	progress := progressOptions{
+		heartbeatInterval: parseDuration(data.ProbeHeartbeatInterval, path.Root("probe_heartbeat_interval"), &resp.Diagnostics),
+		diagnostics:       data.ProbeProgressDiagnostics.ValueBool(),
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	policy := overridePolicy{
+		lockedOptions: make(map[string]bool),
+	}
+	knownOptions := make(map[string]bool)
+	for _, opt := range (&eboptions.Options{}).CLI() {
+		knownOptions[opt.Env] = true
+	}
+	for idx, key := range tfutil.TFListToStringSlice(data.ExtraEnvLockedKeys) {
+		if !knownOptions[key] {
+			resp.Diagnostics.AddAttributeError(path.Root("extra_env_locked_keys").AtListIndex(idx),
+				"Unknown envbuilder option",
+				fmt.Sprintf("%q is not the environment variable name of an envbuilder option.", key),
+			)
+			continue
+		}
+		policy.lockedOptions[key] = true
+	}
 
-	// Example client configuration for data sources and resources
-	client := http.DefaultClient
-	resp.DataSourceData = client
-	resp.ResourceData = client
+	switch data.ExtraEnvOverrideSeverity.ValueString() {
+	case "", "warning":
+	case "error":
+		policy.errorOnOverride = true
+	default:
+		resp.Diagnostics.AddAttributeError(path.Root("extra_env_override_severity"),
+			"Invalid override severity",
+			fmt.Sprintf("%q must be one of \"warning\" or \"error\".", data.ExtraEnvOverrideSeverity.ValueString()),
+		)
+	}
+
+	switch data.ExtraEnvPrecedence.ValueString() {
+	case "", "extra_env":
+	case "attributes":
+		policy.preferAttributes = true
+	default:
+		resp.Diagnostics.AddAttributeError(path.Root("extra_env_precedence"),
+			"Invalid extra_env precedence",
+			fmt.Sprintf("%q must be one of \"extra_env\" or \"attributes\".", data.ExtraEnvPrecedence.ValueString()),
+		)
+	}
+
+	defaultIgnorePaths := tfutil.TFListToStringSlice(data.DefaultIgnorePaths)
+	resp.Diagnostics.Append(checkIgnorePaths(path.Root("default_ignore_paths"), defaultIgnorePaths)...)
+
+	auth := registryAuth{
+		skipLocalDockerConfig:  !data.UseLocalDockerConfig.IsNull() && !data.UseLocalDockerConfig.ValueBool(),
+		dockerConfigSecretPath: data.DockerConfigSecretPath.ValueString(),
+		authFile:               data.RegistryAuthFile.ValueString(),
+		skipCredentialHelpers:  !data.UseCredentialHelpers.IsNull() && !data.UseCredentialHelpers.ValueBool(),
+	}
+	if data.GCPAuth.ValueBool() {
+		auth.cloud = append(auth.cloud, &gcpCredentials{netOpts: netOpts})
+	}
+	if data.AzureAuth.ValueBool() {
+		auth.cloud = append(auth.cloud, &azureCredentials{})
+	}
+	if !data.RegistryCredentialProcess.IsNull() {
+		command := tfutil.TFListToStringSlice(data.RegistryCredentialProcess)
+		if len(command) == 0 || command[0] == "" {
+			resp.Diagnostics.AddAttributeError(path.Root("registry_credential_process"),
+				"Invalid registry credential process",
+				"The command must not be empty.",
+			)
+		}
+		auth.credentials = &registryCredentialProcess{
+			command: command,
+			hosts:   tfutil.TFListToStringSlice(data.RegistryCredentialHosts),
+		}
+	} else if !data.RegistryCredentialHosts.IsNull() {
+		resp.Diagnostics.AddAttributeError(path.Root("registry_credential_hosts"),
+			"Missing registry credential process",
+			"registry_credential_hosts requires registry_credential_process to be set.",
+		)
+	}
+	vault := vaultFromDataModel(data, netOpts, &resp.Diagnostics)
+	audit := auditFromDataModel(data, netOpts, &resp.Diagnostics)
+	executor := probeExecutorFromDataModel(data, netOpts, &resp.Diagnostics)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	pd := &providerData{
+		netOpts:            netOpts,
+		overridePolicy:     policy,
+		defaultIgnorePaths: defaultIgnorePaths,
+		registryAuth:       auth,
+		progress:           progress,
+		scratchLimit:       scratchLimit,
+		probeLimiter:       newProbeLimiter(data.MaxConcurrentProbes.ValueInt64()),
+		probeMode:          data.ProbeMode.ValueString(),
+		memoryLimit:        memoryLimit,
+		probeExecutor:      executor,
+		containerd: containerdOptions{
+			address:   data.ContainerdAddress.ValueString(),
+			namespace: data.ContainerdNamespace.ValueString(),
+		},
+		resultCache: resultCache,
+		vault:       vault,
+		audit:       audit,
+		probeSecrets: probeSecrets{
+			gitPassword:            data.ProbeGitPassword.ValueString(),
+			gitSSHPrivateKeyBase64: data.ProbeGitSSHPrivateKeyBase64.ValueString(),
+			dockerConfigBase64:     data.ProbeDockerConfigBase64.ValueString(),
+		},
+	}
+	resp.DataSourceData = pd
+	resp.ResourceData = pd
+	resp.EphemeralResourceData = pd
+}
+
+// auditFromDataModel returns the audit webhook configured in data, or nil if
+// none is. Events are sent with netOpts.
+func auditFromDataModel(data EnvbuilderProviderModel, netOpts netutil.Options, diags *diag.Diagnostics) *auditWebhook {
+	if data.AuditWebhookURL.IsNull() {
+		if !data.AuditWebhookSecret.IsNull() {
+			diags.AddAttributeWarning(path.Root("audit_webhook_secret"),
+				"Audit webhook secret set without a URL",
+				"audit_webhook_secret has no effect unless audit_webhook_url is also set.",
+			)
+		}
+		return nil
+	}
+	u, err := url.Parse(data.AuditWebhookURL.ValueString())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		diags.AddAttributeError(path.Root("audit_webhook_url"),
+			"Invalid audit webhook URL",
+			fmt.Sprintf("%q is not an HTTP or HTTPS URL.", data.AuditWebhookURL.ValueString()),
+		)
+		return nil
+	}
+	return &auditWebhook{
+		url:    u.String(),
+		secret: data.AuditWebhookSecret.ValueString(),
+		client: &http.Client{Transport: netOpts.Transport()},
+	}
+}
+
+// vaultFromDataModel returns the Vault configuration in data, or nil if no
+// Vault secrets are set. Requests to Vault are made with netOpts.
+func vaultFromDataModel(data EnvbuilderProviderModel, netOpts netutil.Options, diags *diag.Diagnostics) *vaultCredentials {
+	if data.VaultGitSecretPath.IsNull() && data.VaultRegistrySecretPath.IsNull() {
+		return nil
+	}
+	v := &vaultCredentials{
+		address:            stringOrEnv(data.VaultAddress, "VAULT_ADDR"),
+		namespace:          stringOrEnv(data.VaultNamespace, "VAULT_NAMESPACE"),
+		authMethod:         data.VaultAuthMethod.ValueString(),
+		authMount:          data.VaultAuthMount.ValueString(),
+		role:               data.VaultRole.ValueString(),
+		gitSecretPath:      data.VaultGitSecretPath.ValueString(),
+		registrySecretPath: data.VaultRegistrySecretPath.ValueString(),
+		jwtPath:            defaultVaultKubernetesJWTPath,
+		client:             &http.Client{Transport: netOpts.Transport()},
+	}
+	if v.address == "" {
+		diags.AddAttributeError(path.Root("vault_address"),
+			"Missing Vault address",
+			"vault_address or the VAULT_ADDR environment variable must be set to fetch secrets from Vault.",
+		)
+	}
+	if v.authMethod == "" {
+		v.authMethod = vaultAuthToken
+	}
+	if v.authMount == "" {
+		v.authMount = v.authMethod
+	}
+	switch v.authMethod {
+	case vaultAuthToken:
+		v.token = stringOrEnv(data.VaultToken, "VAULT_TOKEN")
+		if v.token == "" {
+			diags.AddAttributeError(path.Root("vault_token"),
+				"Missing Vault token",
+				"vault_token or the VAULT_TOKEN environment variable must be set when vault_auth_method is \"token\".",
+			)
+		}
+	case vaultAuthKubernetes:
+		if v.role == "" {
+			diags.AddAttributeError(path.Root("vault_role"),
+				"Missing Vault role",
+				"vault_role must be set when vault_auth_method is \"kubernetes\".",
+			)
+		}
+	default:
+		diags.AddAttributeError(path.Root("vault_auth_method"),
+			"Invalid Vault auth method",
+			fmt.Sprintf("%q must be one of \"token\" or \"kubernetes\".", v.authMethod),
+		)
+	}
+	return v
+}
+
+// stringOrEnv returns the value of val, or of the environment variable env if
+// val is null.
+func stringOrEnv(val types.String, env string) string {
+	if !val.IsNull() {
+		return val.ValueString()
+	}
+	return os.Getenv(env)
+}
+
+// parseSize parses the size string in val, in binary units. It returns zero
+// if val is null, and adds an error diagnostic for attr if val is not a valid
+// positive size.
+func parseSize(val types.String, attr path.Path, diags *diag.Diagnostics) int64 {
+	if val.IsNull() {
+		return 0
+	}
+	size, err := units.RAMInBytes(val.ValueString())
+	if err != nil || size <= 0 {
+		diags.AddAttributeError(attr,
+			"Invalid size",
+			fmt.Sprintf("%q is not a valid positive size.", val.ValueString()),
+		)
+		return 0
+	}
+	return size
+}
+
+// parseDuration parses the duration string in val. It returns zero if val is
+// null, and adds an error diagnostic for attr if val is not a valid positive
+// duration.
+func parseDuration(val types.String, attr path.Path, diags *diag.Diagnostics) time.Duration {
+	if val.IsNull() {
+		return 0
+	}
+	d, err := time.ParseDuration(val.ValueString())
+	if err != nil || d <= 0 {
+		diags.AddAttributeError(attr,
+			"Invalid duration",
+			fmt.Sprintf("%q is not a valid positive duration.", val.ValueString()),
+		)
+		return 0
+	}
+	return d
 }
 
 func (p *EnvbuilderProvider) Resources(ctx context.Context) []func() resource.Resource {
-	return []func() resource.Resource{NewCachedImageResource}
+	return []func() resource.Resource{NewCachedImageResource, NewPrebuiltImageResource}
+}
+
+func (p *EnvbuilderProvider) EphemeralResources(ctx context.Context) []func() ephemeral.EphemeralResource {
+	return []func() ephemeral.EphemeralResource{NewCachedImageEphemeralResource}
 }
 
 func (p *EnvbuilderProvider) DataSources(ctx context.Context) []func() datasource.DataSource {
-	return []func() datasource.DataSource{}
+	return []func() datasource.DataSource{NewCacheHealthDataSource, NewCacheStatsDataSource}
 }
 
 func (p *EnvbuilderProvider) Functions(ctx context.Context) []func() function.Function {
-	return []func() function.Function{}
+	return []func() function.Function{NewMergeEnvFunction}
 }
 
 func New(version string) func() provider.Provider {
@@ -1,12 +1,31 @@
 package provider
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/tfutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_optionsFromDataModel(t *testing.T) {
@@ -15,6 +34,7 @@ func Test_optionsFromDataModel(t *testing.T) {
 	for _, tc := range []struct {
 		name                  string
 		data                  CachedImageResourceModel
+		policy                overridePolicy
 		expectOpts            eboptions.Options
 		expectNumErrorDiags   int
 		expectNumWarningDiags int
@@ -32,6 +52,20 @@ func Test_optionsFromDataModel(t *testing.T) {
 				RemoteRepoBuildMode: true,
 			},
 		},
+		{
+			name: "cache namespace",
+			data: CachedImageResourceModel{
+				BuilderImage:   basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:      basetypes.NewStringValue("localhost:5000/cache/"),
+				CacheNamespace: basetypes.NewStringValue("team-a/ws"),
+				GitURL:         basetypes.NewStringValue("git@git.local/devcontainer.git"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache/team-a/ws",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+			},
+		},
 		{
 			name: "all options without extra_env",
 			data: CachedImageResourceModel{
@@ -41,11 +75,13 @@ func Test_optionsFromDataModel(t *testing.T) {
 				BaseImageCacheDir:    basetypes.NewStringValue("/tmp/cache"),
 				BuildContextPath:     basetypes.NewStringValue("."),
 				CacheTTLDays:         basetypes.NewInt64Value(7),
+				CoderAgentSubsystem:  listValue("envbox"),
 				DevcontainerDir:      basetypes.NewStringValue(".devcontainer"),
 				DevcontainerJSONPath: basetypes.NewStringValue(".devcontainer/devcontainer.json"),
 				DockerfilePath:       basetypes.NewStringValue("Dockerfile"),
 				DockerConfigBase64:   basetypes.NewStringValue("some base64"),
 				ExitOnBuildFailure:   basetypes.NewBoolValue(true),
+				ExportEnvFile:        basetypes.NewStringValue("/env"),
 				// ExtraEnv: map[string]basetypes.Value{},
 				FallbackImage:        basetypes.NewStringValue("fallback"),
 				GitCloneDepth:        basetypes.NewInt64Value(1),
@@ -54,9 +90,14 @@ func Test_optionsFromDataModel(t *testing.T) {
 				GitPassword:          basetypes.NewStringValue("password"),
 				GitSSHPrivateKeyPath: basetypes.NewStringValue("/tmp/id_rsa"),
 				GitUsername:          basetypes.NewStringValue("user"),
-				IgnorePaths:          listValue("ignore", "paths"),
+				IgnorePaths:          listValue("/ignore", "/paths"),
+				InitArgs:             basetypes.NewStringValue("-c 'echo hi'"),
+				InitCommand:          basetypes.NewStringValue("/bin/bash"),
 				Insecure:             basetypes.NewBoolValue(true),
+				PushImage:            basetypes.NewBoolValue(true),
 				RemoteRepoBuildMode:  basetypes.NewBoolValue(false),
+				RuntimeLayerCacheDir: basetypes.NewStringValue("/layers"),
+				SkipRebuild:          basetypes.NewBoolValue(true),
 				SSLCertBase64:        basetypes.NewStringValue("cert"),
 				Verbose:              basetypes.NewBoolValue(true),
 				WorkspaceFolder:      basetypes.NewStringValue("workspace"),
@@ -67,11 +108,13 @@ func Test_optionsFromDataModel(t *testing.T) {
 				BaseImageCacheDir:    "/tmp/cache",
 				BuildContextPath:     ".",
 				CacheTTLDays:         7,
+				CoderAgentSubsystem:  []string{"envbox"},
 				DevcontainerDir:      ".devcontainer",
 				DevcontainerJSONPath: ".devcontainer/devcontainer.json",
 				DockerfilePath:       "Dockerfile",
 				DockerConfigBase64:   "some base64",
 				ExitOnBuildFailure:   true,
+				ExportEnvFile:        "/env",
 				FallbackImage:        "fallback",
 				GitCloneDepth:        1,
 				GitCloneSingleBranch: true,
@@ -79,9 +122,14 @@ func Test_optionsFromDataModel(t *testing.T) {
 				GitPassword:          "password",
 				GitSSHPrivateKeyPath: "/tmp/id_rsa",
 				GitUsername:          "user",
-				IgnorePaths:          []string{"ignore", "paths"},
+				IgnorePaths:          []string{"/ignore", "/paths"},
+				InitArgs:             "-c 'echo hi'",
+				InitCommand:          "/bin/bash",
 				Insecure:             true,
+				PushImage:            true,
 				RemoteRepoBuildMode:  false,
+				LayerCacheDir:        "/layers",
+				SkipRebuild:          true,
 				SSLCertBase64:        "cert",
 				Verbose:              true,
 				WorkspaceFolder:      "workspace",
@@ -107,6 +155,25 @@ func Test_optionsFromDataModel(t *testing.T) {
 				CoderAgentURL:       "http://coder",
 			},
 		},
+		{
+			name: "extra_env overrides coder_agent_subsystem",
+			data: CachedImageResourceModel{
+				BuilderImage:        basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:           basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:              basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				CoderAgentSubsystem: listValue("envbox", "exectrace"),
+				ExtraEnv: extraEnvMap(t,
+					"CODER_AGENT_SUBSYSTEM", "override",
+				),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+				CoderAgentSubsystem: []string{"override"},
+			},
+			expectNumWarningDiags: 1,
+		},
 		{
 			name: "extra_env override warnings",
 			data: CachedImageResourceModel{
@@ -129,7 +196,7 @@ func Test_optionsFromDataModel(t *testing.T) {
 				GitPassword:          basetypes.NewStringValue("password"),
 				GitSSHPrivateKeyPath: basetypes.NewStringValue("/tmp/id_rsa"),
 				GitUsername:          basetypes.NewStringValue("user"),
-				IgnorePaths:          listValue("ignore", "paths"),
+				IgnorePaths:          listValue("/ignore", "/paths"),
 				Insecure:             basetypes.NewBoolValue(true),
 				RemoteRepoBuildMode:  basetypes.NewBoolValue(false),
 				SSLCertBase64:        basetypes.NewStringValue("cert"),
@@ -153,7 +220,7 @@ func Test_optionsFromDataModel(t *testing.T) {
 					"ENVBUILDER_GIT_PASSWORD", "override",
 					"ENVBUILDER_GIT_SSH_PRIVATE_KEY_PATH", "override",
 					"ENVBUILDER_GIT_USERNAME", "override",
-					"ENVBUILDER_IGNORE_PATHS", "override",
+					"ENVBUILDER_IGNORE_PATHS", "/override",
 					"ENVBUILDER_INSECURE", "false",
 					"ENVBUILDER_REMOTE_REPO_BUILD_MODE", "true",
 					"ENVBUILDER_SSL_CERT_BASE64", "override",
@@ -182,7 +249,7 @@ func Test_optionsFromDataModel(t *testing.T) {
 				GitPassword:          "override",
 				GitSSHPrivateKeyPath: "override",
 				GitUsername:          "override",
-				IgnorePaths:          []string{"override"},
+				IgnorePaths:          []string{"/override"},
 				Insecure:             false,
 				RemoteRepoBuildMode:  true,
 				SSLCertBase64:        "override",
@@ -249,6 +316,281 @@ func Test_optionsFromDataModel(t *testing.T) {
 			},
 			expectNumErrorDiags: 1,
 		},
+		{
+			name: "ignore_paths patterns",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				IgnorePaths:  listValue("/var/cache", "/workspaces/*/node_modules", "/var/log/*.log"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+				IgnorePaths:         []string{"/var/cache", "/workspaces/*/node_modules", "/var/log/*.log"},
+			},
+		},
+		{
+			name: "warns on ignore_paths that never match",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				IgnorePaths:  listValue("/var/cache", "**/node_modules", "*.log", "/workspaces/**/dist", "/var/[cache"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+				IgnorePaths:         []string{"/var/cache", "**/node_modules", "*.log", "/workspaces/**/dist", "/var/[cache"},
+			},
+			expectNumWarningDiags: 4,
+		},
+		{
+			name: "typed options",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				Verbose:      basetypes.NewBoolValue(false),
+				Options: optionsValue(map[string]attr.Value{
+					"git_clone_depth":  basetypes.NewNumberValue(big.NewFloat(1)),
+					"ignore_paths":     listValue("/var/run", "/tmp"),
+					"verbose":          basetypes.NewBoolValue(true),
+					"workspace_folder": basetypes.NewStringValue("/workspace"),
+				}),
+				ExtraEnv: extraEnvMap(t,
+					"ENVBUILDER_WORKSPACE_FOLDER", "/override",
+				),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+				GitCloneDepth:       1,
+				IgnorePaths:         []string{"/var/run", "/tmp"},
+				Verbose:             true,
+				WorkspaceFolder:     "/override",
+			},
+			// verbose overrides the attribute, and extra_env overrides workspace_folder.
+			expectNumWarningDiags: 2,
+		},
+		{
+			name: "typed options errors",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				Options: optionsValue(map[string]attr.Value{
+					"cache_repo":      basetypes.NewStringValue("override"),
+					"git_clone_depth": basetypes.NewNumberValue(big.NewFloat(1.5)),
+					"no_such_option":  basetypes.NewStringValue("value"),
+					"verbose":         basetypes.NewStringValue("true"),
+					"binary_path":     basetypes.NewStringValue("/envbuilder"),
+				}),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+			},
+			expectNumErrorDiags:   4,
+			expectNumWarningDiags: 1,
+		},
+		{
+			name: "locked options",
+			data: CachedImageResourceModel{
+				BuilderImage:         basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:            basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:               basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				GitSSHPrivateKeyPath: basetypes.NewStringValue("/tmp/id_rsa"),
+				Options: optionsValue(map[string]attr.Value{
+					"fallback_image": basetypes.NewStringValue("override"),
+				}),
+				ExtraEnv: extraEnvMap(t,
+					"ENVBUILDER_GIT_SSH_PRIVATE_KEY_PATH", "/override",
+					"FALLBACK_IMAGE", "override",
+				),
+			},
+			policy: overridePolicy{
+				lockedOptions: map[string]bool{
+					"ENVBUILDER_GIT_SSH_PRIVATE_KEY_PATH": true,
+					"ENVBUILDER_FALLBACK_IMAGE":           true,
+				},
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:            "localhost:5000/cache",
+				GitURL:               "git@git.local/devcontainer.git",
+				GitSSHPrivateKeyPath: "/tmp/id_rsa",
+				RemoteRepoBuildMode:  true,
+			},
+			expectNumWarningDiags: 4,
+		},
+		{
+			name: "legacy extra_env names",
+			data: CachedImageResourceModel{
+				BuilderImage:  basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:     basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:        basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				FallbackImage: basetypes.NewStringValue("fallback"),
+				ExtraEnv: extraEnvMap(t,
+					"GIT_URL", "override",
+					"FALLBACK_IMAGE", "override",
+					"VERBOSE", "true",
+					"INIT_SCRIPT", "ignored",
+					"ENVBUILDER_INIT_SCRIPT", "echo hi",
+				),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				FallbackImage:       "override",
+				InitScript:          "echo hi",
+				RemoteRepoBuildMode: true,
+				Verbose:             true,
+			},
+			// One deprecation warning per legacy name, plus one each for the
+			// required and overridden options.
+			expectNumWarningDiags: 6,
+		},
+		{
+			name: "overrides are errors",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				Verbose:      basetypes.NewBoolValue(true),
+				ExtraEnv: extraEnvMap(t,
+					"ENVBUILDER_CACHE_REPO", "override",
+					"ENVBUILDER_VERBOSE", "false",
+				),
+			},
+			policy: overridePolicy{
+				errorOnOverride: true,
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+				Verbose:             false,
+			},
+			expectNumErrorDiags: 2,
+		},
+		{
+			name: "attributes take precedence over extra_env",
+			data: CachedImageResourceModel{
+				BuilderImage:  basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:     basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:        basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				FallbackImage: basetypes.NewStringValue("fallback"),
+				ExtraEnv: extraEnvMap(t,
+					"ENVBUILDER_FALLBACK_IMAGE", "override",
+					"ENVBUILDER_VERBOSE", "true",
+				),
+			},
+			policy: overridePolicy{
+				preferAttributes: true,
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				FallbackImage:       "fallback",
+				RemoteRepoBuildMode: true,
+				Verbose:             true,
+			},
+			expectNumWarningDiags: 1,
+		},
+		{
+			name: "suppressed override warnings",
+			data: CachedImageResourceModel{
+				BuilderImage:  basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:     basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:        basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				FallbackImage: basetypes.NewStringValue("fallback"),
+				Verbose:       basetypes.NewBoolValue(false),
+				ExtraEnv: extraEnvMap(t,
+					"ENVBUILDER_FALLBACK_IMAGE", "override",
+					"ENVBUILDER_VERBOSE", "true",
+				),
+				SuppressOverrideWarnings: listValue("ENVBUILDER_VERBOSE"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				FallbackImage:       "override",
+				RemoteRepoBuildMode: true,
+				Verbose:             true,
+			},
+			expectNumWarningDiags: 1,
+		},
+		{
+			name: "suppressed override warnings are still errors",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				Verbose:      basetypes.NewBoolValue(false),
+				ExtraEnv: extraEnvMap(t,
+					"ENVBUILDER_VERBOSE", "true",
+				),
+				SuppressOverrideWarnings: listValue("ENVBUILDER_VERBOSE"),
+			},
+			policy: overridePolicy{
+				errorOnOverride: true,
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+				Verbose:             true,
+			},
+			expectNumErrorDiags: 1,
+		},
+		{
+			name: "suppressed override warnings unknown option",
+			data: CachedImageResourceModel{
+				BuilderImage:             basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:                basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:                   basetypes.NewStringValue("git@git.local/devcontainer.git"),
+				SuppressOverrideWarnings: listValue("ENVBUILDER_NOT_AN_OPTION"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "git@git.local/devcontainer.git",
+				RemoteRepoBuildMode: true,
+			},
+			expectNumErrorDiags: 1,
+		},
+		{
+			name: "git ref",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("https://git.local/devcontainer.git"),
+				GitRef:       basetypes.NewStringValue("refs/heads/feature/x"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "https://git.local/devcontainer.git#refs/heads/feature/x",
+				RemoteRepoBuildMode: true,
+			},
+		},
+		{
+			name: "git ref with ref in git url",
+			data: CachedImageResourceModel{
+				BuilderImage: basetypes.NewStringValue("envbuilder:latest"),
+				CacheRepo:    basetypes.NewStringValue("localhost:5000/cache"),
+				GitURL:       basetypes.NewStringValue("https://git.local/devcontainer.git#main"),
+				GitRef:       basetypes.NewStringValue("v1.0.0"),
+			},
+			expectOpts: eboptions.Options{
+				CacheRepo:           "localhost:5000/cache",
+				GitURL:              "https://git.local/devcontainer.git#main#v1.0.0",
+				RemoteRepoBuildMode: true,
+			},
+			expectNumErrorDiags: 1,
+		},
 		{
 			name: "required only with base64 ssh key",
 			data: CachedImageResourceModel{
@@ -267,7 +609,7 @@ func Test_optionsFromDataModel(t *testing.T) {
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			actual, diags := optionsFromDataModel(tc.data)
+			actual, diags := optionsFromDataModel(tc.data, tc.policy)
 			assert.Equal(t, tc.expectNumErrorDiags, diags.ErrorsCount())
 			assert.Equal(t, tc.expectNumWarningDiags, diags.WarningsCount())
 			assert.EqualValues(t, tc.expectOpts, actual)
@@ -279,10 +621,11 @@ func Test_computeEnvFromOptions(t *testing.T) {
 	t.Parallel()
 
 	for _, tc := range []struct {
-		name      string
-		opts      eboptions.Options
-		extraEnv  map[string]string
-		expectEnv map[string]string
+		name           string
+		opts           eboptions.Options
+		extraEnv       map[string]string
+		legacyEnvNames string
+		expectEnv      map[string]string
 	}{
 		{
 			name:      "empty",
@@ -336,6 +679,7 @@ func Test_computeEnvFromOptions(t *testing.T) {
 				"FOO":                  "bar",    // should be included
 			},
 			expectEnv: map[string]string{
+				"CODER_AGENT_SUBSYSTEM":               "one,two",
 				"ENVBUILDER_BASE_IMAGE_CACHE_DIR":     "string",
 				"ENVBUILDER_BINARY_PATH":              "string",
 				"ENVBUILDER_BUILD_CONTEXT_PATH":       "string",
@@ -374,18 +718,589 @@ func Test_computeEnvFromOptions(t *testing.T) {
 				"FOO":                                 "bar",
 			},
 		},
+		{
+			name: "legacy extra_env names",
+			opts: eboptions.Options{
+				Verbose: true,
+			},
+			extraEnv: map[string]string{
+				"VERBOSE": "true", // should be ignored
+				"FOO":     "bar",  // should be included
+			},
+			expectEnv: map[string]string{
+				"ENVBUILDER_VERBOSE": "true",
+				"FOO":                "bar",
+			},
+		},
+		{
+			name: "legacy env names both",
+			opts: eboptions.Options{
+				CoderAgentSubsystem: []string{"one"},
+				FallbackImage:       "fallback",
+				Verbose:             true,
+			},
+			extraEnv: map[string]string{
+				"VERBOSE": "false", // should be ignored
+				"FOO":     "bar",   // should be included
+			},
+			legacyEnvNames: legacyEnvNamesBoth,
+			expectEnv: map[string]string{
+				"CODER_AGENT_SUBSYSTEM":     "one",
+				"ENVBUILDER_FALLBACK_IMAGE": "fallback",
+				"ENVBUILDER_VERBOSE":        "true",
+				"FALLBACK_IMAGE":            "fallback",
+				"VERBOSE":                   "true",
+				"FOO":                       "bar",
+			},
+		},
+		{
+			name: "legacy env names only",
+			opts: eboptions.Options{
+				CoderAgentSubsystem: []string{"one"},
+				FallbackImage:       "fallback",
+				Verbose:             true,
+			},
+			legacyEnvNames: legacyEnvNamesOnly,
+			expectEnv: map[string]string{
+				"CODER_AGENT_SUBSYSTEM": "one",
+				"FALLBACK_IMAGE":        "fallback",
+				"VERBOSE":               "true",
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 			if tc.extraEnv == nil {
 				tc.extraEnv = map[string]string{}
 			}
-			actual := computeEnvFromOptions(tc.opts, tc.extraEnv)
+			actual := computeEnvFromOptions(tc.opts, tc.extraEnv, tc.legacyEnvNames)
 			assert.EqualValues(t, tc.expectEnv, actual)
 		})
 	}
 }
 
+func Test_localRepoURL(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		gitURL    string
+		expectURL string
+	}{
+		{gitURL: "https://git.local/repo.git", expectURL: "file:///src/repo#HEAD"},
+		{gitURL: "https://git.local/repo.git#", expectURL: "file:///src/repo#HEAD"},
+		{gitURL: "https://git.local/repo.git#refs/heads/dev", expectURL: "file:///src/repo#refs/heads/dev"},
+		{gitURL: "git@git.local:repo.git#refs/tags/v1", expectURL: "file:///src/repo#refs/tags/v1"},
+	} {
+		t.Run(tc.gitURL, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.expectURL, localRepoURL("/src/repo", tc.gitURL))
+		})
+	}
+}
+
+func Test_checkLocalRepo(t *testing.T) {
+	repo := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(repo, ".git"), 0o755))
+
+	var configErr *probeConfigError
+	err := checkLocalRepo(t.TempDir())
+	require.ErrorAs(t, err, &configErr)
+	assert.Equal(t, "Invalid local repository.", configErr.summary)
+
+	if _, err := exec.LookPath("git"); err == nil {
+		assert.NoError(t, checkLocalRepo(repo))
+	}
+
+	// Without git in the PATH, the repository cannot be cloned from.
+	t.Setenv("PATH", t.TempDir())
+	err = checkLocalRepo(repo)
+	require.ErrorAs(t, err, &configErr)
+	assert.Equal(t, "Git is not installed.", configErr.summary)
+	assert.Contains(t, configErr.detail(), "local_repo_path requires the git executable")
+}
+
+func Test_checkBitbucketAuth(t *testing.T) {
+	t.Parallel()
+
+	const bitbucketURL = "https://bitbucket.org/workspace/repo.git"
+	for _, tc := range []struct {
+		name           string
+		authType       string
+		opts           eboptions.Options
+		expectUsername string
+		expectErr      bool
+		expectWarn     bool
+	}{
+		{
+			name:           "app password",
+			authType:       bitbucketAuthAppPassword,
+			opts:           eboptions.Options{GitURL: bitbucketURL, GitUsername: "user", GitPassword: "secret"},
+			expectUsername: "user",
+		},
+		{
+			name:      "app password with email",
+			authType:  bitbucketAuthAppPassword,
+			opts:      eboptions.Options{GitURL: bitbucketURL, GitUsername: "user@example.com", GitPassword: "secret"},
+			expectErr: true,
+		},
+		{
+			name:      "app password without username",
+			authType:  bitbucketAuthAppPassword,
+			opts:      eboptions.Options{GitURL: bitbucketURL, GitPassword: "secret"},
+			expectErr: true,
+		},
+		{
+			name:           "access token default username",
+			authType:       bitbucketAuthAccessToken,
+			opts:           eboptions.Options{GitURL: bitbucketURL, GitPassword: "token"},
+			expectUsername: "x-token-auth",
+		},
+		{
+			name:           "access token explicit username",
+			authType:       bitbucketAuthAccessToken,
+			opts:           eboptions.Options{GitURL: bitbucketURL, GitUsername: "x-token-auth", GitPassword: "token"},
+			expectUsername: "x-token-auth",
+		},
+		{
+			name:      "access token wrong username",
+			authType:  bitbucketAuthAccessToken,
+			opts:      eboptions.Options{GitURL: bitbucketURL, GitUsername: "user", GitPassword: "token"},
+			expectErr: true,
+		},
+		{
+			name:      "access token without password",
+			authType:  bitbucketAuthAccessToken,
+			opts:      eboptions.Options{GitURL: bitbucketURL},
+			expectErr: true,
+		},
+		{
+			name:       "bitbucket url without username",
+			opts:       eboptions.Options{GitURL: bitbucketURL, GitPassword: "secret"},
+			expectWarn: true,
+		},
+		{
+			name:       "bitbucket url with email",
+			opts:       eboptions.Options{GitURL: bitbucketURL, GitUsername: "user@example.com", GitPassword: "secret"},
+			expectWarn: true,
+		},
+		{
+			name: "other host without username",
+			opts: eboptions.Options{GitURL: "https://git.local/repo.git", GitPassword: "secret"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			opts := tc.opts
+			diags := checkBitbucketAuth(&opts, tc.authType)
+			assert.Equal(t, tc.expectErr, diags.HasError(), diags)
+			assert.Equal(t, tc.expectWarn, diags.WarningsCount() > 0, diags)
+			if tc.expectUsername != "" {
+				assert.Equal(t, tc.expectUsername, opts.GitUsername)
+			}
+		})
+	}
+}
+
+func Test_addDefaultIgnorePaths(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		ignorePaths []string
+		defaults    []string
+		expect      []string
+	}{
+		{name: "no defaults", ignorePaths: []string{"/var/run"}, expect: []string{"/var/run"}},
+		{name: "defaults only", defaults: []string{"/workspaces/repo/node_modules"}, expect: []string{"/workspaces/repo/node_modules"}},
+		{
+			name:        "merged",
+			ignorePaths: []string{"/var/run", "/tmp"},
+			defaults:    []string{"/tmp", "/workspaces/repo/.git"},
+			expect:      []string{"/var/run", "/tmp", "/workspaces/repo/.git"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			opts := eboptions.Options{IgnorePaths: tc.ignorePaths}
+			addDefaultIgnorePaths(&opts, tc.defaults)
+			assert.Equal(t, tc.expect, opts.IgnorePaths)
+		})
+	}
+}
+
+func Test_cacheExpired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name         string
+		created      time.Time
+		cacheTTLDays int64
+		expect       bool
+	}{
+		{name: "default fresh", created: now.Add(-6 * 24 * time.Hour)},
+		{name: "default expired", created: now.Add(-8 * 24 * time.Hour), expect: true},
+		{name: "custom fresh", created: now.Add(-8 * 24 * time.Hour), cacheTTLDays: 10},
+		{name: "custom expired", created: now.Add(-2 * 24 * time.Hour), cacheTTLDays: 1, expect: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.expect, cacheExpired(tc.created, tc.cacheTTLDays, now))
+		})
+	}
+}
+
+func Test_setCreated(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	img, err = mutate.CreatedAt(img, v1.Time{Time: now.Add(-3 * 24 * time.Hour)})
+	require.NoError(t, err)
+
+	var data CachedImageResourceModel
+	created, err := data.setCreated(img, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-3*24*time.Hour), created.UTC())
+	assert.Equal(t, "2024-07-29T00:00:00Z", data.CreatedAt.ValueString())
+	assert.Equal(t, int64(3*24*60*60), data.AgeSeconds.ValueInt64())
+}
+
+func Test_setProbeHistory(t *testing.T) {
+	t.Parallel()
+
+	var data CachedImageResourceModel
+	data.setProbeHistory([]probeHistoryEntry{
+		{ProbedAt: time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC), Hit: false},
+		{ProbedAt: time.Date(2024, 8, 2, 0, 0, 0, 0, time.UTC), Hit: true},
+	})
+	assert.Equal(t, "2024-08-02T00:00:00Z", data.LastProbedAt.ValueString())
+	elems := data.ProbeHistory.Elements()
+	require.Len(t, elems, 2)
+	assert.Equal(t, `{"hit":false,"probed_at":"2024-08-01T00:00:00Z"}`, elems[0].String())
+	assert.Equal(t, `{"hit":true,"probed_at":"2024-08-02T00:00:00Z"}`, elems[1].String())
+}
+
+func Test_setImageConfig(t *testing.T) {
+	t.Parallel()
+
+	var data CachedImageResourceModel
+	data.setImageConfig(&v1.ConfigFile{Config: v1.Config{
+		User:         "root",
+		WorkingDir:   "/",
+		Entrypoint:   []string{"/.envbuilder/bin/envbuilder"},
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}, "53/udp": {}},
+		Labels:       map[string]string{"org.opencontainers.image.revision": "abc123"},
+	}})
+	assert.Equal(t, "root", data.User.ValueString())
+	assert.Equal(t, "/", data.Workdir.ValueString())
+	assert.Equal(t, []string{"/.envbuilder/bin/envbuilder"}, tfutil.TFListToStringSlice(data.Entrypoint))
+	assert.False(t, data.Cmd.IsNull())
+	assert.Empty(t, data.Cmd.Elements())
+	assert.Equal(t, []string{"53/udp", "8080/tcp"}, tfutil.TFListToStringSlice(data.ExposedPorts))
+	assert.Equal(t, map[string]string{"org.opencontainers.image.revision": "abc123"}, tfutil.TFMapToStringMap(data.Labels))
+
+	data.setImageConfig(nil)
+	assert.Equal(t, "", data.User.ValueString())
+	assert.False(t, data.User.IsNull())
+	assert.Empty(t, data.Entrypoint.Elements())
+	assert.Empty(t, data.ExposedPorts.Elements())
+	assert.False(t, data.Labels.IsNull())
+	assert.Empty(t, data.Labels.Elements())
+
+	data.setManifest(&v1.Manifest{
+		Annotations: map[string]string{"org.opencontainers.image.created": "2024-08-01T00:00:00Z"},
+		Layers:      make([]v1.Descriptor, 3),
+	})
+	assert.Equal(t, map[string]string{"org.opencontainers.image.created": "2024-08-01T00:00:00Z"}, tfutil.TFMapToStringMap(data.Annotations))
+	assert.Equal(t, int64(3), data.LayerCount.ValueInt64())
+	data.setManifest(nil)
+	assert.False(t, data.Annotations.IsNull())
+	assert.Empty(t, data.Annotations.Elements())
+	assert.Equal(t, int64(0), data.LayerCount.ValueInt64())
+}
+
+func Test_setImageReference(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		image                             string
+		registry, repository, tag, digest string
+	}{
+		{image: "localhost:5000/cache/team-a@sha256:" + strings.Repeat("a", 64), registry: "localhost:5000", repository: "cache/team-a", digest: "sha256:" + strings.Repeat("a", 64)},
+		{image: "ghcr.io/coder/envbuilder:1.0.4", registry: "ghcr.io", repository: "coder/envbuilder", tag: "1.0.4"},
+		{image: "ubuntu", registry: "index.docker.io", repository: "library/ubuntu", tag: "latest"},
+		{image: "not a reference"},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			t.Parallel()
+			data := CachedImageResourceModel{Image: basetypes.NewStringValue(tc.image)}
+			data.setImageReference()
+			assert.Equal(t, tc.registry, data.ImageRegistry.ValueString())
+			assert.Equal(t, tc.repository, data.ImageRepository.ValueString())
+			assert.Equal(t, tc.tag, data.ImageTag.ValueString())
+			assert.Equal(t, tc.digest, data.ImageDigest.ValueString())
+		})
+	}
+}
+
+func Test_checkRequiredLabels(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg.Config.Labels = map[string]string{"approved": "true"}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name           string
+		requiredLabels basetypes.MapValue
+		policy         string
+		expectErr      bool
+		expectDiags    int
+	}{
+		{name: "none", requiredLabels: basetypes.NewMapNull(basetypes.StringType{})},
+		{name: "present", requiredLabels: extraEnvMap(t, "approved", "true")},
+		{name: "missing", requiredLabels: extraEnvMap(t, "org.opencontainers.image.source", "https://example.com"), expectErr: true},
+		{name: "mismatch", requiredLabels: extraEnvMap(t, "approved", "false"), expectErr: true},
+		{name: "mismatch error policy", requiredLabels: extraEnvMap(t, "approved", "false"), policy: requiredLabelsPolicyError, expectDiags: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			data := CachedImageResourceModel{
+				CacheRepo:            basetypes.NewStringValue("localhost:5000/cache"),
+				RequiredLabels:       tc.requiredLabels,
+				RequiredLabelsPolicy: basetypes.NewStringValue(tc.policy),
+			}
+			var diags diag.Diagnostics
+			err := data.checkRequiredLabels(img, &diags)
+			assert.Equal(t, tc.expectErr, err != nil)
+			assert.Equal(t, tc.expectDiags, diags.ErrorsCount())
+		})
+	}
+}
+
+func Test_checkImageSize(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	size, err := imageSize(img)
+	require.NoError(t, err)
+	require.Greater(t, size, int64(2048))
+
+	for _, tc := range []struct {
+		name           string
+		maxSize        basetypes.Int64Value
+		policy         string
+		expectErrors   int
+		expectWarnings int
+	}{
+		{name: "none", maxSize: basetypes.NewInt64Null()},
+		{name: "within", maxSize: basetypes.NewInt64Value(size)},
+		{name: "exceeded", maxSize: basetypes.NewInt64Value(size - 1), expectErrors: 1},
+		{name: "exceeded warn policy", maxSize: basetypes.NewInt64Value(size - 1), policy: maxImageSizePolicyWarn, expectWarnings: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			data := CachedImageResourceModel{
+				CacheRepo:          basetypes.NewStringValue("localhost:5000/cache"),
+				MaxImageSizeBytes:  tc.maxSize,
+				MaxImageSizePolicy: basetypes.NewStringValue(tc.policy),
+			}
+			var diags diag.Diagnostics
+			data.checkImageSize(img, &diags)
+			assert.Equal(t, size, data.ImageSizeBytes.ValueInt64())
+			assert.Equal(t, tc.expectErrors, diags.ErrorsCount())
+			assert.Equal(t, tc.expectWarnings, diags.WarningsCount())
+		})
+	}
+}
+
+func Test_cacheProbeOptions(t *testing.T) {
+	t.Parallel()
+
+	cert, key := testClientCertificate(t)
+	for _, tc := range []struct {
+		name          string
+		cert          string
+		key           string
+		registries    []string
+		mirrors       []string
+		candidates    []string
+		allowed       []string
+		platform      string
+		platforms     []string
+		expectCert    bool
+		expectHosts   []string
+		expectMirrors []string
+		expectTags    []string
+		expectAllowed registryAllowlist
+		expectOS      string
+		expectErr     bool
+	}{
+		{name: "none"},
+		{name: "cert and key", cert: cert, key: key, expectCert: true},
+		{name: "cert only", cert: cert, expectErr: true},
+		{name: "key only", key: key, expectErr: true},
+		{name: "mismatched", cert: key, key: cert, expectErr: true},
+		{name: "skip verify registries", registries: []string{"Registry.Internal:5000"}, expectHosts: []string{"registry.internal"}},
+		{name: "skip verify registry ip", registries: []string{"10.0.0.1:5000"}, expectErr: true},
+		{name: "mirrors", mirrors: []string{"https://mirror.local/repo.git", "git@mirror.local:org/repo.git#main"}, expectMirrors: []string{"https://mirror.local/repo.git", "ssh://git@mirror.local/org/repo.git#main"}},
+		{name: "invalid mirror", mirrors: []string{"mirror.local/repo.git"}, expectErr: true},
+		{name: "candidate tags", candidates: []string{"{ref}", "main"}, expectTags: []string{"head", "main"}},
+		{name: "invalid candidate tag", candidates: []string{"feature/x"}, expectErr: true},
+		{name: "allowed registries", allowed: []string{"docker.io", "registry.internal:5000"}, expectAllowed: registryAllowlist{"index.docker.io", "registry.internal:5000"}},
+		{name: "invalid allowed registry", allowed: []string{"https://ghcr.io"}, expectErr: true},
+		{name: "platform", platform: "linux/arm64/v8", expectOS: "linux"},
+		{name: "invalid platform", platform: "linux/arm64/v8/extra", expectErr: true},
+		{name: "platforms", platforms: []string{"windows/amd64", "linux/arm64"}, expectOS: "windows"},
+		{name: "duplicate platforms", platforms: []string{"linux/arm64", "linux/arm64"}, expectErr: true},
+		{name: "platform and platforms", platform: "linux/amd64", platforms: []string{"linux/arm64"}, expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			data := CachedImageResourceModel{
+				AllowedRegistries:       basetypes.NewListNull(basetypes.StringType{}),
+				CandidateTags:           basetypes.NewListNull(basetypes.StringType{}),
+				GitMirrorURLs:           basetypes.NewListNull(basetypes.StringType{}),
+				Platforms:               basetypes.NewListNull(basetypes.StringType{}),
+				TLSSkipVerifyRegistries: basetypes.NewListNull(basetypes.StringType{}),
+			}
+			if tc.platforms != nil {
+				data.Platforms = listValue(tc.platforms...)
+			}
+			if tc.candidates != nil {
+				data.CandidateTags = listValue(tc.candidates...)
+			}
+			if tc.allowed != nil {
+				data.AllowedRegistries = listValue(tc.allowed...)
+			}
+			if tc.registries != nil {
+				data.TLSSkipVerifyRegistries = listValue(tc.registries...)
+			}
+			if tc.mirrors != nil {
+				data.GitMirrorURLs = listValue(tc.mirrors...)
+			}
+			if tc.cert != "" {
+				data.GitTLSClientCert = basetypes.NewStringValue(tc.cert)
+			}
+			if tc.key != "" {
+				data.GitTLSClientKey = basetypes.NewStringValue(tc.key)
+			}
+			if tc.platform != "" {
+				data.Platform = basetypes.NewStringValue(tc.platform)
+			}
+			probeOpts, diags := data.cacheProbeOptions(nil)
+			assert.Equal(t, tc.expectErr, diags.HasError(), diags)
+			assert.Equal(t, tc.expectCert, probeOpts.gitClientCert != nil)
+			if !tc.expectErr {
+				assert.ElementsMatch(t, tc.expectHosts, probeOpts.netOpts.TLSSkipVerifyHosts)
+				assert.Equal(t, tc.expectMirrors, probeOpts.gitMirrorURLs)
+				assert.Equal(t, tc.expectTags, probeOpts.candidateTags)
+				assert.Equal(t, tc.expectAllowed, probeOpts.allowedRegistries)
+				if tc.expectOS != "" {
+					require.NotNil(t, probeOpts.platform)
+					assert.Equal(t, tc.expectOS, probeOpts.platform.OS)
+				} else {
+					assert.Nil(t, probeOpts.platform)
+				}
+			}
+		})
+	}
+}
+
+func Test_probeSecrets(t *testing.T) {
+	t.Parallel()
+
+	secrets := probeSecrets{
+		gitPassword:            "probe-password",
+		gitSSHPrivateKeyBase64: "probe-key",
+		dockerConfigBase64:     "probe-config",
+	}
+	for _, tc := range []struct {
+		name   string
+		opts   eboptions.Options
+		expect eboptions.Options
+	}{
+		{
+			name: "unset",
+			expect: eboptions.Options{
+				GitPassword:            "probe-password",
+				GitSSHPrivateKeyBase64: "probe-key",
+				DockerConfigBase64:     "probe-config",
+			},
+		},
+		{
+			name: "set",
+			opts: eboptions.Options{
+				GitPassword:            "password",
+				GitSSHPrivateKeyBase64: "key",
+				DockerConfigBase64:     "config",
+			},
+			expect: eboptions.Options{
+				GitPassword:            "password",
+				GitSSHPrivateKeyBase64: "key",
+				DockerConfigBase64:     "config",
+			},
+		},
+		{
+			name: "ssh key path",
+			opts: eboptions.Options{GitSSHPrivateKeyPath: "/key"},
+			expect: eboptions.Options{
+				GitPassword:          "probe-password",
+				GitSSHPrivateKeyPath: "/key",
+				DockerConfigBase64:   "probe-config",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			opts := tc.opts
+			secrets.apply(&opts)
+			assert.Equal(t, tc.expect, opts)
+		})
+	}
+
+	t.Run("not in env", func(t *testing.T) {
+		t.Parallel()
+		config := []byte(`{"builder_image": "envbuilder:latest", "cache_repo": "localhost:5000/cache", "git_url": "https://git.local/repo.git"}`)
+		providerConfig := []byte(`{"probe_git_password": "probe-password", "probe_git_ssh_private_key_base64": "probe-key", "probe_docker_config_base64": "probe-config"}`)
+		env, diags, err := ComputeEnv(context.Background(), "test", config, providerConfig)
+		require.NoError(t, err)
+		require.False(t, hasErrors(diags), diags)
+		for k, v := range env {
+			assert.NotContains(t, v, "probe-", k)
+		}
+	})
+}
+
+// testClientCertificate returns a PEM encoded self-signed client certificate
+// and its private key.
+func testClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certPEM), string(keyPEM)
+}
+
 func listValue(vs ...string) basetypes.ListValue {
 	vals := make([]attr.Value, len(vs))
 	for i, s := range vs {
@@ -394,6 +1309,14 @@ func listValue(vs ...string) basetypes.ListValue {
 	return basetypes.NewListValueMust(basetypes.StringType{}, vals)
 }
 
+func optionsValue(vals map[string]attr.Value) basetypes.DynamicValue {
+	attrTypes := make(map[string]attr.Type, len(vals))
+	for k, v := range vals {
+		attrTypes[k] = v.Type(context.Background())
+	}
+	return basetypes.NewDynamicValue(basetypes.NewObjectValueMust(attrTypes, vals))
+}
+
 func extraEnvMap(t *testing.T, kvs ...string) basetypes.MapValue {
 	t.Helper()
 	if len(kvs)%2 != 0 {
@@ -12,6 +12,7 @@ import (
 	"testing"
 	"text/template"
 
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
 	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
@@ -24,6 +25,10 @@ import (
 
 const (
 	testContainerLabel = "terraform-provider-envbuilder-test"
+	// testUsername and testPassword are the credentials of the registry
+	// started by setup.
+	testUsername = "testuser"
+	testPassword = "testpassword"
 )
 
 // testAccProtoV6ProviderFactories are used to instantiate a provider during
@@ -40,14 +45,22 @@ type testDependencies struct {
 	CacheRepo          string
 	DockerConfigBase64 string
 	ExtraEnv           map[string]string
-	Repo               testGitRepoSSH
+	Repo               gittest.SSHRepo
+	// Attributes and ProviderAttributes are set on the resource and the
+	// provider in addition to the above, as HCL expressions by name.
+	Attributes         map[string]string
+	ProviderAttributes map[string]string
 }
 
 // Config generates a valid Terraform config file from the dependencies.
 func (d *testDependencies) Config(t testing.TB) string {
 	t.Helper()
 
-	tpl := `provider envbuilder {}
+	tpl := `provider envbuilder {
+	{{ range $k, $v := .ProviderAttributes }}
+	{{ $k }} = {{ $v }}
+	{{ end }}
+}
 resource "envbuilder_cached_image" "test" {
   builder_image              = {{ quote .BuilderImage }}
 	cache_repo               = {{ quote .CacheRepo }}
@@ -60,6 +73,9 @@ resource "envbuilder_cached_image" "test" {
 		{{ quote $k }}: {{ quote $v }}
 	{{ end }}
 	}
+	{{ range $k, $v := .Attributes }}
+	{{ $k }} = {{ $v }}
+	{{ end }}
 }`
 
 	fm := template.FuncMap{"quote": quote}
@@ -81,14 +97,12 @@ func setup(ctx context.Context, t testing.TB, extraEnv, files map[string]string)
 	envbuilderVersion := getEnvOrDefault("ENVBUILDER_VERSION", "latest")
 	envbuilderImageRef := envbuilderImage + ":" + envbuilderVersion
 
-	testUsername := "testuser"
-	testPassword := "testpassword"
 	testAuthBase64 := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", testUsername, testPassword)))
 	regDir := t.TempDir()
 	reg := registrytest.New(t, regDir, registrytest.BasicAuthMW(t, testUsername, testPassword))
 
-	repoDir := setupGitRepo(t, files)
-	gitRepo := serveGitRepoSSH(ctx, t, repoDir)
+	repoDir := gittest.NewRepo(t, files)
+	gitRepo := gittest.ServeSSH(ctx, t, repoDir)
 	dockerConfigJSON := fmt.Sprintf(`{
 		"auths": {
 			"%s": {
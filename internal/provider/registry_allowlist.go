@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// registryAllowlist holds the registries that images referenced by the
+// devcontainer, Dockerfile and fallback image may be pulled from, configured
+// by allowed_registries. An empty allowlist allows any registry.
+type registryAllowlist []string
+
+// normalizeRegistry returns the registry host registry as it appears in
+// image references, so that docker.io matches images without a registry.
+func normalizeRegistry(registry string) (string, error) {
+	reg, err := name.NewRegistry(registry, name.StrictValidation)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid registry host: %w", registry, err)
+	}
+	return reg.RegistryStr(), nil
+}
+
+// registryNotAllowedError is returned by runCacheProbe if an image is
+// referenced from a registry that is not allowed.
+type registryNotAllowedError struct {
+	// source is where the image is referenced.
+	source string
+	// ref is the image reference.
+	ref string
+	// registry is the registry of ref, or empty if ref is not a valid
+	// reference.
+	registry string
+}
+
+func (e *registryNotAllowedError) Error() string {
+	if e.registry == "" {
+		return fmt.Sprintf("%s references %q, which is not a valid image reference, so its registry cannot be checked", e.source, e.ref)
+	}
+	return fmt.Sprintf("%s references %q from registry %q, which is not in allowed_registries", e.source, e.ref, e.registry)
+}
+
+// check returns a *registryNotAllowedError for the first of refs, referenced
+// in source, that is not from an allowed registry.
+func (a registryAllowlist) check(source string, refs ...string) error {
+	if len(a) == 0 {
+		return nil
+	}
+	for _, ref := range refs {
+		parsed, err := name.ParseReference(ref)
+		if err != nil {
+			return &registryNotAllowedError{source: source, ref: ref}
+		}
+		if registry := parsed.Context().RegistryStr(); !slices.Contains(a, registry) {
+			return &registryNotAllowedError{source: source, ref: ref, registry: registry}
+		}
+	}
+	return nil
+}
+
+// String returns the allowed registries for diagnostics.
+func (a registryAllowlist) String() string {
+	return strings.Join(a, ", ")
+}
@@ -0,0 +1,34 @@
+package provider
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryAllowlistCheck(t *testing.T) {
+	t.Parallel()
+
+	var allowlist registryAllowlist
+	for _, registry := range []string{"docker.io", "registry.internal:5000"} {
+		normalized, err := normalizeRegistry(registry)
+		require.NoError(t, err)
+		allowlist = append(allowlist, normalized)
+	}
+
+	assert.NoError(t, allowlist.check("Dockerfile", "ubuntu:22.04", "registry.internal:5000/base@sha256:"+strings.Repeat("0", 64)))
+	assert.NoError(t, registryAllowlist(nil).check("Dockerfile", "ghcr.io/coder/envbuilder"))
+
+	err := allowlist.check("Dockerfile", "ubuntu:22.04", "ghcr.io/coder/envbuilder:latest")
+	var registryErr *registryNotAllowedError
+	require.True(t, errors.As(err, &registryErr), err)
+	assert.Equal(t, "ghcr.io/coder/envbuilder:latest", registryErr.ref)
+	assert.EqualError(t, err, `Dockerfile references "ghcr.io/coder/envbuilder:latest" from registry "ghcr.io", which is not in allowed_registries`)
+
+	err = allowlist.check("fallback_image", "Ubuntu:${VERSION}")
+	require.True(t, errors.As(err, &registryErr), err)
+	assert.Empty(t, registryErr.registry)
+}
@@ -0,0 +1,586 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/docker/cli/cli/config/configfile"
+	dockertypes "github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// registryCredentialProcess gets registry credentials by running an external
+// command, configured by registry_credential_process. The registry host is
+// appended to the command, which prints the credentials as JSON in the same
+// format as a Docker credential helper. A nil *registryCredentialProcess has
+// no credentials.
+type registryCredentialProcess struct {
+	// command is the command and its arguments.
+	command []string
+	// hosts are registry hosts to get credentials for before probing, in
+	// addition to those of cache_repo and builder_image.
+	hosts []string
+
+	mu sync.Mutex
+	// cache holds the credentials of each host for the lifetime of the
+	// provider process.
+	cache map[string]authn.AuthConfig
+}
+
+var (
+	_ authn.Keychain        = &registryCredentialProcess{}
+	_ authn.ContextKeychain = &registryCredentialProcess{}
+)
+
+// credentialProcessOutput is the output of the credential process.
+type credentialProcessOutput struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// credentials returns the credentials of host. If the process prints no
+// credentials, the returned config is empty.
+func (p *registryCredentialProcess) credentials(ctx context.Context, host string) (authn.AuthConfig, error) {
+	if p == nil {
+		return authn.AuthConfig{}, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cfg, ok := p.cache[host]; ok {
+		return cfg, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	//nolint:gosec // The command is configured by the provider user.
+	cmd := exec.CommandContext(ctx, p.command[0], append(p.command[1:], host)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("registry credential process for %q: %w: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var cfg authn.AuthConfig
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		var creds credentialProcessOutput
+		if err := json.Unmarshal(out, &creds); err != nil {
+			return authn.AuthConfig{}, fmt.Errorf("registry credential process for %q: parse output: %w", host, err)
+		}
+		// As with Docker credential helpers, a username of "<token>" means
+		// that the secret is an identity token.
+		if creds.Username == "<token>" {
+			cfg.IdentityToken = creds.Secret
+		} else {
+			cfg.Username, cfg.Password = creds.Username, creds.Secret
+		}
+	}
+	if p.cache == nil {
+		p.cache = make(map[string]authn.AuthConfig)
+	}
+	p.cache[host] = cfg
+	return cfg, nil
+}
+
+func (p *registryCredentialProcess) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return p.ResolveContext(context.Background(), target)
+}
+
+func (p *registryCredentialProcess) ResolveContext(ctx context.Context, target authn.Resource) (authn.Authenticator, error) {
+	cfg, err := p.credentials(ctx, target.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	if cfg == (authn.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(cfg), nil
+}
+
+// registryAuth configures where registry credentials come from, in addition
+// to docker_config_base64.
+type registryAuth struct {
+	// credentials gets registry credentials from an external command. It is
+	// nil if registry_credential_process is not set.
+	credentials *registryCredentialProcess
+	// skipLocalDockerConfig disables the use of the local Docker config.
+	skipLocalDockerConfig bool
+	// dockerConfigSecretPath is the path to a mounted Kubernetes
+	// kubernetes.io/dockerconfigjson secret, or to the directory it is
+	// mounted in. It is read whenever it is used, as mounted secrets are
+	// updated in place when they are rotated. If empty, it is not used.
+	dockerConfigSecretPath string
+	// authFile is the path to a registry auth file, in the format of the
+	// Podman auth file, used instead of the one Podman would use. It is read
+	// whenever it is used. If empty, the Podman auth file is used, if any.
+	authFile string
+	// cloud get credentials for the registries of cloud providers, as
+	// enabled by gcp_auth and azure_auth.
+	cloud []cloudCredentials
+	// skipCredentialHelpers disables the credential helpers configured in
+	// Docker configs, credHelpers and credsStore.
+	skipCredentialHelpers bool
+}
+
+// cloudCredentials gets credentials for the registries of a cloud provider
+// from the identity of the machine running Terraform. They are only used for
+// registries that no other source has credentials for.
+type cloudCredentials interface {
+	authn.Keychain
+	authn.ContextKeychain
+	// registry reports whether host is a registry of the cloud provider.
+	registry(host string) bool
+	// credentials returns the credentials of host. The returned config is
+	// empty if host is not a registry of the cloud provider.
+	credentials(ctx context.Context, host string) (authn.AuthConfig, error)
+}
+
+// dockerConfigSecretKey is the key of the Docker config in a Kubernetes
+// kubernetes.io/dockerconfigjson secret, and so the name of the file it is
+// mounted as.
+const dockerConfigSecretKey = ".dockerconfigjson"
+
+// dockerConfigSecretBase64 returns the base64 encoded Docker config in the
+// secret at dockerConfigSecretPath, or the empty string if it is not set.
+func (a registryAuth) dockerConfigSecretBase64() (string, error) {
+	if a.dockerConfigSecretPath == "" {
+		return "", nil
+	}
+	p := a.dockerConfigSecretPath
+	if info, err := os.Stat(p); err == nil && info.IsDir() {
+		p = filepath.Join(p, dockerConfigSecretKey)
+	}
+	dockerConfig, err := os.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("read docker config secret: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(dockerConfig), nil
+}
+
+// dockerConfigSecretKeychain resolves credentials from the Docker config in
+// the secret of a registryAuth, reading it on every use.
+type dockerConfigSecretKeychain struct {
+	auth registryAuth
+}
+
+func (k dockerConfigSecretKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	dockerConfig, err := k.auth.dockerConfigSecretBase64()
+	if err != nil {
+		return nil, err
+	}
+	if k.auth.skipCredentialHelpers {
+		if dockerConfig, err = dockerConfigWithoutCredentialHelpers(dockerConfig); err != nil {
+			return nil, fmt.Errorf("docker config secret: %w", err)
+		}
+	}
+	kc, err := dockerConfigKeychain(dockerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("docker config secret: %w", err)
+	}
+	return kc.Resolve(target)
+}
+
+// keychain returns the keychain used for registry requests made by the
+// provider. Credentials from the credential process, if any, are used before
+// those of the Docker config secret, if any, and then those of the local
+// Docker config and the registry auth file. Cloud credentials, if enabled, are
+// used for the registries of their cloud that none of these have credentials
+// for.
+func (a registryAuth) keychain() authn.Keychain {
+	podman := imgutil.PodmanKeychain
+	if a.authFile != "" {
+		podman = imgutil.NewPodmanKeychain(a.authFile)
+	}
+	kc := authn.NewMultiKeychain(authn.DefaultKeychain, podman)
+	switch {
+	case a.skipLocalDockerConfig:
+		kc = podman
+	case a.skipCredentialHelpers:
+		kc = authn.NewMultiKeychain(localDockerConfigKeychain{}, podman)
+	}
+	if a.dockerConfigSecretPath != "" {
+		kc = authn.NewMultiKeychain(dockerConfigSecretKeychain{auth: a}, kc)
+	}
+	if a.credentials != nil {
+		kc = authn.NewMultiKeychain(a.credentials, kc)
+	}
+	for _, c := range a.cloud {
+		kc = authn.NewMultiKeychain(kc, c)
+	}
+	return kc
+}
+
+// remoteOptions returns the options for registry requests made by the
+// provider.
+func remoteOptions(netOpts netutil.Options, auth registryAuth) []remote.Option {
+	return []remote.Option{
+		remote.WithTransport(netOpts.Transport()),
+		remote.WithAuthFromKeychain(auth.keychain()),
+	}
+}
+
+// localDockerConfigKeychain resolves credentials from the local Docker config
+// without its credential helpers, reading it on every use.
+type localDockerConfigKeychain struct{}
+
+func (localDockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	dockerConfig, err := os.ReadFile(localDockerConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return authn.Anonymous, nil
+		}
+		return nil, fmt.Errorf("read docker config: %w", err)
+	}
+	withoutHelpers, err := dockerConfigWithoutCredentialHelpers(base64.StdEncoding.EncodeToString(dockerConfig))
+	if err != nil {
+		return nil, err
+	}
+	kc, err := dockerConfigKeychain(withoutHelpers)
+	if err != nil {
+		return nil, err
+	}
+	return kc.Resolve(target)
+}
+
+// probeCredentialHelpers returns the base64 encoded Docker config to use for
+// probing with the credential helpers it configures, credHelpers and
+// credsStore, handled as auth configures. If the helpers are disabled, they
+// are removed. If the probe runs in a container, by a probe executor, the
+// helpers installed on the machine running Terraform cannot run where
+// envbuilder does: the credentials they return for refs' registries are then
+// stored in the config, and the helpers removed. Otherwise envbuilder runs
+// the helpers itself, as the provider does, and the config is unchanged.
+func probeCredentialHelpers(ctx context.Context, dockerConfigBase64 string, auth registryAuth, inContainer bool, refs ...string) (string, error) {
+	if auth.skipCredentialHelpers {
+		return dockerConfigWithoutCredentialHelpers(dockerConfigBase64)
+	}
+	if !inContainer {
+		return dockerConfigBase64, nil
+	}
+	cf, err := loadDockerConfigFile(dockerConfigBase64)
+	if err != nil {
+		return "", err
+	}
+	var hosts []string
+	for _, ref := range refs {
+		// Invalid references are reported when probing.
+		ref, err := name.ParseReference(ref)
+		if err != nil {
+			continue
+		}
+		key := ref.Context().RegistryStr()
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		if cf.CredentialHelpers[key] != "" || cf.CredentialsStore != "" {
+			hosts = append(hosts, ref.Context().RegistryStr())
+		}
+	}
+	resolved, err := dockerConfigWithCredentials(ctx, dockerConfigBase64, func(_ context.Context, host string) (authn.AuthConfig, error) {
+		key := host
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return authn.AuthConfig{}, fmt.Errorf("docker credential helper for %q: %w", host, err)
+		}
+		if cfg.IdentityToken != "" {
+			return authn.AuthConfig{IdentityToken: cfg.IdentityToken}, nil
+		}
+		return authn.AuthConfig{Username: cfg.Username, Password: cfg.Password}, nil
+	}, hosts, true)
+	if err != nil {
+		return "", err
+	}
+	return dockerConfigWithoutCredentialHelpers(resolved)
+}
+
+// dockerConfigWithoutCredentialHelpers returns the base64 encoded Docker
+// config without its credential helpers, credHelpers and credsStore. All
+// other fields are preserved. An empty config is returned unchanged.
+func dockerConfigWithoutCredentialHelpers(dockerConfigBase64 string) (string, error) {
+	dockerConfig, err := base64.StdEncoding.DecodeString(dockerConfigBase64)
+	if err != nil {
+		return "", fmt.Errorf("decode docker config: %w", err)
+	}
+	if len(dockerConfig) == 0 {
+		return dockerConfigBase64, nil
+	}
+	cfg := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(dockerConfig, &cfg); err != nil {
+		return "", fmt.Errorf("parse docker config: %w", err)
+	}
+	if _, ok := cfg["credHelpers"]; !ok {
+		if _, ok := cfg["credsStore"]; !ok {
+			return dockerConfigBase64, nil
+		}
+	}
+	delete(cfg, "credHelpers")
+	delete(cfg, "credsStore")
+	stripped, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(stripped), nil
+}
+
+// dockerConfigKeychain returns a keychain with the credentials in the base64
+// encoded Docker config dockerConfigBase64, including those of its credential
+// helpers, as kaniko would use them for the cache repo.
+func dockerConfigKeychain(dockerConfigBase64 string) (authn.Keychain, error) {
+	cf, err := loadDockerConfigFile(dockerConfigBase64)
+	if err != nil {
+		return nil, err
+	}
+	return dockerConfigFileKeychain{cf: cf}, nil
+}
+
+// loadDockerConfigFile parses the base64 encoded Docker config
+// dockerConfigBase64. An empty config is treated as an empty config file.
+func loadDockerConfigFile(dockerConfigBase64 string) (*configfile.ConfigFile, error) {
+	dockerConfig, err := base64.StdEncoding.DecodeString(dockerConfigBase64)
+	if err != nil {
+		return nil, fmt.Errorf("decode docker config: %w", err)
+	}
+	cf := configfile.New("")
+	if len(dockerConfig) > 0 {
+		if err := cf.LoadFromReader(bytes.NewReader(dockerConfig)); err != nil {
+			return nil, fmt.Errorf("parse docker config: %w", err)
+		}
+	}
+	return cf, nil
+}
+
+// dockerConfigFileKeychain resolves credentials from a Docker config in the
+// same way as authn.DefaultKeychain does from the local one.
+type dockerConfigFileKeychain struct {
+	cf *configfile.ConfigFile
+}
+
+func (k dockerConfigFileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+	cfg, err := k.cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == (dockertypes.AuthConfig{ServerAddress: cfg.ServerAddress}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+// probeDockerConfigBase64 returns the base64 encoded Docker config to use for
+// probing before any other credentials are added: dockerConfigBase64 if set,
+// the Docker config secret of auth if set, or the local Docker config
+// otherwise, as the docker CLI would use. If the local Docker config is not to
+// be used, an empty config is returned instead so that kaniko does not fall
+// back to it.
+func probeDockerConfigBase64(dockerConfigBase64 string, auth registryAuth) (string, error) {
+	if dockerConfigBase64 != "" {
+		return dockerConfigBase64, nil
+	}
+	if auth.dockerConfigSecretPath != "" {
+		return auth.dockerConfigSecretBase64()
+	}
+	if auth.skipLocalDockerConfig {
+		return base64.StdEncoding.EncodeToString([]byte("{}")), nil
+	}
+	dockerConfig, err := os.ReadFile(localDockerConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("read docker config: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(dockerConfig), nil
+}
+
+// dockerConfigWithProcessCredentials returns the base64 encoded Docker config
+// to use for probing, with the credentials that p returns for each of refs'
+// registries, and for the hosts of p, replacing any already in the config.
+// It is returned unchanged if p is nil.
+func dockerConfigWithProcessCredentials(ctx context.Context, dockerConfigBase64 string, p *registryCredentialProcess, refs ...string) (string, error) {
+	if p == nil {
+		return dockerConfigBase64, nil
+	}
+	hosts := append([]string(nil), p.hosts...)
+	for _, ref := range refs {
+		// Invalid references are reported when probing.
+		if ref, err := name.ParseReference(ref); err == nil {
+			hosts = append(hosts, ref.Context().RegistryStr())
+		}
+	}
+
+	return dockerConfigWithCredentials(ctx, dockerConfigBase64, p.credentials, hosts, true)
+}
+
+// dockerConfigWithCloudCredentials returns the base64 encoded Docker config to
+// use for probing, with the credentials that cloud returns for each of refs'
+// registries that are registries of their cloud provider, unless the config
+// already has credentials for them.
+func dockerConfigWithCloudCredentials(ctx context.Context, dockerConfigBase64 string, cloud []cloudCredentials, refs ...string) (string, error) {
+	for _, c := range cloud {
+		var hosts []string
+		for _, ref := range refs {
+			// Invalid references are reported when probing.
+			if ref, err := name.ParseReference(ref); err == nil && c.registry(ref.Context().RegistryStr()) {
+				hosts = append(hosts, ref.Context().RegistryStr())
+			}
+		}
+		var err error
+		dockerConfigBase64, err = dockerConfigWithCredentials(ctx, dockerConfigBase64, c.credentials, hosts, false)
+		if err != nil {
+			return "", err
+		}
+	}
+	return dockerConfigBase64, nil
+}
+
+// dockerConfigWithCredentials returns the base64 encoded Docker config with
+// the credentials that credentials returns for each of hosts. Existing
+// credentials for a host are replaced if replace is true, and kept otherwise.
+func dockerConfigWithCredentials(ctx context.Context, dockerConfigBase64 string, credentials func(context.Context, string) (authn.AuthConfig, error), hosts []string, replace bool) (string, error) {
+	auths := make(map[string]json.RawMessage)
+	for _, host := range hosts {
+		cfg, err := credentials(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		if cfg == (authn.AuthConfig{}) {
+			continue
+		}
+		auth := map[string]string{"identitytoken": cfg.IdentityToken}
+		if cfg.IdentityToken == "" {
+			auth = map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))}
+		}
+		raw, err := json.Marshal(auth)
+		if err != nil {
+			return "", err
+		}
+		if host == name.DefaultRegistry {
+			host = authn.DefaultAuthKey
+		}
+		auths[host] = raw
+	}
+	if len(auths) == 0 {
+		return dockerConfigBase64, nil
+	}
+
+	dockerConfig, err := base64.StdEncoding.DecodeString(dockerConfigBase64)
+	if err != nil {
+		return "", fmt.Errorf("decode docker config: %w", err)
+	}
+	merged, err := setRegistryAuths(dockerConfig, auths, replace)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(merged), nil
+}
+
+// dockerConfigWithPodmanAuth returns the base64 encoded Docker config to use
+// for probing, with the registry credentials in the Podman auth file added
+// for registries it has no credentials for. kaniko only reads the Podman auth
+// file when there is no Docker config at all, so it would otherwise be
+// ignored on hosts with both, or when docker_config_base64 is set. authFile
+// is used instead of the Podman auth file if it is not empty. The config is
+// returned unchanged if there is no Podman auth file.
+func dockerConfigWithPodmanAuth(dockerConfigBase64, authFile string) (string, error) {
+	if authFile == "" {
+		if authFile = imgutil.PodmanAuthFile(); authFile == "" {
+			return dockerConfigBase64, nil
+		}
+	}
+	podmanAuth, err := os.ReadFile(authFile)
+	if err != nil {
+		return "", fmt.Errorf("read registry auth file: %w", err)
+	}
+
+	dockerConfig, err := base64.StdEncoding.DecodeString(dockerConfigBase64)
+	if err != nil {
+		return "", fmt.Errorf("decode docker config: %w", err)
+	}
+	merged, err := mergeRegistryAuths(dockerConfig, podmanAuth)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(merged), nil
+}
+
+// localDockerConfigPath returns the path of the Docker config that would be
+// used by kaniko: config.json in $DOCKER_CONFIG, or in ~/.docker.
+func localDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// mergeRegistryAuths adds the entries of the auths map in podmanAuth to the
+// auths map in dockerConfig, unless dockerConfig already has an entry for the
+// same key. All other fields of dockerConfig are preserved. An empty
+// dockerConfig is treated as an empty config.
+func mergeRegistryAuths(dockerConfig, podmanAuth []byte) ([]byte, error) {
+	var podman struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(podmanAuth, &podman); err != nil {
+		return nil, fmt.Errorf("parse podman auth file: %w", err)
+	}
+	return setRegistryAuths(dockerConfig, podman.Auths, false)
+}
+
+// setRegistryAuths adds auths to the auths map in dockerConfig. Existing
+// entries for the same key are replaced if replace is true, and kept
+// otherwise. All other fields of dockerConfig are preserved. An empty
+// dockerConfig is treated as an empty config.
+func setRegistryAuths(dockerConfig []byte, auths map[string]json.RawMessage, replace bool) ([]byte, error) {
+	cfg := make(map[string]json.RawMessage)
+	if len(dockerConfig) > 0 {
+		if err := json.Unmarshal(dockerConfig, &cfg); err != nil {
+			return nil, fmt.Errorf("parse docker config: %w", err)
+		}
+	}
+	merged := make(map[string]json.RawMessage)
+	if raw, ok := cfg["auths"]; ok {
+		if err := json.Unmarshal(raw, &merged); err != nil {
+			return nil, fmt.Errorf("parse docker config auths: %w", err)
+		}
+	}
+	for key, auth := range auths {
+		if _, ok := merged[key]; ok && !replace {
+			continue
+		}
+		merged[key] = auth
+	}
+
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	cfg["auths"] = raw
+	return json.Marshal(cfg)
+}
@@ -0,0 +1,294 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeRegistryAuths(t *testing.T) {
+	t.Parallel()
+
+	podmanAuth := `{"auths": {"registry.internal": {"auth": "cG9kbWFuOnNlY3JldA=="}, "ghcr.io": {"auth": "cG9kbWFuOmdoY3I="}}}`
+	for _, tc := range []struct {
+		name         string
+		dockerConfig string
+		expect       string
+		expectErr    bool
+	}{
+		{
+			name:   "no docker config",
+			expect: `{"auths": {"registry.internal": {"auth": "cG9kbWFuOnNlY3JldA=="}, "ghcr.io": {"auth": "cG9kbWFuOmdoY3I="}}}`,
+		},
+		{
+			name:         "docker config takes precedence",
+			dockerConfig: `{"auths": {"ghcr.io": {"auth": "ZG9ja2VyOmdoY3I="}}, "credHelpers": {"gcr.io": "gcloud"}}`,
+			expect:       `{"auths": {"registry.internal": {"auth": "cG9kbWFuOnNlY3JldA=="}, "ghcr.io": {"auth": "ZG9ja2VyOmdoY3I="}}, "credHelpers": {"gcr.io": "gcloud"}}`,
+		},
+		{
+			name:         "invalid docker config",
+			dockerConfig: `{"auths": `,
+			expectErr:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			merged, err := mergeRegistryAuths([]byte(tc.dockerConfig), []byte(podmanAuth))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expect, string(merged))
+		})
+	}
+}
+
+func TestRegistryCredentialProcess(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "creds.sh")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+echo "$2" >> "$1"
+case "$2" in
+ghcr.io) echo '{"Username": "user", "Secret": "pass"}' ;;
+registry.internal) echo '{"Username": "<token>", "Secret": "token"}' ;;
+broken.internal) echo 'not json' ;;
+failing.internal) echo 'broker unavailable' >&2; exit 1 ;;
+esac
+`), 0o755))
+	p := &registryCredentialProcess{command: []string{script, calls}}
+
+	for _, tc := range []struct {
+		host      string
+		expect    authn.AuthConfig
+		expectErr string
+	}{
+		{host: "ghcr.io", expect: authn.AuthConfig{Username: "user", Password: "pass"}},
+		{host: "registry.internal", expect: authn.AuthConfig{IdentityToken: "token"}},
+		{host: "docker.io"},
+		{host: "broken.internal", expectErr: "parse output"},
+		{host: "failing.internal", expectErr: "broker unavailable"},
+	} {
+		cfg, err := p.credentials(context.Background(), tc.host)
+		if tc.expectErr != "" {
+			assert.ErrorContains(t, err, tc.expectErr, tc.host)
+			continue
+		}
+		require.NoError(t, err, tc.host)
+		assert.Equal(t, tc.expect, cfg, tc.host)
+	}
+
+	// Credentials are cached, and used by the keychain.
+	repo, err := name.NewRepository("ghcr.io/coder/envbuilder")
+	require.NoError(t, err)
+	auth, err := registryAuth{credentials: p}.keychain().Resolve(repo)
+	require.NoError(t, err)
+	cfg, err := auth.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "user", cfg.Username)
+	called, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr.io\nregistry.internal\ndocker.io\nbroken.internal\nfailing.internal\n", string(called))
+}
+
+func TestDockerConfigWithProcessCredentials(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "creds.sh")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+ghcr.io) echo '{"Username": "user", "Secret": "pass"}' ;;
+index.docker.io) echo '{"Username": "<token>", "Secret": "token"}' ;;
+esac
+`), 0o755))
+	p := &registryCredentialProcess{command: []string{script}, hosts: []string{"ghcr.io"}}
+
+	dockerConfig := base64.StdEncoding.EncodeToString([]byte(`{"auths": {"ghcr.io": {"auth": "b2xkOm9sZA=="}, "registry.internal": {"auth": "b2xkOm9sZA=="}}}`))
+	got, err := dockerConfigWithProcessCredentials(context.Background(), dockerConfig, p, "registry.internal:5000/cache", "envbuilder:latest")
+	require.NoError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {
+		"ghcr.io": {"auth": "dXNlcjpwYXNz"},
+		"registry.internal": {"auth": "b2xkOm9sZA=="},
+		"https://index.docker.io/v1/": {"identitytoken": "token"}
+	}}`, string(decoded))
+
+	// Without a process, the config is unchanged.
+	got, err = dockerConfigWithProcessCredentials(context.Background(), dockerConfig, nil, "ghcr.io/coder/cache")
+	require.NoError(t, err)
+	assert.Equal(t, dockerConfig, got)
+}
+
+func TestProbeDockerConfigBase64(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	localConfig := `{"auths": {"ghcr.io": {"auth": "dXNlcjpwYXNz"}}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(localConfig), 0o600))
+	explicitConfig := base64.StdEncoding.EncodeToString([]byte(`{"auths": {}}`))
+
+	got, err := probeDockerConfigBase64("", registryAuth{})
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(localConfig)), got)
+
+	got, err = probeDockerConfigBase64(explicitConfig, registryAuth{})
+	require.NoError(t, err)
+	assert.Equal(t, explicitConfig, got)
+
+	got, err = probeDockerConfigBase64("", registryAuth{skipLocalDockerConfig: true})
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("{}")), got)
+
+	// The Docker config secret is used instead of the local Docker config.
+	secret := filepath.Join(t.TempDir(), dockerConfigSecretKey)
+	require.NoError(t, os.WriteFile(secret, []byte(`{"auths": {}}`), 0o600))
+	got, err = probeDockerConfigBase64("", registryAuth{dockerConfigSecretPath: secret})
+	require.NoError(t, err)
+	assert.Equal(t, explicitConfig, got)
+
+	// Without a local Docker config, nothing is set.
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	got, err = probeDockerConfigBase64("", registryAuth{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestDockerConfigSecret(t *testing.T) {
+	t.Parallel()
+
+	// Secrets are mounted as a directory with a file per key.
+	dir := t.TempDir()
+	secret := filepath.Join(dir, dockerConfigSecretKey)
+	dockerConfig := `{"auths": {"ghcr.io": {"auth": "dXNlcjpwYXNz"}}}`
+	require.NoError(t, os.WriteFile(secret, []byte(dockerConfig), 0o600))
+
+	for _, p := range []string{dir, secret} {
+		got, err := registryAuth{dockerConfigSecretPath: p}.dockerConfigSecretBase64()
+		require.NoError(t, err, p)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(dockerConfig)), got, p)
+	}
+
+	got, err := registryAuth{}.dockerConfigSecretBase64()
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	_, err = registryAuth{dockerConfigSecretPath: t.TempDir()}.dockerConfigSecretBase64()
+	assert.ErrorContains(t, err, "read docker config secret")
+
+	// The secret is used by the keychain, and read again when it changes.
+	auth := registryAuth{dockerConfigSecretPath: dir, skipLocalDockerConfig: true}
+	repo, err := name.NewRepository("ghcr.io/coder/envbuilder")
+	require.NoError(t, err)
+	authenticator, err := auth.keychain().Resolve(repo)
+	require.NoError(t, err)
+	cfg, err := authenticator.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "user", cfg.Username)
+	assert.Equal(t, "pass", cfg.Password)
+
+	require.NoError(t, os.WriteFile(secret, []byte(`{"auths": {"ghcr.io": {"auth": "cm90YXRlZDpwYXNz"}}}`), 0o600))
+	authenticator, err = auth.keychain().Resolve(repo)
+	require.NoError(t, err)
+	cfg, err = authenticator.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", cfg.Username)
+}
+
+func TestRegistryAuthFile(t *testing.T) {
+	t.Parallel()
+
+	authFile := filepath.Join(t.TempDir(), "auth.json")
+	require.NoError(t, os.WriteFile(authFile, []byte(`{"auths": {"ghcr.io/coder": {"auth": "Y2k6c2VjcmV0"}}}`), 0o600))
+
+	// The auth file is used by the keychain, with repository scoped keys.
+	auth := registryAuth{authFile: authFile, skipLocalDockerConfig: true}
+	repo, err := name.NewRepository("ghcr.io/coder/envbuilder")
+	require.NoError(t, err)
+	authenticator, err := auth.keychain().Resolve(repo)
+	require.NoError(t, err)
+	cfg, err := authenticator.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "ci", cfg.Username)
+	assert.Equal(t, "secret", cfg.Password)
+
+	// It is added to the probe Docker config, which takes precedence.
+	dockerConfig := base64.StdEncoding.EncodeToString([]byte(`{"auths": {"ghcr.io/coder": {"auth": "b2xkOm9sZA=="}, "registry.internal": {"auth": "dXNlcjpwYXNz"}}}`))
+	got, err := dockerConfigWithPodmanAuth(base64.StdEncoding.EncodeToString([]byte(`{}`)), authFile)
+	require.NoError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"ghcr.io/coder": {"auth": "Y2k6c2VjcmV0"}}}`, string(decoded))
+	got, err = dockerConfigWithPodmanAuth(dockerConfig, authFile)
+	require.NoError(t, err)
+	decoded, err = base64.StdEncoding.DecodeString(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"ghcr.io/coder": {"auth": "b2xkOm9sZA=="}, "registry.internal": {"auth": "dXNlcjpwYXNz"}}}`, string(decoded))
+
+	// A missing auth file is an error.
+	missing := registryAuth{authFile: filepath.Join(t.TempDir(), "auth.json"), skipLocalDockerConfig: true}
+	_, err = missing.keychain().Resolve(repo)
+	assert.ErrorContains(t, err, "read podman auth file")
+	_, err = dockerConfigWithPodmanAuth(dockerConfig, missing.authFile)
+	assert.ErrorContains(t, err, "read registry auth file")
+}
+
+func TestProbeCredentialHelpers(t *testing.T) {
+	// The credential helper is found in PATH.
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(`#!/bin/sh
+read host
+echo "{\"ServerURL\": \"$host\", \"Username\": \"helper\", \"Secret\": \"secret\"}"
+`), 0o755))
+	t.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	localConfig := `{"auths": {"ghcr.io": {"auth": "dXNlcjpwYXNz"}}, "credHelpers": {"registry.internal": "test"}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(localConfig), 0o600))
+	dockerConfig := base64.StdEncoding.EncodeToString([]byte(localConfig))
+	decode := func(s string) string {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		require.NoError(t, err)
+		return string(decoded)
+	}
+
+	// Envbuilder runs the helpers itself in the provider process.
+	got, err := probeCredentialHelpers(context.Background(), dockerConfig, registryAuth{}, false, "registry.internal/cache")
+	require.NoError(t, err)
+	assert.Equal(t, dockerConfig, got)
+
+	// In a container, the credentials are resolved beforehand.
+	got, err = probeCredentialHelpers(context.Background(), dockerConfig, registryAuth{}, true, "registry.internal/cache", "ghcr.io/coder/envbuilder")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {
+		"ghcr.io": {"auth": "dXNlcjpwYXNz"},
+		"registry.internal": {"auth": "aGVscGVyOnNlY3JldA=="}
+	}}`, decode(got))
+
+	// Disabled helpers are removed.
+	got, err = probeCredentialHelpers(context.Background(), dockerConfig, registryAuth{skipCredentialHelpers: true}, true, "registry.internal/cache")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"ghcr.io": {"auth": "dXNlcjpwYXNz"}}}`, decode(got))
+
+	// The keychain of the provider uses the helpers unless they are
+	// disabled.
+	repo, err := name.NewRepository("registry.internal/cache")
+	require.NoError(t, err)
+	authenticator, err := registryAuth{}.keychain().Resolve(repo)
+	require.NoError(t, err)
+	cfg, err := authenticator.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "helper", cfg.Username)
+	authenticator, err = registryAuth{skipCredentialHelpers: true}.keychain().Resolve(repo)
+	require.NoError(t, err)
+	assert.Equal(t, authn.Anonymous, authenticator)
+}
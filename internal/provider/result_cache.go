@@ -0,0 +1,260 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/imgutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// defaultProbeResultCacheTTL is how long a cached probe result is reused by
+// default.
+const defaultProbeResultCacheTTL = 24 * time.Hour
+
+// probeResultCacheVersion is part of every key, so that results stored by an
+// incompatible version of the provider are not reused.
+const probeResultCacheVersion = "1"
+
+// probeResultCache stores the results of cache probes that found an image
+// on disk, so that a probe with the same inputs, of the same commit, with the
+// same builder image can be skipped.
+type probeResultCache struct {
+	// dir is the directory results are stored in. If empty, results are not
+	// cached.
+	dir string
+	// ttl is how long a result is reused for.
+	ttl time.Duration
+}
+
+// probeResultCacheEntry is a cached probe result.
+type probeResultCacheEntry struct {
+	StoredAt time.Time `json:"stored_at"`
+	// InputsHash is the probeInputsHash of the probe.
+	InputsHash string `json:"inputs_hash"`
+	// Digest is the digest of the cached image in the cache repo.
+	Digest           string   `json:"digest"`
+	BaseImage        string   `json:"base_image"`
+	GitURL           string   `json:"git_url"`
+	Features         []string `json:"features"`
+	Customizations   string   `json:"customizations"`
+	VSCodeExtensions []string `json:"vscode_extensions"`
+	Dockerfile       string   `json:"dockerfile,omitempty"`
+	Resolved         string   `json:"resolved,omitempty"`
+}
+
+// probeInputsHash returns a hash of the inputs of a probe of builderImage
+// for platform with opts that determine its result. Credentials are left
+// out, as they only determine whether the probe can run, and may be rotated,
+// and so are verbose and the options that the probe clears, which cannot
+// change the cached image found. devcontainerJSON is the content of devcontainer_json_content, which is
+// only hashed if set.
+func probeInputsHash(builderImage string, platform *v1.Platform, opts eboptions.Options, devcontainerEnv map[string]string, devcontainerJSON string) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "version=%s\nbuilder_image=%s\n", probeResultCacheVersion, builderImage)
+	// Probes without a platform hash as they did before it could be set.
+	if platform != nil {
+		_, _ = fmt.Fprintf(h, "platform=%s\n", platform)
+	}
+	clearBuildOnlyOptions(&opts)
+	opts.Verbose = false
+	var lines []string
+	for _, opt := range opts.CLI() {
+		if opt.Env == "" || opt.Value == nil || isSecretOption(opt.Env) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("option %s=%s", opt.Env, opt.Value.String()))
+	}
+	for k, v := range devcontainerEnv {
+		lines = append(lines, fmt.Sprintf("devcontainer_env %s=%s", k, v))
+	}
+	if devcontainerJSON != "" {
+		lines = append(lines, fmt.Sprintf("devcontainer_json_content sha256=%x", sha256.Sum256([]byte(devcontainerJSON))))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		_, _ = fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// key returns the key of the result of a probe with the inputs hash
+// inputsHash, of commit, with the builder image builderDigest.
+func (c probeResultCache) key(inputsHash, commit, builderDigest string) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{inputsHash, commit, builderDigest}, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+func (c probeResultCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// get returns the result stored under key, if it is younger than the TTL at
+// now.
+func (c probeResultCache) get(key string, now time.Time) (probeResultCacheEntry, bool) {
+	var entry probeResultCacheEntry
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, false
+	}
+	if now.Sub(entry.StoredAt) > c.ttl || entry.Digest == "" {
+		return entry, false
+	}
+	return entry, true
+}
+
+// put stores entry under key.
+func (c probeResultCache) put(key string, entry probeResultCacheEntry) error {
+	return writeJSONFile(c.path(key), entry)
+}
+
+// appendHistory appends entry to the history of probes with the inputs hash
+// inputsHash, and returns the last probeHistoryLength entries of the
+// history, oldest first. If results are not cached, the history only has
+// entry.
+func (c probeResultCache) appendHistory(inputsHash string, entry probeHistoryEntry) ([]probeHistoryEntry, error) {
+	if c.dir == "" {
+		return []probeHistoryEntry{entry}, nil
+	}
+	path := filepath.Join(c.dir, "history", inputsHash+".json")
+	var history []probeHistoryEntry
+	if data, err := os.ReadFile(path); err == nil {
+		// A history that cannot be read is replaced.
+		_ = json.Unmarshal(data, &history)
+	}
+	history = append(history, entry)
+	if len(history) > probeHistoryLength {
+		history = history[len(history)-probeHistoryLength:]
+	}
+	return history, writeJSONFile(path, history)
+}
+
+// writeJSONFile writes v as JSON to a temporary file that replaces the file
+// at path, if any, as providers may run concurrently.
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".probe-result-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// latest returns the most recently stored result of a probe with the inputs
+// hash inputsHash that is younger than the TTL at now, of any commit and
+// builder image.
+func (c probeResultCache) latest(inputsHash string, now time.Time) (probeResultCacheEntry, bool) {
+	if c.dir == "" {
+		return probeResultCacheEntry{}, false
+	}
+	paths, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	var latest probeResultCacheEntry
+	found := false
+	for _, p := range paths {
+		entry, ok := c.get(strings.TrimSuffix(filepath.Base(p), ".json"), now)
+		if !ok || entry.InputsHash != inputsHash {
+			continue
+		}
+		if !found || entry.StoredAt.After(latest.StoredAt) {
+			latest, found = entry, true
+		}
+	}
+	return latest, found
+}
+
+// remove removes the result stored under key, if any.
+func (c probeResultCache) remove(key string) {
+	_ = os.Remove(c.path(key))
+}
+
+// resolveProbeInputs returns the commit that the git URL in opts resolves to,
+// listing its refs with gitTr, and the digest of builderImage.
+func resolveProbeInputs(ctx context.Context, logf func(string, ...any), builderImage string, opts eboptions.Options, gitTr *http.Transport, remoteOpts ...remote.Option) (commit, builderDigest string, err error) {
+	commit, err = resolveGitCommit(ctx, logf, opts, gitTr)
+	if err != nil {
+		return "", "", fmt.Errorf("resolve commit of %s: %w", opts.GitURL, err)
+	}
+	dgst, err := imgutil.GetImageDigest(ctx, builderImage, remoteOpts...)
+	if err != nil {
+		return "", "", fmt.Errorf("resolve digest of %s: %w", builderImage, err)
+	}
+	return commit, dgst.String(), nil
+}
+
+// result returns the probe result in entry, fetching the cached image from
+// cacheRepo to check that it still exists.
+func (e probeResultCacheEntry) result(ctx context.Context, cacheRepo string, remoteOpts ...remote.Option) (cacheProbeResult, error) {
+	ref, err := name.ParseReference(cacheRepo + "@" + e.Digest)
+	if err != nil {
+		return cacheProbeResult{}, err
+	}
+	img, err := remote.Image(ref, append(remoteOpts, remote.WithContext(ctx))...)
+	if err != nil {
+		return cacheProbeResult{}, err
+	}
+	return cacheProbeResult{
+		image:     img,
+		baseImage: e.BaseImage,
+		gitURL:    e.GitURL,
+		devcontainer: probedDevcontainer{
+			features:         e.Features,
+			customizations:   e.Customizations,
+			vscodeExtensions: e.VSCodeExtensions,
+			resolved:         e.Resolved,
+		},
+		dockerfile: e.Dockerfile,
+	}, nil
+}
+
+// newProbeResultCacheEntry returns the entry for result of a probe with the
+// inputs hash inputsHash, stored at now.
+func newProbeResultCacheEntry(result cacheProbeResult, inputsHash string, now time.Time) (probeResultCacheEntry, error) {
+	dgst, err := result.image.Digest()
+	if err != nil {
+		return probeResultCacheEntry{}, err
+	}
+	return probeResultCacheEntry{
+		StoredAt:         now,
+		InputsHash:       inputsHash,
+		Digest:           dgst.String(),
+		BaseImage:        result.baseImage,
+		GitURL:           result.gitURL,
+		Features:         result.devcontainer.features,
+		Customizations:   result.devcontainer.customizations,
+		VSCodeExtensions: result.devcontainer.vscodeExtensions,
+		Dockerfile:       result.dockerfile,
+		Resolved:         result.devcontainer.resolved,
+	}, nil
+}
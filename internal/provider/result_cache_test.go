@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/testutil/gittest"
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeResultCache(t *testing.T) {
+	t.Parallel()
+
+	c := probeResultCache{dir: filepath.Join(t.TempDir(), "results"), ttl: time.Hour}
+	now := time.Now()
+	key := c.key("inputs", "commit", "builder")
+	assert.NotEqual(t, key, c.key("inputs", "other-commit", "builder"))
+
+	_, ok := c.get(key, now)
+	assert.False(t, ok)
+
+	entry := probeResultCacheEntry{StoredAt: now, Digest: "sha256:abc", Features: []string{"feature"}}
+	require.NoError(t, c.put(key, entry))
+	got, ok := c.get(key, now.Add(time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, entry.Digest, got.Digest)
+	assert.Equal(t, entry.Features, got.Features)
+
+	// Results expire after the TTL.
+	_, ok = c.get(key, now.Add(2*time.Hour))
+	assert.False(t, ok)
+
+	c.remove(key)
+	_, ok = c.get(key, now)
+	assert.False(t, ok)
+}
+
+func TestProbeResultCacheLatest(t *testing.T) {
+	t.Parallel()
+
+	c := probeResultCache{dir: filepath.Join(t.TempDir(), "results"), ttl: 24 * time.Hour}
+	now := time.Now()
+	_, ok := c.latest("hash", now)
+	assert.False(t, ok)
+
+	// Results of other commits with the same inputs are considered, but not
+	// those of other inputs or that have expired.
+	for key, entry := range map[string]probeResultCacheEntry{
+		c.key("hash", "commit1", "builder"):  {StoredAt: now.Add(-2 * time.Hour), InputsHash: "hash", Digest: "sha256:1"},
+		c.key("hash", "commit2", "builder"):  {StoredAt: now.Add(-time.Hour), InputsHash: "hash", Digest: "sha256:2"},
+		c.key("hash", "commit0", "builder"):  {StoredAt: now.Add(-48 * time.Hour), InputsHash: "hash", Digest: "sha256:0"},
+		c.key("other", "commit3", "builder"): {StoredAt: now, InputsHash: "other", Digest: "sha256:3"},
+	} {
+		require.NoError(t, c.put(key, entry))
+	}
+	entry, ok := c.latest("hash", now)
+	require.True(t, ok)
+	assert.Equal(t, "sha256:2", entry.Digest)
+
+	_, ok = probeResultCache{}.latest("hash", now)
+	assert.False(t, ok)
+}
+
+func TestProbeResultCacheHistory(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(i int) probeHistoryEntry {
+		return probeHistoryEntry{ProbedAt: start.Add(time.Duration(i) * time.Hour), Hit: i%2 == 0}
+	}
+
+	// Without a directory, only the last probe is known.
+	history, err := probeResultCache{}.appendHistory("hash", entry(0))
+	require.NoError(t, err)
+	assert.Equal(t, []probeHistoryEntry{entry(0)}, history)
+
+	c := probeResultCache{dir: filepath.Join(t.TempDir(), "results"), ttl: time.Hour}
+	for i := 0; i < probeHistoryLength+2; i++ {
+		history, err = c.appendHistory("hash", entry(i))
+		require.NoError(t, err)
+	}
+	require.Len(t, history, probeHistoryLength)
+	assert.Equal(t, entry(2), history[0])
+	assert.Equal(t, entry(probeHistoryLength+1), history[probeHistoryLength-1])
+
+	// Histories are kept per inputs hash.
+	history, err = c.appendHistory("other", entry(0))
+	require.NoError(t, err)
+	assert.Equal(t, []probeHistoryEntry{entry(0)}, history)
+}
+
+func TestProbeInputsHash(t *testing.T) {
+	t.Parallel()
+
+	opts := eboptions.Options{CacheRepo: "localhost:5000/cache", GitURL: "https://git.local/repo.git"}
+	hash := probeInputsHash("envbuilder:latest", nil, opts, map[string]string{"FOO": "bar"}, "")
+
+	// Credentials are not part of the inputs.
+	withSecrets := opts
+	withSecrets.GitPassword = "password"
+	withSecrets.DockerConfigBase64 = "e30="
+	assert.Equal(t, hash, probeInputsHash("envbuilder:latest", nil, withSecrets, map[string]string{"FOO": "bar"}, ""))
+
+	// Neither are the options that only take effect in the final builder
+	// image, which are updated in place.
+	buildOnly := opts
+	buildOnly.PushImage = true
+	buildOnly.InitCommand = "/bin/bash"
+	buildOnly.SkipRebuild = true
+	buildOnly.Verbose = true
+	assert.Equal(t, hash, probeInputsHash("envbuilder:latest", nil, buildOnly, map[string]string{"FOO": "bar"}, ""))
+
+	otherRepo := opts
+	otherRepo.CacheRepo = "localhost:5000/other"
+	assert.NotEqual(t, hash, probeInputsHash("envbuilder:latest", nil, otherRepo, map[string]string{"FOO": "bar"}, ""))
+	assert.NotEqual(t, hash, probeInputsHash("envbuilder:latest", nil, opts, map[string]string{"FOO": "baz"}, ""))
+	assert.NotEqual(t, hash, probeInputsHash("envbuilder:other", nil, opts, map[string]string{"FOO": "bar"}, ""))
+	assert.NotEqual(t, hash, probeInputsHash("envbuilder:latest", &v1.Platform{OS: "linux", Architecture: "arm64"}, opts, map[string]string{"FOO": "bar"}, ""))
+	assert.NotEqual(t, hash, probeInputsHash("envbuilder:latest", nil, opts, map[string]string{"FOO": "bar"}, `{"image": "ubuntu"}`))
+}
+
+// Not parallel, as the cache probe replaces process-wide state.
+func TestRunCacheProbeResultCache(t *testing.T) {
+	reg := registrytest.New(t, t.TempDir())
+	repo := gittest.NewRepo(t, map[string]string{"Dockerfile": "FROM " + reg + "/base:latest"})
+	// The builder image does not contain envbuilder, so the probe fails
+	// unless it is skipped.
+	builderImage := reg + "/envbuilder:latest"
+	registrytest.WriteRandomImage(t, builderImage)
+	cached := registrytest.WriteRandomImage(t, reg+"/cache:cached")
+	cachedDigest, err := cached.Digest()
+	require.NoError(t, err)
+
+	opts := eboptions.Options{
+		CacheRepo:      reg + "/cache",
+		GitURL:         "file://" + repo,
+		DockerfilePath: "Dockerfile",
+	}
+	probeOpts := cacheProbeOptions{
+		registryAuth: registryAuth{skipLocalDockerConfig: true},
+		resultCache:  probeResultCache{dir: t.TempDir(), ttl: time.Hour},
+	}
+	ctx := context.Background()
+	logf := func(format string, args ...any) { t.Logf(format, args...) }
+	commit, builderDigest, err := resolveProbeInputs(ctx, logf, builderImage, opts, nil)
+	require.NoError(t, err)
+	key := probeOpts.resultCache.key(probeInputsHash(builderImage, nil, opts, nil, ""), commit, builderDigest)
+
+	// A cached result whose image exists is used.
+	require.NoError(t, probeOpts.resultCache.put(key, probeResultCacheEntry{
+		StoredAt:  time.Now(),
+		Digest:    cachedDigest.String(),
+		BaseImage: reg + "/base:latest",
+		GitURL:    opts.GitURL,
+	}))
+	result, err := runCacheProbe(ctx, builderImage, opts, probeOpts)
+	require.NoError(t, err)
+	resultDigest, err := result.image.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, cachedDigest, resultDigest)
+	assert.Equal(t, reg+"/base:latest", result.baseImage)
+	assert.Contains(t, result.progress, "Checking the probe result cache")
+	assert.Equal(t, commit, result.commit)
+	assert.Equal(t, builderDigest, result.builderDigest)
+
+	// A cached result whose image no longer exists is removed, and the
+	// repository is probed.
+	require.NoError(t, probeOpts.resultCache.put(key, probeResultCacheEntry{
+		StoredAt: time.Now(),
+		Digest:   "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}))
+	_, err = runCacheProbe(ctx, builderImage, opts, probeOpts)
+	require.ErrorContains(t, err, "failed to fetch the envbuilder binary")
+	_, ok := probeOpts.resultCache.get(key, time.Now())
+	assert.False(t, ok)
+}
@@ -0,0 +1,476 @@
+package provider
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/uuid"
+)
+
+// Values of sbom_format.
+const (
+	sbomFormatSPDX      = "spdx-json"
+	sbomFormatCycloneDX = "cyclonedx-json"
+)
+
+// Media types of SBOM documents, which are also the artifact types of the
+// referrers they are attached to images with.
+const (
+	spdxMediaType      = "application/spdx+json"
+	cycloneDXMediaType = "application/vnd.cyclonedx+json"
+)
+
+// sbomToolName is the name of the tool recorded as the creator of SBOMs.
+const sbomToolName = "terraform-provider-envbuilder"
+
+// Paths of the files an SBOM is generated from, relative to the root of the
+// image.
+const (
+	osReleasePath      = "etc/os-release"
+	osReleaseFallback  = "usr/lib/os-release"
+	dpkgStatusPath     = "var/lib/dpkg/status"
+	dpkgStatusDirPath  = "var/lib/dpkg/status.d"
+	apkInstalledDBPath = "lib/apk/db/installed"
+)
+
+// sbomPackage is an operating system package installed in an image.
+type sbomPackage struct {
+	name    string
+	version string
+	arch    string
+	// purlType is the type of the package URL of the package: deb or apk.
+	purlType string
+}
+
+// sbomImage holds what an SBOM describes: the image and its packages.
+type sbomImage struct {
+	// ref is the image, by digest.
+	ref name.Digest
+	// created is when the image was created. The SBOM is created at the
+	// same time, so that the same image always has the same SBOM.
+	created time.Time
+	// distro is the ID of the distribution of the image in os-release, if
+	// it has one.
+	distro   string
+	packages []sbomPackage
+}
+
+// purl returns the package URL of the package in distro.
+func (p sbomPackage) purl(distro string) string {
+	if distro == "" {
+		distro = p.purlType
+	}
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", p.purlType, url.PathEscape(distro), url.PathEscape(p.name), url.PathEscape(p.version))
+	if p.arch != "" {
+		purl += "?arch=" + url.QueryEscape(p.arch)
+	}
+	return purl
+}
+
+// imagePURL returns the package URL of the image ref.
+func imagePURL(ref name.Digest) string {
+	repo := ref.Context()
+	return fmt.Sprintf("pkg:oci/%s@%s?repository_url=%s",
+		url.PathEscape(path.Base(repo.RepositoryStr())),
+		strings.ReplaceAll(ref.DigestStr(), ":", "%3A"),
+		url.QueryEscape(repo.Name()),
+	)
+}
+
+// readSBOMImage reads the operating system packages installed in img, ref,
+// from the package databases of dpkg and apk. Packages installed otherwise,
+// for example with rpm or a language package manager, are not included.
+func readSBOMImage(ref name.Digest, img v1.Image) (sbomImage, error) {
+	result := sbomImage{ref: ref}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return result, fmt.Errorf("get image config: %w", err)
+	}
+	result.created = cfg.Created.Time.UTC()
+	if result.created.IsZero() {
+		result.created = time.Now().UTC()
+	}
+
+	// Extract flattens the layers, so deleted files are not seen.
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	files := map[string][]byte{}
+	tr := tar.NewReader(rc)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("read image filesystem: %w", err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+th.Name), "/")
+		if th.Typeflag != tar.TypeReg || !sbomSourceFile(name) {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return result, fmt.Errorf("read %s: %w", name, err)
+		}
+		files[name] = content
+	}
+
+	osRelease, ok := files[osReleasePath]
+	if !ok {
+		osRelease = files[osReleaseFallback]
+	}
+	result.distro = osReleaseID(osRelease)
+	for name, content := range files {
+		switch {
+		case name == dpkgStatusPath, path.Dir(name) == dpkgStatusDirPath:
+			result.packages = append(result.packages, parseDpkgStatus(content)...)
+		case name == apkInstalledDBPath:
+			result.packages = append(result.packages, parseApkInstalled(content)...)
+		}
+	}
+	sort.Slice(result.packages, func(i, j int) bool {
+		a, b := result.packages[i], result.packages[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.version != b.version {
+			return a.version < b.version
+		}
+		return a.arch < b.arch
+	})
+	return result, nil
+}
+
+// sbomSourceFile returns whether the file at name, relative to the root of
+// the image, is read to generate an SBOM.
+func sbomSourceFile(name string) bool {
+	switch name {
+	case osReleasePath, osReleaseFallback, dpkgStatusPath, apkInstalledDBPath:
+		return true
+	}
+	return path.Dir(name) == dpkgStatusDirPath
+}
+
+// osReleaseID returns the ID in the os-release file content.
+func osReleaseID(content []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(s.Text()), "ID="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// parseDpkgStatus returns the installed packages in the dpkg status file
+// content, or in a file of the status.d directory of distroless images.
+func parseDpkgStatus(content []byte) []sbomPackage {
+	var pkgs []sbomPackage
+	for _, paragraph := range strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n\n") {
+		fields := map[string]string{}
+		for _, line := range strings.Split(paragraph, "\n") {
+			// Continuation lines start with whitespace.
+			if line == "" || line[0] == ' ' || line[0] == '\t' {
+				continue
+			}
+			if key, value, ok := strings.Cut(line, ":"); ok {
+				fields[key] = strings.TrimSpace(value)
+			}
+		}
+		if fields["Package"] == "" {
+			continue
+		}
+		// Files in status.d have no status, as their packages are all
+		// installed.
+		if status, ok := fields["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		pkgs = append(pkgs, sbomPackage{
+			name:     fields["Package"],
+			version:  fields["Version"],
+			arch:     fields["Architecture"],
+			purlType: "deb",
+		})
+	}
+	return pkgs
+}
+
+// parseApkInstalled returns the packages in the apk installed database
+// content.
+func parseApkInstalled(content []byte) []sbomPackage {
+	var pkgs []sbomPackage
+	var pkg sbomPackage
+	flush := func() {
+		if pkg.name != "" {
+			pkg.purlType = "apk"
+			pkgs = append(pkgs, pkg)
+		}
+		pkg = sbomPackage{}
+	}
+	s := bufio.NewScanner(bytes.NewReader(content))
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "P":
+			pkg.name = value
+		case "V":
+			pkg.version = value
+		case "A":
+			pkg.arch = value
+		}
+	}
+	flush()
+	return pkgs
+}
+
+// sbomMediaType returns the media type of SBOMs in format.
+func sbomMediaType(format string) types.MediaType {
+	if format == sbomFormatCycloneDX {
+		return cycloneDXMediaType
+	}
+	return spdxMediaType
+}
+
+// generateSBOM returns the SBOM of image in format.
+func generateSBOM(format string, image sbomImage) ([]byte, error) {
+	switch format {
+	case sbomFormatSPDX:
+		return json.MarshalIndent(spdxDocument(image), "", "  ")
+	case sbomFormatCycloneDX:
+		return json.MarshalIndent(cycloneDXDocument(image), "", "  ")
+	}
+	return nil, fmt.Errorf("unknown SBOM format %q", format)
+}
+
+type spdxDoc struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxDocument returns the SPDX 2.3 document describing image.
+func spdxDocument(image sbomImage) spdxDoc {
+	purlRef := func(purl string) []spdxExternalRef {
+		return []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: purl}}
+	}
+	doc := spdxDoc{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              image.ref.String(),
+		DocumentNamespace: "https://github.com/coder/terraform-provider-envbuilder/sbom/" + image.ref.Context().Name() + "/" + image.ref.DigestStr(),
+		CreationInfo: spdxCreationInfo{
+			Created:  image.created.Format(time.RFC3339),
+			Creators: []string{"Tool: " + sbomToolName},
+		},
+		Packages: []spdxPackage{{
+			Name:                  image.ref.Context().Name(),
+			SPDXID:                "SPDXRef-Image",
+			VersionInfo:           image.ref.DigestStr(),
+			DownloadLocation:      "NOASSERTION",
+			PrimaryPackagePurpose: "CONTAINER",
+			ExternalRefs:          purlRef(imagePURL(image.ref)),
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: "SPDXRef-Image",
+		}},
+	}
+	for i, pkg := range image.packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             pkg.name,
+			SPDXID:           id,
+			VersionInfo:      pkg.version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     purlRef(pkg.purl(image.distro)),
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-Image",
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+	return doc
+}
+
+type cycloneDXDoc struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type    string `json:"type"`
+	BOMRef  string `json:"bom-ref,omitempty"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+// cycloneDXDocument returns the CycloneDX 1.5 document describing image.
+func cycloneDXDocument(image sbomImage) cycloneDXDoc {
+	imageRef := imagePURL(image.ref)
+	doc := cycloneDXDoc{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		// The serial number is derived from the image, so that the same
+		// image always has the same SBOM.
+		SerialNumber: "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, []byte(imageRef)).String(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: image.created.Format(time.RFC3339),
+			Tools: cycloneDXTools{Components: []cycloneDXComponent{{
+				Type: "application",
+				Name: sbomToolName,
+			}}},
+			Component: cycloneDXComponent{
+				Type:    "container",
+				BOMRef:  imageRef,
+				Name:    image.ref.Context().Name(),
+				Version: image.ref.DigestStr(),
+				PURL:    imageRef,
+			},
+		},
+		Components: []cycloneDXComponent{},
+	}
+	for _, pkg := range image.packages {
+		purl := pkg.purl(image.distro)
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  purl,
+			Name:    pkg.name,
+			Version: pkg.version,
+			PURL:    purl,
+		})
+	}
+	return doc
+}
+
+// attachSBOM generates the SBOM of img, ref, in format and pushes it to the
+// repository of ref as a referrer of img. It returns the digest of the
+// manifest of the referrer.
+func attachSBOM(ctx context.Context, ref name.Digest, img v1.Image, format string, remoteOpts ...remote.Option) (v1.Hash, error) {
+	image, err := readSBOMImage(ref, img)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	doc, err := generateSBOM(format, image)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	subject, err := imageDescriptor(img)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	mediaType := sbomMediaType(format)
+	artifact, err := mutate.Append(empty.Image, mutate.Addendum{Layer: static.NewLayer(doc, mediaType)})
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("create SBOM artifact: %w", err)
+	}
+	artifact = mutate.MediaType(artifact, types.OCIManifestSchema1)
+	// Registries use the media type of the config as the artifact type of
+	// the referrer.
+	artifact = mutate.ConfigMediaType(artifact, mediaType)
+	artifact = mutate.Subject(artifact, subject).(v1.Image)
+	digest, err := artifact.Digest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("get SBOM artifact digest: %w", err)
+	}
+	// Registries without the referrers API get the referrer added to the
+	// index tagged with the digest of img instead.
+	if err := remote.Write(ref.Context().Digest(digest.String()), artifact, append(remoteOpts, remote.WithContext(ctx))...); err != nil {
+		return v1.Hash{}, fmt.Errorf("push SBOM: %w", err)
+	}
+	return digest, nil
+}
+
+// imageDescriptor returns the descriptor of the manifest of img.
+func imageDescriptor(img v1.Image) (v1.Descriptor, error) {
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("get image media type: %w", err)
+	}
+	size, err := img.Size()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("get image size: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("get image digest: %w", err)
+	}
+	return v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}, nil
+}
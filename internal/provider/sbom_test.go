@@ -0,0 +1,163 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/coder/terraform-provider-envbuilder/testutil/registrytest"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDpkgStatus = `Package: curl
+Status: install ok installed
+Architecture: amd64
+Version: 7.88.1-10
+Description: command line tool for transferring data with URL syntax
+ curl is a command line tool for transferring data with URL syntax.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: base-files
+Status: install ok installed
+Architecture: amd64
+Version: 12.4
+`
+
+func TestParseDpkgStatus(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []sbomPackage{
+		{name: "curl", version: "7.88.1-10", arch: "amd64", purlType: "deb"},
+		{name: "base-files", version: "12.4", arch: "amd64", purlType: "deb"},
+	}, parseDpkgStatus([]byte(testDpkgStatus)))
+
+	// Files in status.d of distroless images have no status.
+	assert.Equal(t, []sbomPackage{
+		{name: "tzdata", version: "2024a", arch: "all", purlType: "deb"},
+	}, parseDpkgStatus([]byte("Package: tzdata\nVersion: 2024a\nArchitecture: all\n")))
+}
+
+func TestParseApkInstalled(t *testing.T) {
+	t.Parallel()
+
+	content := "C:Q1abc=\nP:musl\nV:1.2.4-r2\nA:x86_64\nT:the musl c library\n\nP:busybox\nV:1.36.1-r5\nA:x86_64\n"
+	assert.Equal(t, []sbomPackage{
+		{name: "musl", version: "1.2.4-r2", arch: "x86_64", purlType: "apk"},
+		{name: "busybox", version: "1.36.1-r5", arch: "x86_64", purlType: "apk"},
+	}, parseApkInstalled([]byte(content)))
+}
+
+func TestGenerateSBOM(t *testing.T) {
+	t.Parallel()
+
+	ref, err := name.NewDigest("localhost:5000/cache@sha256:" + string(bytes.Repeat([]byte("a"), 64)))
+	require.NoError(t, err)
+	image := sbomImage{
+		ref:      ref,
+		distro:   "debian",
+		packages: []sbomPackage{{name: "curl", version: "7.88.1-10", arch: "amd64", purlType: "deb"}},
+	}
+
+	raw, err := generateSBOM(sbomFormatSPDX, image)
+	require.NoError(t, err)
+	var spdx spdxDoc
+	require.NoError(t, json.Unmarshal(raw, &spdx))
+	assert.Equal(t, "SPDX-2.3", spdx.SPDXVersion)
+	require.Len(t, spdx.Packages, 2)
+	assert.Equal(t, "CONTAINER", spdx.Packages[0].PrimaryPackagePurpose)
+	assert.Equal(t, "pkg:deb/debian/curl@7.88.1-10?arch=amd64", spdx.Packages[1].ExternalRefs[0].ReferenceLocator)
+	assert.Len(t, spdx.Relationships, 2)
+
+	raw, err = generateSBOM(sbomFormatCycloneDX, image)
+	require.NoError(t, err)
+	var cdx cycloneDXDoc
+	require.NoError(t, json.Unmarshal(raw, &cdx))
+	assert.Equal(t, "CycloneDX", cdx.BOMFormat)
+	assert.Equal(t, "container", cdx.Metadata.Component.Type)
+	assert.Equal(t, "pkg:oci/cache@sha256%3A"+string(bytes.Repeat([]byte("a"), 64))+"?repository_url=localhost%3A5000%2Fcache", cdx.Metadata.Component.PURL)
+	require.Len(t, cdx.Components, 1)
+	assert.Equal(t, "pkg:deb/debian/curl@7.88.1-10?arch=amd64", cdx.Components[0].PURL)
+
+	// The same image always has the same SBOM.
+	again, err := generateSBOM(sbomFormatCycloneDX, image)
+	require.NoError(t, err)
+	assert.Equal(t, raw, again)
+
+	_, err = generateSBOM("xml", image)
+	assert.Error(t, err)
+}
+
+func TestAttachSBOM(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"etc/os-release":      "NAME=\"Debian GNU/Linux\"\nID=debian\n",
+		"var/lib/dpkg/status": testDpkgStatus,
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+
+	reg := registrytest.New(t, t.TempDir())
+	registrytest.WriteImage(t, reg+"/cache:latest", img)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	ref, err := name.NewDigest(reg + "/cache@" + digest.String())
+	require.NoError(t, err)
+	remoteImg, err := remote.Image(ref)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	sbomDigest, err := attachSBOM(ctx, ref, remoteImg, sbomFormatSPDX)
+	require.NoError(t, err)
+
+	referrers, err := remote.Referrers(ref)
+	require.NoError(t, err)
+	manifest, err := referrers.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 1)
+	assert.Equal(t, sbomDigest, manifest.Manifests[0].Digest)
+	assert.Equal(t, spdxMediaType, manifest.Manifests[0].ArtifactType)
+
+	artifact, err := remote.Image(ref.Context().Digest(sbomDigest.String()))
+	require.NoError(t, err)
+	layers, err := artifact.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	rc, err := layers[0].Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	var spdx spdxDoc
+	require.NoError(t, json.NewDecoder(rc).Decode(&spdx))
+	var purls []string
+	for _, pkg := range spdx.Packages[1:] {
+		purls = append(purls, pkg.ExternalRefs[0].ReferenceLocator)
+	}
+	assert.Equal(t, []string{
+		"pkg:deb/debian/base-files@12.4?arch=amd64",
+		"pkg:deb/debian/curl@7.88.1-10?arch=amd64",
+	}, purls)
+}
@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// scratchCheckInterval is the interval at which the size of a scratch
+// directory is checked against its limit.
+var scratchCheckInterval = time.Second
+
+// scratchDir is a temporary directory used by a single cache probe.
+type scratchDir struct {
+	// path is the path of the directory.
+	path string
+	// ctx is done once the directory grows beyond its limit, with a
+	// *scratchLimitError as its cause.
+	ctx  context.Context
+	stop func()
+}
+
+// scratchLimitError is the cause of the cancellation of a cache probe whose
+// scratch directory grew beyond its limit.
+type scratchLimitError struct {
+	limit, size int64
+}
+
+func (e *scratchLimitError) Error() string {
+	return fmt.Sprintf("the cache probe used %s of scratch space, more than the limit of %s",
+		units.BytesSize(float64(e.size)), units.BytesSize(float64(e.limit)))
+}
+
+// newScratchDir creates a new temporary directory. If limit is positive, the
+// size of the directory is checked periodically, and the context of the
+// returned scratchDir, derived from ctx, is cancelled once it exceeds limit
+// bytes. cleanup must be called to remove the directory.
+func newScratchDir(ctx context.Context, limit int64) (*scratchDir, error) {
+	path, err := os.MkdirTemp(os.TempDir(), "envbuilder-provider-cached-image-data-source")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	s := &scratchDir{path: path, ctx: ctx}
+	if limit <= 0 {
+		s.stop = func() { cancel(nil) }
+		return s, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(scratchCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if size := dirSize(path); size > limit {
+					cancel(&scratchLimitError{limit: limit, size: size})
+					return
+				}
+			}
+		}
+	}()
+	s.stop = func() {
+		cancel(nil)
+		<-done
+	}
+	return s, nil
+}
+
+// cleanup stops checking the size of the directory and removes it.
+func (s *scratchDir) cleanup(ctx context.Context) {
+	s.stop()
+	if err := os.RemoveAll(s.path); err != nil {
+		tflog.Error(ctx, "failed to clean up tmpDir", map[string]any{"tmpDir": s.path, "err": err})
+	}
+}
+
+// dirSize returns the total size of the regular files in the directory at
+// path. Files that cannot be read, for example because they were removed
+// while walking the directory, are skipped.
+func dirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScratchDir(t *testing.T) {
+	oldInterval := scratchCheckInterval
+	scratchCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { scratchCheckInterval = oldInterval })
+
+	t.Run("WithinLimit", func(t *testing.T) {
+		s, err := newScratchDir(context.Background(), 1024)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(s.path, "small"), make([]byte, 512), 0o600))
+		time.Sleep(5 * scratchCheckInterval)
+		assert.NoError(t, s.ctx.Err())
+
+		s.cleanup(context.Background())
+		assert.NoDirExists(t, s.path)
+		assert.ErrorIs(t, s.ctx.Err(), context.Canceled)
+	})
+
+	t.Run("ExceedsLimit", func(t *testing.T) {
+		s, err := newScratchDir(context.Background(), 1024)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.cleanup(context.Background()) })
+		require.NoError(t, os.MkdirAll(filepath.Join(s.path, "repo"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(s.path, "repo", "large"), make([]byte, 2048), 0o600))
+
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("context was not cancelled")
+		}
+		var scratchErr *scratchLimitError
+		require.True(t, errors.As(context.Cause(s.ctx), &scratchErr))
+		assert.Equal(t, int64(2048), scratchErr.size)
+		assert.Equal(t, "the cache probe used 2KiB of scratch space, more than the limit of 1KiB", scratchErr.Error())
+	})
+
+	t.Run("NoLimit", func(t *testing.T) {
+		s, err := newScratchDir(context.Background(), 0)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(s.path, "large"), make([]byte, 2048), 0o600))
+		time.Sleep(5 * scratchCheckInterval)
+		assert.NoError(t, s.ctx.Err())
+		s.cleanup(context.Background())
+		assert.NoDirExists(t, s.path)
+	})
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+)
+
+// validateSource checks that exactly one of git_url and source_dir is set,
+// and that the attributes that only apply to a git repository are not set
+// with source_dir.
+func (data *CachedImageResourceModel) validateSource() diag.Diagnostics {
+	var diags diag.Diagnostics
+	switch {
+	case data.GitURL.IsNull() && data.SourceDir.IsNull():
+		diags.AddAttributeError(path.Root("git_url"), "Missing source",
+			"One of git_url or source_dir must be set.")
+		return diags
+	case !data.GitURL.IsNull() && !data.SourceDir.IsNull():
+		diags.AddAttributeError(path.Root("source_dir"), "Conflicting source",
+			"Only one of git_url and source_dir may be set.")
+		return diags
+	case data.SourceDir.IsNull():
+		return diags
+	}
+	for _, other := range []struct {
+		name  string
+		value interface{ IsNull() bool }
+	}{
+		{"git_ref", data.GitRef},
+		{"git_mirror_urls", data.GitMirrorURLs},
+		{"local_repo_path", data.LocalRepoPath},
+	} {
+		if !other.value.IsNull() {
+			diags.AddAttributeError(path.Root(other.name), "Conflicting source",
+				fmt.Sprintf("%s only applies to git_url, so it cannot be set with source_dir.", other.name))
+		}
+	}
+	return diags
+}
+
+// source returns git_url with git_ref, or source_dir if set instead.
+func (data *CachedImageResourceModel) source() string {
+	if !data.SourceDir.IsNull() {
+		return data.SourceDir.ValueString()
+	}
+	return data.gitURL()
+}
+
+// copySourceDir copies the directory src to dst, which is created if it does
+// not exist. File modes and symbolic links are preserved, as they are part
+// of the cache keys of COPY and ADD instructions.
+func copySourceDir(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			// Directories stay writable by the owner, so that their
+			// contents can be copied and the scratch directory removed.
+			return os.Chmod(target, info.Mode().Perm()|0o700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyRegularFile(p, target, info.Mode().Perm())
+		default:
+			// Sockets, devices and pipes cannot be copied into an image.
+			return nil
+		}
+	})
+}
+
+// copyRegularFile copies the regular file src to dst, with mode perm.
+func copyRegularFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// The mode given to OpenFile is subject to the umask.
+	return os.Chmod(dst, perm)
+}
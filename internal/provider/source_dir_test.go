@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSource(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		data   CachedImageResourceModel
+		expect []string
+	}{
+		{
+			name: "git_url",
+			data: CachedImageResourceModel{GitURL: types.StringValue("https://example.com/repo.git"), GitRef: types.StringValue("main")},
+		},
+		{
+			name: "source_dir",
+			data: CachedImageResourceModel{SourceDir: types.StringValue("/src/repo")},
+		},
+		{
+			name: "unknown git_url",
+			data: CachedImageResourceModel{GitURL: types.StringUnknown()},
+		},
+		{
+			name:   "neither",
+			data:   CachedImageResourceModel{},
+			expect: []string{"One of git_url or source_dir must be set."},
+		},
+		{
+			name:   "both",
+			data:   CachedImageResourceModel{GitURL: types.StringValue("https://example.com/repo.git"), SourceDir: types.StringValue("/src/repo")},
+			expect: []string{"Only one of git_url and source_dir may be set."},
+		},
+		{
+			name: "git attributes",
+			data: CachedImageResourceModel{
+				SourceDir:     types.StringValue("/src/repo"),
+				GitRef:        types.StringValue("main"),
+				GitMirrorURLs: types.ListValueMust(types.StringType, []attr.Value{types.StringValue("https://mirror.example.com/repo.git")}),
+			},
+			expect: []string{
+				"git_ref only applies to git_url, so it cannot be set with source_dir.",
+				"git_mirror_urls only applies to git_url, so it cannot be set with source_dir.",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var details []string
+			for _, d := range tc.data.validateSource() {
+				details = append(details, d.Detail())
+			}
+			assert.Equal(t, tc.expect, details)
+		})
+	}
+}
+
+func TestCopySourceDir(t *testing.T) {
+	t.Parallel()
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, ".devcontainer"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, ".devcontainer", "devcontainer.json"), []byte(`{"build": {"dockerfile": "Dockerfile"}}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, os.Symlink("run.sh", filepath.Join(src, "link.sh")))
+
+	dst := filepath.Join(t.TempDir(), "workspace")
+	require.NoError(t, copySourceDir(src, dst))
+
+	content, err := os.ReadFile(filepath.Join(dst, ".devcontainer", "devcontainer.json"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"build": {"dockerfile": "Dockerfile"}}`, string(content))
+	info, err := os.Stat(filepath.Join(dst, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	link, err := os.Readlink(filepath.Join(dst, "link.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "run.sh", link)
+
+	// The source is not modified.
+	entries, err := os.ReadDir(src)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	eschema "github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// timeoutsBlock returns the timeouts block of the cached image resource,
+// which bounds the time taken by the cache probe in Create and by refreshing
+// in Read.
+func timeoutsBlock() schema.Block {
+	return schema.SingleNestedBlock{
+		MarkdownDescription: "Bounds the time taken by the cache probe, like the timeouts of other resources. Without a timeout, only the timeout of Terraform itself applies. A probe that times out is reported as such, and the builder image is used instead.",
+		Attributes: map[string]schema.Attribute{
+			"create": schema.StringAttribute{
+				MarkdownDescription: "The timeout of the cache probe when the resource is created, as a duration string (e.g. `5m`).",
+				Optional:            true,
+				Validators:          []validator.String{duration()},
+			},
+			"read": schema.StringAttribute{
+				MarkdownDescription: "The timeout of refreshing the resource, which checks whether the cached image still exists and whether the cache probe is outdated, as a duration string (e.g. `1m`).",
+				Optional:            true,
+				Validators:          []validator.String{duration()},
+			},
+		},
+	}
+}
+
+// ephemeralTimeoutsBlock returns the timeouts block of the cached image
+// ephemeral resource, which bounds the time taken by the cache probe in
+// Open.
+func ephemeralTimeoutsBlock() eschema.Block {
+	return eschema.SingleNestedBlock{
+		MarkdownDescription: "Bounds the time taken by the cache probe. Without a timeout, only the timeout of Terraform itself applies. A probe that times out is reported as such, and the builder image is used instead.",
+		Attributes: map[string]eschema.Attribute{
+			"open": eschema.StringAttribute{
+				MarkdownDescription: "The timeout of the cache probe when the ephemeral resource is opened, as a duration string (e.g. `5m`).",
+				Optional:            true,
+				Validators:          []validator.String{duration()},
+			},
+		},
+	}
+}
+
+// withTimeout returns ctx with the deadline set by the timeout attribute
+// name of data.Timeouts, or ctx unchanged if it is not set. Durations are
+// validated by the schema, so invalid ones are ignored.
+func (data *CachedImageResourceModel) withTimeout(ctx context.Context, name string) (context.Context, context.CancelFunc) {
+	if data.Timeouts.IsNull() || data.Timeouts.IsUnknown() {
+		return context.WithCancel(ctx)
+	}
+	value, ok := data.Timeouts.Attributes()[name].(types.String)
+	if !ok || value.IsNull() || value.IsUnknown() {
+		return context.WithCancel(ctx)
+	}
+	d, err := time.ParseDuration(value.ValueString())
+	if err != nil || d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeout(t *testing.T) {
+	t.Parallel()
+
+	attrTypes := map[string]attr.Type{"create": types.StringType, "read": types.StringType}
+	data := CachedImageResourceModel{Timeouts: types.ObjectNull(attrTypes)}
+	ctx, cancel := data.withTimeout(context.Background(), "create")
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+	assert.Error(t, ctx.Err())
+
+	data.Timeouts = types.ObjectValueMust(attrTypes, map[string]attr.Value{
+		"create": types.StringValue("5m"),
+		"read":   types.StringNull(),
+	})
+	ctx, cancel = data.withTimeout(context.Background(), "create")
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), deadline, time.Minute)
+
+	ctx, cancel = data.withTimeout(context.Background(), "read")
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
@@ -0,0 +1,244 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	eboptions "github.com/coder/envbuilder/options"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/kballard/go-shellquote"
+)
+
+// stringValidator is a validator.String that checks a known, non-null string
+// value with check, which returns a description of the problem if the value
+// is invalid.
+type stringValidator struct {
+	description string
+	check       func(s string) string
+}
+
+var _ validator.String = stringValidator{}
+
+func (v stringValidator) Description(ctx context.Context) string {
+	return v.description
+}
+
+func (v stringValidator) MarkdownDescription(ctx context.Context) string {
+	return v.description
+}
+
+func (v stringValidator) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+	if problem := v.check(req.ConfigValue.ValueString()); problem != "" {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid attribute value", problem)
+	}
+}
+
+// nonEmptyString validates that a string is not empty.
+func nonEmptyString() validator.String {
+	return stringValidator{
+		description: "value must not be empty",
+		check: func(s string) string {
+			if s == "" {
+				return "The value must not be empty."
+			}
+			return ""
+		},
+	}
+}
+
+// absolutePath validates that a string is an absolute path.
+func absolutePath() validator.String {
+	return stringValidator{
+		description: "value must be an absolute path",
+		check: func(s string) string {
+			if !filepath.IsAbs(s) {
+				return fmt.Sprintf("%q is not an absolute path.", s)
+			}
+			return ""
+		},
+	}
+}
+
+// duration validates that a string is a positive duration, such as "5m".
+func duration() validator.String {
+	return stringValidator{
+		description: "value must be a positive duration",
+		check: func(s string) string {
+			if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+				return fmt.Sprintf("%q is not a valid positive duration.", s)
+			}
+			return ""
+		},
+	}
+}
+
+// platform validates that a string is a platform, such as "linux/arm64".
+func platform() validator.String {
+	return stringValidator{
+		description: "value must be a platform in the form os/arch[/variant]",
+		check: func(s string) string {
+			p, err := v1.ParsePlatform(s)
+			if err != nil || p.OS == "" || p.Architecture == "" {
+				return fmt.Sprintf("%q is not a platform in the form os/arch[/variant].", s)
+			}
+			return ""
+		},
+	}
+}
+
+// shellWords validates that a string can be split into words according to
+// /bin/sh rules, as envbuilder does for ENVBUILDER_INIT_ARGS.
+func shellWords() validator.String {
+	return stringValidator{
+		description: "value must be valid /bin/sh words",
+		check: func(s string) string {
+			if _, err := shellquote.Split(s); err != nil {
+				return fmt.Sprintf("%q cannot be split into arguments: %s.", s, err)
+			}
+			return ""
+		},
+	}
+}
+
+// gitURL validates that a string is a git URL that envbuilder can clone: a
+// URL with a git transport scheme, an scp-style URL or an absolute path.
+func gitURL() validator.String {
+	return stringValidator{
+		description: "value must be a valid git URL",
+		check: func(s string) string {
+			if _, err := normalizeGitURL(s); err != nil {
+				return fmt.Sprintf("%q is not a valid git URL: %s.", s, err)
+			}
+			return ""
+		},
+	}
+}
+
+// oneOf validates that a string is one of the given values.
+func oneOf(values ...string) validator.String {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return stringValidator{
+		description: "value must be one of " + strings.Join(quoted, ", "),
+		check: func(s string) string {
+			if slices.Contains(values, s) {
+				return ""
+			}
+			return fmt.Sprintf("%q must be one of %s.", s, strings.Join(quoted, ", "))
+		},
+	}
+}
+
+// typedOptionsValidator validates the names and types of the values in the
+// options attribute.
+type typedOptionsValidator struct{}
+
+var _ validator.Dynamic = typedOptionsValidator{}
+
+func (v typedOptionsValidator) Description(ctx context.Context) string {
+	return "value must map envbuilder option names to values of the option's type"
+}
+
+func (v typedOptionsValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v typedOptionsValidator) ValidateDynamic(ctx context.Context, req validator.DynamicRequest, resp *validator.DynamicResponse) {
+	// Only report errors here. Warnings about overrides depend on the other
+	// attributes, and are reported when the options are used.
+	var opts eboptions.Options
+	for _, d := range overrideOptionsFromTyped(&opts, req.ConfigValue, map[string]bool{}, overridePolicy{}) {
+		if d.Severity() == diag.SeverityError {
+			resp.Diagnostics.Append(d)
+		}
+	}
+}
+
+// cacheTagFormat validates that a string is a valid cache_tag_format.
+// Placeholders are expanded with a placeholder value, so this only checks
+// the literal part of the format.
+func cacheTagFormat() validator.String {
+	return stringValidator{
+		description: "value must be a valid image tag, with {ref} and {repo} placeholders",
+		check: func(s string) string {
+			format := strings.NewReplacer("{ref}", "x", "{repo}", "x").Replace(s)
+			if !cacheTagPattern.MatchString(format) {
+				return fmt.Sprintf("%q is not a valid image tag format: a tag is at most 128 letters, digits, underscores, periods and dashes, and may not start with a period or dash. Only the {ref} and {repo} placeholders are supported.", s)
+			}
+			return ""
+		},
+	}
+}
+
+// cacheNamespaceComponent matches a path component of a repository name, as
+// defined by the OCI distribution spec.
+var cacheNamespaceComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*$`)
+
+// cacheNamespace validates that a string is one or more path components of a
+// repository name, separated by slashes.
+func cacheNamespace() validator.String {
+	return stringValidator{
+		description: "value must be path components of a repository name",
+		check: func(s string) string {
+			for _, component := range strings.Split(s, "/") {
+				if !cacheNamespaceComponent.MatchString(component) {
+					return fmt.Sprintf("%q is not a valid cache namespace: %q must be lowercase letters and digits, optionally separated by periods, underscores or dashes.", s, component)
+				}
+			}
+			return ""
+		},
+	}
+}
+
+// int64Validator is a validator.Int64 that checks a known, non-null integer
+// value with check, which returns a description of the problem if the value
+// is invalid.
+type int64Validator struct {
+	description string
+	check       func(i int64) string
+}
+
+var _ validator.Int64 = int64Validator{}
+
+func (v int64Validator) Description(ctx context.Context) string {
+	return v.description
+}
+
+func (v int64Validator) MarkdownDescription(ctx context.Context) string {
+	return v.description
+}
+
+func (v int64Validator) ValidateInt64(ctx context.Context, req validator.Int64Request, resp *validator.Int64Response) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+	if problem := v.check(req.ConfigValue.ValueInt64()); problem != "" {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid attribute value", problem)
+	}
+}
+
+// positive validates that an integer is greater than zero.
+func positive() validator.Int64 {
+	return int64Validator{
+		description: "value must be greater than zero",
+		check: func(i int64) string {
+			if i <= 0 {
+				return fmt.Sprintf("%d is not greater than zero.", i)
+			}
+			return ""
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringValidators(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		validator validator.String
+		value     types.String
+		expectErr bool
+	}{
+		{name: "non-empty null", validator: nonEmptyString(), value: types.StringNull()},
+		{name: "non-empty unknown", validator: nonEmptyString(), value: types.StringUnknown()},
+		{name: "non-empty ok", validator: nonEmptyString(), value: types.StringValue("/bin/sh")},
+		{name: "non-empty empty", validator: nonEmptyString(), value: types.StringValue(""), expectErr: true},
+		{name: "absolute path ok", validator: absolutePath(), value: types.StringValue("/tmp/env")},
+		{name: "absolute path relative", validator: absolutePath(), value: types.StringValue("tmp/env"), expectErr: true},
+		{name: "duration ok", validator: duration(), value: types.StringValue("1m30s")},
+		{name: "duration zero", validator: duration(), value: types.StringValue("0s"), expectErr: true},
+		{name: "duration without unit", validator: duration(), value: types.StringValue("30"), expectErr: true},
+		{name: "platform ok", validator: platform(), value: types.StringValue("linux/arm64/v8")},
+		{name: "platform without architecture", validator: platform(), value: types.StringValue("linux"), expectErr: true},
+		{name: "shell words ok", validator: shellWords(), value: types.StringValue(`-c "echo hello world"`)},
+		{name: "shell words unterminated", validator: shellWords(), value: types.StringValue(`-c "echo`), expectErr: true},
+		{name: "git URL ok", validator: gitURL(), value: types.StringValue("git@github.com:coder/envbuilder.git#main")},
+		{name: "git URL malformed", validator: gitURL(), value: types.StringValue("git@github.com/coder/envbuilder.git"), expectErr: true},
+		{name: "one of ok", validator: oneOf("a", "b"), value: types.StringValue("b")},
+		{name: "one of other", validator: oneOf("a", "b"), value: types.StringValue("c"), expectErr: true},
+		{name: "cache tag format ok", validator: cacheTagFormat(), value: types.StringValue("team-a_{repo}.{ref}")},
+		{name: "cache tag format invalid character", validator: cacheTagFormat(), value: types.StringValue("team/{ref}"), expectErr: true},
+		{name: "cache tag format unknown placeholder", validator: cacheTagFormat(), value: types.StringValue("{branch}"), expectErr: true},
+		{name: "cache namespace ok", validator: cacheNamespace(), value: types.StringValue("team-a/ws_1")},
+		{name: "cache namespace uppercase", validator: cacheNamespace(), value: types.StringValue("Team"), expectErr: true},
+		{name: "cache namespace empty component", validator: cacheNamespace(), value: types.StringValue("a//b"), expectErr: true},
+		{name: "cache namespace leading separator", validator: cacheNamespace(), value: types.StringValue("-a"), expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var resp validator.StringResponse
+			tc.validator.ValidateString(context.Background(), validator.StringRequest{
+				Path:        path.Root("test"),
+				ConfigValue: tc.value,
+			}, &resp)
+			assert.Equal(t, tc.expectErr, resp.Diagnostics.HasError())
+		})
+	}
+}
+
+func TestInt64Validators(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		validator validator.Int64
+		value     types.Int64
+		expectErr bool
+	}{
+		{name: "positive null", validator: positive(), value: types.Int64Null()},
+		{name: "positive unknown", validator: positive(), value: types.Int64Unknown()},
+		{name: "positive ok", validator: positive(), value: types.Int64Value(1)},
+		{name: "positive zero", validator: positive(), value: types.Int64Value(0), expectErr: true},
+		{name: "positive negative", validator: positive(), value: types.Int64Value(-1), expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var resp validator.Int64Response
+			tc.validator.ValidateInt64(context.Background(), validator.Int64Request{
+				Path:        path.Root("test"),
+				ConfigValue: tc.value,
+			}, &resp)
+			assert.Equal(t, tc.expectErr, resp.Diagnostics.HasError())
+		})
+	}
+}
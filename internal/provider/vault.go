@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// vaultAuthToken authenticates to Vault with a token.
+	vaultAuthToken = "token"
+	// vaultAuthKubernetes authenticates to Vault with the Kubernetes service
+	// account token of the pod Terraform runs in.
+	vaultAuthKubernetes = "kubernetes"
+	// defaultVaultKubernetesJWTPath is where Kubernetes mounts the service
+	// account token in pods.
+	defaultVaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// vaultCredentials fetches git and registry credentials for probing from
+// HashiCorp Vault secrets, configured by the vault_* attributes of the
+// provider. The secrets are read once, when they are first needed, and held
+// for the lifetime of the provider process. A nil *vaultCredentials has no
+// credentials.
+type vaultCredentials struct {
+	// address is the address of the Vault server, e.g.
+	// https://vault.example.com:8200.
+	address string
+	// namespace is the Vault Enterprise namespace, if any.
+	namespace string
+	// authMethod is one of vaultAuthToken or vaultAuthKubernetes.
+	authMethod string
+	// authMount is the path the auth method is mounted at.
+	authMount string
+	// role is the role to log in with the Kubernetes auth method.
+	role string
+	// token is the token used by the token auth method.
+	token string
+	// jwtPath is the path to the service account token used by the
+	// Kubernetes auth method.
+	jwtPath string
+	// gitSecretPath and registrySecretPath are the API paths of the secrets
+	// holding the git and registry credentials. Either may be empty.
+	gitSecretPath      string
+	registrySecretPath string
+	// client makes the requests to Vault.
+	client *http.Client
+
+	mu     sync.Mutex
+	cached *probeSecrets
+}
+
+// secrets returns the credentials in the git and registry secrets.
+func (v *vaultCredentials) secrets(ctx context.Context) (probeSecrets, error) {
+	if v == nil {
+		return probeSecrets{}, nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.cached != nil {
+		return *v.cached, nil
+	}
+
+	token, err := v.login(ctx)
+	if err != nil {
+		return probeSecrets{}, fmt.Errorf("log in to vault: %w", err)
+	}
+	var secrets probeSecrets
+	if v.gitSecretPath != "" {
+		data, err := v.readSecret(ctx, token, v.gitSecretPath)
+		if err != nil {
+			return probeSecrets{}, err
+		}
+		secrets.gitUsername = data["username"]
+		secrets.gitPassword = data["password"]
+		if key := data["ssh_private_key"]; key != "" {
+			secrets.gitSSHPrivateKeyBase64 = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+	if v.registrySecretPath != "" {
+		data, err := v.readSecret(ctx, token, v.registrySecretPath)
+		if err != nil {
+			return probeSecrets{}, err
+		}
+		dockerConfig, ok := data[dockerConfigSecretKey]
+		if !ok {
+			return probeSecrets{}, fmt.Errorf("vault secret %q has no %q key", v.registrySecretPath, dockerConfigSecretKey)
+		}
+		secrets.dockerConfigBase64 = base64.StdEncoding.EncodeToString([]byte(dockerConfig))
+	}
+	v.cached = &secrets
+	return secrets, nil
+}
+
+// login returns a Vault token using the auth method.
+func (v *vaultCredentials) login(ctx context.Context) (string, error) {
+	switch v.authMethod {
+	case vaultAuthToken:
+		return v.token, nil
+	case vaultAuthKubernetes:
+		jwt, err := os.ReadFile(v.jwtPath)
+		if err != nil {
+			return "", fmt.Errorf("read service account token: %w", err)
+		}
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		err = v.do(ctx, http.MethodPost, "auth/"+v.authMount+"/login", "", map[string]string{
+			"role": v.role,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		}, &resp)
+		if err != nil {
+			return "", err
+		}
+		if resp.Auth.ClientToken == "" {
+			return "", errors.New("no client token in login response")
+		}
+		return resp.Auth.ClientToken, nil
+	default:
+		return "", fmt.Errorf("unsupported auth method %q", v.authMethod)
+	}
+}
+
+// readSecret returns the string values of the secret at path. Both KV version
+// 1 and 2 secrets are supported; for the latter, path includes the data/
+// segment, e.g. secret/data/envbuilder.
+func (v *vaultCredentials) readSecret(ctx context.Context, token, path string) (map[string]string, error) {
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, path, token, nil, &resp); err != nil {
+		return nil, fmt.Errorf("read vault secret %q: %w", path, err)
+	}
+	data := resp.Data
+	// KV version 2 nests the secret and its metadata.
+	if nested, ok := data["data"]; ok {
+		if _, ok := data["metadata"]; ok {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return nil, fmt.Errorf("read vault secret %q: %w", path, err)
+			}
+		}
+	}
+	values := make(map[string]string, len(data))
+	for k, raw := range data {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("vault secret %q: value of %q is not a string", path, k)
+		}
+		values[k] = s
+	}
+	return values, nil
+}
+
+// do makes a request to the Vault API at path with body encoded as JSON, if
+// not nil, and decodes the response into out.
+func (v *vaultCredentials) do(ctx context.Context, method, path, token string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	url := strings.TrimSuffix(v.address, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	client := v.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(respBody, &errResp); err == nil && len(errResp.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(errResp.Errors, "; "))
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,148 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	eboptions "github.com/coder/envbuilder/options"
+	"github.com/coder/terraform-provider-envbuilder/internal/netutil"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultCredentials(t *testing.T) {
+	t.Parallel()
+
+	var reads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "team", r.Header.Get("X-Vault-Namespace"))
+		switch r.URL.Path {
+		case "/v1/auth/k8s/login":
+			var body map[string]string
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if body["role"] != "envbuilder" || body["jwt"] != "service-account-token" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"auth": {"client_token": "client-token"}}`))
+		case "/v1/secret/data/git":
+			reads++
+			assert.Equal(t, "client-token", r.Header.Get("X-Vault-Token"))
+			// KV version 2.
+			_, _ = w.Write([]byte(`{"data": {"data": {"username": "user", "password": "pass", "ssh_private_key": "key"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/registry":
+			assert.Equal(t, "client-token", r.Header.Get("X-Vault-Token"))
+			// KV version 1.
+			_, _ = w.Write([]byte(`{"data": {".dockerconfigjson": "{\"auths\": {}}"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	jwtPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(jwtPath, []byte("service-account-token\n"), 0o600))
+	v := &vaultCredentials{
+		address:            srv.URL,
+		namespace:          "team",
+		authMethod:         vaultAuthKubernetes,
+		authMount:          "k8s",
+		role:               "envbuilder",
+		jwtPath:            jwtPath,
+		gitSecretPath:      "secret/data/git",
+		registrySecretPath: "kv/registry",
+	}
+	secrets, err := v.secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, probeSecrets{
+		gitUsername:            "user",
+		gitPassword:            "pass",
+		gitSSHPrivateKeyBase64: base64.StdEncoding.EncodeToString([]byte("key")),
+		dockerConfigBase64:     base64.StdEncoding.EncodeToString([]byte(`{"auths": {}}`)),
+	}, secrets)
+
+	// The secrets are only read once.
+	_, err = v.secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, reads)
+
+	// Credentials that are set are not replaced.
+	opts := eboptions.Options{GitPassword: "explicit"}
+	secrets.apply(&opts)
+	assert.Equal(t, "user", opts.GitUsername)
+	assert.Equal(t, "explicit", opts.GitPassword)
+
+	v = &vaultCredentials{address: srv.URL, namespace: "team", authMethod: vaultAuthKubernetes, authMount: "k8s", role: "other", jwtPath: jwtPath, gitSecretPath: "secret/data/git"}
+	_, err = v.secrets(context.Background())
+	assert.ErrorContains(t, err, "403 Forbidden: permission denied")
+
+	v = &vaultCredentials{address: srv.URL, namespace: "team", authMethod: vaultAuthToken, token: "client-token", gitSecretPath: "secret/data/missing"}
+	_, err = v.secrets(context.Background())
+	assert.ErrorContains(t, err, `read vault secret "secret/data/missing": 404 Not Found`)
+
+	// A nil *vaultCredentials has no credentials.
+	secrets, err = (*vaultCredentials)(nil).secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, probeSecrets{}, secrets)
+}
+
+func TestVaultFromDataModel(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "https://vault.local:8200")
+	t.Setenv("VAULT_TOKEN", "")
+
+	for _, tc := range []struct {
+		name      string
+		data      EnvbuilderProviderModel
+		expectNil bool
+		expectErr string
+	}{
+		{name: "not configured", data: EnvbuilderProviderModel{VaultAddress: types.StringValue("https://vault.local")}, expectNil: true},
+		{
+			name: "kubernetes",
+			data: EnvbuilderProviderModel{VaultAuthMethod: types.StringValue("kubernetes"), VaultRole: types.StringValue("envbuilder"), VaultGitSecretPath: types.StringValue("secret/data/git")},
+		},
+		{
+			name:      "missing role",
+			data:      EnvbuilderProviderModel{VaultAuthMethod: types.StringValue("kubernetes"), VaultGitSecretPath: types.StringValue("secret/data/git")},
+			expectErr: "Missing Vault role",
+		},
+		{
+			name:      "missing token",
+			data:      EnvbuilderProviderModel{VaultRegistrySecretPath: types.StringValue("secret/data/registry")},
+			expectErr: "Missing Vault token",
+		},
+		{
+			name:      "invalid auth method",
+			data:      EnvbuilderProviderModel{VaultAuthMethod: types.StringValue("ldap"), VaultGitSecretPath: types.StringValue("secret/data/git")},
+			expectErr: "Invalid Vault auth method",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var diags diag.Diagnostics
+			v := vaultFromDataModel(tc.data, netutil.Options{}, &diags)
+			if tc.expectErr != "" {
+				require.True(t, diags.HasError())
+				assert.Equal(t, tc.expectErr, diags.Errors()[0].Summary())
+				return
+			}
+			require.False(t, diags.HasError(), diags)
+			if tc.expectNil {
+				assert.Nil(t, v)
+				return
+			}
+			require.NotNil(t, v)
+			assert.Equal(t, "https://vault.local:8200", v.address)
+			assert.Equal(t, v.authMethod, v.authMount)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"log"
+	"os"
 
 	"github.com/coder/terraform-provider-envbuilder/internal/provider"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
@@ -19,6 +20,9 @@ import (
 // can be customized.
 //go:generate go run github.com/hashicorp/terraform-plugin-docs/cmd/tfplugindocs generate
 
+// Generate the JSON schema of the environment computed by envbuilder_cached_image.
+//go:generate go run . env-schema -o schemas/env.schema.json
+
 // these will be set by the goreleaser configuration
 // to appropriate values for the compiled binary.
 var version string = "dev"
@@ -27,6 +31,24 @@ var version string = "dev"
 // https://goreleaser.com/cookbooks/using-main.version/
 
 func main() {
+	// The probe subcommand runs a cache probe outside of Terraform, for
+	// debugging cache misses. The doctor subcommand checks that the remotes
+	// used by a cache probe can be reached. The env-schema subcommand prints a
+	// JSON schema of the computed environment. The probe-envbuilder
+	// subcommand is run by the provider itself to probe in a subprocess.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "probe":
+			os.Exit(provider.ProbeCommand(context.Background(), version, os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "doctor":
+			os.Exit(provider.DoctorCommand(context.Background(), version, os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "env-schema":
+			os.Exit(provider.EnvSchemaCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "probe-envbuilder":
+			os.Exit(provider.EnvbuilderSubprocessCommand(context.Background(), os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
 	var debug bool
 
 	flag.BoolVar(&debug, "debug", false, "set to true to run the provider with support for debuggers like delve")
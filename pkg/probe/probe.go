@@ -0,0 +1,230 @@
+// Package probe runs the cache probe of the envbuilder_cached_image resource
+// of the envbuilder Terraform provider from other Go programs.
+//
+// The configuration is validated, converted to envbuilder options, and
+// probed by the provider itself, driven as Terraform would drive it, so the
+// semantics are exactly those of the provider version that is imported.
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/coder/terraform-provider-envbuilder/internal/provider"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+// Config is the configuration of a cache probe.
+type Config struct {
+	// Resource holds the attributes of an envbuilder_cached_image resource,
+	// with the same names and values as in Terraform, for example
+	// {"builder_image": "...", "cache_repo": "...", "git_url": "..."}.
+	// Values must be encodable as JSON. Attributes that are not set, or are
+	// nil, are null.
+	Resource map[string]any
+	// Provider holds the attributes of the provider in the same way. If it
+	// is nil, the defaults of the provider are used.
+	Provider map[string]any
+}
+
+// Severity is the severity of a Diagnostic.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is an error or warning reported by the provider, as Terraform
+// would show it.
+type Diagnostic struct {
+	Severity Severity
+	Summary  string
+	Detail   string
+	// Attribute is the path of the attribute the diagnostic is about, in
+	// the form used by the plugin protocol, for example
+	// AttributeName("git_url"). It is empty if the diagnostic is not about
+	// an attribute.
+	Attribute string
+}
+
+// HasErrors returns whether any of diags are errors.
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Result is the result of a cache probe. Its fields are the computed
+// attributes of the envbuilder_cached_image resource of the same names.
+type Result struct {
+	// Image is the cached image if it exists, or the builder image
+	// otherwise.
+	Image  string
+	Exists bool
+	// ID is the digest of the cached image, or the nil UUID if it does not
+	// exist.
+	ID string
+	// CreatedAt is the creation time of the cached image in RFC 3339
+	// format, or empty if it does not exist.
+	CreatedAt            string
+	BaseImage            string
+	BaseImageDigest      string
+	GitURLCanonical      string
+	GitURLUsed           string
+	CacheRepoUsed        string
+	CacheTag             string
+	CandidateTag         string
+	CompiledDockerfile   string
+	Stale                bool
+	ImageRegistry        string
+	ImageRepository      string
+	ImageTag             string
+	ImageDigest          string
+	LastProbedAt         string
+	ImageSizeBytes       int64
+	LayerCount           int64
+	GitCommit            string
+	PlatformImages       map[string]string
+	MissingLayers        []string
+	UsesFeatures         bool
+	Customizations       json.RawMessage
+	DevcontainerResolved json.RawMessage
+	VSCodeExtensions     []string
+	User                 string
+	Workdir              string
+	Entrypoint           []string
+	Cmd                  []string
+	ExposedPorts         []string
+	Labels               map[string]string
+	Annotations          map[string]string
+	// Env is the environment to run envbuilder with. It may contain
+	// secrets.
+	Env map[string]string
+}
+
+// Run probes for a cached image with cfg, as creating an
+// envbuilder_cached_image resource would. The result is nil if there are
+// error diagnostics. An error is returned if cfg cannot be decoded.
+//
+// As in the provider, envbuilder runs with process-wide state replaced,
+// including http.DefaultTransport, and the environment if devcontainer_env
+// is set. Concurrent calls take turns to run it.
+func Run(ctx context.Context, cfg Config) (*Result, []Diagnostic, error) {
+	config, providerConfig, err := cfg.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	result, diags, err := provider.RunProbe(ctx, providerVersion(), config, providerConfig)
+	if err != nil || result == nil {
+		return nil, convertDiags(diags), err
+	}
+	return &Result{
+		Image:                result.Image,
+		Exists:               result.Exists,
+		ID:                   result.ID,
+		CreatedAt:            result.CreatedAt,
+		BaseImage:            result.BaseImage,
+		BaseImageDigest:      result.BaseImageDigest,
+		GitURLCanonical:      result.GitURLCanonical,
+		GitURLUsed:           result.GitURLUsed,
+		CacheRepoUsed:        result.CacheRepoUsed,
+		CacheTag:             result.CacheTag,
+		CandidateTag:         result.CandidateTag,
+		CompiledDockerfile:   result.CompiledDockerfile,
+		Stale:                result.Stale,
+		ImageRegistry:        result.ImageRegistry,
+		ImageRepository:      result.ImageRepository,
+		ImageTag:             result.ImageTag,
+		ImageDigest:          result.ImageDigest,
+		LastProbedAt:         result.LastProbedAt,
+		ImageSizeBytes:       result.ImageSizeBytes,
+		LayerCount:           result.LayerCount,
+		GitCommit:            result.GitCommit,
+		PlatformImages:       result.PlatformImages,
+		MissingLayers:        result.MissingLayers,
+		UsesFeatures:         result.UsesFeatures,
+		Customizations:       json.RawMessage(result.Customizations),
+		DevcontainerResolved: json.RawMessage(result.DevcontainerResolved),
+		VSCodeExtensions:     result.VSCodeExtensions,
+		User:                 result.User,
+		Workdir:              result.Workdir,
+		Entrypoint:           result.Entrypoint,
+		Cmd:                  result.Cmd,
+		ExposedPorts:         result.ExposedPorts,
+		Labels:               result.Labels,
+		Annotations:          result.Annotations,
+		Env:                  result.Env,
+	}, convertDiags(diags), nil
+}
+
+// Env returns the environment to run envbuilder with for cfg, as the
+// env_map attribute of an envbuilder_cached_image resource, without
+// probing. The environment is nil if there are error diagnostics. An error
+// is returned if cfg cannot be decoded.
+func Env(ctx context.Context, cfg Config) (map[string]string, []Diagnostic, error) {
+	config, providerConfig, err := cfg.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	env, diags, err := provider.ComputeEnv(ctx, providerVersion(), config, providerConfig)
+	return env, convertDiags(diags), err
+}
+
+func (cfg Config) marshal() (config, providerConfig []byte, err error) {
+	config, err = marshalAttributes(cfg.Resource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode resource configuration: %w", err)
+	}
+	providerConfig, err = marshalAttributes(cfg.Provider)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode provider configuration: %w", err)
+	}
+	return config, providerConfig, nil
+}
+
+// marshalAttributes encodes attrs as a JSON object, omitting nil values.
+func marshalAttributes(attrs map[string]any) ([]byte, error) {
+	set := make(map[string]any, len(attrs))
+	for name, value := range attrs {
+		if value != nil {
+			set[name] = value
+		}
+	}
+	return json.Marshal(set)
+}
+
+func convertDiags(diags []provider.Diagnostic) []Diagnostic {
+	converted := make([]Diagnostic, 0, len(diags))
+	for _, d := range diags {
+		severity := SeverityWarning
+		if d.Severity == tfprotov6.DiagnosticSeverityError.String() {
+			severity = SeverityError
+		}
+		converted = append(converted, Diagnostic{
+			Severity:  severity,
+			Summary:   d.Summary,
+			Detail:    d.Detail,
+			Attribute: d.Attribute,
+		})
+	}
+	return converted
+}
+
+// providerVersion returns the version of the provider module that is
+// imported, as the provider would report it.
+func providerVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/coder/terraform-provider-envbuilder" {
+				return dep.Version
+			}
+		}
+	}
+	return "dev"
+}
@@ -0,0 +1,46 @@
+package probe_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coder/terraform-provider-envbuilder/pkg/probe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnv(t *testing.T) {
+	t.Parallel()
+
+	env, diags, err := probe.Env(context.Background(), probe.Config{
+		Resource: map[string]any{
+			"builder_image": "ghcr.io/coder/envbuilder:latest",
+			"cache_repo":    "localhost:5000/cache",
+			"git_url":       "https://git.local/repo.git",
+			"extra_env":     map[string]string{"FOO": "bar"},
+			"insecure":      nil,
+		},
+	})
+	require.NoError(t, err)
+	assert.False(t, probe.HasErrors(diags), diags)
+	assert.Equal(t, "https://git.local/repo.git", env["ENVBUILDER_GIT_URL"])
+	assert.Equal(t, "localhost:5000/cache", env["ENVBUILDER_CACHE_REPO"])
+	assert.Equal(t, "bar", env["FOO"])
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	result, diags, err := probe.Run(context.Background(), probe.Config{
+		Resource: map[string]any{"builder_image": "ghcr.io/coder/envbuilder:latest"},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, result)
+	require.True(t, probe.HasErrors(diags))
+	assert.Equal(t, "Missing required argument", diags[0].Summary)
+
+	_, _, err = probe.Run(context.Background(), probe.Config{
+		Resource: map[string]any{"no_such_attribute": true},
+	})
+	require.Error(t, err)
+}
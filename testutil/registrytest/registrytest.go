@@ -1,13 +1,21 @@
+// Package registrytest provides container registries for tests, and helpers
+// to seed them with images.
 package registrytest
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,6 +35,9 @@ func New(t testing.TB, dir string, mws ...func(http.Handler) http.Handler) strin
 	return fmt.Sprintf("localhost:%s", regSrvURL.Port())
 }
 
+// BasicAuthMW returns a middleware for New that requires requests to use
+// basic authentication with username and password. If both are empty, no
+// authentication is required.
 func BasicAuthMW(t testing.TB, username, password string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,3 +53,32 @@ func BasicAuthMW(t testing.TB, username, password string) func(http.Handler) htt
 		})
 	}
 }
+
+// DockerConfigBase64 returns a base64 encoded Docker config with the
+// credentials for registry, for example for docker_config_base64.
+func DockerConfigBase64(registry, username, password string) string {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	config := fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, registry, auth)
+	return base64.StdEncoding.EncodeToString([]byte(config))
+}
+
+// WriteImage pushes img to ref, for example a builder image or a base image
+// in a registry started by New. Options such as remote.WithAuth are passed
+// to remote.Write, and the image is pushed anonymously otherwise.
+func WriteImage(t testing.TB, ref string, img v1.Image, opts ...remote.Option) {
+	t.Helper()
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err, "parse reference")
+	opts = append([]remote.Option{remote.WithAuth(authn.Anonymous)}, opts...)
+	require.NoError(t, remote.Write(parsed, img, opts...), "write image")
+}
+
+// WriteRandomImage pushes an image with random layers to ref, as
+// WriteImage, and returns it.
+func WriteRandomImage(t testing.TB, ref string, opts ...remote.Option) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err, "create random image")
+	WriteImage(t, ref, img, opts...)
+	return img
+}